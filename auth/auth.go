@@ -0,0 +1,510 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/sdcoffey/olympus/util"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const MinPasswordLength = 8
+
+// PBKDF2 iterations used for new password hashes. Each user's hash records its own count, so raising this
+// only affects passwords set afterwards.
+var Iterations = 100000
+
+// How long a username and password stay verified after a successful Authenticate. Clients using Basic auth
+// send them with every request, and hashing each time would cost a PBKDF2 per request.
+var CredentialTTL = time.Minute
+
+// Failed logins for a username, or from an address, beyond FreeLoginAttempts must wait LoginBackoff before
+// the next attempt, doubling with each further failure up to MaxLoginBackoff
+var (
+	FreeLoginAttempts = 5
+	LoginBackoff      = time.Second
+	MaxLoginBackoff   = 5 * time.Minute
+)
+
+var (
+	ErrInvalidCredentials = errors.New("Invalid username or password")
+	ErrInvalidToken       = errors.New("Invalid or expired token")
+	ErrTooManyAttempts    = errors.New("Too many failed logins; try again later")
+)
+
+type User struct {
+	Username string    `json:"username"`
+	Admin    bool      `json:"admin"`
+	Groups   []string  `json:"groups,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// A credential for the api, standing in for its user's password. Only a hash of the token itself is kept,
+// so it can't be recovered after it's issued.
+type Token struct {
+	Id       string    `json:"id"`
+	Name     string    `json:"name"`
+	Username string    `json:"username"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires,omitempty"`
+}
+
+func (token Token) Expired() bool {
+	return !token.Expires.IsZero() && !time.Now().Before(token.Expires)
+}
+
+// A salted PBKDF2 hash of a password
+type PasswordHash struct {
+	Hash       string `json:"hash"`
+	Salt       string `json:"salt"`
+	Iterations int    `json:"iterations"`
+}
+
+// Salt for the hash Authenticate computes for usernames that don't exist, which never matches
+const unknownUserSalt = "00000000000000000000000000000000"
+
+func HashPassword(password string) (PasswordHash, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return PasswordHash{}, err
+	}
+
+	return PasswordHash{
+		Salt:       hex.EncodeToString(salt),
+		Iterations: Iterations,
+		Hash:       hex.EncodeToString(pbkdf2.Key([]byte(password), salt, Iterations, sha256.Size, sha256.New)),
+	}, nil
+}
+
+func (hash PasswordHash) Matches(password string) bool {
+	salt, err := hex.DecodeString(hash.Salt)
+	if err != nil {
+		return false
+	}
+
+	candidate := hex.EncodeToString(pbkdf2.Key([]byte(password), salt, hash.Iterations, sha256.Size, sha256.New))
+	return subtle.ConstantTimeCompare([]byte(candidate), []byte(hash.Hash)) == 1
+}
+
+type account struct {
+	User
+	PasswordHash
+}
+
+type storedToken struct {
+	Token
+	Hash string `json:"hash"`
+}
+
+type storeFile struct {
+	Accounts []*account    `json:"users"`
+	Tokens   []storedToken `json:"tokens"`
+}
+
+// Users and their tokens, saved to a JSON file on every change
+type Store struct {
+	sync.RWMutex
+	path     string
+	accounts map[string]*account
+	tokens   map[string]storedToken // by hash
+
+	// Guards verified and failures, which are only kept in memory
+	logins sync.Mutex
+	// Usernames by a keyed hash of the username and password they were verified with
+	verified  map[string]verifiedLogin
+	verifyKey []byte
+	// Recent failed logins by "user:<username>" and "address:<address>"
+	failures map[string]*failedLogins
+}
+
+type verifiedLogin struct {
+	username string
+	expires  time.Time
+}
+
+type failedLogins struct {
+	count int
+	until time.Time
+}
+
+// Load the store at path, creating it when the first user is added. An empty path keeps everything in
+// memory only.
+func NewStore(path string) (*Store, error) {
+	store := &Store{
+		path:      path,
+		accounts:  make(map[string]*account),
+		tokens:    make(map[string]storedToken),
+		verified:  make(map[string]verifiedLogin),
+		verifyKey: make([]byte, 32),
+		failures:  make(map[string]*failedLogins),
+	}
+	if _, err := rand.Read(store.verifyKey); err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		return store, nil
+	} else if dat, err := ioutil.ReadFile(path); os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading users: %s", err.Error())
+	} else {
+		var saved storeFile
+		if err = json.Unmarshal(dat, &saved); err != nil {
+			return nil, fmt.Errorf("Error reading users: %s", err.Error())
+		}
+		for _, acct := range saved.Accounts {
+			store.accounts[acct.Username] = acct
+		}
+		for _, token := range saved.Tokens {
+			store.tokens[token.Hash] = token
+		}
+	}
+
+	return store, nil
+}
+
+// All users, by username
+func (store *Store) Users() []User {
+	store.RLock()
+	defer store.RUnlock()
+
+	users := make([]User, 0, len(store.accounts))
+	for _, acct := range store.accounts {
+		users = append(users, acct.User)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
+}
+
+func (store *Store) User(username string) (User, bool) {
+	store.RLock()
+	defer store.RUnlock()
+	if acct, ok := store.accounts[username]; ok {
+		return acct.User, true
+	}
+	return User{}, false
+}
+
+func (store *Store) AddUser(username, password string, admin bool) (User, error) {
+	if username == "" || strings.ContainsAny(username, ":/") {
+		return User{}, fmt.Errorf("Invalid username: %s", username)
+	}
+
+	acct := &account{User: User{Username: username, Admin: admin, Created: time.Now().UTC()}}
+	if err := acct.setPassword(password); err != nil {
+		return User{}, err
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if _, exists := store.accounts[username]; exists {
+		return User{}, fmt.Errorf("User %s already exists", username)
+	}
+
+	store.accounts[username] = acct
+	if err := store.save(); err != nil {
+		delete(store.accounts, username)
+		return User{}, err
+	}
+
+	return acct.User, nil
+}
+
+// Remove a user along with all their tokens
+func (store *Store) RemoveUser(username string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.accounts[username]; !ok {
+		return fmt.Errorf("No such user: %s", username)
+	}
+
+	delete(store.accounts, username)
+	for hash, token := range store.tokens {
+		if token.Username == username {
+			delete(store.tokens, hash)
+		}
+	}
+	store.forgetVerified(username)
+
+	return store.save()
+}
+
+func (store *Store) SetPassword(username, password string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	acct, ok := store.accounts[username]
+	if !ok {
+		return fmt.Errorf("No such user: %s", username)
+	}
+
+	updated := *acct
+	if err := updated.setPassword(password); err != nil {
+		return err
+	}
+	store.accounts[username] = &updated
+	store.forgetVerified(username)
+
+	return store.save()
+}
+
+// Replace the groups a user belongs to, which decide their access to nodes owned by others
+func (store *Store) SetGroups(username string, groups []string) error {
+	for _, group := range groups {
+		if group == "" || strings.ContainsAny(group, ":/") {
+			return fmt.Errorf("Invalid group: %s", group)
+		}
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	acct, ok := store.accounts[username]
+	if !ok {
+		return fmt.Errorf("No such user: %s", username)
+	}
+
+	updated := *acct
+	updated.Groups = append([]string(nil), groups...)
+	store.accounts[username] = &updated
+
+	return store.save()
+}
+
+// The user with this username and password, logging in from address, which may be empty if it's unknown.
+// Fails with ErrInvalidCredentials without saying which was wrong, or with ErrTooManyAttempts, without
+// checking the password, while the username or address is backing off after failed logins.
+func (store *Store) Authenticate(username, password, address string) (User, error) {
+	userKey, addressKey := "user:"+username, "address:"+address
+	mac := hmac.New(sha256.New, store.verifyKey)
+	mac.Write([]byte(username + "\x00" + password))
+	credential := hex.EncodeToString(mac.Sum(nil))
+
+	store.logins.Lock()
+	verified, cached := store.verified[credential]
+	cached = cached && time.Now().Before(verified.expires)
+	throttled := store.backingOff(userKey) || address != "" && store.backingOff(addressKey)
+	store.logins.Unlock()
+
+	store.RLock()
+	acct, ok := store.accounts[username]
+	store.RUnlock()
+
+	// Unknown usernames are hashed against a salt too, so they take as long to refuse as wrong passwords
+	hash := PasswordHash{Salt: unknownUserSalt, Iterations: Iterations}
+	if ok {
+		hash = acct.PasswordHash
+	}
+
+	if ok && cached {
+		return acct.User, nil
+	} else if throttled {
+		return User{}, ErrTooManyAttempts
+	} else if !hash.Matches(password) || !ok {
+		store.logins.Lock()
+		store.failed(userKey)
+		if address != "" {
+			store.failed(addressKey)
+		}
+		store.logins.Unlock()
+		return User{}, ErrInvalidCredentials
+	}
+
+	store.logins.Lock()
+	defer store.logins.Unlock()
+	delete(store.failures, userKey)
+	delete(store.failures, addressKey)
+	if len(store.verified) > 1000 {
+		store.forgetExpired()
+	}
+	store.verified[credential] = verifiedLogin{username, time.Now().Add(CredentialTTL)}
+	return acct.User, nil
+}
+
+// Whether logins for key must wait after failing. Call with the logins lock held.
+func (store *Store) backingOff(key string) bool {
+	failures, ok := store.failures[key]
+	return ok && time.Now().Before(failures.until)
+}
+
+// Count a failed login for key, making it back off once it's used its free attempts. Call with the logins
+// lock held.
+func (store *Store) failed(key string) {
+	now := time.Now()
+	if len(store.failures) > 10000 {
+		// Forget keys whose backoff is long over, so failures from many addresses don't grow without bound
+		for k, failures := range store.failures {
+			if now.Sub(failures.until) > MaxLoginBackoff {
+				delete(store.failures, k)
+			}
+		}
+	}
+
+	failures, ok := store.failures[key]
+	if !ok {
+		failures = new(failedLogins)
+		store.failures[key] = failures
+	}
+	failures.count++
+
+	if excess := failures.count - FreeLoginAttempts; excess > 0 {
+		wait := MaxLoginBackoff
+		if excess < 32 && LoginBackoff<<uint(excess-1) < MaxLoginBackoff {
+			wait = LoginBackoff << uint(excess-1)
+		}
+		failures.until = now.Add(wait)
+	}
+}
+
+// Drop verified logins for username, so a changed password or removed user takes effect at once
+func (store *Store) forgetVerified(username string) {
+	store.logins.Lock()
+	defer store.logins.Unlock()
+	for credential, verified := range store.verified {
+		if verified.username == username {
+			delete(store.verified, credential)
+		}
+	}
+}
+
+// Drop verified logins that have expired. Call with the logins lock held.
+func (store *Store) forgetExpired() {
+	now := time.Now()
+	for credential, verified := range store.verified {
+		if now.After(verified.expires) {
+			delete(store.verified, credential)
+		}
+	}
+}
+
+// Issue a new token for a user, returning the token itself along with its details. A ttl of 0 issues a
+// token that never expires.
+func (store *Store) IssueToken(username, name string, ttl time.Duration) (Token, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Token{}, "", err
+	}
+	value := hex.EncodeToString(secret)
+
+	token := Token{Id: uuid.New(), Name: name, Username: username, Created: time.Now().UTC()}
+	if ttl > 0 {
+		token.Expires = token.Created.Add(ttl)
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if _, ok := store.accounts[username]; !ok {
+		return Token{}, "", fmt.Errorf("No such user: %s", username)
+	}
+
+	hash := hashToken(value)
+	store.tokens[hash] = storedToken{token, hash}
+	if err := store.save(); err != nil {
+		delete(store.tokens, hash)
+		return Token{}, "", err
+	}
+
+	return token, value, nil
+}
+
+// The user a token belongs to, if it's valid
+func (store *Store) ValidateToken(value string) (User, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	token, ok := store.tokens[hashToken(value)]
+	if !ok || token.Expired() {
+		return User{}, ErrInvalidToken
+	} else if acct, ok := store.accounts[token.Username]; !ok {
+		return User{}, ErrInvalidToken
+	} else {
+		return acct.User, nil
+	}
+}
+
+// A user's unexpired tokens, oldest first
+func (store *Store) Tokens(username string) []Token {
+	store.RLock()
+	defer store.RUnlock()
+
+	tokens := make([]Token, 0)
+	for _, token := range store.tokens {
+		if token.Username == username && !token.Expired() {
+			tokens = append(tokens, token.Token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].Created.Equal(tokens[j].Created) {
+			return tokens[i].Created.Before(tokens[j].Created)
+		}
+		return tokens[i].Id < tokens[j].Id
+	})
+	return tokens
+}
+
+func (store *Store) RevokeToken(username, tokenId string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	for hash, token := range store.tokens {
+		if token.Id == tokenId && token.Username == username {
+			delete(store.tokens, hash)
+			return store.save()
+		}
+	}
+
+	return fmt.Errorf("No such token: %s", tokenId)
+}
+
+func (store *Store) save() error {
+	if store.path == "" {
+		return nil
+	}
+
+	var saved storeFile
+	for _, acct := range store.accounts {
+		saved.Accounts = append(saved.Accounts, acct)
+	}
+	for _, token := range store.tokens {
+		if !token.Expired() {
+			saved.Tokens = append(saved.Tokens, token)
+		}
+	}
+
+	if dat, err := json.MarshalIndent(saved, "", "  "); err != nil {
+		return err
+	} else if err = util.WriteFileAtomic(store.path, dat, 0600); err != nil {
+		return fmt.Errorf("Error saving users: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (acct *account) setPassword(password string) (err error) {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("Password must be at least %d characters", MinPasswordLength)
+	}
+
+	acct.PasswordHash, err = HashPassword(password)
+	return err
+}
+
+func hashToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	Iterations = 10
+}
+
+func TestPasswordHash_matchesRfc7914Vectors(t *testing.T) {
+	salt := hex.EncodeToString([]byte("salt"))
+	assert.True(t, PasswordHash{
+		Hash: "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b",
+		Salt: salt, Iterations: 1,
+	}.Matches("password"))
+	assert.True(t, PasswordHash{
+		Hash: "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43",
+		Salt: salt, Iterations: 2,
+	}.Matches("password"))
+	assert.False(t, PasswordHash{
+		Hash: "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43",
+		Salt: salt, Iterations: 1,
+	}.Matches("password"))
+}
+
+func TestStore_authenticatesUsers(t *testing.T) {
+	store, _ := NewStore("")
+
+	_, err := store.AddUser("alice", "short", false)
+	assert.Error(t, err)
+	_, err = store.AddUser("al:ice", "long enough", false)
+	assert.Error(t, err)
+
+	user, err := store.AddUser("alice", "correct horse", true)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", user.Username)
+	assert.Equal(t, true, user.Admin)
+
+	_, err = store.AddUser("alice", "another password", false)
+	assert.Error(t, err)
+
+	authenticated, err := store.Authenticate("alice", "correct horse", "")
+	assert.NoError(t, err)
+	assert.Equal(t, user, authenticated)
+
+	_, err = store.Authenticate("alice", "wrong horse", "")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, err = store.Authenticate("bob", "correct horse", "")
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	assert.NoError(t, store.SetPassword("alice", "battery staple"))
+	_, err = store.Authenticate("alice", "correct horse", "")
+	assert.Equal(t, ErrInvalidCredentials, err)
+	_, err = store.Authenticate("alice", "battery staple", "")
+	assert.NoError(t, err)
+}
+
+func TestStore_refusesUnknownUsersAsSlowlyAsWrongPasswords(t *testing.T) {
+	store, _ := NewStore("")
+	defer func(iterations int) { Iterations = iterations }(Iterations)
+	Iterations = 200000
+	store.AddUser("alice", "correct horse", false)
+
+	timed := func(username string) time.Duration {
+		start := time.Now()
+		_, err := store.Authenticate(username, "wrong horse", "")
+		assert.Equal(t, ErrInvalidCredentials, err)
+		return time.Since(start)
+	}
+
+	wrongPassword, unknownUser := timed("alice"), timed("bob")
+	assert.True(t, unknownUser > wrongPassword/2, "%s refusing bob, %s refusing alice", unknownUser, wrongPassword)
+}
+
+func TestStore_backsOffAfterFailedLogins(t *testing.T) {
+	defer func(free int, backoff time.Duration) {
+		FreeLoginAttempts, LoginBackoff = free, backoff
+	}(FreeLoginAttempts, LoginBackoff)
+	FreeLoginAttempts, LoginBackoff = 2, 50*time.Millisecond
+
+	store, _ := NewStore("")
+	store.AddUser("alice", "correct horse", false)
+	store.AddUser("bob", "battery staple", false)
+
+	for i := 0; i < 3; i++ {
+		_, err := store.Authenticate("alice", "wrong horse", "10.0.0.1")
+		assert.Equal(t, ErrInvalidCredentials, err)
+	}
+
+	// Both alice and the address are backing off, even with the right password
+	_, err := store.Authenticate("alice", "correct horse", "10.0.0.2")
+	assert.Equal(t, ErrTooManyAttempts, err)
+	_, err = store.Authenticate("bob", "battery staple", "10.0.0.1")
+	assert.Equal(t, ErrTooManyAttempts, err)
+	_, err = store.Authenticate("bob", "battery staple", "10.0.0.2")
+	assert.NoError(t, err)
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = store.Authenticate("alice", "correct horse", "10.0.0.1")
+	assert.NoError(t, err)
+	_, err = store.Authenticate("alice", "wrong horse", "10.0.0.1")
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestStore_forgetsVerifiedLoginsWhenPasswordChanges(t *testing.T) {
+	store, _ := NewStore("")
+	store.AddUser("alice", "correct horse", false)
+
+	_, err := store.Authenticate("alice", "correct horse", "")
+	assert.NoError(t, err)
+	_, err = store.Authenticate("alice", "correct horse", "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.SetPassword("alice", "battery staple"))
+	_, err = store.Authenticate("alice", "correct horse", "")
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	store.Authenticate("alice", "battery staple", "")
+	assert.NoError(t, store.RemoveUser("alice"))
+	_, err = store.Authenticate("alice", "battery staple", "")
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestStore_issuesAndRevokesTokens(t *testing.T) {
+	store, _ := NewStore("")
+	store.AddUser("alice", "correct horse", false)
+
+	token, value, err := store.IssueToken("alice", "laptop", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "laptop", token.Name)
+	assert.Equal(t, true, token.Expires.IsZero())
+
+	user, err := store.ValidateToken(value)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", user.Username)
+	assert.Equal(t, []Token{token}, store.Tokens("alice"))
+
+	_, err = store.ValidateToken(value + "0")
+	assert.Equal(t, ErrInvalidToken, err)
+
+	assert.Error(t, store.RevokeToken("bob", token.Id))
+	assert.NoError(t, store.RevokeToken("alice", token.Id))
+	_, err = store.ValidateToken(value)
+	assert.Equal(t, ErrInvalidToken, err)
+
+	_, _, err = store.IssueToken("bob", "", 0)
+	assert.Error(t, err)
+}
+
+func TestStore_rejectsExpiredTokens(t *testing.T) {
+	store, _ := NewStore("")
+	store.AddUser("alice", "correct horse", false)
+
+	_, value, _ := store.IssueToken("alice", "", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	_, err := store.ValidateToken(value)
+	assert.Equal(t, ErrInvalidToken, err)
+	assert.Equal(t, 0, len(store.Tokens("alice")))
+}
+
+func TestStore_removingUserRevokesTokens(t *testing.T) {
+	store, _ := NewStore("")
+	store.AddUser("alice", "correct horse", false)
+	_, value, _ := store.IssueToken("alice", "", 0)
+
+	assert.NoError(t, store.RemoveUser("alice"))
+	_, err := store.ValidateToken(value)
+	assert.Equal(t, ErrInvalidToken, err)
+	assert.Error(t, store.RemoveUser("alice"))
+}
+
+func TestStore_persistsUsersAndTokens(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "users")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+
+	store, err := NewStore(path)
+	assert.NoError(t, err)
+	store.AddUser("alice", "correct horse", true)
+	_, value, _ := store.IssueToken("alice", "", 0)
+
+	store, err = NewStore(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(store.Users()))
+	_, err = store.Authenticate("alice", "correct horse", "")
+	assert.NoError(t, err)
+	_, err = store.ValidateToken(value)
+	assert.NoError(t, err)
+
+	info, _ := os.Stat(path)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestStore_setsGroups(t *testing.T) {
+	store, _ := NewStore("")
+	store.AddUser("alice", "correct horse", false)
+
+	assert.Error(t, store.SetGroups("alice", []string{"friends", "fam:ily"}))
+	assert.Error(t, store.SetGroups("bob", []string{"friends"}))
+
+	assert.NoError(t, store.SetGroups("alice", []string{"friends", "family"}))
+	user, _ := store.User("alice")
+	assert.Equal(t, []string{"friends", "family"}, user.Groups)
+
+	authenticated, _ := store.Authenticate("alice", "correct horse", "")
+	assert.Equal(t, user, authenticated)
+}
@@ -0,0 +1,165 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	CertFile = "cert.pem"
+	KeyFile  = "key.pem"
+)
+
+// How long a generated certificate is good for. Clients pin it rather than trusting a CA, so there's little
+// to gain from making it short.
+var Validity = 10 * 365 * 24 * time.Hour
+
+var ErrFingerprintMismatch = errors.New("Server certificate does not match pinned fingerprint")
+
+// Load the certificate and key at certPath and keyPath. If neither is given, load the self-signed certificate
+// in dir instead, generating it the first time.
+func Load(certPath, keyPath, dir string) (tls.Certificate, error) {
+	if certPath == "" && keyPath == "" {
+		certPath, keyPath = filepath.Join(dir, CertFile), filepath.Join(dir, KeyFile)
+		if _, err := os.Stat(certPath); os.IsNotExist(err) {
+			if err := Generate(certPath, keyPath); err != nil {
+				return tls.Certificate{}, err
+			}
+		}
+	} else if certPath == "" || keyPath == "" {
+		return tls.Certificate{}, errors.New("Error loading certificate: both a certificate and key are required")
+	}
+
+	if certificate, err := tls.LoadX509KeyPair(certPath, keyPath); err != nil {
+		return tls.Certificate{}, fmt.Errorf("Error loading certificate: %s", err.Error())
+	} else {
+		return certificate, nil
+	}
+}
+
+// Write a new self-signed certificate for this host to certPath, and its key to keyPath
+func Generate(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Error generating key: %s", err.Error())
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("Error generating certificate: %s", err.Error())
+	}
+
+	hostname, _ := os.Hostname()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Olympus"}, CommonName: hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+				template.IPAddresses = append(template.IPAddresses, ipNet.IP)
+			}
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("Error generating certificate: %s", err.Error())
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("Error generating key: %s", err.Error())
+	}
+
+	if err := writePem(keyPath, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	return writePem(certPath, "CERTIFICATE", der, 0644)
+}
+
+func writePem(path, kind string, der []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Error writing %s: %s", path, err.Error())
+	} else if file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode); err != nil {
+		return fmt.Errorf("Error writing %s: %s", path, err.Error())
+	} else if err := pem.Encode(file, &pem.Block{Type: kind, Bytes: der}); err != nil {
+		file.Close()
+		return fmt.Errorf("Error writing %s: %s", path, err.Error())
+	} else {
+		return file.Close()
+	}
+}
+
+// SHA-256 fingerprint of a certificate's leaf, as lowercase hex
+func Fingerprint(certificate tls.Certificate) string {
+	if len(certificate.Certificate) == 0 {
+		return ""
+	}
+	return fingerprint(certificate.Certificate[0])
+}
+
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// Put a fingerprint copied from somewhere else, like a browser's "AB:CD:…", in the form Fingerprint returns
+func Normalize(fingerprint string) string {
+	fingerprint = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(fingerprint)), "sha256:")
+	return strings.NewReplacer(":", "", " ", "").Replace(fingerprint)
+}
+
+// TLS config for serving the certificate getCertificate returns, offering HTTP/2. The certificate can be
+// changed while it's being served.
+func ServerConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// TLS config for a client that trusts exactly the server certificate with fingerprint pin, self-signed or not,
+// and nothing else
+func PinnedConfig(pin string) *tls.Config {
+	expected := []byte(Normalize(pin))
+	return &tls.Config{
+		// The chain isn't verified against any CA; the check below is what authenticates the server
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrFingerprintMismatch
+			} else if subtle.ConstantTimeCompare([]byte(fingerprint(rawCerts[0])), expected) != 1 {
+				return ErrFingerprintMismatch
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,128 @@
+package cert
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "olympus-cert")
+	assert.NoError(t, err)
+	return dir
+}
+
+func TestLoad_generatesCertificateOnce(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	first, err := Load("", "", dir)
+	assert.NoError(t, err)
+	assert.Len(t, Fingerprint(first), 64)
+
+	stat, err := os.Stat(filepath.Join(dir, KeyFile))
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0600, stat.Mode().Perm())
+
+	second, err := Load("", "", dir)
+	assert.NoError(t, err)
+	assert.Equal(t, Fingerprint(first), Fingerprint(second))
+}
+
+func TestLoad_usesGivenFiles(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	assert.NoError(t, Generate(certPath, keyPath))
+
+	certificate, err := Load(certPath, keyPath, filepath.Join(dir, "unused"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, Fingerprint(certificate))
+
+	_, err = os.Stat(filepath.Join(dir, "unused"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLoad_requiresCertificateAndKey(t *testing.T) {
+	_, err := Load("server.crt", "", "")
+	assert.Error(t, err)
+}
+
+func TestNormalize(t *testing.T) {
+	assert.Equal(t, "abcd01", Normalize("AB:CD:01"))
+	assert.Equal(t, "abcd01", Normalize(" sha256:ab cd 01\n"))
+	assert.Equal(t, "abcd01", Normalize("abcd01"))
+}
+
+func TestPinnedConfig(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	certificate, err := Load("", "", dir)
+	assert.NoError(t, err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", ServerConfig(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &certificate, nil
+	}))
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	dial := func(pin string) error {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), PinnedConfig(pin))
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	assert.NoError(t, dial(Fingerprint(certificate)))
+	assert.NoError(t, dial(strings.ToUpper(Fingerprint(certificate))))
+
+	assert.Equal(t, ErrFingerprintMismatch, dial(strings.Repeat("0", 64)))
+}
+
+func TestKnownHosts_persistsPins(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "client", KnownHostsFile)
+	known, err := LoadKnownHosts(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "", known.Fingerprint("10.0.0.2:3000"))
+
+	assert.NoError(t, known.Pin("10.0.0.2:3000", "AB:CD"))
+	assert.NoError(t, known.Pin("10.0.0.3:3000", "ef01"))
+	assert.NoError(t, known.Pin("10.0.0.2:3000", "2345"))
+
+	reloaded, err := LoadKnownHosts(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "2345", reloaded.Fingerprint("10.0.0.2:3000"))
+	assert.Equal(t, "ef01", reloaded.Fingerprint("10.0.0.3:3000"))
+}
+
+func TestKnownHosts_rejectsMalformedLines(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, KnownHostsFile)
+	assert.NoError(t, ioutil.WriteFile(path, []byte("# pins\n10.0.0.2:3000\n"), 0600))
+
+	_, err := LoadKnownHosts(path)
+	assert.Error(t, err)
+}
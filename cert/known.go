@@ -0,0 +1,74 @@
+package cert
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sdcoffey/olympus/util"
+)
+
+const KnownHostsFile = "known_hosts"
+
+// Fingerprints a client has chosen to trust, by host and port, kept one "host fingerprint" per line like
+// ssh's known_hosts. A missing file has no pins.
+type KnownHosts struct {
+	path  string
+	hosts map[string]string
+}
+
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	known := &KnownHosts{path: path, hosts: make(map[string]string)}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		} else if fields := strings.Fields(text); len(fields) != 2 {
+			return nil, fmt.Errorf("Error reading %s: line %d is not \"host fingerprint\"", path, line)
+		} else {
+			known.hosts[fields[0]] = Normalize(fields[1])
+		}
+	}
+	return known, scanner.Err()
+}
+
+// The fingerprint pinned for host, or "" if there isn't one
+func (known *KnownHosts) Fingerprint(host string) string {
+	return known.hosts[host]
+}
+
+// Trust the certificate with fingerprint for host from now on, replacing any earlier pin
+func (known *KnownHosts) Pin(host, fingerprint string) error {
+	known.hosts[host] = Normalize(fingerprint)
+	return known.save()
+}
+
+func (known *KnownHosts) save() error {
+	hosts := make([]string, 0, len(known.hosts))
+	for host := range known.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var contents string
+	for _, host := range hosts {
+		contents += fmt.Sprintf("%s %s\n", host, known.hosts[host])
+	}
+
+	if err := os.MkdirAll(filepath.Dir(known.path), 0700); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(known.path, []byte(contents), 0600)
+}
@@ -9,28 +9,140 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/sdcoffey/olympus/cert"
 	"github.com/sdcoffey/olympus/graph"
 	"github.com/sdcoffey/olympus/server/api"
+	"github.com/sdcoffey/olympus/upload"
+	"golang.org/x/net/http2"
 )
 
 type OlympusClient interface {
 	ListNodes(parentId string) ([]graph.NodeInfo, error)
+	ListNodesSorted(parentId string, sorter graph.Sorter) ([]graph.NodeInfo, error)
 	ListBlocks(nodeId string) ([]graph.BlockInfo, error)
 	WriteBlock(nodeId string, offset int64, hash string, data io.Reader) error
+	LinkBlock(nodeId string, offset int64, hash string) error
+	MissingBlocks(hashes []string) ([]string, error)
+	Uploads() ([]upload.Session, error)
+	OpenUpload(parentId string, uploadRequest api.UploadRequest) (api.UploadResponse, error)
+	UploadStatus(uploadId string) (api.UploadResponse, error)
+	UploadBlock(uploadId string, index int, data []byte) error
+	CommitUpload(uploadId string) (graph.NodeInfo, error)
 	RemoveNode(nodeId string) error
 	CreateNode(info graph.NodeInfo) (graph.NodeInfo, error)
 	UpdateNode(info graph.NodeInfo) error
 	ReadBlock(nodeId string, offset int64) (io.Reader, error)
+	BlockSize() int64
 }
 
+// Talks to the api at Address. Requests authenticate with Token if it's set, else with Username and Password
+// if they are. If Fingerprint is set, the server's certificate must have that fingerprint, and is trusted
+// whether or not it's signed by a known CA. Server describes the server once Connect has asked it.
 type ApiClient struct {
-	Address  string
-	Encoding api.Encoding
+	Address     string
+	Encoding    api.Encoding
+	Token       string
+	Username    string
+	Password    string
+	Fingerprint string
+	Server      api.InfoResponse
+}
+
+var (
+	pinnedClients     = make(map[string]*http.Client)
+	pinnedClientsLock sync.Mutex
+)
+
+// Clients are shared between ApiClients with the same pin, so connections are reused
+func (client ApiClient) httpClient() *http.Client {
+	if client.Fingerprint == "" {
+		return http.DefaultClient
+	}
+
+	pinnedClientsLock.Lock()
+	defer pinnedClientsLock.Unlock()
+
+	fingerprint := cert.Normalize(client.Fingerprint)
+	if httpClient, ok := pinnedClients[fingerprint]; ok {
+		return httpClient
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     cert.PinnedConfig(fingerprint),
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	// A custom TLS config turns off HTTP/2 unless it's asked for explicitly
+	http2.ConfigureTransport(transport)
+
+	httpClient := &http.Client{Transport: transport}
+	pinnedClients[fingerprint] = httpClient
+	return httpClient
+}
+
+// Exchange a username and password for a token, returning a client that authenticates with it
+func (client ApiClient) Login(username, password string) (ApiClient, error) {
+	login := api.LoginRequest{Username: username, Password: password}
+	login.Name = "olympus cli"
+
+	if request, err := client.request(api.Login); err != nil {
+		return client, err
+	} else {
+		var response api.TokenResponse
+		if err := client.do(request, login, &response); err != nil {
+			return client, err
+		}
+		client.Token = response.Token
+		return client, nil
+	}
+}
+
+// Ask the server what it supports, returning a client that talks to it accordingly: it splits files into
+// the server's block size, and falls back to JSON if the server can't use the client's encoding
+func (client ApiClient) Connect() (ApiClient, error) {
+	var info api.InfoResponse
+	if request, err := client.request(api.ServerInfo); err != nil {
+		return client, err
+	} else if err := client.do(request, nil, &info); err != nil {
+		return client, fmt.Errorf("Error reading server info: %s", err.Error())
+	} else if info.ApiVersion != api.ApiVersion {
+		return client, fmt.Errorf("Server uses api version %d, but this client uses %d", info.ApiVersion, api.ApiVersion)
+	} else if info.HashAlgorithm != graph.HashAlgorithm {
+		return client, fmt.Errorf("Server hashes blocks with %s, but this client uses %s", info.HashAlgorithm, graph.HashAlgorithm)
+	} else if info.BlockSize <= 0 {
+		return client, fmt.Errorf("Server reported an invalid block size %d", info.BlockSize)
+	}
+
+	supported := false
+	for _, encoding := range info.Encodings {
+		supported = supported || encoding == client.Encoding
+	}
+	if !supported {
+		client.Encoding = api.JsonEncoding
+	}
+	client.Server = info
+	return client, nil
+}
+
+// Size of the blocks files are split into: the server's, once Connect has asked it
+func (client ApiClient) BlockSize() int64 {
+	if client.Server.BlockSize > 0 {
+		return client.Server.BlockSize
+	}
+	return graph.BLOCK_SIZE
 }
 
 func (client ApiClient) ListNodes(parentId string) ([]graph.NodeInfo, error) {
-	if request, err := client.request(api.ListNodes, parentId); err != nil {
+	return client.ListNodesSorted(parentId, graph.Alphabetical)
+}
+
+func (client ApiClient) ListNodesSorted(parentId string, sorter graph.Sorter) ([]graph.NodeInfo, error) {
+	sortName, order, dirsFirst := sorter.Params()
+	endpoint := api.ListNodes.Query("sort", sortName).Query("order", order).Query("dirs_first", fmt.Sprint(dirsFirst))
+	if request, err := client.request(endpoint, parentId); err != nil {
 		return make([]graph.NodeInfo, 0), err
 	} else {
 		var infos []graph.NodeInfo
@@ -66,6 +178,54 @@ func (client ApiClient) WriteBlock(nodeId string, offset int64, hash string, dat
 	return nil
 }
 
+// Use a block the server already has at offset in the node, without sending it
+func (client ApiClient) LinkBlock(nodeId string, offset int64, hash string) error {
+	if request, err := client.request(api.LinkBlock, nodeId, offset, hash); err != nil {
+		return err
+	} else {
+		return client.do(request, nil, nil)
+	}
+}
+
+// Which of the blocks with these hashes the server doesn't have, asking about api.MaxMissingBlocks at a time
+func (client ApiClient) MissingBlocks(hashes []string) ([]string, error) {
+	missing := make([]string, 0)
+	for start := 0; start < len(hashes); start += api.MaxMissingBlocks {
+		end := start + api.MaxMissingBlocks
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+
+		var response api.BlockHashes
+		if request, err := client.request(api.MissingBlocks); err != nil {
+			return nil, err
+		} else if err := client.do(request, api.BlockHashes{Hashes: hashes[start:end]}, &response); err != nil {
+			return nil, err
+		}
+		missing = append(missing, response.Hashes...)
+	}
+	return missing, nil
+}
+
+// Whether the server has a good copy of the block
+func (client ApiClient) HasBlock(hash string) (bool, error) {
+	if request, err := http.NewRequest("HEAD", fmt.Sprint(client.Address, "/block/", hash), nil); err != nil {
+		return false, err
+	} else if resp, err := client.httpClient().Do(client.authorize(request)); err != nil {
+		return false, err
+	} else {
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return true, nil
+		case http.StatusNotFound:
+			return false, nil
+		default:
+			return false, fmt.Errorf("Error checking for block %s: %s", hash, resp.Status)
+		}
+	}
+}
+
 func (client ApiClient) RemoveNode(nodeId string) error {
 	if request, err := client.request(api.RemoveNode, nodeId); err != nil {
 		return err
@@ -119,8 +279,17 @@ func (client ApiClient) request(endpoint api.Endpoint, args ...interface{}) (*ht
 		if endpoint.Verb == "POST" || endpoint.Verb == "PATCH" || endpoint.Verb == "PUT" {
 			req.Header.Add("Content-Type", string(client.Encoding))
 		}
-		return req, nil
+		return client.authorize(req), nil
+	}
+}
+
+func (client ApiClient) authorize(req *http.Request) *http.Request {
+	if client.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.Token)
+	} else if client.Username != "" {
+		req.SetBasicAuth(client.Username, client.Password)
 	}
+	return req
 }
 
 func (client ApiClient) do(req *http.Request, body interface{}, responseBody interface{}) error {
@@ -139,9 +308,10 @@ func (client ApiClient) do(req *http.Request, body interface{}, responseBody int
 		}
 	}
 
-	if resp, err := http.DefaultClient.Do(req); err != nil {
+	if resp, err := client.httpClient().Do(req); err != nil {
 		return err
-	} else if responseBody != nil {
+	} else if responseBody != nil || resp.StatusCode >= http.StatusBadRequest {
+		// Errors are decoded even when there's no body expected, so failures like 401s aren't mistaken for success
 		var response = api.ApiResponse{
 			Data: responseBody,
 		}
@@ -156,6 +326,7 @@ func (client ApiClient) do(req *http.Request, body interface{}, responseBody int
 			return nil
 		}
 	} else {
+		resp.Body.Close()
 		return nil
 	}
 }
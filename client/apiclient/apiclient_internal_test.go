@@ -4,36 +4,39 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"encoding/xml"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/sdcoffey/olympus/graph"
 	"github.com/sdcoffey/olympus/server/api"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestApiClient_TestEncoder_returnsCorrectEncoder(t *testing.T) {
-	client := ApiClient{"", api.JsonEncoding}
+	client := ApiClient{Address: "", Encoding: api.JsonEncoding}
 	assert.IsType(t, &json.Encoder{}, client.encoder(nil))
 
-	client = ApiClient{"", api.GobEncoding}
+	client = ApiClient{Address: "", Encoding: api.GobEncoding}
 	assert.IsType(t, &gob.Encoder{}, client.encoder(nil))
 
-	client = ApiClient{"", api.XmlEncoding}
+	client = ApiClient{Address: "", Encoding: api.XmlEncoding}
 	assert.IsType(t, &xml.Encoder{}, client.encoder(nil))
 }
 
 func TestApiClient_TestDecoder_returnsCorrectEncoder(t *testing.T) {
-	client := ApiClient{"", api.JsonEncoding}
+	client := ApiClient{Address: "", Encoding: api.JsonEncoding}
 	assert.IsType(t, &json.Decoder{}, client.decoder(nil))
 
-	client = ApiClient{"", api.GobEncoding}
+	client = ApiClient{Address: "", Encoding: api.GobEncoding}
 	assert.IsType(t, &gob.Decoder{}, client.decoder(nil))
 
-	client = ApiClient{"", api.XmlEncoding}
+	client = ApiClient{Address: "", Encoding: api.XmlEncoding}
 	assert.IsType(t, &xml.Decoder{}, client.decoder(nil))
 }
 
 func TestApiClient_request_setsCorrectHeaders(t *testing.T) {
-	client := ApiClient{"http://localhost", api.JsonEncoding}
+	client := ApiClient{Address: "http://localhost", Encoding: api.JsonEncoding}
 
 	request, err := client.request(api.ListNodes, "abcd")
 	assert.NoError(t, err)
@@ -57,7 +60,7 @@ func TestApiClient_request_setsCorrectHeaders(t *testing.T) {
 
 func TestApiCLient_request_buildsCorrectUrl(t *testing.T) {
 	address := "http://localhost"
-	client := ApiClient{address, api.JsonEncoding}
+	client := ApiClient{Address: address, Encoding: api.JsonEncoding}
 
 	request, err := client.request(api.CreateNode, "abcd")
 	assert.NoError(t, err)
@@ -66,7 +69,7 @@ func TestApiCLient_request_buildsCorrectUrl(t *testing.T) {
 }
 
 func TestApiClient_request_setsCorrectVerb(t *testing.T) {
-	client := ApiClient{"http://localhost", api.JsonEncoding}
+	client := ApiClient{Address: "http://localhost", Encoding: api.JsonEncoding}
 
 	request, err := client.request(api.ListNodes, "abcd")
 	assert.NoError(t, err)
@@ -88,3 +91,36 @@ func TestApiClient_request_setsCorrectVerb(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "PATCH", request.Method)
 }
+
+func TestReadEvents_handlesEachChangeOnceAndTracksIds(t *testing.T) {
+	stream := strings.Join([]string{
+		"retry: 500",
+		"id: 2",
+		"",
+		": keep-alive",
+		"",
+		"id: 2",
+		"event: created",
+		`data: {"seq":2,"kind":"created","node_id":"a"}`,
+		"",
+		"id: 3",
+		"event: renamed",
+		`data: {"seq":3,"kind":"renamed",`,
+		`data: "node_id":"a"}`,
+		"",
+		"id: 7",
+		"",
+		"id: 8", // Incomplete, so never dispatched
+	}, "\n")
+
+	var handled []graph.Change
+	lastId, retry := readEvents(strings.NewReader(stream), 1, time.Second, func(change graph.Change) {
+		handled = append(handled, change)
+	})
+
+	assert.Equal(t, 1, len(handled))
+	assert.Equal(t, graph.Renamed, handled[0].Kind)
+	assert.Equal(t, "a", handled[0].NodeId)
+	assert.Equal(t, uint64(7), lastId)
+	assert.Equal(t, 500*time.Millisecond, retry)
+}
@@ -0,0 +1,111 @@
+package apiclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/server/api"
+)
+
+// Stream changes to subtree, or everything if it's empty, to handle until stop is closed. Starts after
+// cursor, or from when the stream opens if it's 0. Dropped connections are retried, resuming after the last change seen, so
+// handle sees every change once and in order.
+func (client ApiClient) Watch(subtree string, cursor uint64, stop <-chan struct{}, handle func(graph.Change)) {
+	retry := 3 * time.Second
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if resp, err := client.openEvents(ctx, subtree, cursor); err == nil {
+				defer resp.Body.Close()
+				cursor, retry = readEvents(resp.Body, cursor, retry, handle)
+			}
+		}()
+
+		select {
+		case <-stop:
+			cancel()
+			<-done
+			return
+		case <-done:
+			cancel()
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+func (client ApiClient) openEvents(ctx context.Context, subtree string, cursor uint64) (*http.Response, error) {
+	req, err := client.request(api.Events.Query("subtree", subtree))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+	if cursor > 0 {
+		req.Header.Set("Last-Event-ID", fmt.Sprint(cursor))
+	}
+
+	resp, err := client.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Error watching for changes: %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+// Parse a text/event-stream, passing each change to handle, until it ends. Returns the last event id and the
+// retry interval the server asked for, if any.
+func readEvents(rd io.Reader, lastId uint64, retry time.Duration, handle func(graph.Change)) (uint64, time.Duration) {
+	var data string
+	var id uint64
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*graph.KILOBYTE), graph.MEGABYTE)
+	for scanner.Scan() {
+		line := scanner.Text()
+		field, value := line, ""
+		if colon := strings.Index(line, ":"); colon >= 0 {
+			field, value = line[:colon], strings.TrimPrefix(line[colon+1:], " ")
+		}
+
+		if line == "" {
+			var change graph.Change
+			if data != "" && json.Unmarshal([]byte(data), &change) == nil && change.Seq > lastId {
+				handle(change)
+				lastId = change.Seq
+			}
+			if id > lastId {
+				lastId = id
+			}
+			data, id = "", 0
+		} else if field == "data" && data != "" {
+			data += "\n" + value
+		} else if field == "data" {
+			data = value
+		} else if field == "id" {
+			id, _ = strconv.ParseUint(value, 10, 64)
+		} else if field == "retry" {
+			if millis, err := strconv.Atoi(value); err == nil {
+				retry = time.Duration(millis) * time.Millisecond
+			}
+		}
+	}
+
+	return lastId, retry
+}
@@ -26,7 +26,7 @@ type ApiClientTestSuite struct {
 func (suite *ApiClientTestSuite) SetUpTest(t *C) {
 	suite.ng, suite.testDir = testutils.TestInit()
 	suite.server = httptest.NewServer(api.NewApi(suite.ng))
-	suite.client = apiclient.ApiClient{suite.server.URL, api.JsonEncoding}
+	suite.client = apiclient.ApiClient{Address: suite.server.URL, Encoding: api.JsonEncoding}
 }
 
 func (suite *ApiClientTestSuite) TearDownTest(t *C) {
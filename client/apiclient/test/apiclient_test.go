@@ -2,13 +2,18 @@ package test
 
 import (
 	"bytes"
+	"net/http/httptest"
 	"os"
-
+	"strings"
 	"time"
 
+	"github.com/sdcoffey/olympus/auth"
+	"github.com/sdcoffey/olympus/cert"
 	. "github.com/sdcoffey/olympus/checkers"
+	"github.com/sdcoffey/olympus/client/apiclient"
 	"github.com/sdcoffey/olympus/graph"
 	"github.com/sdcoffey/olympus/graph/testutils"
+	"github.com/sdcoffey/olympus/server/api"
 	. "gopkg.in/check.v1"
 )
 
@@ -119,3 +124,105 @@ func (suite *ApiClientTestSuite) TestApiClient_do_readsErrorFromBodyOnNonOkStatu
 	_, err := suite.client.ListNodes("not-found")
 	t.Check(err, ErrorMatches, "^no_such_node => not-found$")
 }
+
+func (suite *ApiClientTestSuite) TestApiClient_Watch_streamsChangesUntilStopped(t *C) {
+	journal, _ := graph.OpenJournal("")
+	suite.ng.UseJournal(journal)
+	dir, _ := suite.ng.NewNode("dir", graph.RootNodeId, os.ModeDir)
+
+	changes := make(chan graph.Change, 10)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		suite.client.Watch(dir.Id, journal.Seq(), stop, func(change graph.Change) {
+			changes <- change
+		})
+		close(stopped)
+	}()
+
+	node, _ := suite.ng.NewNode("file", dir.Id, os.FileMode(0644))
+	suite.ng.NewNode("elsewhere", graph.RootNodeId, os.FileMode(0644))
+	node.Touch(time.Now().Add(-time.Hour))
+
+	for _, kind := range []graph.ChangeKind{graph.Created, graph.Touched} {
+		select {
+		case change := <-changes:
+			t.Check(change.Kind, Equals, kind)
+			t.Check(change.NodeId, Equals, node.Id)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for change")
+		}
+	}
+
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch didn't return after being stopped")
+	}
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_Login_authenticatesLaterRequests(t *C) {
+	auth.Iterations = 10
+	store, _ := auth.NewStore("")
+	store.AddUser("user", "user password", false)
+	server := httptest.NewServer(api.NewApi(suite.ng, api.WithAuth(store)))
+	defer server.Close()
+	unauthenticated := apiclient.ApiClient{Address: server.URL, Encoding: api.JsonEncoding}
+
+	_, err := unauthenticated.ListNodes(graph.RootNodeId)
+	t.Check(err, ErrorMatches, "^unauthorized => .*")
+	t.Check(unauthenticated.RemoveNode(graph.RootNodeId), ErrorMatches, "^unauthorized => .*")
+
+	_, err = unauthenticated.Login("user", "wrong password")
+	t.Check(err, ErrorMatches, "^unauthorized => .*")
+
+	client, err := unauthenticated.Login("user", "user password")
+	t.Assert(err, IsNil)
+	t.Check(client.Token, Not(Equals), "")
+	_, err = client.ListNodes(graph.RootNodeId)
+	t.Check(err, IsNil)
+
+	basic := apiclient.ApiClient{Address: server.URL, Encoding: api.JsonEncoding, Username: "user", Password: "user password"}
+	_, err = basic.ListNodes(graph.RootNodeId)
+	t.Check(err, IsNil)
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_Fingerprint_pinsServerCertificate(t *C) {
+	server := httptest.NewTLSServer(api.NewApi(suite.ng))
+	defer server.Close()
+	fingerprint := cert.Fingerprint(server.TLS.Certificates[0])
+
+	unpinned := apiclient.ApiClient{Address: server.URL, Encoding: api.JsonEncoding}
+	_, err := unpinned.ListNodes(graph.RootNodeId)
+	t.Check(err, NotNil)
+
+	pinned := apiclient.ApiClient{Address: server.URL, Encoding: api.JsonEncoding, Fingerprint: fingerprint}
+	_, err = pinned.ListNodes(graph.RootNodeId)
+	t.Check(err, IsNil)
+
+	mispinned := apiclient.ApiClient{Address: server.URL, Encoding: api.JsonEncoding, Fingerprint: strings.Repeat("ab:", 31) + "ab"}
+	_, err = mispinned.ListNodes(graph.RootNodeId)
+	t.Check(err, ErrorMatches, ".*"+cert.ErrFingerprintMismatch.Error())
+}
+
+func (suite *ApiClientTestSuite) TestApiClient_Connect_negotiatesWithServer(t *C) {
+	auth.Iterations = 10
+	store, _ := auth.NewStore("")
+	server := httptest.NewServer(api.NewApi(suite.ng, api.WithAuth(store)))
+	defer server.Close()
+
+	unknownEncoding := apiclient.ApiClient{Address: server.URL, Encoding: api.Encoding("application/yaml")}
+	client, err := unknownEncoding.Connect()
+	t.Assert(err, IsNil)
+	t.Check(client.Encoding, Equals, api.JsonEncoding)
+	t.Check(client.BlockSize(), Equals, int64(graph.BLOCK_SIZE))
+	t.Check(client.Server.Version, Equals, api.Version)
+	t.Check(client.Server.Has(api.AuthFeature), IsTrue)
+	t.Check(client.Server.Has(api.WebhooksFeature), Equals, false)
+
+	gob := apiclient.ApiClient{Address: server.URL, Encoding: api.GobEncoding}
+	client, err = gob.Connect()
+	t.Assert(err, IsNil)
+	t.Check(client.Encoding, Equals, api.GobEncoding)
+}
@@ -0,0 +1,69 @@
+package apiclient
+
+import (
+	"bytes"
+
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/server/api"
+	"github.com/sdcoffey/olympus/upload"
+)
+
+// The caller's open upload sessions, oldest first
+func (client ApiClient) Uploads() ([]upload.Session, error) {
+	var sessions []upload.Session
+	if request, err := client.request(api.ListUploads); err != nil {
+		return nil, err
+	} else if err := client.do(request, nil, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Open a session for uploading a file into parentId a block at a time
+func (client ApiClient) OpenUpload(parentId string, uploadRequest api.UploadRequest) (api.UploadResponse, error) {
+	var response api.UploadResponse
+	if request, err := client.request(api.OpenUpload, parentId); err != nil {
+		return response, err
+	} else if err := client.do(request, uploadRequest, &response); err != nil {
+		return api.UploadResponse{}, err
+	}
+	return response, nil
+}
+
+// The session, and which of its blocks the server still needs
+func (client ApiClient) UploadStatus(uploadId string) (api.UploadResponse, error) {
+	var response api.UploadResponse
+	if request, err := client.request(api.UploadStatus, uploadId); err != nil {
+		return response, err
+	} else if err := client.do(request, nil, &response); err != nil {
+		return api.UploadResponse{}, err
+	}
+	return response, nil
+}
+
+func (client ApiClient) UploadBlock(uploadId string, index int, data []byte) error {
+	if request, err := client.request(api.UploadBlock, uploadId, index); err != nil {
+		return err
+	} else {
+		return client.do(request, bytes.NewReader(data), nil)
+	}
+}
+
+// Create the uploaded file, once every block has been sent
+func (client ApiClient) CommitUpload(uploadId string) (graph.NodeInfo, error) {
+	var info graph.NodeInfo
+	if request, err := client.request(api.CommitUpload, uploadId); err != nil {
+		return info, err
+	} else if err := client.do(request, nil, &info); err != nil {
+		return graph.NodeInfo{}, err
+	}
+	return info, nil
+}
+
+func (client ApiClient) AbortUpload(uploadId string) error {
+	if request, err := client.request(api.AbortUpload, uploadId); err != nil {
+		return err
+	} else {
+		return client.do(request, nil, nil)
+	}
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cayleygraph/cayley"
 	"github.com/chzyer/readline"
 	"github.com/codegangsta/cli"
+	"github.com/sdcoffey/olympus/cert"
 	"github.com/sdcoffey/olympus/client/apiclient"
 	"github.com/sdcoffey/olympus/client/shared"
+	"github.com/sdcoffey/olympus/env"
 	"github.com/sdcoffey/olympus/graph"
 	"github.com/sdcoffey/olympus/peer"
 	"github.com/sdcoffey/olympus/server/api"
@@ -24,38 +30,82 @@ import (
 var (
 	manager *shared.Manager
 	model   *shared.Model
+	// Held to replace model, and to read it from anywhere but the command loop
+	modelLock sync.Mutex
 )
 
 func main() {
 	handle := initDb()
 
 	var address string
+	var username, token, pin string
 	flag.StringVar(&address, "address", "", "Olympus address (CLI will listen for local servers if none given")
+	flag.StringVar(&username, "user", "", "Username to log in as, prompting for a password")
+	flag.StringVar(&token, "token", "", "API token to authenticate with, instead of logging in")
+	flag.StringVar(&pin, "pin", "", "Fingerprint of the server's certificate, as printed by server -fingerprint")
 	flag.Parse()
 
+	var announced string
 	if address == "" {
 		println("Searching for Olympus instances")
 
-		if olympusAddress, err := peer.FindServer(time.Second * 5); err != nil {
+		if server, err := peer.FindServer(time.Second * 5); err != nil {
 			color.Println("@rCould not find Olympus Instance on network: " + err.Error())
+		} else if server.Scheme != "https" {
+			// Anyone on the network can announce, so an announcement is never reason to give up on https
+			color.Println("@rFound Olympus at", server.Address(), "but it doesn't serve https; pass -address to use it anyway")
+			os.Exit(1)
 		} else {
-			address = olympusAddress.String() + ":3000"
-			color.Println("@gFound Olympus At:", olympusAddress.String())
+			address = server.Address()
+			announced = server.Fingerprint
+			color.Println("@gFound Olympus At:", address)
 		}
 	}
 
 	if !strings.HasPrefix(address, "http") {
-		address = "http://" + address
+		address = "https://" + address
 	}
 
-	client := apiclient.ApiClient{Address: address, Encoding: api.JsonEncoding}
+	if strings.HasPrefix(address, "https://") {
+		var err error
+		if pin, err = trustedFingerprint(address, pin, announced); err != nil {
+			color.Println("@r" + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	client := apiclient.ApiClient{Address: address, Encoding: api.JsonEncoding, Token: token, Fingerprint: pin}
+	if username != "" && token == "" {
+		if password, err := readline.Password("Password: "); err != nil {
+			panic(err)
+		} else if client, err = client.Login(username, string(password)); err != nil {
+			color.Println("@rCould not log in: " + err.Error())
+			os.Exit(1)
+		}
+	}
 
 	var err error
+	if client, err = client.Connect(); err != nil {
+		color.Println("@rCould not connect: " + err.Error())
+		os.Exit(1)
+	}
+
 	manager = shared.NewManager(client, handle)
 	if model, err = manager.Model(graph.RootNodeId); err != nil {
 		panic(err)
 	}
 
+	// Keep the working directory's listing current as other clients change it
+	go client.Watch("", 0, nil, func(change graph.Change) {
+		modelLock.Lock()
+		current := model
+		modelLock.Unlock()
+
+		if change.Under(current.Root.Id) {
+			current.Invalidate()
+		}
+	})
+
 	app := cli.NewApp()
 	app.HelpName = "Olympus"
 	app.Commands = []cli.Command{
@@ -68,6 +118,19 @@ func main() {
 					Name:  "l",
 					Usage: "Prints each object on a new line",
 				},
+				cli.StringFlag{
+					Name:  "sort",
+					Value: "name",
+					Usage: "Sort by name, mtime, size, type, natural or iname",
+				},
+				cli.BoolFlag{
+					Name:  "r",
+					Usage: "Reverse the sort order",
+				},
+				cli.BoolFlag{
+					Name:  "dirs-first",
+					Usage: "List directories before files",
+				},
 			},
 		},
 		{
@@ -94,12 +157,28 @@ func main() {
 			Name:   "put",
 			Usage:  "Upload file",
 			Action: put,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "force",
+					Usage: "Replace a file of the same name, keeping its old content as a version",
+				},
+			},
 		},
 		{
 			Name:   "mv",
 			Usage:  "Move or rename file",
 			Action: mv,
 		},
+		{
+			Name:   "chmod",
+			Usage:  "Set permissions of a node, as octal like 750",
+			Action: chmod,
+		},
+		{
+			Name:   "chown",
+			Usage:  "Set the owner and group of a node, as owner, owner:group or :group",
+			Action: chown,
+		},
 	}
 
 	config := &readline.Config{
@@ -128,6 +207,10 @@ func main() {
 			break
 		}
 
+		if err := model.Sync(); err != nil {
+			color.Println("@r", err.Error())
+		}
+
 		line = strings.TrimSpace(line)
 		args := strings.Split(strings.TrimSpace(line), " ")
 		args = append([]string{"olympus"}, args...) // This is a hack :(
@@ -136,6 +219,43 @@ func main() {
 	}
 }
 
+// The fingerprint to pin for the server at address, remembered per host and port like ssh's known_hosts. A pin
+// given with -pin replaces what's remembered. A fingerprint the server announced is only trusted once the
+// user confirms it; without either, the certificate is verified against the system's CAs.
+func trustedFingerprint(address, pin, announced string) (string, error) {
+	server, err := url.Parse(address)
+	if err != nil {
+		return "", err
+	}
+	known, err := cert.LoadKnownHosts(filepath.Join(env.EnvPath(env.ConfigPath), cert.KnownHostsFile))
+	if err != nil {
+		return "", err
+	}
+
+	pinned := known.Fingerprint(server.Host)
+	if pin != "" {
+		if cert.Normalize(pin) != pinned {
+			return pin, known.Pin(server.Host, pin)
+		}
+		return pin, nil
+	} else if pinned != "" {
+		if announced != "" && cert.Normalize(announced) != pinned {
+			color.Println("@rServer announced a different certificate than the one pinned for", server.Host)
+		}
+		return pinned, nil
+	} else if announced == "" {
+		return "", nil
+	}
+
+	color.Println("@yServer announced certificate", announced)
+	if answer, err := readline.Line(fmt.Sprintf("Trust it for %s? [y/N] ", server.Host)); err != nil {
+		return "", err
+	} else if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+		return "", errors.New("Certificate not trusted; pass -pin to trust it")
+	}
+	return announced, known.Pin(server.Host, announced)
+}
+
 func initDb() *cayley.Handle {
 	graph, err := cayley.NewMemoryGraph()
 	if err != nil {
@@ -145,16 +265,23 @@ func initDb() *cayley.Handle {
 }
 
 func ls(c *cli.Context) {
-	if err := model.Refresh(); err != nil {
+	order := "asc"
+	if c.Bool("r") {
+		order = "desc"
+	}
+
+	if sorter, err := graph.ParseSorter(c.String("sort"), order, c.Bool("dirs-first")); err != nil {
+		color.Println("@r", err.Error())
+	} else if infos, err := model.RefreshSorted(sorter); err != nil {
 		color.Println("@r", err.Error())
 	} else {
-		for _, node := range model.Root.Children() {
+		for _, info := range infos {
 			if c.Bool("l") {
-				fmt.Println(node.String())
+				fmt.Println(info.String())
 			} else {
-				name := node.Name()
+				name := info.Name
 				var col string
-				if node.IsDir() {
+				if info.IsDir() {
 					name += "/"
 				}
 				color.Print(col, name, "    ")
@@ -173,20 +300,32 @@ func cd(c *cli.Context) {
 	}
 
 	dirname := c.Args()[0]
-	var err error
 	if dirname == ".." {
 		if model.Root.Parent() == nil {
 			return
-		} else if model, err = manager.Model(model.Root.Parent().Id); err != nil {
+		} else if err := changeDirectory(model.Root.Parent().Id); err != nil {
 			panic(err)
 		}
 	} else if node := model.FindNodeByName(dirname); node == nil {
 		color.Println("@rNo such node: ", dirname)
-	} else if model, err = manager.Model(node.Id); err != nil {
+	} else if err := changeDirectory(node.Id); err != nil {
 		color.Println("@r", err.Error())
 	}
 }
 
+// Make the directory with nodeId the working directory
+func changeDirectory(nodeId string) error {
+	next, err := manager.Model(nodeId)
+	if err != nil {
+		return err
+	}
+
+	modelLock.Lock()
+	defer modelLock.Unlock()
+	model = next
+	return nil
+}
+
 func mkdir(c *cli.Context) {
 	var name string
 	if len(c.Args()) == 0 {
@@ -239,7 +378,7 @@ func put(c *cli.Context) {
 			bar.Set(int(progress))
 		}
 
-		if _, err := manager.UploadFile(model.Root.Id, target, updateCallback); err != nil {
+		if _, err := manager.UploadFile(model.Root.Id, target, c.Bool("force"), updateCallback); err != nil {
 			color.Println(fmt.Sprintf("@rError uploading %s: %s", target, err.Error()))
 		} else {
 			bar.FinishPrint("Finished Uploading")
@@ -294,6 +433,47 @@ func mv(c *cli.Context) {
 	}
 }
 
+func chmod(c *cli.Context) {
+	if len(c.Args()) < 2 {
+		color.Println("@yNot enough arguments in call to chmod")
+		return
+	}
+
+	name := c.Args()[1]
+	if perm, err := strconv.ParseUint(c.Args()[0], 8, 32); err != nil || perm > 0777 {
+		color.Println("@rInvalid mode: ", c.Args()[0])
+	} else if node := model.FindNodeByName(name); node == nil {
+		color.Println("@rNo such node: ", name)
+	} else if err := manager.Chmod(node.Id, os.FileMode(perm)); err != nil {
+		color.Println("@r", err.Error())
+	} else {
+		model.Refresh()
+	}
+}
+
+func chown(c *cli.Context) {
+	if len(c.Args()) < 2 {
+		color.Println("@yNot enough arguments in call to chown")
+		return
+	}
+
+	owner, group := c.Args()[0], ""
+	if i := strings.Index(owner, ":"); i >= 0 {
+		owner, group = owner[:i], owner[i+1:]
+	}
+
+	name := c.Args()[1]
+	if owner == "" && group == "" {
+		color.Println("@rInvalid owner: ", c.Args()[0])
+	} else if node := model.FindNodeByName(name); node == nil {
+		color.Println("@rNo such node: ", name)
+	} else if err := manager.Chown(node.Id, owner, group); err != nil {
+		color.Println("@r", err.Error())
+	} else {
+		model.Refresh()
+	}
+}
+
 func workingDirectory() string {
 	here := model.Root
 	var path string
@@ -1,19 +1,20 @@
 package shared
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cayleygraph/cayley"
 	"github.com/sdcoffey/olympus/client/apiclient"
 	"github.com/sdcoffey/olympus/graph"
-	"github.com/sdcoffey/olympus/util"
+	"github.com/sdcoffey/olympus/server/api"
+	"github.com/sdcoffey/olympus/upload"
 )
 
 type Manager struct {
@@ -68,6 +69,26 @@ func (manager *Manager) MoveNode(nodeId, newParentId, newName string) error {
 	return manager.api.UpdateNode(nodeInfo)
 }
 
+// Set the permission bits of a node, keeping its type
+func (manager *Manager) Chmod(nodeId string, perm os.FileMode) error {
+	node := manager.graph.NodeWithId(nodeId)
+	nodeInfo := graph.NodeInfo{
+		Id:   nodeId,
+		Mode: node.Mode()&^os.ModePerm | perm.Perm(),
+	}
+	return manager.api.UpdateNode(nodeInfo)
+}
+
+// Give a node to another owner or group, leaving either unchanged if it's empty
+func (manager *Manager) Chown(nodeId, owner, group string) error {
+	nodeInfo := graph.NodeInfo{
+		Id:    nodeId,
+		Owner: owner,
+		Group: group,
+	}
+	return manager.api.UpdateNode(nodeInfo)
+}
+
 func (manager *Manager) FindNodeByPath(path string) (*graph.Node, error) {
 	if !filepath.IsAbs(path) {
 		return nil, fmt.Errorf("Error finding node by path (%s) => path must be absolute", path)
@@ -98,7 +119,11 @@ func (manager *Manager) FindNodeByPath(path string) (*graph.Node, error) {
 
 type ProgressCallback func(total, current int64)
 
-func (manager *Manager) UploadFile(parentId, localPath string, callback ProgressCallback) (*graph.Node, error) {
+// Upload a file through an upload session, resuming the caller's earlier session for the same file if one
+// was interrupted. Only the blocks the server doesn't have are sent, each once, and the file appears on the
+// server when the session is committed. With replace, a file of the same name that's already there has its
+// content swapped for the upload's in one step, and keeps its old content as a version.
+func (manager *Manager) UploadFile(parentId, localPath string, replace bool, callback ProgressCallback) (*graph.Node, error) {
 	errorFmt := func(err error) error {
 		return fmt.Errorf("Error uploading file: %s", err.Error())
 	}
@@ -107,92 +132,177 @@ func (manager *Manager) UploadFile(parentId, localPath string, callback Progress
 		return nil, errorFmt(err)
 	} else if fi.IsDir() {
 		return nil, errors.New("Cannot upload a directory")
+	} else if localFile, err := os.Open(localPath); err != nil {
+		return nil, errorFmt(err)
 	} else {
-		nodeInfo := graph.NodeInfo{
-			Name:     filepath.Base(fi.Name()),
-			Size:     fi.Size(),
-			Mode:     0700,
-			MTime:    time.Now(),
-			ParentId: parentId,
-			Type:     util.MimeType(fi.Name()),
-		}
-		if newNode, err := manager.api.CreateNode(nodeInfo); err != nil {
-			return nil, errorFmt(err)
-		} else if localFile, err := os.Open(localPath); err != nil {
-			return nil, errorFmt(err)
-		} else {
-			defer localFile.Close()
+		defer localFile.Close()
 
-			errChan := make(chan error)
-			uploadChan := make(chan heap, 5)
-			defer close(uploadChan)
+		blockSize := manager.api.BlockSize()
+		readBlock := func(offset int64) ([]byte, error) {
+			buf := make([]byte, min(fi.Size()-offset, blockSize))
+			_, err := localFile.ReadAt(buf, offset)
+			return buf, err
+		}
 
-			var wg sync.WaitGroup
-			numBlocks := int(fi.Size() / graph.BLOCK_SIZE)
-			if fi.Size()%graph.BLOCK_SIZE > 0 {
-				numBlocks++
+		uploadRequest := api.UploadRequest{
+			Name:    filepath.Base(fi.Name()),
+			Mode:    0700,
+			Size:    fi.Size(),
+			Hashes:  make([]string, 0),
+			Replace: replace,
+		}
+		for offset := int64(0); offset < fi.Size(); offset += blockSize {
+			if buf, err := readBlock(offset); err != nil {
+				return nil, errorFmt(err)
+			} else {
+				uploadRequest.Hashes = append(uploadRequest.Hashes, graph.Hash(buf))
 			}
+		}
 
-			wg.Add(numBlocks)
-			var uploadedBytes int64
-			for i := 0; i < 5; i++ { // TODO: min(numblocks, 5)
-				go func() {
-					for h := range uploadChan {
-						payloadSize := int64(len(h.data))
-
-						rd := bytes.NewBuffer(h.data)
-						hash := graph.Hash(h.data)
-						if err = manager.api.WriteBlock(newNode.Id, h.offset, hash, rd); err != nil {
-							errChan <- err
-						}
-						uploadedBytes += payloadSize
-						callback(fi.Size(), uploadedBytes)
-						wg.Done()
-					}
-				}()
+		response, err := manager.uploadSession(parentId, uploadRequest, blockSize)
+		if err != nil {
+			return nil, errorFmt(err)
+		}
+		session := response.Info
+
+		// Each missing block is sent once, even if the file repeats it
+		var unsent []int
+		repeats := make(map[string]int)
+		remaining := int64(0)
+		for _, i := range response.Missing {
+			if repeats[session.Hashes[i]] == 0 {
+				unsent = append(unsent, i)
 			}
+			repeats[session.Hashes[i]]++
+			remaining += session.BlockLength(i)
+		}
+
+		var uploadedBytes int64
+		progress := func(size int64) {
+			callback(fi.Size(), atomic.AddInt64(&uploadedBytes, size))
+		}
+		if remaining < fi.Size() {
+			progress(fi.Size() - remaining)
+		}
 
-			errChecker := func() error {
-				select {
-				case err := <-errChan:
-					return errorFmt(err)
-				default:
-					return nil
+		errChan := make(chan error, len(unsent))
+		uploadChan := make(chan heap, 5)
+		defer close(uploadChan)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ { // TODO: min(numblocks, 5)
+			go func() {
+				for h := range uploadChan {
+					if err := manager.sendBlock(session.Id, h.index, h.data); err != nil {
+						errChan <- err
+					} else {
+						progress(int64(len(h.data) * repeats[session.Hashes[h.index]]))
+					}
+					wg.Done()
 				}
+			}()
+		}
+
+		errChecker := func() error {
+			select {
+			case err := <-errChan:
+				return errorFmt(err)
+			default:
+				return nil
 			}
+		}
 
-			var offset int64
-			for offset = 0; offset < fi.Size(); offset += graph.BLOCK_SIZE {
-				buf := make([]byte, min(fi.Size()-offset, graph.BLOCK_SIZE))
-				if _, err = localFile.ReadAt(buf, offset); err != nil {
-					return nil, errorFmt(err)
-				}
-				uploadChan <- heap{offset, buf}
+		for _, i := range unsent {
+			if buf, err := readBlock(session.Offset(i)); err != nil {
+				return nil, errorFmt(err)
+			} else {
+				wg.Add(1)
+				uploadChan <- heap{i, buf}
+			}
 
-				if err := errChecker(); err != nil {
+			if err := errChecker(); err != nil {
+				return nil, err
+			}
+		}
+
+		wg.Wait()
+		if err := errChecker(); err != nil {
+			return nil, err
+		}
+
+		info, err := manager.api.CommitUpload(session.Id)
+		if apiErr, ok := err.(*api.ApiError); ok && apiErr.Code == api.BLOCKS_MISSING {
+			// Blocks the server said it had can go missing before the commit, so send those it lists and try again
+			for _, i := range apiErr.MissingBlocks() {
+				if buf, err := readBlock(session.Offset(i)); err != nil {
+					return nil, errorFmt(err)
+				} else if err = manager.sendBlock(session.Id, i, buf); err != nil {
 					return nil, errorFmt(err)
 				}
 			}
+			info, err = manager.api.CommitUpload(session.Id)
+		}
+		if err != nil {
+			return nil, errorFmt(err)
+		}
 
-			if err := errChecker(); err != nil {
+		localNode := manager.graph.NodeWithName(parentId, info.Name)
+		if localNode == nil {
+			if localNode, err = manager.graph.NewNode(info.Name, parentId, info.Mode); err != nil {
 				return nil, errorFmt(err)
 			}
-			wg.Wait()
+		}
+		if err := localNode.Touch(info.MTime); err != nil {
+			return nil, errorFmt(err)
+		}
+		return localNode, nil
+	}
+}
 
-			if localNode, err := manager.graph.NewNode(nodeInfo.Name, parentId, nodeInfo.Mode); err != nil {
-				return nil, errorFmt(err)
-			} else if localNode.Touch(nodeInfo.MTime); err != nil {
-				return nil, errorFmt(err)
-			} else {
-				return localNode, nil
+// The caller's open session for uploading this file, if an earlier upload of it was interrupted, or a new one
+func (manager *Manager) uploadSession(parentId string, uploadRequest api.UploadRequest, blockSize int64) (api.UploadResponse, error) {
+	file := upload.Session{
+		ParentId:  parentId,
+		Name:      uploadRequest.Name,
+		Size:      uploadRequest.Size,
+		BlockSize: blockSize,
+		Hashes:    uploadRequest.Hashes,
+		Replace:   uploadRequest.Replace,
+	}
+
+	if sessions, err := manager.api.Uploads(); err != nil {
+		return api.UploadResponse{}, err
+	} else {
+		for _, session := range sessions {
+			if session.Matches(file) {
+				return manager.api.UploadStatus(session.Id)
 			}
 		}
 	}
+
+	return manager.api.OpenUpload(parentId, uploadRequest)
+}
+
+// Times to try sending each block before giving up on an upload, which can then be resumed
+const uploadAttempts = 3
+
+func (manager *Manager) sendBlock(uploadId string, index int, data []byte) (err error) {
+	for attempt := 1; attempt <= uploadAttempts; attempt++ {
+		if err = manager.api.UploadBlock(uploadId, index, data); err == nil {
+			return nil
+		} else if _, rejected := err.(*api.ApiError); rejected {
+			// The server got the block and refused it, so sending it again won't help
+			return err
+		} else if attempt < uploadAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
 }
 
 type heap struct {
-	offset int64
-	data   []byte
+	index int
+	data  []byte
 }
 
 func min(a, b int64) int64 {
@@ -0,0 +1,174 @@
+package shared
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cayleygraph/cayley"
+	"github.com/sdcoffey/olympus/client/apiclient"
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/graph/testutils"
+	"github.com/sdcoffey/olympus/server/api"
+	"github.com/sdcoffey/olympus/upload"
+	. "gopkg.in/check.v1"
+)
+
+func init() {
+	Suite(&ManagerTestSuite{})
+}
+
+type ManagerTestSuite struct {
+	manager *Manager
+	server  *httptest.Server
+	tmpDir  string
+
+	sync.Mutex
+	sentBlocks int
+	sentBytes  int64
+}
+
+func TestManagerTestSuite(t *testing.T) {
+	TestingT(t)
+}
+
+func (t *ManagerTestSuite) SetUpTest(c *C) {
+	var ng *graph.NodeGraph
+	ng, t.tmpDir = testutils.TestInit()
+	t.sentBlocks, t.sentBytes = 0, 0
+
+	uploads, _ := upload.NewStore("", time.Hour)
+	serverApi := api.NewApi(ng, api.WithUploads(uploads))
+	t.server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		// Blocks are sent with a PUT of their data; bodies are chunked, so they're counted as they're read
+		if req.Method == "PUT" {
+			body, _ := ioutil.ReadAll(req.Body)
+			if len(body) > 0 {
+				t.Lock()
+				t.sentBlocks++
+				t.sentBytes += int64(len(body))
+				t.Unlock()
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		serverApi.ServeHTTP(writer, req)
+	}))
+
+	handle, _ := cayley.NewMemoryGraph()
+	t.manager = NewManager(apiclient.ApiClient{Address: t.server.URL, Encoding: api.JsonEncoding}, handle)
+}
+
+func (t *ManagerTestSuite) TearDownTest(c *C) {
+	t.server.Close()
+	os.RemoveAll(t.tmpDir)
+}
+
+func (t *ManagerTestSuite) TestUploadFile_sendsOnlyBlocksServerIsMissing(c *C) {
+	block := testutils.RandDat(graph.BLOCK_SIZE)
+	dat := append(append(append([]byte{}, block...), block...), testutils.RandDat(100)...)
+	first := filepath.Join(t.tmpDir, "first")
+	second := filepath.Join(t.tmpDir, "second")
+	c.Assert(ioutil.WriteFile(first, dat, 0644), IsNil)
+	c.Assert(ioutil.WriteFile(second, dat, 0644), IsNil)
+
+	var uploaded int64
+	progress := func(total, current int64) {
+		t.Lock()
+		defer t.Unlock()
+		if current > uploaded {
+			uploaded = current
+		}
+	}
+
+	_, err := t.manager.UploadFile(graph.RootNodeId, first, false, progress)
+	c.Assert(err, IsNil)
+	c.Check(uploaded, Equals, int64(len(dat)))
+	// The repeated block is only sent once
+	c.Check(t.sentBlocks, Equals, 2)
+	c.Check(t.sentBytes, Equals, int64(graph.BLOCK_SIZE+100))
+
+	uploaded = 0
+	_, err = t.manager.UploadFile(graph.RootNodeId, second, false, progress)
+	c.Assert(err, IsNil)
+	c.Check(uploaded, Equals, int64(len(dat)))
+	c.Check(t.sentBlocks, Equals, 2)
+
+	nodes, err := t.manager.api.ListNodes(graph.RootNodeId)
+	c.Assert(err, IsNil)
+	c.Assert(nodes, HasLen, 2)
+	for _, node := range nodes {
+		blocks, err := t.manager.api.ListBlocks(node.Id)
+		c.Assert(err, IsNil)
+		c.Check(blocks, HasLen, 3)
+	}
+}
+
+func (t *ManagerTestSuite) TestUploadFile_resumesInterruptedUpload(c *C) {
+	dat := testutils.RandDat(graph.BLOCK_SIZE*2 + 100)
+	localPath := filepath.Join(t.tmpDir, "resumed")
+	c.Assert(ioutil.WriteFile(localPath, dat, 0644), IsNil)
+
+	// An earlier upload of the file got as far as its first block
+	uploadRequest := api.UploadRequest{
+		Name:   "resumed",
+		Mode:   0700,
+		Size:   int64(len(dat)),
+		Hashes: []string{graph.Hash(dat[:graph.BLOCK_SIZE]), graph.Hash(dat[graph.BLOCK_SIZE : graph.BLOCK_SIZE*2]), graph.Hash(dat[graph.BLOCK_SIZE*2:])},
+	}
+	opened, err := t.manager.api.OpenUpload(graph.RootNodeId, uploadRequest)
+	c.Assert(err, IsNil)
+	c.Assert(t.manager.api.UploadBlock(opened.Info.Id, 0, dat[:graph.BLOCK_SIZE]), IsNil)
+
+	var uploaded int64
+	_, err = t.manager.UploadFile(graph.RootNodeId, localPath, false, func(total, current int64) {
+		t.Lock()
+		defer t.Unlock()
+		if current > uploaded {
+			uploaded = current
+		}
+	})
+	c.Assert(err, IsNil)
+	c.Check(uploaded, Equals, int64(len(dat)))
+	c.Check(t.sentBlocks, Equals, 3)
+	c.Check(t.sentBytes, Equals, int64(len(dat)))
+
+	sessions, err := t.manager.api.Uploads()
+	c.Assert(err, IsNil)
+	c.Check(sessions, HasLen, 0)
+
+	nodes, err := t.manager.api.ListNodes(graph.RootNodeId)
+	c.Assert(err, IsNil)
+	c.Assert(nodes, HasLen, 1)
+	blocks, err := t.manager.api.ListBlocks(nodes[0].Id)
+	c.Assert(err, IsNil)
+	c.Check(blocks, HasLen, 3)
+}
+
+func (t *ManagerTestSuite) TestUploadFile_replacesExistingFileWhenForced(c *C) {
+	localPath := filepath.Join(t.tmpDir, "file")
+	c.Assert(ioutil.WriteFile(localPath, testutils.RandDat(1024), 0644), IsNil)
+	_, err := t.manager.UploadFile(graph.RootNodeId, localPath, false, func(total, current int64) {})
+	c.Assert(err, IsNil)
+	nodes, err := t.manager.api.ListNodes(graph.RootNodeId)
+	c.Assert(err, IsNil)
+	c.Assert(nodes, HasLen, 1)
+
+	dat := testutils.RandDat(2048)
+	c.Assert(ioutil.WriteFile(localPath, dat, 0644), IsNil)
+	_, err = t.manager.UploadFile(graph.RootNodeId, localPath, false, func(total, current int64) {})
+	c.Check(err, ErrorMatches, ".*node_exists.*")
+
+	_, err = t.manager.UploadFile(graph.RootNodeId, localPath, true, func(total, current int64) {})
+	c.Assert(err, IsNil)
+	replaced, err := t.manager.api.ListNodes(graph.RootNodeId)
+	c.Assert(err, IsNil)
+	c.Assert(replaced, HasLen, 1)
+	c.Check(replaced[0].Id, Equals, nodes[0].Id)
+	c.Check(replaced[0].Size, Equals, int64(len(dat)))
+}
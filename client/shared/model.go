@@ -3,6 +3,7 @@ package shared
 import (
 	"errors"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/sdcoffey/olympus/client/apiclient"
 	"github.com/sdcoffey/olympus/graph"
@@ -12,6 +13,7 @@ type Model struct {
 	graph *graph.NodeGraph
 	Root  *graph.Node
 	api   apiclient.OlympusClient
+	stale int32
 }
 
 func newModel(api apiclient.OlympusClient, rootNode *graph.Node, ng *graph.NodeGraph) *Model {
@@ -35,12 +37,19 @@ func (model *Model) init() error {
 }
 
 func (model *Model) Refresh() error {
+	_, err := model.RefreshSorted(graph.Alphabetical)
+	return err
+}
+
+// Refresh the cache, returning the server's listing in the order given by sorter. Sizes are only known to
+// the server, so orders that depend on them can't be reproduced from the cache.
+func (model *Model) RefreshSorted(sorter graph.Sorter) ([]graph.NodeInfo, error) {
 	for _, nodeOnDisk := range model.Root.Children() {
 		model.graph.RemoveNode(nodeOnDisk)
 	}
 
-	if nodeInfos, err := model.api.ListNodes(model.Root.Id); err != nil {
-		return fmt.Errorf("Error listing nodes: %s", err.Error())
+	if nodeInfos, err := model.api.ListNodesSorted(model.Root.Id, sorter); err != nil {
+		return nil, fmt.Errorf("Error listing nodes: %s", err.Error())
 	} else {
 		var err error
 		var curNode *graph.Node
@@ -52,10 +61,24 @@ func (model *Model) Refresh() error {
 		}
 
 		if err != nil {
-			return fmt.Errorf("Error refreshing model: %s", err.Error())
+			return nil, fmt.Errorf("Error refreshing model: %s", err.Error())
 		}
+
+		return nodeInfos, nil
 	}
+}
 
+// Mark the cache as out of date, e.g. when the server announces a change under Root. Safe to call from any
+// goroutine, unlike the methods that touch the cache.
+func (model *Model) Invalidate() {
+	atomic.StoreInt32(&model.stale, 1)
+}
+
+// Refresh the cache if it's been invalidated since it was last refreshed
+func (model *Model) Sync() error {
+	if atomic.CompareAndSwapInt32(&model.stale, 1, 0) {
+		return model.Refresh()
+	}
 	return nil
 }
 
@@ -35,7 +35,7 @@ func (t *ModelTestSuite) SetUpTest(c *C) {
 
 	t.nodeGraph, t.tmpDir = testutils.TestInit()
 	t.server = httptest.NewServer(api.NewApi(memNg))
-	t.client = apiclient.ApiClient{t.server.URL, api.JsonEncoding}
+	t.client = apiclient.ApiClient{Address: t.server.URL, Encoding: api.JsonEncoding}
 }
 
 func (t *ModelTestSuite) TearDownTest(c *C) {
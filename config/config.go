@@ -0,0 +1,219 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"time"
+)
+
+const FileName = "olympus.json"
+
+const (
+	Bolt   = "bolt"
+	Memory = "memory"
+)
+
+// Server settings. They're read from a JSON file in the config directory, then overridden by OLYMPUS_*
+// environment variables, then by command line flags; see settings for the names of each.
+type Config struct {
+	// Address to serve the api on
+	Listen string `json:"listen"`
+	// Where the node graph is kept: Bolt, in DbDir, or Memory, in which case nothing but blocks is persisted
+	Storage string `json:"storage"`
+	DbDir   string `json:"db_dir,omitempty"`
+	// Directories blocks are written to, Copies times each. Empty means $OLYMPUS_HOME/dat.
+	DataDirs []string `json:"data_dirs,omitempty"`
+	Copies   int      `json:"copies"`
+	Auth     bool     `json:"auth"`
+	// Admins may ingest server-side paths under IngestRoot through the api. Empty turns that off, leaving
+	// ingest to the -ingest flag.
+	IngestRoot string `json:"ingest_root,omitempty"`
+	// Addresses or CIDR ranges of proxies in front of the server, whose X-Forwarded-For and X-Forwarded-Proto
+	// headers are believed
+	TrustedProxies []string  `json:"trusted_proxies,omitempty"`
+	TLS            TLS       `json:"tls"`
+	Discovery      Discovery `json:"discovery"`
+	Limits         Limits    `json:"limits"`
+	Log            Log       `json:"log"`
+}
+
+// Without Cert and Key, a self-signed certificate is generated in the config directory
+type TLS struct {
+	Enabled bool   `json:"enabled"`
+	Cert    string `json:"cert,omitempty"`
+	Key     string `json:"key,omitempty"`
+}
+
+// Announcing the server to clients on the local network
+type Discovery struct {
+	Enabled  bool     `json:"enabled"`
+	Interval Duration `json:"interval"`
+}
+
+type Limits struct {
+	// How long keep-alive connections are held open between requests, and the largest request headers
+	// accepted
+	IdleTimeout    Duration `json:"idle_timeout"`
+	MaxHeaderBytes int      `json:"max_header_bytes"`
+	// Webhook deliveries are attempted up to WebhookAttempts times, waiting WebhookBackoff before the first
+	// retry and doubling the wait after each
+	WebhookAttempts int      `json:"webhook_attempts"`
+	WebhookBackoff  Duration `json:"webhook_backoff"`
+	// The server isn't ready for requests while any data directory has less than MinFreeBytes free
+	MinFreeBytes int64 `json:"min_free_bytes"`
+	// On SIGTERM or SIGINT, requests in flight are given ShutdownTimeout to finish before their connections
+	// are closed
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// Upload sessions that haven't been committed UploadTimeout after they're opened expire
+	UploadTimeout Duration `json:"upload_timeout"`
+	// The change journal keeps at least the latest JournalChanges changes, or all of them if it's 0; clients
+	// syncing from older cursors have to start over
+	JournalChanges int `json:"journal_changes"`
+	// Files keep their FileVersions latest earlier contents when they're replaced, or all of them if it's 0
+	FileVersions int `json:"file_versions"`
+}
+
+// Server output goes to File if it's set, or stderr. It's reopened when the config is reloaded, so it can be
+// rotated. Access and error logs are written to Dir, defaulting to $OLYMPUS_HOME/log, and rotated once they
+// reach RotateBytes, keeping Keep old files of each.
+type Log struct {
+	File        string `json:"file,omitempty"`
+	Dir         string `json:"dir,omitempty"`
+	RotateBytes int64  `json:"rotate_bytes"`
+	Keep        int    `json:"keep"`
+}
+
+// A time.Duration written as a string like "1m30s"
+type Duration time.Duration
+
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("Durations must be strings like \"30s\"")
+	} else if parsed, err := time.ParseDuration(s); err != nil {
+		return err
+	} else {
+		*duration = Duration(parsed)
+		return nil
+	}
+}
+
+func Default() Config {
+	return Config{
+		Listen:  ":3000",
+		Storage: Bolt,
+		Copies:  1,
+		Auth:    true,
+		TLS:     TLS{Enabled: true},
+		Discovery: Discovery{
+			Enabled:  true,
+			Interval: Duration(time.Second),
+		},
+		Limits: Limits{
+			IdleTimeout:     Duration(2 * time.Minute),
+			MaxHeaderBytes:  1 << 20,
+			WebhookAttempts: 6,
+			WebhookBackoff:  Duration(time.Second),
+			MinFreeBytes:    100 << 20,
+			ShutdownTimeout: Duration(30 * time.Second),
+			UploadTimeout:   Duration(24 * time.Hour),
+			JournalChanges:  100000,
+			FileVersions:    10,
+		},
+		Log: Log{
+			RotateBytes: 10 << 20,
+			Keep:        5,
+		},
+	}
+}
+
+// Read the config file at path over the defaults, if it exists, then apply the environment and flags, and
+// validate the result
+func Load(path string, flags Flags) (Config, error) {
+	config := Default()
+	if data, err := ioutil.ReadFile(path); err != nil && !os.IsNotExist(err) {
+		return config, fmt.Errorf("Error reading %s: %s", path, err.Error())
+	} else if err == nil {
+		if err = json.Unmarshal(data, &config); err != nil {
+			return config, fmt.Errorf("Error reading %s: %s", path, err.Error())
+		}
+	}
+
+	if err := config.applyEnv(os.Getenv); err != nil {
+		return config, err
+	} else if err := flags.apply(&config); err != nil {
+		return config, err
+	}
+
+	return config, config.Validate()
+}
+
+func (config Config) Validate() error {
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+		return fmt.Errorf("Invalid listen address %s: %s", config.Listen, err.Error())
+	} else if config.Storage != Bolt && config.Storage != Memory {
+		return fmt.Errorf("Invalid storage %s: must be %s or %s", config.Storage, Bolt, Memory)
+	} else if config.Copies < 1 || config.Copies > len(config.DataDirs) && config.Copies > 1 {
+		return errors.New("Number of copies must be between 1 and the number of data directories")
+	} else if config.TLS.Enabled && (config.TLS.Cert == "") != (config.TLS.Key == "") {
+		return errors.New("Both a TLS certificate and key are required")
+	} else if config.Discovery.Enabled && config.Discovery.Interval <= 0 {
+		return errors.New("Discovery interval must be positive")
+	} else if config.Limits.IdleTimeout < 0 || config.Limits.MaxHeaderBytes < 0 || config.Limits.MinFreeBytes < 0 ||
+		config.Limits.ShutdownTimeout < 0 || config.Limits.JournalChanges < 0 || config.Limits.FileVersions < 0 {
+		return errors.New("Limits must not be negative")
+	} else if config.Limits.UploadTimeout <= 0 {
+		return errors.New("Upload timeout must be positive")
+	} else if config.Limits.WebhookAttempts < 1 || config.Limits.WebhookBackoff < 0 {
+		return errors.New("Webhooks must be attempted at least once, with a backoff that isn't negative")
+	} else if config.Log.RotateBytes < 0 || config.Log.Keep < 0 {
+		return errors.New("Log rotation settings must not be negative")
+	}
+
+	for _, proxy := range config.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return fmt.Errorf("Invalid trusted proxy %s: must be an IP address or CIDR range", proxy)
+		}
+	}
+	return nil
+}
+
+// Names of the settings that differ between config and other, but that only take effect on restart
+func (config Config) RestartRequired(other Config) []string {
+	var names []string
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			names = append(names, name)
+		}
+	}
+
+	check("listen", config.Listen, other.Listen)
+	check("storage", config.Storage, other.Storage)
+	check("db_dir", config.DbDir, other.DbDir)
+	check("data_dirs", config.DataDirs, other.DataDirs)
+	check("copies", config.Copies, other.Copies)
+	check("auth", config.Auth, other.Auth)
+	check("ingest_root", config.IngestRoot, other.IngestRoot)
+	check("trusted_proxies", config.TrustedProxies, other.TrustedProxies)
+	check("tls.enabled", config.TLS.Enabled, other.TLS.Enabled)
+	check("limits.idle_timeout", config.Limits.IdleTimeout, other.Limits.IdleTimeout)
+	check("limits.max_header_bytes", config.Limits.MaxHeaderBytes, other.Limits.MaxHeaderBytes)
+	check("limits.min_free_bytes", config.Limits.MinFreeBytes, other.Limits.MinFreeBytes)
+	check("limits.upload_timeout", config.Limits.UploadTimeout, other.Limits.UploadTimeout)
+	check("limits.journal_changes", config.Limits.JournalChanges, other.Limits.JournalChanges)
+	check("limits.file_versions", config.Limits.FileVersions, other.Limits.FileVersions)
+	check("log.dir", config.Log.Dir, other.Log.Dir)
+	check("log.rotate_bytes", config.Log.RotateBytes, other.Log.RotateBytes)
+	check("log.keep", config.Log.Keep, other.Log.Keep)
+
+	return names
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, contents string) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "olympus-config")
+	assert.NoError(t, err)
+	path = filepath.Join(dir, FileName)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(contents), 0600))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoad_usesDefaultsWithoutFile(t *testing.T) {
+	config, err := Load(filepath.Join(os.TempDir(), "no-such-dir", FileName), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), config)
+}
+
+func TestLoad_fileOverridesDefaults(t *testing.T) {
+	path, cleanup := writeConfig(t, `{
+		"listen": "127.0.0.1:4000",
+		"discovery": {"interval": "5s"},
+		"limits": {"webhook_attempts": 2}
+	}`)
+	defer cleanup()
+
+	config, err := Load(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:4000", config.Listen)
+	assert.Equal(t, Duration(5*time.Second), config.Discovery.Interval)
+	assert.True(t, config.Discovery.Enabled)
+	assert.Equal(t, 2, config.Limits.WebhookAttempts)
+	assert.Equal(t, Default().Limits.WebhookBackoff, config.Limits.WebhookBackoff)
+}
+
+func TestLoad_flagsOverrideEnvironmentOverridesFile(t *testing.T) {
+	path, cleanup := writeConfig(t, `{"listen": ":4000", "storage": "memory", "tls": {"enabled": true}}`)
+	defer cleanup()
+
+	os.Setenv("OLYMPUS_LISTEN", ":5000")
+	os.Setenv("OLYMPUS_TLS", "false")
+	defer os.Unsetenv("OLYMPUS_LISTEN")
+	defer os.Unsetenv("OLYMPUS_TLS")
+
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(flagSet)
+	assert.NoError(t, flagSet.Parse([]string{"-listen", ":6000", "-auth=false", "-data", "a,b", "-copies", "2"}))
+
+	config, err := Load(path, flags)
+	assert.NoError(t, err)
+	assert.Equal(t, ":6000", config.Listen)
+	assert.Equal(t, Memory, config.Storage)
+	assert.False(t, config.TLS.Enabled)
+	assert.False(t, config.Auth)
+	assert.Equal(t, []string{"a", "b"}, config.DataDirs)
+	assert.Equal(t, 2, config.Copies)
+}
+
+func TestLoad_rejectsInvalidConfig(t *testing.T) {
+	path, cleanup := writeConfig(t, `{"listen": 3000}`)
+	defer cleanup()
+	_, err := Load(path, nil)
+	assert.Error(t, err)
+
+	for _, args := range [][]string{
+		{"-listen", "nowhere"},
+		{"-storage", "floppy"},
+		{"-copies", "2"},
+		{"-copies", "two"},
+		{"-cert", "server.crt"},
+		{"-discovery-interval", "0s"},
+		{"-webhook-attempts", "0"},
+		{"-min-free-bytes", "-1"},
+		{"-shutdown-timeout", "-1s"},
+		{"-upload-timeout", "0s"},
+		{"-journal-changes", "-1"},
+		{"-file-versions", "-1"},
+		{"-trusted-proxies", "10.0.0.1,proxy.local"},
+		{"-auth=maybe"},
+	} {
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := RegisterFlags(flagSet)
+		assert.NoError(t, flagSet.Parse(args))
+
+		_, err := Load("", flags)
+		assert.Error(t, err, "%v", args)
+	}
+}
+
+func TestDuration_roundTripsAsString(t *testing.T) {
+	data, err := json.Marshal(Duration(90 * time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, `"1m30s"`, string(data))
+
+	var duration Duration
+	assert.NoError(t, json.Unmarshal(data, &duration))
+	assert.Equal(t, Duration(90*time.Second), duration)
+
+	assert.Error(t, json.Unmarshal([]byte("90"), &duration))
+}
+
+func TestConfig_RestartRequired(t *testing.T) {
+	config := Default()
+	next := Default()
+	next.Discovery.Interval = Duration(time.Minute)
+	next.Log.File = "olympus.log"
+	assert.Empty(t, config.RestartRequired(next))
+
+	next.Listen = ":4000"
+	next.DataDirs = []string{"a"}
+	assert.Equal(t, []string{"listen", "data_dirs"}, config.RestartRequired(next))
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const envPrefix = "OLYMPUS_"
+
+// A setting that can be overridden by the flag -name, or the environment variable OLYMPUS_NAME (in upper
+// case, with - as _)
+type setting struct {
+	name    string
+	usage   string
+	boolean bool
+	set     func(config *Config, value string) error
+}
+
+func (s setting) env() string {
+	return envPrefix + strings.ToUpper(strings.Replace(s.name, "-", "_", -1))
+}
+
+var settings = []setting{
+	{name: "listen", usage: "Address to serve the api on", set: func(config *Config, value string) error {
+		config.Listen = value
+		return nil
+	}},
+	{name: "storage", usage: "Where to keep the node graph: bolt, or memory to persist nothing but blocks", set: func(config *Config, value string) error {
+		config.Storage = value
+		return nil
+	}},
+	{name: "db", usage: "Directory for the node graph (defaults to $OLYMPUS_HOME/db)", set: func(config *Config, value string) error {
+		config.DbDir = value
+		return nil
+	}},
+	{name: "data", usage: "Comma-separated list of directories to store blocks in (defaults to $OLYMPUS_HOME/dat)", set: func(config *Config, value string) error {
+		config.DataDirs = strings.Split(value, ",")
+		return nil
+	}},
+	{name: "copies", usage: "Number of data directories each block is written to", set: func(config *Config, value string) error {
+		return setInt(&config.Copies, value)
+	}},
+	{name: "auth", usage: "Require clients to log in", boolean: true, set: func(config *Config, value string) error {
+		return setBool(&config.Auth, value)
+	}},
+	{name: "ingest-root", usage: "Directory admins may ingest server-side paths from through the api", set: func(config *Config, value string) error {
+		config.IngestRoot = value
+		return nil
+	}},
+	{name: "trusted-proxies", usage: "Comma separated addresses or CIDR ranges of proxies whose forwarding headers are believed", set: func(config *Config, value string) error {
+		config.TrustedProxies = strings.Split(value, ",")
+		return nil
+	}},
+	{name: "tls", usage: "Serve HTTPS; turn off to serve plain HTTP behind a proxy that terminates TLS", boolean: true, set: func(config *Config, value string) error {
+		return setBool(&config.TLS.Enabled, value)
+	}},
+	{name: "cert", usage: "TLS certificate file (defaults to a self-signed certificate in $OLYMPUS_HOME/cfg)", set: func(config *Config, value string) error {
+		config.TLS.Cert = value
+		return nil
+	}},
+	{name: "key", usage: "TLS key file for -cert", set: func(config *Config, value string) error {
+		config.TLS.Key = value
+		return nil
+	}},
+	{name: "discovery", usage: "Announce the server to clients on the local network", boolean: true, set: func(config *Config, value string) error {
+		return setBool(&config.Discovery.Enabled, value)
+	}},
+	{name: "discovery-interval", usage: "How often to announce the server", set: func(config *Config, value string) error {
+		return setDuration(&config.Discovery.Interval, value)
+	}},
+	{name: "idle-timeout", usage: "How long to keep idle connections open", set: func(config *Config, value string) error {
+		return setDuration(&config.Limits.IdleTimeout, value)
+	}},
+	{name: "max-header-bytes", usage: "Largest request headers to accept", set: func(config *Config, value string) error {
+		return setInt(&config.Limits.MaxHeaderBytes, value)
+	}},
+	{name: "webhook-attempts", usage: "Times to attempt each webhook delivery", set: func(config *Config, value string) error {
+		return setInt(&config.Limits.WebhookAttempts, value)
+	}},
+	{name: "webhook-backoff", usage: "Wait before retrying a webhook delivery, doubled after each retry", set: func(config *Config, value string) error {
+		return setDuration(&config.Limits.WebhookBackoff, value)
+	}},
+	{name: "min-free-bytes", usage: "Free space each data directory needs for the server to be ready", set: func(config *Config, value string) error {
+		return setInt64(&config.Limits.MinFreeBytes, value)
+	}},
+	{name: "shutdown-timeout", usage: "How long to let requests finish when shutting down", set: func(config *Config, value string) error {
+		return setDuration(&config.Limits.ShutdownTimeout, value)
+	}},
+	{name: "upload-timeout", usage: "How long an upload session may wait to be committed", set: func(config *Config, value string) error {
+		return setDuration(&config.Limits.UploadTimeout, value)
+	}},
+	{name: "journal-changes", usage: "Number of changes the change journal keeps, or 0 for all", set: func(config *Config, value string) error {
+		return setInt(&config.Limits.JournalChanges, value)
+	}},
+	{name: "file-versions", usage: "Number of earlier contents each file keeps, or 0 for all", set: func(config *Config, value string) error {
+		return setInt(&config.Limits.FileVersions, value)
+	}},
+	{name: "log-file", usage: "File to write server output to, instead of stderr", set: func(config *Config, value string) error {
+		config.Log.File = value
+		return nil
+	}},
+	{name: "log-dir", usage: "Directory for access and error logs (defaults to $OLYMPUS_HOME/log)", set: func(config *Config, value string) error {
+		config.Log.Dir = value
+		return nil
+	}},
+	{name: "log-rotate-bytes", usage: "Size at which access and error logs are rotated", set: func(config *Config, value string) error {
+		return setInt64(&config.Log.RotateBytes, value)
+	}},
+	{name: "log-keep", usage: "Number of rotated access and error logs to keep", set: func(config *Config, value string) error {
+		return setInt(&config.Log.Keep, value)
+	}},
+}
+
+func setInt(field *int, value string) error {
+	if i, err := strconv.Atoi(value); err != nil {
+		return fmt.Errorf("%s is not a number", value)
+	} else {
+		*field = i
+		return nil
+	}
+}
+
+func setInt64(field *int64, value string) error {
+	if i, err := strconv.ParseInt(value, 10, 64); err != nil {
+		return fmt.Errorf("%s is not a number", value)
+	} else {
+		*field = i
+		return nil
+	}
+}
+
+func setBool(field *bool, value string) error {
+	if b, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("%s is not true or false", value)
+	} else {
+		*field = b
+		return nil
+	}
+}
+
+func setDuration(field *Duration, value string) error {
+	if d, err := time.ParseDuration(value); err != nil {
+		return err
+	} else {
+		*field = Duration(d)
+		return nil
+	}
+}
+
+func (config *Config) applyEnv(getenv func(string) string) error {
+	for _, s := range settings {
+		if value := getenv(s.env()); value == "" {
+			continue
+		} else if err := s.set(config, value); err != nil {
+			return fmt.Errorf("Invalid $%s: %s", s.env(), err.Error())
+		}
+	}
+	return nil
+}
+
+// Values of the setting flags given on the command line, by name
+type Flags map[string]string
+
+// Define a flag on flagSet for each setting. Their values are recorded in the returned Flags as flagSet is
+// parsed, to be applied by Load.
+func RegisterFlags(flagSet *flag.FlagSet) Flags {
+	flags := make(Flags)
+	for _, s := range settings {
+		flagSet.Var(flagValue{s, flags}, s.name, s.usage)
+	}
+	return flags
+}
+
+func (flags Flags) apply(config *Config) error {
+	for _, s := range settings {
+		if value, ok := flags[s.name]; !ok {
+			continue
+		} else if err := s.set(config, value); err != nil {
+			return fmt.Errorf("Invalid -%s: %s", s.name, err.Error())
+		}
+	}
+	return nil
+}
+
+type flagValue struct {
+	setting
+	flags Flags
+}
+
+func (value flagValue) String() string {
+	if value.flags == nil {
+		return ""
+	}
+	return value.flags[value.name]
+}
+
+// Values are checked when they're applied, so errors name where they came from
+func (value flagValue) Set(s string) error {
+	value.flags[value.name] = s
+	return nil
+}
+
+func (value flagValue) IsBoolFlag() bool {
+	return value.boolean
+}
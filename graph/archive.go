@@ -0,0 +1,239 @@
+package graph
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	archiveNodePrefix  = "nodes/"
+	archiveBlockPrefix = "blocks/"
+)
+
+// An archive is a tar stream of node entries in depth-first order, each followed by entries for any blocks
+// it references that haven't appeared earlier in the stream, so every parent precedes its children and
+// every block is stored once.
+type archiveNode struct {
+	Info   NodeInfo    `json:"info"`
+	Blocks []BlockInfo `json:"blocks"`
+}
+
+type ImportReport struct {
+	Nodes         int `json:"nodes"`
+	Blocks        int `json:"blocks"`
+	SkippedBlocks int `json:"skipped_blocks"`
+}
+
+// Write the subtree rooted at nd to w as a tar archive. Blocks are read and written one at a time, so the
+// archive is never held in memory. Descendants include rejects are left out along with everything under them;
+// a nil include keeps every node.
+func (ng *NodeGraph) Export(nd *Node, w io.Writer, include func(*Node) bool) error {
+	if !nd.Exists() {
+		return fmt.Errorf("Error exporting node: %s does not exist", nd.Id)
+	}
+
+	tw := tar.NewWriter(w)
+	written := make(map[string]bool)
+	if include == nil {
+		include = func(*Node) bool { return true }
+	}
+	if err := ng.exportNode(nd, tw, written, include); err != nil {
+		return fmt.Errorf("Error exporting node: %s", err.Error())
+	}
+
+	return tw.Close()
+}
+
+func (ng *NodeGraph) exportNode(nd *Node, tw *tar.Writer, written map[string]bool, include func(*Node) bool) error {
+	entry := archiveNode{
+		Info:   nd.NodeInfo(),
+		Blocks: nd.Blocks(),
+	}
+
+	if dat, err := json.Marshal(entry); err != nil {
+		return err
+	} else if err = writeTarEntry(tw, archiveNodePrefix+nd.Id, entry.Info.MTime, dat); err != nil {
+		return err
+	}
+
+	for _, block := range entry.Blocks {
+		if written[block.Hash] {
+			continue
+		}
+
+		if dat, err := RawData(block.Hash); err != nil {
+			return fmt.Errorf("reading block %s: %s", block.Hash, err.Error())
+		} else if err = writeTarEntry(tw, archiveBlockPrefix+block.Hash, entry.Info.MTime, dat); err != nil {
+			return err
+		}
+		written[block.Hash] = true
+	}
+
+	for _, child := range nd.Children() {
+		if !include(child) {
+			continue
+		} else if err := ng.exportNode(child, tw, written, include); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, mTime time.Time, dat []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(dat)),
+		ModTime: mTime,
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(dat)
+	return err
+}
+
+// Recreate the tree stored in an archive under parentId. The exported top-level node becomes a child of
+// parentId; if the whole graph was exported, the old root's children are placed in parentId directly. Blocks
+// the graph already has a good copy of are skipped without being written. If the import fails partway, the
+// nodes it created are removed again; blocks it wrote are kept, since other files may use them. Imported
+// nodes are owned by owner, or inherit their parent's owner as NewOwnedNode does when it's empty.
+func (ng *NodeGraph) Import(r io.Reader, parentId, owner string) (report ImportReport, err error) {
+	var created []*Node
+	fail := func(err error) (ImportReport, error) {
+		for i := len(created) - 1; i >= 0; i-- {
+			ng.RemoveNode(created[i])
+		}
+		return ImportReport{}, fmt.Errorf("Error importing archive: %s", err.Error())
+	}
+
+	if parent := ng.NodeWithId(parentId); !parent.Exists() {
+		return fail(fmt.Errorf("parent %s does not exist", parentId))
+	} else if !parent.IsDir() {
+		return fail(errors.New("parent is not a directory"))
+	}
+
+	ids := make(map[string]string)
+	pending := make(map[string][]pendingBlock)
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+
+		switch {
+		case strings.HasPrefix(header.Name, archiveNodePrefix):
+			var entry archiveNode
+			if err := json.NewDecoder(tr).Decode(&entry); err != nil {
+				return fail(err)
+			} else if len(ids) == 0 && entry.Info.Id == RootNodeId {
+				ids[entry.Info.Id] = parentId
+				continue
+			}
+
+			nd, err := ng.importNode(entry, parentId, owner, ids, pending)
+			// Every other node is created under one placed directly in parentId, so is removed along with it
+			if nd != nil && nd.Parent().Id == parentId {
+				created = append(created, nd)
+			}
+			if err != nil {
+				return fail(err)
+			}
+			report.Nodes++
+		case strings.HasPrefix(header.Name, archiveBlockPrefix):
+			hash := path.Base(header.Name)
+			if HasBlock(hash) {
+				report.SkippedBlocks++
+			} else if header.Size > BLOCK_SIZE {
+				return fail(fmt.Errorf("block %s exceeds max block size", hash))
+			} else if dat, err := ioutil.ReadAll(tr); err != nil {
+				return fail(err)
+			} else if _, err = Write(hash, dat); err != nil {
+				return fail(err)
+			} else {
+				report.Blocks++
+			}
+
+			for _, p := range pending[hash] {
+				if err := importBlock(p.node, p.offset, hash); err != nil {
+					return fail(err)
+				}
+			}
+			delete(pending, hash)
+		}
+	}
+
+	if len(pending) > 0 {
+		return fail(fmt.Errorf("archive is missing %d blocks", len(pending)))
+	}
+
+	return report, nil
+}
+
+type pendingBlock struct {
+	node   *Node
+	offset int64
+}
+
+func (ng *NodeGraph) importNode(entry archiveNode, parentId, owner string, ids map[string]string, pending map[string][]pendingBlock) (*Node, error) {
+	info := entry.Info
+	if len(ids) > 0 {
+		if mapped, ok := ids[info.ParentId]; !ok {
+			return nil, fmt.Errorf("parent of %s appears after it in the archive", info.Name)
+		} else {
+			parentId = mapped
+		}
+	}
+
+	if existing := ng.NodeWithName(parentId, info.Name); existing != nil {
+		return nil, fmt.Errorf("%s already exists in %s", info.Name, ng.NodeWithId(parentId).Name())
+	}
+
+	nd, err := ng.NewOwnedNode(info.Name, parentId, info.Mode, owner)
+	if err != nil {
+		return nil, err
+	}
+	ids[info.Id] = nd.Id
+	if err = nd.Touch(info.MTime); err != nil {
+		return nd, err
+	}
+
+	for _, block := range entry.Blocks {
+		if HasBlock(block.Hash) {
+			if err = importBlock(nd, block.Offset, block.Hash); err != nil {
+				return nd, err
+			}
+		} else {
+			pending[block.Hash] = append(pending[block.Hash], pendingBlock{nd, block.Offset})
+		}
+	}
+
+	return nd, nil
+}
+
+// Point an offset of nd at a block that's already on disk, inspecting it if it's nd's first block
+func importBlock(nd *Node, offset int64, hash string) error {
+	if err := nd.setBlock(offset, hash); err != nil {
+		return err
+	} else if offset != 0 {
+		return nil
+	} else if dat, err := RawData(hash); err != nil {
+		return err
+	} else {
+		return nd.inspectFirstBlock(dat)
+	}
+}
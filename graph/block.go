@@ -9,8 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-
-	"github.com/sdcoffey/olympus/env"
+	"sync/atomic"
 )
 
 const (
@@ -23,6 +22,19 @@ const (
 	BLOCK_SIZE = MEGABYTE
 )
 
+var blockWrites struct {
+	written, deduplicated uint64
+}
+
+// How many blocks have been written since the process started, and how many of those were already stored
+// in every directory they're placed in, so weren't written again
+func BlockWrites() (written, deduplicated uint64) {
+	return atomic.LoadUint64(&blockWrites.written), atomic.LoadUint64(&blockWrites.deduplicated)
+}
+
+// Name of the hash Hash computes, which blocks are addressed by
+const HashAlgorithm = "sha1"
+
 func Hash(d []byte) string {
 	sha := crypto.SHA1.New()
 	sha.Write(d)
@@ -30,19 +42,39 @@ func Hash(d []byte) string {
 }
 
 func Reader(hash string) (io.Reader, error) {
-	return backingFile(hash)
+	if dat, err := RawData(hash); err != nil {
+		return nil, err
+	} else {
+		return bytes.NewReader(dat), nil
+	}
 }
 
+// Read a block from the first copy whose contents match its hash. Only the copy served is verified; if any
+// copy the block is placed in turned out to be missing or corrupt on the way, the block is queued to be
+// repaired in the background.
 func RawData(hash string) ([]byte, error) {
-	if file, err := backingFile(hash); err != nil {
-		return []byte{}, err
-	} else if p, err := ioutil.ReadAll(file); err != nil {
-		return []byte{}, err
-	} else {
+	dirs, copies := placement(hash)
+	for i, dir := range dirs {
+		p, err := ioutil.ReadFile(filepath.Join(dir, hash))
+		if err != nil || Hash(p) != hash {
+			continue
+		}
+
+		for j, placed := range dirs[:copies] {
+			if j < i || j > i && !exists(filepath.Join(placed, hash)) {
+				queueRepair(hash)
+				break
+			}
+		}
 		return p, nil
 	}
+
+	return []byte{}, os.ErrNotExist
 }
 
+// Write a block to each of the data directories it is placed in. If a directory can't be written to, the
+// next directory in the block's placement order is used instead, so a failed disk doesn't reduce redundancy
+// for new blocks.
 func Write(hash string, d []byte) (int, error) {
 	dataHash := Hash(d)
 	if len(d) > BLOCK_SIZE {
@@ -51,17 +83,94 @@ func Write(hash string, d []byte) (int, error) {
 		return 0, errors.New("Data hash does not match this block's hash")
 	}
 
-	if file, err := os.OpenFile(LocationOnDisk(hash), os.O_CREATE|os.O_EXCL|os.O_RDWR, os.FileMode(0644)); err != nil {
-		if os.IsExist(err) { // If we've already written this data, short circuit
-			return len(d), nil
+	var written int
+	var lastErr error
+	deduplicated := true
+	dirs, copies := placement(hash)
+	for _, dir := range dirs {
+		if written >= copies {
+			break
+		} else if !exists(filepath.Join(dir, hash)) {
+			deduplicated = false
+		}
+
+		if err := writeCopy(dir, hash, d); err != nil {
+			lastErr = err
 		} else {
-			return 0, err
+			written++
+		}
+	}
+
+	if written == 0 {
+		return 0, lastErr
+	}
+
+	countWrite(deduplicated)
+	return len(d), nil
+}
+
+func countWrite(deduplicated bool) {
+	atomic.AddUint64(&blockWrites.written, 1)
+	if deduplicated {
+		atomic.AddUint64(&blockWrites.deduplicated, 1)
+	}
+}
+
+// Whether hash has the form of a block's hash
+func ValidHash(hash string) bool {
+	return blockNameRegex.MatchString(hash)
+}
+
+// Whether a good copy of the block is stored in any data directory
+func HasBlock(hash string) bool {
+	if !ValidHash(hash) {
+		return false
+	}
+
+	for _, dir := range rankedDirs(hash) {
+		if verifyCopy(dir, hash) {
+			return true
 		}
-	} else {
-		buf := bytes.NewBuffer([]byte(d))
-		n, err := io.Copy(file, buf)
-		return int(n), err
 	}
+	return false
+}
+
+// Check that each of hashes is stored, by looking for a copy of it, and read the first so it can be
+// inspected. Returns os.ErrNotExist if any of them isn't stored.
+func statBlocks(hashes []string) (firstBlock []byte, err error) {
+	for i, hash := range hashes {
+		if !ValidHash(hash) {
+			return nil, os.ErrNotExist
+		} else if i == 0 {
+			if firstBlock, err = RawData(hash); err != nil {
+				return nil, err
+			}
+		} else if _, err = SizeOnDisk(hash); err != nil {
+			return nil, err
+		}
+	}
+	return firstBlock, nil
+}
+
+// Delete every copy of a block, returning whether there were any
+func removeBlock(hash string) bool {
+	var removed bool
+	for _, dir := range DataDirs() {
+		if err := os.Remove(filepath.Join(dir, hash)); err == nil {
+			removed = true
+		}
+	}
+	return removed
+}
+
+// Whether any copy of the block is stored, found without reading it. Blocks are only ever written under
+// their name once complete, and copies that go bad are repaired when they're read.
+func Stored(hash string) bool {
+	if !blockNameRegex.MatchString(hash) {
+		return false
+	}
+	_, err := SizeOnDisk(hash)
+	return err == nil
 }
 
 func SizeOnDisk(hash string) (int64, error) {
@@ -72,14 +181,64 @@ func SizeOnDisk(hash string) (int64, error) {
 	}
 }
 
+// Path of the first copy of this block on disk, or of where its first copy would be written if there is none
 func LocationOnDisk(hash string) string {
-	return filepath.Join(env.EnvPath(env.DataPath), hash)
+	for _, dir := range rankedDirs(hash) {
+		if location := filepath.Join(dir, hash); exists(location) {
+			return location
+		}
+	}
+
+	return filepath.Join(rankedDirs(hash)[0], hash)
 }
 
-func backingFile(hash string) (*os.File, error) {
-	if backingFile, err := os.Open(LocationOnDisk(hash)); err != nil {
-		return nil, err
+// Write a copy of a block into dir, unless a good copy is already there. The data goes to a temp file that's
+// synced and renamed into place, so a crash can never leave a partial block under the block's name.
+func writeCopy(dir, hash string, d []byte) error {
+	if verifyCopy(dir, hash) {
+		return nil
+	}
+
+	file, err := ioutil.TempFile(dir, tempPrefix+hash)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(d); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), os.FileMode(0644))
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(dir, hash))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// Make renames into dir durable
+func syncDir(dir string) error {
+	if file, err := os.Open(dir); err != nil {
+		return err
 	} else {
-		return backingFile, nil
+		defer file.Close()
+		return file.Sync()
 	}
 }
+
+func verifyCopy(dir, hash string) bool {
+	p, err := ioutil.ReadFile(filepath.Join(dir, hash))
+	return err == nil && Hash(p) == hash
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package graph
+
+// Free space can't be measured on this platform
+func FreeBytes(dir string) (int64, bool) {
+	return 0, false
+}
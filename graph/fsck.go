@@ -0,0 +1,311 @@
+package graph
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cayleygraph/cayley"
+	"github.com/cayleygraph/cayley/quad"
+)
+
+const LostAndFoundName = "lost+found"
+
+type FsckProblem string
+
+const (
+	MissingName     FsckProblem = "missing_name"
+	MissingMode     FsckProblem = "missing_mode"
+	MultipleParents FsckProblem = "multiple_parents"
+	OrphanedNode    FsckProblem = "orphaned_node"
+	ParentCycle     FsckProblem = "parent_cycle"
+	DuplicateName   FsckProblem = "duplicate_name"
+	DanglingBlock   FsckProblem = "dangling_block"
+)
+
+type FsckIssue struct {
+	Problem  FsckProblem `json:"problem"`
+	NodeId   string      `json:"node_id"`
+	Details  string      `json:"details"`
+	Repaired bool        `json:"repaired"`
+}
+
+func (issue FsckIssue) String() string {
+	status := "found"
+	if issue.Repaired {
+		status = "repaired"
+	}
+	return fmt.Sprintf("%s	%s	%s (%s)", issue.Problem, issue.NodeId, issue.Details, status)
+}
+
+type FsckReport struct {
+	NodesChecked int         `json:"nodes_checked"`
+	Issues       []FsckIssue `json:"issues"`
+}
+
+func (report FsckReport) Clean() bool {
+	return len(report.Issues) == 0
+}
+
+// Snapshot of the node-related quads for a single subject, gathered in one pass over the store
+type fsckEntry struct {
+	id      string
+	names   []string
+	modes   int
+	parents []string
+	offsets map[string]string
+	version bool
+}
+
+// Fsck walks every quad in the graph and reports metadata left inconsistent by interrupted or racing writes:
+// nodes missing names or modes, nodes whose parent is gone, parent cycles, sibling name collisions and offset
+// edges to blocks that are no longer on disk. When repair is true, each problem is fixed as it is found;
+// detached nodes are reattached under /lost+found and dangling block edges are dropped.
+func (ng *NodeGraph) Fsck(repair bool) (report FsckReport, err error) {
+	entries := ng.fsckEntries()
+	report.NodesChecked = len(entries)
+
+	ids := make([]string, 0, len(entries))
+	for id := range entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	record := func(problem FsckProblem, id, details string, fix func() error) {
+		issue := FsckIssue{Problem: problem, NodeId: id, Details: details}
+		if repair && fix != nil && err == nil {
+			if err = fix(); err == nil {
+				issue.Repaired = true
+			}
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	for _, id := range ids {
+		entry := entries[id]
+		nd := ng.NodeWithId(id)
+
+		// Versions of files are kept outside the tree, without names or modes of their own
+		if len(entry.names) == 0 && !entry.version {
+			record(MissingName, id, "node has no name", func() error {
+				return nd.updateProperty(nameLink, "", id)
+			})
+		}
+
+		if entry.modes == 0 && !entry.version {
+			record(MissingMode, id, "node has no mode", func() error {
+				mode := os.FileMode(0644)
+				if len(entry.offsets) == 0 && ng.hasChildren(id) {
+					mode = os.ModeDir | 0755
+				}
+				return nd.updateProperty(modeLink, 0, int(mode))
+			})
+		}
+
+		if len(entry.parents) > 1 {
+			record(MultipleParents, id, fmt.Sprintf("node has parents %s", strings.Join(entry.parents, ", ")), func() error {
+				for _, extra := range entry.parents[1:] {
+					if err := ng.RemoveQuad(cayley.Triple(id, parentLink, extra)); err != nil {
+						return err
+					}
+				}
+				entry.parents = entry.parents[:1]
+				return nil
+			})
+		}
+
+		for _, offset := range sortedKeys(entry.offsets) {
+			hash := entry.offsets[offset]
+			if _, statErr := SizeOnDisk(hash); statErr != nil {
+				record(DanglingBlock, id, fmt.Sprintf("%s points at missing block %s", offset, hash), func() error {
+					return ng.RemoveQuad(cayley.Triple(id, offset, hash))
+				})
+			}
+		}
+	}
+
+	exists := func(id string) bool {
+		_, ok := entries[id]
+		return ok || id == RootNodeId
+	}
+
+	for _, id := range ids {
+		if id == RootNodeId || entries[id].version {
+			continue
+		}
+
+		entry := entries[id]
+		if len(entry.parents) == 0 {
+			record(OrphanedNode, id, "node has no parent", func() error {
+				return ng.reattach(id, entry)
+			})
+		} else if !exists(entry.parents[0]) {
+			record(OrphanedNode, id, fmt.Sprintf("parent %s does not exist", entry.parents[0]), func() error {
+				return ng.reattach(id, entry)
+			})
+		}
+	}
+
+	// A node is in a cycle if walking its parents brings us back to it before reaching the root
+	inCycle := make(map[string]bool)
+	for _, id := range ids {
+		if inCycle[id] {
+			continue
+		}
+
+		visited := map[string]bool{id: true}
+		chain := []string{id}
+		for cur := entries[id]; cur != nil && len(cur.parents) > 0; cur = entries[cur.parents[0]] {
+			next := cur.parents[0]
+			if next == id {
+				for _, member := range chain {
+					inCycle[member] = true
+				}
+				entry := entries[id]
+				record(ParentCycle, id, fmt.Sprintf("cycle through %s", strings.Join(chain, " -> ")), func() error {
+					return ng.reattach(id, entry)
+				})
+				break
+			} else if visited[next] {
+				break
+			}
+			visited[next] = true
+			chain = append(chain, next)
+		}
+	}
+
+	siblings := make(map[string][]string)
+	for _, id := range ids {
+		entry := entries[id]
+		if len(entry.parents) > 0 && len(entry.names) > 0 {
+			key := entry.parents[0] + "/" + entry.names[0]
+			siblings[key] = append(siblings[key], id)
+		}
+	}
+
+	keys := make([]string, 0, len(siblings))
+	for key := range siblings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		dupes := siblings[key]
+		for _, id := range dupes[1:] {
+			entry := entries[id]
+			record(DuplicateName, id, fmt.Sprintf("name %s is also used by %s", entry.names[0], dupes[0]), func() error {
+				return ng.NodeWithId(id).updateProperty(nameLink, entry.names[0], uniqueName(entry.names[0], id))
+			})
+		}
+	}
+
+	return report, err
+}
+
+func (ng *NodeGraph) fsckEntries() map[string]*fsckEntry {
+	entries := make(map[string]*fsckEntry)
+	entry := func(id string) *fsckEntry {
+		if e, ok := entries[id]; ok {
+			return e
+		}
+		e := &fsckEntry{id: id, offsets: make(map[string]string)}
+		entries[id] = e
+		return e
+	}
+
+	it := ng.QuadsAllIterator()
+	for it.Next() {
+		q := ng.Quad(it.Result())
+		subject, predicate := nativeString(q.Subject), nativeString(q.Predicate)
+		if subject == "" {
+			continue
+		}
+
+		switch {
+		case predicate == nameLink:
+			entry(subject).names = append(entry(subject).names, nativeString(q.Object))
+		case predicate == modeLink:
+			entry(subject).modes++
+		case predicate == parentLink:
+			entry(subject).parents = append(entry(subject).parents, nativeString(q.Object))
+		case predicate == mTimeLink, predicate == typeLink, predicate == ownerLink, predicate == groupLink, strings.HasPrefix(predicate, metadataPrefix):
+			entry(subject)
+		case predicate == versionLink:
+			entry(subject).version = true
+		case strings.HasPrefix(predicate, "offset-"):
+			entry(subject).offsets[predicate] = nativeString(q.Object)
+		}
+	}
+
+	return entries
+}
+
+func (ng *NodeGraph) hasChildren(id string) bool {
+	return cayley.StartPath(ng, quad.String(id)).In(parentLink).BuildIterator().Next()
+}
+
+// Detach a node from whatever parents it has and file it under /lost+found. Parent quads are rewritten
+// directly rather than through Move, since Move walks ancestors and would never terminate inside a cycle.
+func (ng *NodeGraph) reattach(id string, entry *fsckEntry) error {
+	lostAndFound, err := ng.lostAndFound()
+	if err != nil {
+		return err
+	}
+
+	transaction := cayley.NewTransaction()
+	for _, parentId := range entry.parents {
+		transaction.RemoveQuad(cayley.Triple(id, parentLink, parentId))
+	}
+	transaction.AddQuad(cayley.Triple(id, parentLink, lostAndFound.Id))
+	if err := ng.ApplyTransaction(transaction); err != nil {
+		return err
+	}
+	entry.parents = []string{lostAndFound.Id}
+
+	if len(entry.names) > 0 {
+		if existing := ng.NodeWithName(lostAndFound.Id, entry.names[0]); existing != nil && existing.Id != id {
+			newName := uniqueName(entry.names[0], id)
+			if err := ng.NodeWithId(id).updateProperty(nameLink, entry.names[0], newName); err != nil {
+				return err
+			}
+			entry.names[0] = newName
+		}
+	}
+
+	return nil
+}
+
+func (ng *NodeGraph) lostAndFound() (*Node, error) {
+	if nd := ng.NodeWithName(RootNodeId, LostAndFoundName); nd != nil {
+		return nd, nil
+	}
+
+	return ng.NewNode(LostAndFoundName, RootNodeId, os.ModeDir|0700)
+}
+
+func uniqueName(name, id string) string {
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	return fmt.Sprint(name, "-", id)
+}
+
+func nativeString(value quad.Value) string {
+	if value == nil {
+		return ""
+	} else if s, ok := quad.NativeOf(value).(string); ok {
+		return s
+	}
+
+	return ""
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
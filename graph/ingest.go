@@ -0,0 +1,153 @@
+package graph
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type IngestProgress struct {
+	Path    string   `json:"path"`
+	Files   int      `json:"files"`
+	Dirs    int      `json:"dirs"`
+	Skipped int      `json:"skipped"`
+	Bytes   int64    `json:"bytes"`
+	Errors  []string `json:"errors"`
+}
+
+type IngestCallback func(progress IngestProgress)
+
+// Copy a file or directory tree from the local filesystem into the graph under parentId, chunking files into
+// blocks the same way uploads are. Modes and modification times are preserved. Files whose node already has
+// the same size and mtime are skipped, so re-running an ingest only copies what changed. Problems with
+// individual files are collected in the progress report rather than stopping the walk. The callback, if
+// any, is called after each file or directory is processed.
+func (ng *NodeGraph) Ingest(localPath, parentId string, callback IngestCallback) (IngestProgress, error) {
+	var progress IngestProgress
+	if parent := ng.NodeWithId(parentId); !parent.Exists() {
+		return progress, fmt.Errorf("Error ingesting %s: parent %s does not exist", localPath, parentId)
+	} else if !parent.IsDir() {
+		return progress, fmt.Errorf("Error ingesting %s: parent is not a directory", localPath)
+	} else if fi, err := os.Lstat(localPath); err != nil {
+		return progress, fmt.Errorf("Error ingesting %s: %s", localPath, err.Error())
+	} else {
+		if callback == nil {
+			callback = func(IngestProgress) {}
+		}
+		ng.ingest(localPath, fi, parentId, &progress, callback)
+		return progress, nil
+	}
+}
+
+func (ng *NodeGraph) ingest(localPath string, fi os.FileInfo, parentId string, progress *IngestProgress, callback IngestCallback) {
+	progress.Path = localPath
+	fail := func(err error) {
+		progress.Errors = append(progress.Errors, fmt.Sprintf("%s: %s", localPath, err.Error()))
+		callback(*progress)
+	}
+
+	if !fi.IsDir() && !fi.Mode().IsRegular() {
+		progress.Skipped++
+		callback(*progress)
+		return
+	}
+
+	existing := ng.NodeWithName(parentId, fi.Name())
+	if existing != nil && existing.IsDir() != fi.IsDir() {
+		fail(fmt.Errorf("%s already exists with a different type", existing.Name()))
+		return
+	}
+
+	if fi.IsDir() {
+		nd := existing
+		if nd == nil {
+			var err error
+			if nd, err = ng.NewNode(fi.Name(), parentId, os.ModeDir|fi.Mode().Perm()); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		infos, err := ioutil.ReadDir(localPath)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		progress.Dirs++
+		callback(*progress)
+		for _, child := range infos {
+			ng.ingest(filepath.Join(localPath, child.Name()), child, nd.Id, progress, callback)
+		}
+
+		if err = nd.Touch(notAfterNow(fi.ModTime())); err != nil {
+			fail(err)
+		}
+	} else if existing != nil && existing.Size() == fi.Size() && existing.MTime().Unix() == fi.ModTime().Unix() {
+		progress.Skipped++
+		callback(*progress)
+	} else {
+		nd := existing
+		if nd == nil {
+			var err error
+			if nd, err = ng.NewNode(fi.Name(), parentId, fi.Mode().Perm()); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		if written, err := ingestFile(nd, localPath, fi); err != nil {
+			fail(err)
+		} else {
+			progress.Files++
+			progress.Bytes += written
+			callback(*progress)
+		}
+	}
+}
+
+func ingestFile(nd *Node, localPath string, fi os.FileInfo) (int64, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var offset int64
+	buf := make([]byte, BLOCK_SIZE)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			if writeErr := nd.WriteData(buf[:n], offset); writeErr != nil {
+				return offset, writeErr
+			}
+			offset += int64(n)
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return offset, err
+		}
+	}
+
+	if err = nd.truncateBlocks(offset); err != nil {
+		return offset, err
+	} else if err = nd.SetMode(fi.Mode().Perm()); err != nil {
+		return offset, err
+	}
+
+	return offset, nd.Touch(notAfterNow(fi.ModTime()))
+}
+
+// Files modified in the last instant, or on a disk from a machine with a fast clock, can carry an mtime
+// slightly ahead of ours, which Touch would reject
+func notAfterNow(t time.Time) time.Time {
+	if now := time.Now(); t.After(now) {
+		return now
+	}
+	return t
+}
@@ -0,0 +1,361 @@
+package graph
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type ChangeKind string
+
+const (
+	Created        ChangeKind = "created"
+	Renamed        ChangeKind = "renamed"
+	Moved          ChangeKind = "moved"
+	ModeChanged    ChangeKind = "mode_changed"
+	OwnerChanged   ChangeKind = "owner_changed"
+	Touched        ChangeKind = "touched"
+	ContentChanged ChangeKind = "content_changed"
+	Deleted        ChangeKind = "deleted"
+)
+
+// A single mutation of the graph. Ancestors holds the ids of every directory the node was under when the
+// change was made; for a move, that's its ancestors both before and after, so watchers of either subtree
+// see it. Info is the node's state after the change, less its size, and is absent for deletions.
+type Change struct {
+	Seq       uint64     `json:"seq"`
+	Kind      ChangeKind `json:"kind"`
+	NodeId    string     `json:"node_id"`
+	Ancestors []string   `json:"ancestors"`
+	Time      time.Time  `json:"time"`
+	Info      *NodeInfo  `json:"info,omitempty"`
+}
+
+func (change Change) Under(nodeId string) bool {
+	if nodeId == "" || nodeId == change.NodeId {
+		return true
+	}
+
+	for _, ancestor := range change.Ancestors {
+		if ancestor == nodeId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// An append-only log of changes, numbered from 1. Each change is written to the journal file as a line of
+// JSON as it's recorded, and the retained ones are kept in memory to answer queries. Writes aren't synced,
+// so a crash can lose the last few changes even though the graph has them.
+type Journal struct {
+	sync.RWMutex
+	path        string
+	file        *os.File
+	changes     []Change
+	retain      int
+	subscribers map[chan struct{}]bool
+}
+
+// Open the journal at path, creating it if it doesn't exist. An empty path gives a journal that is only
+// kept in memory.
+func OpenJournal(path string) (*Journal, error) {
+	journal := new(Journal)
+	if path == "" {
+		return journal, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening journal: %s", err.Error())
+	}
+
+	var intact int64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*KILOBYTE), MEGABYTE)
+	for scanner.Scan() {
+		var change Change
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil {
+			break
+		}
+		journal.changes = append(journal.changes, change)
+		intact += int64(len(scanner.Bytes())) + 1
+	}
+
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Error reading journal: %s", err.Error())
+	}
+
+	// A partial last line is left by a crash mid-write; drop it so new changes start on a line of their own
+	if err := file.Truncate(intact); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Error repairing journal: %s", err.Error())
+	}
+
+	journal.path = path
+	journal.file = file
+	return journal, nil
+}
+
+// Keep at least the latest max changes. Older ones are dropped, and the journal file rewritten without them,
+// once it holds twice that. Zero, the default, keeps everything.
+func (journal *Journal) Retain(max int) error {
+	journal.Lock()
+	defer journal.Unlock()
+
+	journal.retain = max
+	return journal.compact()
+}
+
+// Drop all but the latest retain changes, if there are more
+func (journal *Journal) compact() error {
+	if journal.retain <= 0 || len(journal.changes) <= journal.retain {
+		return nil
+	}
+
+	kept := append([]Change(nil), journal.changes[len(journal.changes)-journal.retain:]...)
+	if journal.file != nil {
+		if err := journal.rewrite(kept); err != nil {
+			return fmt.Errorf("Error compacting journal: %s", err.Error())
+		}
+	}
+
+	journal.changes = kept
+	return nil
+}
+
+// Replace the journal file with one holding only changes, written beside it and renamed over it
+func (journal *Journal) rewrite(changes []Change) error {
+	tmpPath := journal.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for _, change := range changes {
+		if dat, err := json.Marshal(change); err != nil {
+			tmp.Close()
+			return err
+		} else if _, err = writer.Write(append(dat, '\n')); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	} else if err = os.Rename(tmpPath, journal.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(journal.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	journal.file.Close()
+	journal.file = file
+	return nil
+}
+
+func (journal *Journal) Close() error {
+	journal.Lock()
+	defer journal.Unlock()
+
+	if journal.file == nil {
+		return nil
+	}
+	err := journal.file.Sync()
+	if closeErr := journal.file.Close(); err == nil {
+		err = closeErr
+	}
+	journal.file = nil
+	return err
+}
+
+// Sequence number of the latest change, or 0 if nothing has been recorded
+func (journal *Journal) Seq() uint64 {
+	journal.RLock()
+	defer journal.RUnlock()
+	return journal.seq()
+}
+
+// The oldest cursor Since can answer in full. Changes at or before it have been dropped, so a reader with an
+// older cursor has missed some and should start over from Seq.
+func (journal *Journal) MinCursor() uint64 {
+	journal.RLock()
+	defer journal.RUnlock()
+
+	if len(journal.changes) == 0 {
+		return 0
+	}
+	return journal.changes[0].Seq - 1
+}
+
+func (journal *Journal) seq() uint64 {
+	if len(journal.changes) == 0 {
+		return 0
+	}
+	return journal.changes[len(journal.changes)-1].Seq
+}
+
+func (journal *Journal) Record(change Change) (Change, error) {
+	journal.Lock()
+	defer journal.Unlock()
+
+	change.Seq = journal.seq() + 1
+	change.Time = time.Now().UTC()
+
+	if journal.file != nil {
+		dat, err := json.Marshal(change)
+		if err != nil {
+			return change, err
+		} else if _, err = journal.file.Write(append(dat, '\n')); err != nil {
+			return change, fmt.Errorf("Error writing journal: %s", err.Error())
+		}
+	}
+
+	journal.changes = append(journal.changes, change)
+	for subscriber := range journal.subscribers {
+		select {
+		case subscriber <- struct{}{}:
+		default: // Already has a notification pending
+		}
+	}
+
+	if journal.retain > 0 && len(journal.changes) >= 2*journal.retain {
+		return change, journal.compact()
+	}
+	return change, nil
+}
+
+// Get notified when changes are recorded. Notifications carry nothing and may be coalesced, so subscribers
+// should call Since with the last cursor they saw on each one. Call the returned func to unsubscribe.
+func (journal *Journal) Subscribe() (<-chan struct{}, func()) {
+	journal.Lock()
+	defer journal.Unlock()
+
+	if journal.subscribers == nil {
+		journal.subscribers = make(map[chan struct{}]bool)
+	}
+	subscriber := make(chan struct{}, 1)
+	journal.subscribers[subscriber] = true
+
+	return subscriber, func() {
+		journal.Lock()
+		defer journal.Unlock()
+		delete(journal.subscribers, subscriber)
+	}
+}
+
+// Changes after cursor affecting nodeId or anything under it, oldest first, along with the cursor to pass
+// next time. An empty nodeId matches everything; limit caps the number returned if it's positive.
+func (journal *Journal) Since(cursor uint64, nodeId string, limit int) ([]Change, uint64) {
+	journal.RLock()
+	defer journal.RUnlock()
+
+	changes := make([]Change, 0)
+	next := cursor
+	for i := journal.firstAfter(cursor); i < len(journal.changes); i++ {
+		if limit > 0 && len(changes) >= limit {
+			break
+		}
+
+		change := journal.changes[i]
+		if change.Under(nodeId) {
+			changes = append(changes, change)
+		}
+		next = change.Seq
+	}
+
+	if next < cursor {
+		next = cursor
+	}
+
+	return changes, next
+}
+
+// Index of the first change with a sequence number greater than cursor. Sequence numbers are dense, so
+// this is usually a direct lookup.
+func (journal *Journal) firstAfter(cursor uint64) int {
+	if len(journal.changes) == 0 {
+		return 0
+	}
+
+	first := journal.changes[0].Seq
+	if cursor < first {
+		return 0
+	} else if i := int(cursor - first + 1); i <= len(journal.changes) {
+		return i
+	}
+	return len(journal.changes)
+}
+
+func (ng *NodeGraph) UseJournal(journal *Journal) {
+	ng.journal = journal
+}
+
+func (ng *NodeGraph) Journal() *Journal {
+	return ng.journal
+}
+
+// Ids of each directory above nd, nearest first
+func (nd *Node) ancestors() []string {
+	ancestors := make([]string, 0)
+	for parent := nd.Parent(); parent != nil; parent = parent.Parent() {
+		ancestors = append(ancestors, parent.Id)
+	}
+	return ancestors
+}
+
+// Append a change to nd to the graph's journal, if it has one. Journal errors are only logged, since the
+// graph has already been changed by the time a change is recorded.
+func (nd *Node) record(kind ChangeKind, extraAncestors ...string) {
+	journal := nd.graph.journal
+	if journal == nil {
+		return
+	}
+
+	change := Change{
+		Kind:      kind,
+		NodeId:    nd.Id,
+		Ancestors: nd.ancestors(),
+	}
+	for _, extra := range extraAncestors {
+		if !change.Under(extra) {
+			change.Ancestors = append(change.Ancestors, extra)
+		}
+	}
+	if kind != Deleted {
+		// Not NodeInfo, whose size walks every block, which would make writing a file quadratic
+		info := NodeInfo{
+			Id:    nd.Id,
+			Mode:  nd.Mode(),
+			MTime: nd.MTime(),
+			Name:  nd.Name(),
+			Type:  nd.Type(),
+			Owner: nd.Owner(),
+			Group: nd.Group(),
+		}
+		if parent := nd.Parent(); parent != nil {
+			info.ParentId = parent.Id
+		}
+		change.Info = &info
+	}
+
+	if _, err := journal.Record(change); err != nil {
+		log.Println(err.Error())
+	}
+}
@@ -0,0 +1,104 @@
+package graph
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cayleygraph/cayley"
+	"github.com/cayleygraph/cayley/graph"
+	"github.com/sdcoffey/olympus/media"
+)
+
+const metadataPrefix = "meta-"
+
+// NodeInfo plus any metadata extracted from the node's content
+type ExtendedNodeInfo struct {
+	NodeInfo
+	Metadata media.Metadata `json:"metadata"`
+}
+
+func (nd *Node) ExtendedNodeInfo() ExtendedNodeInfo {
+	return ExtendedNodeInfo{
+		NodeInfo: nd.NodeInfo(),
+		Metadata: nd.Metadata(),
+	}
+}
+
+func (nd *Node) Metadata() media.Metadata {
+	md := make(media.Metadata)
+	for _, key := range media.Keys {
+		if val := nd.graphValue(metadataPrefix + key); val != nil {
+			md[key] = val.(string)
+		}
+	}
+
+	return md
+}
+
+// Replace all of this node's metadata with md, in transaction
+func (nd *Node) replaceMetadata(transaction *graph.Transaction, md media.Metadata) {
+	for key, value := range nd.Metadata() {
+		transaction.RemoveQuad(cayley.Triple(nd.Id, metadataPrefix+key, value))
+	}
+	for key, value := range md {
+		transaction.AddQuad(cayley.Triple(nd.Id, metadataPrefix+key, value))
+	}
+}
+
+// Selects nodes by their metadata. Fields must match exactly, ignoring case; a node matches a capture time
+// bound only if its capture time is known. The lower bound is inclusive and the upper exclusive.
+type MetadataFilter struct {
+	Fields         map[string]string
+	CapturedAfter  time.Time
+	CapturedBefore time.Time
+}
+
+func (filter MetadataFilter) Empty() bool {
+	return len(filter.Fields) == 0 && filter.CapturedAfter.IsZero() && filter.CapturedBefore.IsZero()
+}
+
+func (filter MetadataFilter) Matches(md media.Metadata) bool {
+	for key, value := range filter.Fields {
+		if !strings.EqualFold(md[key], value) {
+			return false
+		}
+	}
+
+	if filter.CapturedAfter.IsZero() && filter.CapturedBefore.IsZero() {
+		return true
+	} else if captured, ok := md.CapturedAt(); !ok {
+		return false
+	} else if !filter.CapturedAfter.IsZero() && captured.Before(filter.CapturedAfter) {
+		return false
+	} else if !filter.CapturedBefore.IsZero() && !captured.Before(filter.CapturedBefore) {
+		return false
+	}
+
+	return true
+}
+
+// Files under root whose metadata matches filter, in depth-first order, stopping once limit are found if
+// limit is positive
+func (ng *NodeGraph) Search(root *Node, filter MetadataFilter, limit int) []*Node {
+	results := make([]*Node, 0)
+
+	var search func(nd *Node) bool
+	search = func(nd *Node) bool {
+		for _, child := range nd.Children() {
+			if child.IsDir() {
+				if !search(child) {
+					return false
+				}
+			} else if filter.Matches(child.Metadata()) {
+				results = append(results, child)
+				if limit > 0 && len(results) >= limit {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	search(root)
+
+	return results
+}
@@ -0,0 +1,290 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sdcoffey/olympus/env"
+)
+
+type mirrorSet struct {
+	sync.RWMutex
+	dirs   []string
+	copies int
+}
+
+// Until UseDataDirs is called, blocks live in a single copy under env.DataPath
+var mirrors = &mirrorSet{copies: 1}
+
+var blockNameRegex = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// Blocks are written to files named with these prefixes before being renamed into place, and data
+// directories are probed with them, so any found at startup were left by a crash
+const (
+	tempPrefix  = ".tmp-"
+	probePrefix = ".probe"
+)
+
+// Store blocks across several data directories, keeping the given number of copies of each block.
+// Directories are created if they don't already exist.
+func UseDataDirs(dirs []string, copies int) error {
+	if len(dirs) == 0 {
+		return errors.New("At least one data directory is required")
+	} else if copies < 1 || copies > len(dirs) {
+		return errors.New("Number of copies must be between 1 and the number of data directories")
+	}
+
+	absDirs := make([]string, len(dirs))
+	for i, dir := range dirs {
+		if abs, err := filepath.Abs(dir); err != nil {
+			return err
+		} else if err = os.MkdirAll(abs, 0744); err != nil {
+			return err
+		} else {
+			absDirs[i] = abs
+		}
+	}
+
+	mirrors.Lock()
+	defer mirrors.Unlock()
+	mirrors.dirs = absDirs
+	mirrors.copies = copies
+
+	return nil
+}
+
+// Go back to storing a single copy of each block under env.DataPath
+func UseDefaultDataDir() {
+	mirrors.Lock()
+	defer mirrors.Unlock()
+	mirrors.dirs = nil
+	mirrors.copies = 1
+}
+
+func DataDirs() []string {
+	mirrors.RLock()
+	defer mirrors.RUnlock()
+
+	if len(mirrors.dirs) == 0 {
+		return []string{env.EnvPath(env.DataPath)}
+	}
+
+	dirs := make([]string, len(mirrors.dirs))
+	copy(dirs, mirrors.dirs)
+	return dirs
+}
+
+func Copies() int {
+	mirrors.RLock()
+	defer mirrors.RUnlock()
+	return mirrors.copies
+}
+
+// All data directories, ordered by preference for holding this block. The first Copies() directories are
+// where the block is placed; the rest are searched too, in case it was written while one was unavailable.
+// Ranking each directory by the hash of its path and the block hash spreads blocks evenly, and keeps the
+// placement of existing blocks stable when directories are added.
+func rankedDirs(hash string) []string {
+	dirs := DataDirs()
+	sort.Slice(dirs, func(i, j int) bool {
+		return Hash([]byte(dirs[i]+hash)) < Hash([]byte(dirs[j]+hash))
+	})
+	return dirs
+}
+
+// rankedDirs for hash, along with how many of them the block is placed in, read together so they agree
+func placement(hash string) ([]string, int) {
+	mirrors.RLock()
+	copies := mirrors.copies
+	mirrors.RUnlock()
+
+	dirs := rankedDirs(hash)
+	if copies > len(dirs) {
+		copies = len(dirs)
+	}
+	return dirs, copies
+}
+
+// Copies found missing or corrupt by reads are rewritten by a single background worker, so reads never wait
+// on repairs. Each block is queued at most once at a time, and when the queue is full repairs are dropped;
+// the block's next read or a replication check will find it again.
+var repairs = struct {
+	sync.Mutex
+	pending map[string]bool
+	queue   chan string
+	started sync.Once
+	wg      sync.WaitGroup
+}{pending: make(map[string]bool), queue: make(chan string, 256)}
+
+func queueRepair(hash string) {
+	repairs.Lock()
+	defer repairs.Unlock()
+
+	if repairs.pending[hash] {
+		return
+	}
+
+	repairs.wg.Add(1)
+	select {
+	case repairs.queue <- hash:
+		repairs.pending[hash] = true
+		repairs.started.Do(func() { go repairQueued() })
+	default:
+		repairs.wg.Done()
+	}
+}
+
+func repairQueued() {
+	for hash := range repairs.queue {
+		repairBlock(hash)
+
+		repairs.Lock()
+		delete(repairs.pending, hash)
+		repairs.Unlock()
+		repairs.wg.Done()
+	}
+}
+
+// Wait for the repairs queued by reads so far to finish
+func WaitForRepairs() {
+	repairs.wg.Wait()
+}
+
+// Rewrite any missing or corrupt copies of a block in the directories it's placed in from a good copy,
+// returning whether there was a good copy to repair from
+func repairBlock(hash string) bool {
+	dirs, copies := placement(hash)
+	for _, dir := range dirs {
+		if dat, err := ioutil.ReadFile(filepath.Join(dir, hash)); err == nil && Hash(dat) == hash {
+			for _, placed := range dirs[:copies] {
+				writeCopy(placed, hash, dat)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+type DataDirHealth struct {
+	Path     string `json:"path"`
+	Blocks   int    `json:"blocks"`
+	Bytes    int64  `json:"bytes"`
+	Writable bool   `json:"writable"`
+}
+
+type ReplicationReport struct {
+	Copies          int             `json:"copies"`
+	Blocks          int             `json:"blocks"`
+	Healthy         int             `json:"healthy"`
+	UnderReplicated []string        `json:"under_replicated"`
+	Corrupt         []string        `json:"corrupt"`
+	Lost            []string        `json:"lost"`
+	Repaired        int             `json:"repaired"`
+	Dirs            []DataDirHealth `json:"dirs"`
+}
+
+// Survey every data directory and count how many good copies each block has. Copies are only hashed when
+// verify is true, since that means reading every block. With repair, blocks with fewer than the configured
+// number of copies are re-replicated from a good copy.
+func CheckReplication(verify, repair bool) ReplicationReport {
+	report := ReplicationReport{Copies: Copies()}
+	locations := make(map[string][]string)
+
+	for _, dir := range DataDirs() {
+		health := DataDirHealth{Path: dir, Writable: writable(dir)}
+		if infos, err := ioutil.ReadDir(dir); err == nil {
+			for _, fi := range infos {
+				if !fi.Mode().IsRegular() || !blockNameRegex.MatchString(fi.Name()) {
+					continue
+				}
+				health.Blocks++
+				health.Bytes += fi.Size()
+				locations[fi.Name()] = append(locations[fi.Name()], dir)
+			}
+		}
+		report.Dirs = append(report.Dirs, health)
+	}
+
+	hashes := make([]string, 0, len(locations))
+	for hash := range locations {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	for _, hash := range hashes {
+		report.Blocks++
+
+		good := len(locations[hash])
+		if verify {
+			good = 0
+			for _, dir := range locations[hash] {
+				if verifyCopy(dir, hash) {
+					good++
+				} else {
+					report.Corrupt = append(report.Corrupt, filepath.Join(dir, hash))
+				}
+			}
+		}
+
+		if good == 0 {
+			report.Lost = append(report.Lost, hash)
+			continue
+		} else if good >= report.Copies {
+			report.Healthy++
+			continue
+		}
+
+		report.UnderReplicated = append(report.UnderReplicated, hash)
+		if repair && repairBlock(hash) {
+			report.Repaired++
+		}
+	}
+
+	return report
+}
+
+// Remove temp files left in the data directories by writes that never finished, returning how many were
+// removed. Only safe to call before any blocks are being written.
+func RemoveStaleTempFiles() (int, error) {
+	var removed int
+	for _, dir := range DataDirs() {
+		infos, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, fmt.Errorf("Error reading %s: %s", dir, err.Error())
+		}
+
+		for _, fi := range infos {
+			if fi.IsDir() || !strings.HasPrefix(fi.Name(), tempPrefix) && !strings.HasPrefix(fi.Name(), probePrefix) {
+				continue
+			} else if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+				return removed, fmt.Errorf("Error removing %s: %s", fi.Name(), err.Error())
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func writable(dir string) bool {
+	return CheckDataDir(dir) == nil
+}
+
+// Check that files can be created in the data directory dir
+func CheckDataDir(dir string) error {
+	if file, err := ioutil.TempFile(dir, probePrefix); err != nil {
+		return fmt.Errorf("Error writing to %s: %s", dir, err.Error())
+	} else {
+		file.Close()
+		os.Remove(file.Name())
+		return nil
+	}
+}
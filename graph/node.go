@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/cayleygraph/cayley"
 	"github.com/cayleygraph/cayley/graph"
 	"github.com/cayleygraph/cayley/graph/path"
 	"github.com/cayleygraph/cayley/quad"
+	"github.com/sdcoffey/olympus/media"
 	"github.com/sdcoffey/olympus/util"
 )
 
@@ -19,6 +21,7 @@ const (
 	nameLink   = "isNamed"
 	modeLink   = "hasMode"
 	mTimeLink  = "hasMTime"
+	typeLink   = "hasType"
 )
 
 type Node struct {
@@ -71,8 +74,20 @@ func (nd *Node) MTime() time.Time {
 	}
 }
 
+// The node's MIME type, from the content of its first block when that was recognized, otherwise from its name
 func (nd *Node) Type() string {
-	return util.MimeType(nd.Name())
+	return util.ResolveType(nd.detectedType(), nd.Name())
+}
+
+func (nd *Node) detectedType() string {
+	if val, ok := nd.propCache[typeLink]; ok {
+		return val.(string)
+	} else if val := nd.graphValue(typeLink); val != nil {
+		nd.propCache[typeLink] = val.(string)
+		return val.(string)
+	} else {
+		return ""
+	}
 }
 
 // Convenience method determining whether this node is a directory or not.
@@ -80,6 +95,16 @@ func (nd *Node) IsDir() bool {
 	return nd.Mode()&os.ModeDir > 0
 }
 
+// Absolute path of this node, made of the names of its ancestors below the root
+func (nd *Node) Path() string {
+	var names []string
+	for node := nd; node != nil && node.Id != RootNodeId; node = node.Parent() {
+		names = append([]string{node.Name()}, names...)
+	}
+
+	return "/" + strings.Join(names, "/")
+}
+
 // Return the logical parent of this node, i.e. the node id with an incoming parent edge from this node.
 func (nd *Node) Parent() *Node {
 	if val, ok := nd.propCache[parentLink]; ok {
@@ -98,6 +123,7 @@ func (nd *Node) Children() []*Node {
 }
 
 func (nd *Node) ChildrenSorted(sorter Sorter) []*Node {
+	defer nd.graph.timeQuery("children", time.Now())
 	if !nd.IsDir() {
 		return make([]*Node, 0)
 	}
@@ -115,6 +141,7 @@ func (nd *Node) ChildrenSorted(sorter Sorter) []*Node {
 }
 
 func (nd *Node) BlockWithOffset(offset int64) string {
+	defer nd.graph.timeQuery("block", time.Now())
 	if nd.IsDir() {
 		return ""
 	}
@@ -128,6 +155,7 @@ func (nd *Node) BlockWithOffset(offset int64) string {
 }
 
 func (nd *Node) Blocks() []BlockInfo {
+	defer nd.graph.timeQuery("blocks", time.Now())
 	if nd.IsDir() {
 		return make([]BlockInfo, 0)
 	}
@@ -159,6 +187,76 @@ func (nd *Node) WriteData(data []byte, offset int64) error {
 	}
 
 	hash := Hash(data)
+	if err := nd.setBlock(offset, hash); err != nil {
+		return err
+	}
+
+	if _, err := Write(hash, data); err != nil {
+		return err
+	}
+
+	if offset == 0 {
+		return nd.inspectFirstBlock(data)
+	}
+
+	return nil
+}
+
+// Use a block that's already stored as this node's data at offset, so it needn't be sent again. Returns
+// os.ErrNotExist if there's no good copy of the block.
+func (nd *Node) LinkBlock(hash string, offset int64) error {
+	if nd.IsDir() {
+		return errors.New("Cannot write data to directory")
+	} else if offset%BLOCK_SIZE != 0 {
+		return errors.New(fmt.Sprintf("%d is not a valid offset for block size %d", offset, BLOCK_SIZE))
+	} else if !blockNameRegex.MatchString(hash) {
+		return os.ErrNotExist
+	}
+
+	data, err := RawData(hash)
+	if err != nil {
+		return err
+	} else if err = nd.setBlock(offset, hash); err != nil {
+		return err
+	}
+	countWrite(true)
+
+	if offset == 0 {
+		return nd.inspectFirstBlock(data)
+	}
+
+	return nil
+}
+
+// Record what the start of a file says about it: its type, and any metadata for types we can parse
+func (nd *Node) inspectFirstBlock(data []byte) error {
+	transaction := graph.NewTransaction()
+	mimeType := nd.inspect(transaction, data)
+	if err := nd.graph.ApplyTransaction(transaction); err != nil {
+		return fmt.Errorf("Error setting type: %s", err.Error())
+	}
+
+	nd.propCache[typeLink] = mimeType
+	return nil
+}
+
+// Add the quads recording what data, the start of this file, says about it to transaction, returning the
+// type detected, which should be cached once the transaction is applied
+func (nd *Node) inspect(transaction *graph.Transaction, data []byte) string {
+	mimeType := util.DetectContentType(data)
+	if existingType := nd.detectedType(); existingType != mimeType {
+		if existingType != "" {
+			transaction.RemoveQuad(cayley.Triple(nd.Id, typeLink, existingType))
+		}
+		transaction.AddQuad(cayley.Triple(nd.Id, typeLink, mimeType))
+	}
+
+	nd.replaceMetadata(transaction, media.Extract(util.ResolveType(mimeType, nd.Name()), data))
+	return mimeType
+}
+
+// Point the given offset of this node at a block, replacing whichever block was there before
+func (nd *Node) setBlock(offset int64, hash string) error {
 	transaction := graph.NewTransaction()
 
 	// Determine if we already have a block for this offset
@@ -168,14 +266,34 @@ func (nd *Node) WriteData(data []byte, offset int64) error {
 	}
 	transaction.AddQuad(cayley.Triple(nd.Id, linkName, hash))
 
+	nd.graph.blocks.RLock()
+	defer nd.graph.blocks.RUnlock()
 	if err := nd.graph.ApplyTransaction(transaction); err != nil {
 		return err
 	}
 
-	if _, err := Write(hash, data); err != nil {
+	nd.record(ContentChanged)
+	return nil
+}
+
+// Drop any blocks at or beyond size, for when a file's content is replaced with something shorter
+func (nd *Node) truncateBlocks(size int64) error {
+	transaction := graph.NewTransaction()
+	var truncated bool
+	for _, block := range nd.Blocks() {
+		if block.Offset >= size {
+			transaction.RemoveQuad(cayley.Triple(nd.Id, fmt.Sprint("offset-", block.Offset), block.Hash))
+			truncated = true
+		}
+	}
+
+	if !truncated {
+		return nil
+	} else if err := nd.graph.ApplyTransaction(transaction); err != nil {
 		return err
 	}
 
+	nd.record(ContentChanged)
 	return nil
 }
 
@@ -206,6 +324,8 @@ func (nd *Node) SetName(newName string) error {
 		return errors.New("Error updating name: cannot rename root node")
 	} else if newName == "" {
 		return errors.New("Error updating name: name cannot be blank")
+	} else if strings.Contains(newName, "/") {
+		return errors.New("Error updating name: name cannot contain /")
 	} else if nd.Parent() != nil && nd.graph.NodeWithName(nd.Parent().Id, newName) != nil {
 		return fmt.Errorf("Error moving node: Node with name %s already exists in %s", nd.Name(), nd.Parent().Name())
 	} else if err := nd.updateProperty(nameLink, existingName, newName); err != nil {
@@ -213,6 +333,7 @@ func (nd *Node) SetName(newName string) error {
 	}
 
 	nd.propCache[nameLink] = newName
+	nd.record(Renamed)
 
 	return nil
 }
@@ -227,6 +348,7 @@ func (nd *Node) SetMode(newMode os.FileMode) error {
 	}
 
 	nd.propCache[modeLink] = newMode
+	nd.record(ModeChanged)
 
 	return nil
 }
@@ -242,6 +364,7 @@ func (nd *Node) Touch(newTime time.Time) error {
 	}
 
 	nd.propCache[mTimeLink] = newTime
+	nd.record(Touched)
 
 	return nil
 }
@@ -263,6 +386,7 @@ func (nd *Node) Move(newParentId string) error {
 		return fmt.Errorf("Error moving node: Node with name %s already exists in %s", nd.Name(), newParent.Name())
 	}
 
+	oldAncestors := nd.ancestors()
 	if nd.Parent() != nil {
 		nd.graph.RemoveQuad(cayley.Triple(nd.Id, parentLink, nd.Parent().Id))
 	}
@@ -273,6 +397,7 @@ func (nd *Node) Move(newParentId string) error {
 		nd.propCache[parentLink] = newParentId
 	}
 
+	nd.record(Moved, oldAncestors...)
 	return nil
 }
 
@@ -302,6 +427,18 @@ func (nd *Node) Update(info NodeInfo) error {
 			}
 			return nil
 		},
+		func() error {
+			if info.Owner != "" {
+				return nd.SetOwner(info.Owner)
+			}
+			return nil
+		},
+		func() error {
+			if info.Group != "" {
+				return nd.SetGroup(info.Group)
+			}
+			return nil
+		},
 	}
 
 	var err error
@@ -323,6 +460,8 @@ func (nd *Node) NodeInfo() NodeInfo {
 		Name:  nd.Name(),
 		Size:  nd.Size(),
 		Type:  nd.Type(),
+		Owner: nd.Owner(),
+		Group: nd.Group(),
 	}
 	if nd.Parent() != nil {
 		info.ParentId = nd.Parent().Id
@@ -392,6 +531,7 @@ func (nd *Node) String() string {
 }
 
 func (nd *Node) graphValue(key string) (value interface{}) {
+	defer nd.graph.timeQuery("property", time.Now())
 	it := path.StartPath(nd.graph, quad.String(nd.Id)).Out(key).BuildIterator()
 	if it.Next() {
 		value = quad.NativeOf(nd.graph.NameOf(it.Result()))
@@ -1,6 +1,7 @@
 package graph
 
 import (
+	"fmt"
 	"os"
 	"time"
 )
@@ -13,6 +14,24 @@ type NodeInfo struct {
 	MTime    time.Time   `json:"m_time"`
 	Mode     os.FileMode `json:"mode"`
 	Type     string      `json:"type"`
+	Path     string      `json:"path,omitempty"`
+	Owner    string      `json:"owner,omitempty"`
+	Group    string      `json:"group,omitempty"`
+}
+
+func (info NodeInfo) IsDir() bool {
+	return info.Mode&os.ModeDir > 0
+}
+
+func (info NodeInfo) String() string {
+	owner, group := info.Owner, info.Group
+	if owner == "" {
+		owner = "-"
+	}
+	if group == "" {
+		group = "-"
+	}
+	return fmt.Sprintf("%s	%s	%s	%d	%s	%s (%s)", info.Mode, owner, group, info.Size, info.MTime.Format(time.Stamp), info.Name, info.Id)
 }
 
 type BlockInfo struct {
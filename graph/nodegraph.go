@@ -4,23 +4,36 @@ import (
 	"errors"
 	"fmt"
 	"os"
-
+	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/cayleygraph/cayley"
+	"github.com/cayleygraph/cayley/graph"
 	"github.com/cayleygraph/cayley/quad"
 	"github.com/pborman/uuid"
 )
 
 const RootNodeId = "rootNode"
 
+const probeLink = "isProbedAt"
+
 type NodeGraph struct {
 	*cayley.Handle
-	RootNode *Node
+	RootNode     *Node
+	journal      *Journal
+	observeQuery func(query string, duration time.Duration)
+	keepVersions int
+	// Held from checking a new node's name is free until the node is added, so two can't take one name
+	creating sync.Mutex
+	// Held for reading while blocks are linked to nodes, and for writing while unused blocks are removed, so a
+	// block can't be removed as it's linked
+	blocks sync.RWMutex
 }
 
 func NewGraph(graph *cayley.Handle) (*NodeGraph, error) {
-	ng := &NodeGraph{graph, nil}
+	ng := &NodeGraph{Handle: graph}
 
 	root := new(Node)
 	root.Id = RootNodeId
@@ -45,6 +58,56 @@ func NewGraph(graph *cayley.Handle) (*NodeGraph, error) {
 	return ng, nil
 }
 
+// Close the journal and the quad store. The graph can't be used afterwards.
+func (ng *NodeGraph) Close() error {
+	var err error
+	if ng.journal != nil {
+		err = ng.journal.Close()
+	}
+	ng.Handle.Close()
+	return err
+}
+
+// Check that the quad store accepts writes, by adding and removing a quad that's not part of any node
+func (ng *NodeGraph) CheckWritable() error {
+	probe := cayley.Triple(uuid.New(), probeLink, time.Now().UnixNano())
+	if err := ng.AddQuad(probe); err != nil {
+		return fmt.Errorf("Error writing to graph: %s", err.Error())
+	} else if err := ng.RemoveQuad(probe); err != nil {
+		return fmt.Errorf("Error writing to graph: %s", err.Error())
+	}
+	return nil
+}
+
+// Report how long each kind of query the graph makes of its quad store takes. Not safe to call while the
+// graph is in use.
+func (ng *NodeGraph) ObserveQueries(observe func(query string, duration time.Duration)) {
+	ng.observeQuery = observe
+}
+
+// Have files keep only their latest n earlier contents when they're replaced, or all of them if n is 0. Not
+// safe to call while the graph is in use.
+func (ng *NodeGraph) KeepVersions(n int) {
+	ng.keepVersions = n
+}
+
+func (ng *NodeGraph) timeQuery(query string, start time.Time) {
+	if ng.observeQuery != nil {
+		ng.observeQuery(query, time.Since(start))
+	}
+}
+
+// Number of nodes in the graph, including the root
+func (ng *NodeGraph) NodeCount() (count int) {
+	defer ng.timeQuery("count", time.Now())
+	it := ng.QuadIterator(quad.Predicate, ng.ValueOf(quad.String(nameLink)))
+	defer it.Close()
+	for it.Next() {
+		count++
+	}
+	return count
+}
+
 func (ng *NodeGraph) _newNode() *Node {
 	nd := new(Node)
 	nd.Id = uuid.New()
@@ -55,34 +118,175 @@ func (ng *NodeGraph) _newNode() *Node {
 }
 
 func (ng *NodeGraph) NewNode(name, parentId string, mode os.FileMode) (nd *Node, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			nd = nil
+	return ng.NewOwnedNode(name, parentId, mode, "")
+}
+
+// Create a node owned by owner. Nodes inherit their parent's owner when given none, and their parent's group.
+// Everything is checked before anything is written, and the node is added in a single transaction, so a node
+// that can't be created leaves nothing behind.
+func (ng *NodeGraph) NewOwnedNode(name, parentId string, mode os.FileMode, owner string) (*Node, error) {
+	return ng.newOwnedNode(name, parentId, mode, owner, false)
+}
+
+// Like NewOwnedNode, except that a taken name is numbered as AvailableName does rather than refused
+func (ng *NodeGraph) NewAvailableNode(name, parentId string, mode os.FileMode, owner string) (*Node, error) {
+	return ng.newOwnedNode(name, parentId, mode, owner, true)
+}
+
+func (ng *NodeGraph) newOwnedNode(name, parentId string, mode os.FileMode, owner string, renumber bool) (*Node, error) {
+	ng.creating.Lock()
+	if renumber {
+		name = ng.AvailableName(parentId, name)
+	}
+	nd, transaction, err := ng.prepareNode(name, parentId, mode, owner, time.Now())
+	if err == nil {
+		if err = ng.ApplyTransaction(transaction); err != nil {
 			err = fmt.Errorf("Error creating new node: %s", err.Error())
 		}
-	}()
+	}
+	ng.creating.Unlock()
 
-	ok := func(err error) {
-		if err != nil {
-			panic(err)
-		}
+	if err != nil {
+		return nil, err
+	}
+	nd.record(Created)
+	return nd, nil
+}
+
+// Create a file owned by owner whose content is the stored blocks hashes, in order, and whose modified time
+// is mTime, or now if it's zero. The node, its blocks and the type and metadata read from its first block are
+// added in a single transaction, so the file is never seen without its content. Returns os.ErrNotExist if
+// any of the blocks isn't stored.
+func (ng *NodeGraph) NewFile(name, parentId string, mode os.FileMode, owner string, hashes []string, mTime time.Time) (*Node, error) {
+	if mode&os.ModeDir > 0 {
+		return nil, errors.New("Error creating new node: Cannot write data to directory")
+	} else if mTime.IsZero() {
+		mTime = time.Now()
 	}
 
-	nd = ng._newNode()
+	ng.blocks.RLock()
+	defer ng.blocks.RUnlock()
+	firstBlock, err := statBlocks(hashes)
+	if err != nil {
+		return nil, err
+	}
 
-	ok(nd.SetName(name))
-	ok(nd.Move(parentId))
-	ok(nd.Touch(time.Now()))
-	ok(nd.SetMode(mode))
+	var mimeType string
+	ng.creating.Lock()
+	nd, transaction, err := ng.prepareNode(name, parentId, mode, owner, mTime)
+	if err == nil {
+		for i, hash := range hashes {
+			transaction.AddQuad(cayley.Triple(nd.Id, fmt.Sprint("offset-", int64(i)*BLOCK_SIZE), hash))
+		}
+		if firstBlock != nil {
+			mimeType = nd.inspect(transaction, firstBlock)
+		}
+		if err = ng.ApplyTransaction(transaction); err != nil {
+			err = fmt.Errorf("Error creating new node: %s", err.Error())
+		}
+	}
+	ng.creating.Unlock()
 
+	if err != nil {
+		return nil, err
+	}
+	if firstBlock != nil {
+		nd.propCache[typeLink] = mimeType
+	}
+	nd.record(Created)
 	return nd, nil
 }
 
+// Delete the blocks among hashes that no file or version uses, returning how many were deleted. This is for
+// blocks stored for files that were never created, like those of an abandoned upload, which nothing else
+// would remove.
+func (ng *NodeGraph) RemoveUnusedBlocks(hashes []string) (removed int) {
+	ng.blocks.Lock()
+	defer ng.blocks.Unlock()
+
+	checked := make(map[string]bool)
+	for _, hash := range hashes {
+		if checked[hash] || !ValidHash(hash) {
+			continue
+		}
+		checked[hash] = true
+		if !ng.blockUsed(hash) && removeBlock(hash) {
+			removed++
+		}
+	}
+	return removed
+}
+
+// Whether any node links to the block hash, at one of its offsets or as a thumbnail
+func (ng *NodeGraph) blockUsed(hash string) bool {
+	value := ng.ValueOf(quad.String(hash))
+	if value == nil {
+		return false
+	}
+
+	it := ng.QuadIterator(quad.Object, value)
+	defer it.Close()
+	for it.Next() {
+		if predicate := nativeString(ng.Quad(it.Result()).Predicate); strings.HasPrefix(predicate, "offset-") ||
+			strings.HasPrefix(predicate, thumbnailPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// A new node with the given properties, and a transaction adding its quads, once the name has been checked
+// to be valid and free in parentId
+func (ng *NodeGraph) prepareNode(name, parentId string, mode os.FileMode, owner string, mTime time.Time) (*Node, *graph.Transaction, error) {
+	parent := ng.NodeWithId(parentId)
+	mTime = mTime.UTC()
+	if name == "" {
+		return nil, nil, errors.New("Error creating new node: name cannot be blank")
+	} else if strings.Contains(name, "/") {
+		return nil, nil, errors.New("Error creating new node: name cannot contain /")
+	} else if !parent.Exists() {
+		return nil, nil, errors.New("Error creating new node: Parent does not exist")
+	} else if !parent.IsDir() {
+		return nil, nil, errors.New("Error creating new node: Cannot add node to a non-directory")
+	} else if ng.NodeWithName(parentId, name) != nil {
+		return nil, nil, fmt.Errorf("Error creating new node: Node with name %s already exists in %s", name, parent.Name())
+	} else if mTime.After(time.Now()) {
+		return nil, nil, errors.New("Error creating new node: Cannot set modified time in the future")
+	}
+
+	nd := ng._newNode()
+	mode, inheritedOwner, group := inherit(parent, mode)
+	if owner == "" {
+		owner = inheritedOwner
+	}
+
+	transaction := graph.NewTransaction()
+	transaction.AddQuad(cayley.Triple(nd.Id, nameLink, name))
+	transaction.AddQuad(cayley.Triple(nd.Id, parentLink, parentId))
+	transaction.AddQuad(cayley.Triple(nd.Id, mTimeLink, mTime.Unix()))
+	transaction.AddQuad(cayley.Triple(nd.Id, modeLink, int(mode)))
+	nd.propCache[nameLink] = name
+	nd.propCache[parentLink] = parentId
+	nd.propCache[mTimeLink] = mTime
+	nd.propCache[modeLink] = mode
+	if owner != "" {
+		transaction.AddQuad(cayley.Triple(nd.Id, ownerLink, owner))
+		nd.propCache[ownerLink] = owner
+	}
+	if group != "" {
+		transaction.AddQuad(cayley.Triple(nd.Id, groupLink, group))
+		nd.propCache[groupLink] = group
+	}
+
+	return nd, transaction, nil
+}
+
 func (ng *NodeGraph) NodeWithId(id string) *Node {
 	return &Node{Id: id, graph: ng, propCache: make(map[string]interface{})}
 }
 
 func (ng *NodeGraph) NodeWithName(parentId, name string) *Node {
+	defer ng.timeQuery("name", time.Now())
 	namePath := cayley.StartPath(ng, quad.String(name)).In(nameLink)
 	parentPath := cayley.StartPath(ng, quad.String(parentId)).In(parentLink)
 
@@ -94,6 +298,42 @@ func (ng *NodeGraph) NodeWithName(parentId, name string) *Node {
 	return nil
 }
 
+// A name for a new node in parentId: name itself if that's free, otherwise name numbered before its
+// extension, like "photo (2).jpg"
+func (ng *NodeGraph) AvailableName(parentId, name string) string {
+	if ng.NodeWithName(parentId, name) == nil {
+		return name
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if ng.NodeWithName(parentId, candidate) == nil {
+			return candidate
+		}
+	}
+}
+
+// Find a node by its absolute path, or nil if nothing exists there. The leading slash is optional, and empty
+// or "." components are ignored.
+func (ng *NodeGraph) NodeWithPath(nodePath string) *Node {
+	nd := ng.RootNode
+	for _, name := range strings.Split(nodePath, "/") {
+		if name == "" || name == "." {
+			continue
+		} else if name == ".." {
+			if parent := nd.Parent(); parent != nil {
+				nd = parent
+			}
+		} else if nd = ng.NodeWithName(nd.Id, name); nd == nil {
+			return nil
+		}
+	}
+
+	return nd
+}
+
 func (ng *NodeGraph) RemoveNode(nd *Node) (err error) {
 	if nd.Id == RootNodeId {
 		return errors.New("Cannot delete root node")
@@ -114,6 +354,13 @@ func (ng *NodeGraph) removeNode(nd *Node) (err error) {
 		return errors.New("Can't delete node with children, must delete children first")
 	}
 
+	ancestors := nd.ancestors()
+	defer func() {
+		if err == nil {
+			nd.record(Deleted, ancestors...)
+		}
+	}()
+
 	transaction := cayley.NewTransaction()
 	if nd.Mode() > 0 {
 		transaction.RemoveQuad(cayley.Triple(nd.Id, modeLink, int(nd.Mode())))
@@ -124,9 +371,30 @@ func (ng *NodeGraph) removeNode(nd *Node) (err error) {
 	if nd.Name() != "" {
 		transaction.RemoveQuad(cayley.Triple(nd.Id, nameLink, nd.Name()))
 	}
+	if owner := nd.Owner(); owner != "" {
+		transaction.RemoveQuad(cayley.Triple(nd.Id, ownerLink, owner))
+	}
+	if group := nd.Group(); group != "" {
+		transaction.RemoveQuad(cayley.Triple(nd.Id, groupLink, group))
+	}
+	if detectedType := nd.detectedType(); detectedType != "" {
+		transaction.RemoveQuad(cayley.Triple(nd.Id, typeLink, detectedType))
+	}
+	for key, value := range nd.Metadata() {
+		transaction.RemoveQuad(cayley.Triple(nd.Id, metadataPrefix+key, value))
+	}
+	if source := nd.thumbnailSource(); source != "" {
+		transaction.RemoveQuad(cayley.Triple(nd.Id, thumbnailSourceLink, source))
+		for _, size := range ThumbnailSizes {
+			if hash := nd.thumbnailHash(size); hash != "" {
+				transaction.RemoveQuad(cayley.Triple(nd.Id, fmt.Sprint(thumbnailPrefix, size), hash))
+			}
+		}
+	}
 	if nd.Parent() != nil {
 		transaction.RemoveQuad(cayley.Triple(nd.Id, parentLink, nd.Parent().Id))
 	}
+	nd.removeVersions(transaction)
 
 	return ng.ApplyTransaction(transaction)
 }
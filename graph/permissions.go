@@ -0,0 +1,128 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	ownerLink = "hasOwner"
+	groupLink = "hasGroup"
+)
+
+// Access a node's mode grants, as in the rwx bits of each class of its permissions
+type Permission os.FileMode
+
+const (
+	ReadPermission    Permission = 04
+	WritePermission   Permission = 02
+	ExecutePermission Permission = 01
+)
+
+func (perm Permission) String() string {
+	switch perm {
+	case ReadPermission:
+		return "read"
+	case WritePermission:
+		return "write"
+	case ExecutePermission:
+		return "execute"
+	default:
+		return fmt.Sprintf("%03o", uint32(perm))
+	}
+}
+
+// The username owning this node, or empty if it has none
+func (nd *Node) Owner() string {
+	return nd.stringProperty(ownerLink)
+}
+
+// The group this node belongs to, or empty if it has none
+func (nd *Node) Group() string {
+	return nd.stringProperty(groupLink)
+}
+
+func (nd *Node) SetOwner(owner string) error {
+	if existingOwner := nd.Owner(); existingOwner == owner {
+		return nil
+	} else if owner == "" {
+		return errors.New("Error setting owner: owner cannot be blank")
+	} else if err := nd.updateProperty(ownerLink, existingOwner, owner); err != nil {
+		return fmt.Errorf("Error setting owner: %s", err.Error())
+	}
+
+	nd.propCache[ownerLink] = owner
+	nd.record(OwnerChanged)
+
+	return nil
+}
+
+func (nd *Node) SetGroup(group string) error {
+	if existingGroup := nd.Group(); existingGroup == group {
+		return nil
+	} else if group == "" {
+		return errors.New("Error setting group: group cannot be blank")
+	} else if err := nd.updateProperty(groupLink, existingGroup, group); err != nil {
+		return fmt.Errorf("Error setting group: %s", err.Error())
+	}
+
+	nd.propCache[groupLink] = group
+	nd.record(OwnerChanged)
+
+	return nil
+}
+
+// Whether a user in groups is granted perm by this node's mode: the owner's bits if they own it, the group's
+// bits if they're in its group, and everyone else's otherwise. Nodes without an owner predate ownership, so
+// are open to everyone until they're given one.
+func (nd *Node) Permits(username string, groups []string, perm Permission) bool {
+	owner := nd.Owner()
+	if owner == "" {
+		return true
+	}
+
+	bits := Permission(nd.Mode().Perm())
+	if owner == username {
+		bits >>= 6
+	} else if group := nd.Group(); group != "" && contains(groups, group) {
+		bits >>= 3
+	}
+
+	return bits&perm == perm
+}
+
+// The mode, owner and group a new node in parent gets: its parent's owner and group, and its parent's
+// permissions when it wasn't given any of its own. Files don't inherit execute bits.
+func inherit(parent *Node, mode os.FileMode) (os.FileMode, string, string) {
+	owner := parent.Owner()
+	if owner != "" {
+		if mode.Perm() == 0 && mode.IsDir() {
+			mode |= parent.Mode().Perm()
+		} else if mode.Perm() == 0 {
+			mode |= parent.Mode().Perm() &^ 0111
+		}
+	}
+
+	return mode, owner, parent.Group()
+}
+
+func (nd *Node) stringProperty(key string) string {
+	if val, ok := nd.propCache[key]; ok {
+		return val.(string)
+	} else if val := nd.graphValue(key); val != nil {
+		nd.propCache[key] = val.(string)
+		return val.(string)
+	} else {
+		return ""
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,31 +1,212 @@
 package graph
 
-import "sort"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
 
 type Sorter int
 
 const (
 	Alphabetical Sorter = iota + 1
 	DateModified
+	FileSize
+	FileType
+	Natural
+	CaseInsensitive
+
+	// Modifier bit, see DirectoriesFirst
+	dirsFirst Sorter = 1 << 8
 )
 
+var sorterNames = map[Sorter]string{
+	Alphabetical:    "name",
+	DateModified:    "mtime",
+	FileSize:        "size",
+	FileType:        "type",
+	Natural:         "natural",
+	CaseInsensitive: "iname",
+}
+
 func Reversed(s Sorter) Sorter {
 	return Sorter(-int(s))
 }
 
+// Modify a sorter to list directories ahead of files, with each group ordered by s. This holds for reversed
+// sorters too; only the order within each group is reversed.
+func DirectoriesFirst(s Sorter) Sorter {
+	if s < 0 {
+		return -(-s | dirsFirst)
+	}
+	return s | dirsFirst
+}
+
+// Build a sorter from its name ("name", "mtime", "size", "type", "natural" or "iname") and an order of "asc"
+// or "desc". An empty name or order means alphabetical and ascending respectively.
+func ParseSorter(name, order string, directoriesFirst bool) (Sorter, error) {
+	sorter := Alphabetical
+	if name != "" {
+		sorter = 0
+		for s, sName := range sorterNames {
+			if sName == strings.ToLower(name) {
+				sorter = s
+			}
+		}
+		if sorter == 0 {
+			return 0, fmt.Errorf("Unknown sort order: %s", name)
+		}
+	}
+
+	switch strings.ToLower(order) {
+	case "", "asc":
+	case "desc":
+		sorter = Reversed(sorter)
+	default:
+		return 0, fmt.Errorf("Order must be asc or desc, not %s", order)
+	}
+
+	if directoriesFirst {
+		sorter = DirectoriesFirst(sorter)
+	}
+
+	return sorter, nil
+}
+
+// The inverse of ParseSorter
+func (s Sorter) Params() (name, order string, directoriesFirst bool) {
+	order = "asc"
+	if s < 0 {
+		s, order = -s, "desc"
+	}
+
+	return sorterNames[s&^dirsFirst], order, s&dirsFirst > 0
+}
+
+// The values a node is compared by, read once up front since some of them (size in particular) aren't cached
+type sortKey struct {
+	node  *Node
+	id    string
+	name  string
+	isDir bool
+	mTime time.Time
+	size  int64
+	mime  string
+}
+
 func Sort(nodes []*Node, sType Sorter) {
-	sort.Slice(nodes, func(i, j int) bool {
+	reverse := sType < 0
+	if reverse {
+		sType = -sType
+	}
+	directoriesFirst := sType&dirsFirst > 0
+	sType &^= dirsFirst
+
+	keys := make([]sortKey, len(nodes))
+	for i, nd := range nodes {
+		keys[i] = sortKey{node: nd, id: nd.Id, name: nd.Name(), isDir: nd.IsDir()}
 		switch sType {
-		case Alphabetical:
-			return nodes[i].Name() < nodes[j].Name()
-		case -Alphabetical:
-			return nodes[i].Name() > nodes[j].Name()
 		case DateModified:
-			return nodes[i].MTime().Before(nodes[j].MTime())
-		case -DateModified:
-			return nodes[i].MTime().After(nodes[j].MTime())
-		default:
-			return false
+			keys[i].mTime = nd.MTime()
+		case FileSize:
+			keys[i].size = nd.Size()
+		case FileType:
+			keys[i].mime = nd.Type()
 		}
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if directoriesFirst && a.isDir != b.isDir {
+			return a.isDir
+		}
+
+		if c := compareKeys(a, b, sType); c != 0 {
+			if reverse {
+				return c > 0
+			}
+			return c < 0
+		}
+
+		// Ties are broken by name, then id, so equal keys always come out in the same order
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.id < b.id
 	})
+
+	for i := range keys {
+		nodes[i] = keys[i].node
+	}
+}
+
+func compareKeys(a, b sortKey, sType Sorter) int {
+	switch sType {
+	case Alphabetical:
+		return strings.Compare(a.name, b.name)
+	case DateModified:
+		if a.mTime.Before(b.mTime) {
+			return -1
+		} else if a.mTime.After(b.mTime) {
+			return 1
+		}
+		return 0
+	case FileSize:
+		if a.size < b.size {
+			return -1
+		} else if a.size > b.size {
+			return 1
+		}
+		return 0
+	case FileType:
+		return strings.Compare(a.mime, b.mime)
+	case Natural:
+		return NaturalCompare(a.name, b.name)
+	case CaseInsensitive:
+		return strings.Compare(strings.ToLower(a.name), strings.ToLower(b.name))
+	default:
+		return 0
+	}
+}
+
+// Compare two strings treating runs of digits as numbers, so "file2" sorts before "file10"
+func NaturalCompare(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	for len(ar) > 0 && len(br) > 0 {
+		var aChunk, bChunk []rune
+		aChunk, ar = nextChunk(ar)
+		bChunk, br = nextChunk(br)
+
+		aDigits, bDigits := unicode.IsDigit(aChunk[0]), unicode.IsDigit(bChunk[0])
+		if aDigits && bDigits {
+			aNum, bNum := trimZeros(aChunk), trimZeros(bChunk)
+			if len(aNum) != len(bNum) {
+				return len(aNum) - len(bNum)
+			} else if c := strings.Compare(string(aNum), string(bNum)); c != 0 {
+				return c
+			}
+		} else if c := strings.Compare(string(aChunk), string(bChunk)); c != 0 {
+			return c
+		}
+	}
+
+	return len(ar) - len(br)
+}
+
+func nextChunk(r []rune) (chunk, rest []rune) {
+	digits := unicode.IsDigit(r[0])
+	i := 1
+	for i < len(r) && unicode.IsDigit(r[i]) == digits {
+		i++
+	}
+	return r[:i], r[i:]
+}
+
+func trimZeros(r []rune) []rune {
+	for len(r) > 1 && r[0] == '0' {
+		r = r[1:]
+	}
+	return r
 }
@@ -0,0 +1,133 @@
+package graph
+
+import (
+	"bytes"
+	"os"
+
+	. "github.com/sdcoffey/olympus/checkers"
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/graph/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *GraphTestSuite) TestExportImport_recreatesSubtree(t *C) {
+	folder, err := suite.ng.NewNode("folder", graph.RootNodeId, os.ModeDir)
+	t.Check(err, IsNil)
+	nested, err := suite.ng.NewNode("nested", folder.Id, os.ModeDir)
+	t.Check(err, IsNil)
+	file, err := suite.ng.NewNode("file.txt", nested.Id, os.FileMode(0644))
+	t.Check(err, IsNil)
+
+	dat := testutils.RandDat(graph.MEGABYTE + 1024)
+	t.Check(file.WriteData(dat[:graph.MEGABYTE], 0), IsNil)
+	t.Check(file.WriteData(dat[graph.MEGABYTE:], graph.MEGABYTE), IsNil)
+
+	destination, err := suite.ng.NewNode("destination", graph.RootNodeId, os.ModeDir)
+	t.Check(err, IsNil)
+
+	var buf bytes.Buffer
+	t.Check(suite.ng.Export(folder, &buf, nil), IsNil)
+
+	report, err := suite.ng.Import(&buf, destination.Id, "")
+	t.Check(err, IsNil)
+	t.Check(report.Nodes, Equals, 3)
+	t.Check(report.Blocks, Equals, 0)
+	t.Check(report.SkippedBlocks, Equals, 2)
+
+	importedFolder := suite.ng.NodeWithName(destination.Id, "folder")
+	t.Assert(importedFolder, NotNil)
+	t.Check(importedFolder.Id, Not(Equals), folder.Id)
+	t.Check(importedFolder.IsDir(), Equals, true)
+
+	importedNested := suite.ng.NodeWithName(importedFolder.Id, "nested")
+	t.Assert(importedNested, NotNil)
+
+	importedFile := suite.ng.NodeWithName(importedNested.Id, "file.txt")
+	t.Assert(importedFile, NotNil)
+	t.Check(importedFile.Blocks(), DeepEquals, file.Blocks())
+	t.Check(importedFile.Mode(), Equals, os.FileMode(0644))
+	t.Check(importedFile.MTime().Unix(), Equals, file.MTime().Unix())
+}
+
+func (suite *GraphTestSuite) TestImport_writesBlocksMissingFromGraph(t *C) {
+	file, err := suite.ng.NewNode("file.txt", graph.RootNodeId, os.FileMode(0644))
+	t.Check(err, IsNil)
+
+	dat := testutils.RandDat(1024)
+	t.Check(file.WriteData(dat, 0), IsNil)
+
+	var buf bytes.Buffer
+	t.Check(suite.ng.Export(file, &buf, nil), IsNil)
+
+	t.Check(suite.ng.RemoveNode(file), IsNil)
+	t.Check(os.Remove(graph.LocationOnDisk(graph.Hash(dat))), IsNil)
+
+	report, err := suite.ng.Import(&buf, graph.RootNodeId, "")
+	t.Check(err, IsNil)
+	t.Check(report.Nodes, Equals, 1)
+	t.Check(report.Blocks, Equals, 1)
+
+	imported := suite.ng.NodeWithName(graph.RootNodeId, "file.txt")
+	t.Assert(imported, NotNil)
+	readDat, err := graph.RawData(imported.BlockWithOffset(0))
+	t.Check(err, IsNil)
+	t.Check(readDat, DeepEquals, dat)
+}
+
+func (suite *GraphTestSuite) TestImport_wholeGraphExportMergesIntoParent(t *C) {
+	_, err := suite.ng.NewNode("child", graph.RootNodeId, os.ModeDir)
+	t.Check(err, IsNil)
+	destination, err := suite.ng.NewNode("destination", graph.RootNodeId, os.ModeDir)
+	t.Check(err, IsNil)
+
+	var buf bytes.Buffer
+	t.Check(suite.ng.Export(suite.ng.RootNode, &buf, nil), IsNil)
+
+	_, err = suite.ng.Import(&buf, destination.Id, "")
+	t.Check(err, IsNil)
+
+	t.Check(suite.ng.NodeWithName(destination.Id, "child"), NotNil)
+	t.Check(suite.ng.NodeWithName(destination.Id, "root"), IsNil)
+}
+
+func (suite *GraphTestSuite) TestImport_throwsForMissingParent(t *C) {
+	_, err := suite.ng.Import(&bytes.Buffer{}, "not-a-node", "")
+	t.Check(err, ErrorMatches, ".*parent not-a-node does not exist")
+}
+
+func (suite *GraphTestSuite) TestImport_throwsForNameTakenInParent(t *C) {
+	folder, err := suite.ng.NewNode("folder", graph.RootNodeId, os.ModeDir)
+	t.Assert(err, IsNil)
+	_, err = suite.ng.NewNode("file.txt", folder.Id, os.FileMode(0644))
+	t.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	t.Check(suite.ng.Export(folder, &buf, nil), IsNil)
+
+	_, err = suite.ng.Import(&buf, graph.RootNodeId, "")
+	t.Check(err, ErrorMatches, ".*folder already exists in root")
+	t.Check(suite.ng.NodeCount(), Equals, 3)
+}
+
+func (suite *GraphTestSuite) TestImport_removesNodesWhenArchiveIsIncomplete(t *C) {
+	folder, err := suite.ng.NewNode("folder", graph.RootNodeId, os.ModeDir)
+	t.Assert(err, IsNil)
+	file, err := suite.ng.NewNode("file.txt", folder.Id, os.FileMode(0644))
+	t.Assert(err, IsNil)
+	dat := testutils.RandDat(1024)
+	t.Assert(file.WriteData(dat, 0), IsNil)
+
+	var buf bytes.Buffer
+	t.Check(suite.ng.Export(folder, &buf, nil), IsNil)
+	t.Check(suite.ng.RemoveNode(folder), IsNil)
+	t.Check(os.Remove(graph.LocationOnDisk(graph.Hash(dat))), IsNil)
+
+	// Cut the archive off before the file's block
+	archive := buf.Bytes()
+	end := bytes.Index(archive, []byte("blocks/"))
+	t.Assert(end > 0, IsTrue)
+	_, err = suite.ng.Import(bytes.NewReader(archive[:end]), graph.RootNodeId, "")
+	t.Check(err, NotNil)
+	t.Check(suite.ng.NodeWithName(graph.RootNodeId, "folder"), IsNil)
+	t.Check(suite.ng.NodeCount(), Equals, 1)
+}
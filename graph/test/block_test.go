@@ -96,6 +96,92 @@ func (suite *GraphTestSuite) TestWrite_doesNotDuplicateDataOnDisk(t *C) {
 	t.Check(time.Now().UTC().Sub(createTime) >= time.Second, Equals, true)
 }
 
+func (suite *GraphTestSuite) TestWrite_countsDeduplicatedBlocks(t *C) {
+	dat := testutils.RandDat(1024)
+	hash := graph.Hash(dat)
+	written, deduplicated := graph.BlockWrites()
+
+	_, err := graph.Write(hash, dat)
+	t.Assert(err, IsNil)
+	_, err = graph.Write(hash, dat)
+	t.Assert(err, IsNil)
+
+	nowWritten, nowDeduplicated := graph.BlockWrites()
+	t.Check(nowWritten-written, Equals, uint64(2))
+	t.Check(nowDeduplicated-deduplicated, Equals, uint64(1))
+}
+
+func (suite *GraphTestSuite) TestWrite_replacesTruncatedBlock(t *C) {
+	dat := testutils.RandDat(1024)
+	hash := graph.Hash(dat)
+	location := graph.LocationOnDisk(hash)
+	t.Assert(ioutil.WriteFile(location, dat[:100], 0644), IsNil)
+
+	_, err := graph.Write(hash, dat)
+	t.Assert(err, IsNil)
+
+	written, err := ioutil.ReadFile(location)
+	t.Assert(err, IsNil)
+	t.Check(graph.Hash(written), Equals, hash)
+}
+
+func (suite *GraphTestSuite) TestWrite_leavesNoTempFiles(t *C) {
+	dat := testutils.RandDat(1024)
+	_, err := graph.Write(graph.Hash(dat), dat)
+	t.Assert(err, IsNil)
+
+	infos, err := ioutil.ReadDir(env.EnvPath(env.DataPath))
+	t.Assert(err, IsNil)
+	for _, fi := range infos {
+		t.Check(fi.Name(), Not(Matches), `\..*`)
+	}
+}
+
+func (suite *GraphTestSuite) TestRemoveStaleTempFiles_removesOnlyTempFiles(t *C) {
+	dataDir := env.EnvPath(env.DataPath)
+	dat := testutils.RandDat(1024)
+	hash := graph.Hash(dat)
+	_, err := graph.Write(hash, dat)
+	t.Assert(err, IsNil)
+
+	t.Assert(ioutil.WriteFile(filepath.Join(dataDir, ".tmp-"+hash+"123"), dat[:100], 0600), IsNil)
+	t.Assert(ioutil.WriteFile(filepath.Join(dataDir, ".probe456"), nil, 0600), IsNil)
+
+	removed, err := graph.RemoveStaleTempFiles()
+	t.Assert(err, IsNil)
+	t.Check(removed, Equals, 2)
+
+	infos, err := ioutil.ReadDir(dataDir)
+	t.Assert(err, IsNil)
+	t.Assert(infos, HasLen, 1)
+	t.Check(infos[0].Name(), Equals, hash)
+}
+
+func (suite *GraphTestSuite) TestHasBlock_findsOnlyGoodCopies(t *C) {
+	dat := testutils.RandDat(1024)
+	hash := graph.Hash(dat)
+	t.Check(graph.HasBlock(hash), Equals, false)
+
+	_, err := graph.Write(hash, dat)
+	t.Assert(err, IsNil)
+	t.Check(graph.HasBlock(hash), Equals, true)
+
+	t.Assert(ioutil.WriteFile(graph.LocationOnDisk(hash), dat[:100], 0644), IsNil)
+	t.Check(graph.HasBlock(hash), Equals, false)
+	t.Check(graph.HasBlock("../../etc/passwd"), Equals, false)
+}
+
+func (suite *GraphTestSuite) TestStored_findsCopiesWithoutReadingThem(t *C) {
+	dat := testutils.RandDat(1024)
+	hash := graph.Hash(dat)
+	t.Check(graph.Stored(hash), Equals, false)
+
+	_, err := graph.Write(hash, dat)
+	t.Assert(err, IsNil)
+	t.Check(graph.Stored(hash), Equals, true)
+	t.Check(graph.Stored("../../etc/passwd"), Equals, false)
+}
+
 func (suite *GraphTestSuite) TestWrite_throwsIfBadSize(t *C) {
 	dat := testutils.RandDat(graph.MEGABYTE + 1)
 	fingerprint := graph.Hash(dat)
@@ -0,0 +1,119 @@
+package graph
+
+import (
+	"os"
+
+	"github.com/cayleygraph/cayley"
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/graph/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *GraphTestSuite) TestFsck_reportsNothingForCleanGraph(t *C) {
+	folder, err := suite.ng.NewNode("folder", graph.RootNodeId, os.ModeDir)
+	t.Check(err, IsNil)
+	_, err = suite.ng.NewNode("child", folder.Id, os.FileMode(0755))
+	t.Check(err, IsNil)
+
+	report, err := suite.ng.Fsck(false)
+	t.Check(err, IsNil)
+	t.Check(report.Issues, HasLen, 0)
+	t.Check(report.NodesChecked, Equals, 3)
+}
+
+func (suite *GraphTestSuite) TestFsck_findsMissingNameAndMode(t *C) {
+	t.Check(suite.ng.AddQuad(cayley.Triple("nameless", "hasParent", graph.RootNodeId)), IsNil)
+
+	report, err := suite.ng.Fsck(false)
+	t.Check(err, IsNil)
+	t.Assert(report.Issues, HasLen, 2)
+	t.Check(report.Issues[0].Problem, Equals, graph.MissingName)
+	t.Check(report.Issues[1].Problem, Equals, graph.MissingMode)
+	t.Check(report.Issues[0].Repaired, Equals, false)
+
+	report, err = suite.ng.Fsck(true)
+	t.Check(err, IsNil)
+	t.Check(report.Issues[0].Repaired, Equals, true)
+
+	node := suite.ng.NodeWithId("nameless")
+	t.Check(node.Name(), Equals, "nameless")
+	t.Check(node.Mode(), Equals, os.FileMode(0644))
+}
+
+func (suite *GraphTestSuite) TestFsck_reattachesOrphansToLostAndFound(t *C) {
+	folder, err := suite.ng.NewNode("folder", graph.RootNodeId, os.ModeDir)
+	t.Check(err, IsNil)
+	child, err := suite.ng.NewNode("child", folder.Id, os.FileMode(0755))
+	t.Check(err, IsNil)
+
+	t.Check(suite.ng.RemoveQuad(cayley.Triple(folder.Id, "isNamed", "folder")), IsNil)
+	t.Check(suite.ng.RemoveQuad(cayley.Triple(folder.Id, "hasMode", int(os.ModeDir))), IsNil)
+	t.Check(suite.ng.RemoveQuad(cayley.Triple(folder.Id, "hasParent", graph.RootNodeId)), IsNil)
+	t.Check(suite.ng.RemoveQuad(cayley.Triple(folder.Id, "hasMTime", folder.MTime().Unix())), IsNil)
+
+	report, err := suite.ng.Fsck(true)
+	t.Check(err, IsNil)
+	t.Assert(report.Issues, HasLen, 1)
+	t.Check(report.Issues[0].Problem, Equals, graph.OrphanedNode)
+	t.Check(report.Issues[0].NodeId, Equals, child.Id)
+
+	lostAndFound := suite.ng.NodeWithName(graph.RootNodeId, graph.LostAndFoundName)
+	t.Assert(lostAndFound, NotNil)
+	t.Check(suite.ng.NodeWithId(child.Id).Parent().Id, Equals, lostAndFound.Id)
+}
+
+func (suite *GraphTestSuite) TestFsck_breaksParentCycles(t *C) {
+	a, err := suite.ng.NewNode("a", graph.RootNodeId, os.ModeDir)
+	t.Check(err, IsNil)
+	b, err := suite.ng.NewNode("b", a.Id, os.ModeDir)
+	t.Check(err, IsNil)
+
+	t.Check(suite.ng.RemoveQuad(cayley.Triple(a.Id, "hasParent", graph.RootNodeId)), IsNil)
+	t.Check(suite.ng.AddQuad(cayley.Triple(a.Id, "hasParent", b.Id)), IsNil)
+
+	report, err := suite.ng.Fsck(true)
+	t.Check(err, IsNil)
+	t.Assert(report.Issues, HasLen, 1)
+	t.Check(report.Issues[0].Problem, Equals, graph.ParentCycle)
+	t.Check(report.Issues[0].Repaired, Equals, true)
+
+	report, err = suite.ng.Fsck(false)
+	t.Check(err, IsNil)
+	t.Check(report.Issues, HasLen, 0)
+}
+
+func (suite *GraphTestSuite) TestFsck_renamesDuplicateSiblings(t *C) {
+	_, err := suite.ng.NewNode("twin", graph.RootNodeId, os.FileMode(0755))
+	t.Check(err, IsNil)
+	other, err := suite.ng.NewNode("other", graph.RootNodeId, os.FileMode(0755))
+	t.Check(err, IsNil)
+
+	t.Check(suite.ng.RemoveQuad(cayley.Triple(other.Id, "isNamed", "other")), IsNil)
+	t.Check(suite.ng.AddQuad(cayley.Triple(other.Id, "isNamed", "twin")), IsNil)
+
+	report, err := suite.ng.Fsck(true)
+	t.Check(err, IsNil)
+	t.Assert(report.Issues, HasLen, 1)
+	t.Check(report.Issues[0].Problem, Equals, graph.DuplicateName)
+
+	names := make(map[string]bool)
+	for _, child := range suite.ng.RootNode.Children() {
+		names[child.Name()] = true
+	}
+	t.Check(names, HasLen, 2)
+}
+
+func (suite *GraphTestSuite) TestFsck_dropsDanglingBlockEdges(t *C) {
+	child, err := suite.ng.NewNode("child", graph.RootNodeId, os.FileMode(0755))
+	t.Check(err, IsNil)
+
+	dat := testutils.RandDat(1024)
+	t.Check(child.WriteData(dat, 0), IsNil)
+	t.Check(os.Remove(graph.LocationOnDisk(graph.Hash(dat))), IsNil)
+
+	report, err := suite.ng.Fsck(true)
+	t.Check(err, IsNil)
+	t.Assert(report.Issues, HasLen, 1)
+	t.Check(report.Issues[0].Problem, Equals, graph.DanglingBlock)
+	t.Check(suite.ng.NodeWithId(child.Id).Blocks(), HasLen, 0)
+}
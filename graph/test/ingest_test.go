@@ -0,0 +1,76 @@
+package graph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/graph/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *GraphTestSuite) localTree(t *C) string {
+	root := filepath.Join(suite.testDir, "photos")
+	t.Assert(os.MkdirAll(filepath.Join(root, "2017"), 0755), IsNil)
+	t.Assert(ioutil.WriteFile(filepath.Join(root, "readme.txt"), []byte("hello"), 0600), IsNil)
+	t.Assert(ioutil.WriteFile(filepath.Join(root, "2017", "big.jpg"), testutils.RandDat(graph.MEGABYTE+10), 0644), IsNil)
+
+	then := time.Now().Add(-time.Hour)
+	t.Assert(os.Chtimes(filepath.Join(root, "readme.txt"), then, then), IsNil)
+	return root
+}
+
+func (suite *GraphTestSuite) TestIngest_copiesTreeIntoGraph(t *C) {
+	root := suite.localTree(t)
+
+	progress, err := suite.ng.Ingest(root, graph.RootNodeId, nil)
+	t.Check(err, IsNil)
+	t.Check(progress.Errors, HasLen, 0)
+	t.Check(progress.Dirs, Equals, 2)
+	t.Check(progress.Files, Equals, 2)
+	t.Check(progress.Bytes, Equals, int64(graph.MEGABYTE+15))
+
+	photos := suite.ng.NodeWithName(graph.RootNodeId, "photos")
+	t.Assert(photos, NotNil)
+	t.Check(photos.IsDir(), Equals, true)
+
+	readme := suite.ng.NodeWithName(photos.Id, "readme.txt")
+	t.Assert(readme, NotNil)
+	t.Check(readme.Size(), Equals, int64(5))
+	t.Check(readme.Mode(), Equals, os.FileMode(0600))
+
+	fi, _ := os.Stat(filepath.Join(root, "readme.txt"))
+	t.Check(readme.MTime().Unix(), Equals, fi.ModTime().Unix())
+
+	year := suite.ng.NodeWithName(photos.Id, "2017")
+	t.Assert(year, NotNil)
+	big := suite.ng.NodeWithName(year.Id, "big.jpg")
+	t.Assert(big, NotNil)
+	t.Check(big.Blocks(), HasLen, 2)
+}
+
+func (suite *GraphTestSuite) TestIngest_skipsUnchangedFilesOnRerun(t *C) {
+	root := suite.localTree(t)
+
+	_, err := suite.ng.Ingest(root, graph.RootNodeId, nil)
+	t.Check(err, IsNil)
+
+	t.Check(ioutil.WriteFile(filepath.Join(root, "readme.txt"), []byte("hi"), 0600), IsNil)
+
+	var calls int
+	progress, err := suite.ng.Ingest(root, graph.RootNodeId, func(graph.IngestProgress) { calls++ })
+	t.Check(err, IsNil)
+	t.Check(progress.Files, Equals, 1)
+	t.Check(progress.Skipped, Equals, 1)
+	t.Check(calls > 0, Equals, true)
+
+	photos := suite.ng.NodeWithName(graph.RootNodeId, "photos")
+	t.Check(suite.ng.NodeWithName(photos.Id, "readme.txt").Size(), Equals, int64(2))
+}
+
+func (suite *GraphTestSuite) TestIngest_throwsForMissingPath(t *C) {
+	_, err := suite.ng.Ingest(filepath.Join(suite.testDir, "nope"), graph.RootNodeId, nil)
+	t.Check(err, ErrorMatches, "Error ingesting .*")
+}
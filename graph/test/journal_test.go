@@ -0,0 +1,211 @@
+package graph
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/sdcoffey/olympus/checkers"
+	"github.com/sdcoffey/olympus/graph"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *GraphTestSuite) useJournal(t *C) *graph.Journal {
+	journal, err := graph.OpenJournal("")
+	t.Assert(err, IsNil)
+	suite.ng.UseJournal(journal)
+	return journal
+}
+
+func kinds(changes []graph.Change) []graph.ChangeKind {
+	result := make([]graph.ChangeKind, len(changes))
+	for i, change := range changes {
+		result[i] = change.Kind
+	}
+	return result
+}
+
+func (suite *GraphTestSuite) TestJournal_recordsEachMutation(t *C) {
+	journal := suite.useJournal(t)
+
+	dir, err := suite.ng.NewNode("dir", graph.RootNodeId, os.ModeDir)
+	t.Assert(err, IsNil)
+	nd, err := suite.ng.NewNode("file", graph.RootNodeId, os.FileMode(0644))
+	t.Assert(err, IsNil)
+
+	t.Check(nd.SetName("renamed"), IsNil)
+	t.Check(nd.Move(dir.Id), IsNil)
+	t.Check(nd.SetMode(os.FileMode(0600)), IsNil)
+	t.Check(nd.Touch(time.Now().Add(-time.Hour)), IsNil)
+	t.Check(nd.WriteData([]byte("data"), 0), IsNil)
+	t.Check(suite.ng.RemoveNode(nd), IsNil)
+
+	changes, cursor := journal.Since(0, "", 0)
+	t.Check(kinds(changes), DeepEquals, []graph.ChangeKind{
+		graph.Created, graph.Created, graph.Renamed, graph.Moved, graph.ModeChanged,
+		graph.Touched, graph.ContentChanged, graph.Deleted,
+	})
+	t.Check(cursor, Equals, uint64(8))
+	t.Check(journal.Seq(), Equals, uint64(8))
+
+	for i, change := range changes {
+		t.Check(change.Seq, Equals, uint64(i+1))
+	}
+	t.Check(changes[2].Info.Name, Equals, "renamed")
+	t.Check(changes[7].NodeId, Equals, nd.Id)
+	t.Check(changes[7].Info, IsNil)
+}
+
+func (suite *GraphTestSuite) TestJournal_sinceFiltersByCursorAndSubtree(t *C) {
+	journal := suite.useJournal(t)
+
+	dir, _ := suite.ng.NewNode("dir", graph.RootNodeId, os.ModeDir)
+	inside, _ := suite.ng.NewNode("inside", dir.Id, os.FileMode(0644))
+	suite.ng.NewNode("outside", graph.RootNodeId, os.FileMode(0644))
+	t.Check(inside.SetName("still-inside"), IsNil)
+
+	changes, cursor := journal.Since(0, dir.Id, 0)
+	t.Check(changes, HasLen, 3)
+	t.Check(cursor, Equals, uint64(4))
+
+	changes, cursor = journal.Since(2, dir.Id, 0)
+	t.Check(changes, HasLen, 1)
+	t.Check(changes[0].Kind, Equals, graph.Renamed)
+
+	changes, cursor = journal.Since(cursor, dir.Id, 0)
+	t.Check(changes, HasLen, 0)
+	t.Check(cursor, Equals, uint64(4))
+
+	changes, cursor = journal.Since(0, "", 2)
+	t.Check(changes, HasLen, 2)
+	t.Check(cursor, Equals, uint64(2))
+}
+
+func (suite *GraphTestSuite) TestJournal_moveIsVisibleFromBothSubtrees(t *C) {
+	journal := suite.useJournal(t)
+
+	from, _ := suite.ng.NewNode("from", graph.RootNodeId, os.ModeDir)
+	to, _ := suite.ng.NewNode("to", graph.RootNodeId, os.ModeDir)
+	nd, _ := suite.ng.NewNode("file", from.Id, os.FileMode(0644))
+	cursor := journal.Seq()
+
+	t.Check(nd.Move(to.Id), IsNil)
+
+	fromChanges, _ := journal.Since(cursor, from.Id, 0)
+	toChanges, _ := journal.Since(cursor, to.Id, 0)
+	t.Check(kinds(fromChanges), DeepEquals, []graph.ChangeKind{graph.Moved})
+	t.Check(kinds(toChanges), DeepEquals, []graph.ChangeKind{graph.Moved})
+	t.Check(toChanges[0].Info.ParentId, Equals, to.Id)
+}
+
+func (suite *GraphTestSuite) TestJournal_persistsAcrossReopen(t *C) {
+	path := filepath.Join(suite.testDir, "journal.log")
+	journal, err := graph.OpenJournal(path)
+	t.Assert(err, IsNil)
+	suite.ng.UseJournal(journal)
+
+	nd, _ := suite.ng.NewNode("file", graph.RootNodeId, os.FileMode(0644))
+	t.Check(nd.SetName("renamed"), IsNil)
+	t.Assert(journal.Close(), IsNil)
+
+	// Simulate a crash partway through writing a change
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	t.Assert(err, IsNil)
+	file.WriteString(`{"seq":3,"kind":"ren`)
+	file.Close()
+
+	journal, err = graph.OpenJournal(path)
+	t.Assert(err, IsNil)
+	t.Check(journal.Seq(), Equals, uint64(2))
+
+	changes, _ := journal.Since(1, "", 0)
+	t.Check(changes, HasLen, 1)
+	t.Check(changes[0].Kind, Equals, graph.Renamed)
+	t.Check(changes[0].NodeId, Equals, nd.Id)
+	t.Check(changes[0].Time.IsZero(), Equals, false)
+
+	// The partial change was dropped, so the next one is readable after another reopen
+	suite.ng.UseJournal(journal)
+	t.Check(nd.SetName("renamed-again"), IsNil)
+	t.Assert(journal.Close(), IsNil)
+
+	journal, err = graph.OpenJournal(path)
+	t.Assert(err, IsNil)
+	t.Check(journal.Seq(), Equals, uint64(3))
+	journal.Close()
+}
+
+func (suite *GraphTestSuite) TestJournal_retainDropsOldChangesFromMemoryAndFile(t *C) {
+	path := filepath.Join(suite.testDir, "journal.log")
+	journal, err := graph.OpenJournal(path)
+	t.Assert(err, IsNil)
+	suite.ng.UseJournal(journal)
+
+	for i := 0; i < 5; i++ {
+		suite.ng.NewNode(fmt.Sprint("file", i), graph.RootNodeId, os.FileMode(0644))
+	}
+	t.Check(journal.MinCursor(), Equals, uint64(0))
+
+	t.Assert(journal.Retain(2), IsNil)
+	t.Check(journal.MinCursor(), Equals, uint64(3))
+	changes, cursor := journal.Since(3, "", 0)
+	t.Check(changes, HasLen, 2)
+	t.Check(cursor, Equals, uint64(5))
+
+	// Once twice as many are kept, the older ones go again
+	suite.ng.NewNode("file5", graph.RootNodeId, os.FileMode(0644))
+	t.Check(journal.MinCursor(), Equals, uint64(3))
+	suite.ng.NewNode("file6", graph.RootNodeId, os.FileMode(0644))
+	t.Check(journal.MinCursor(), Equals, uint64(5))
+	t.Assert(journal.Close(), IsNil)
+
+	journal, err = graph.OpenJournal(path)
+	t.Assert(err, IsNil)
+	defer journal.Close()
+	t.Check(journal.MinCursor(), Equals, uint64(5))
+	t.Check(journal.Seq(), Equals, uint64(7))
+}
+
+func (suite *GraphTestSuite) TestJournal_changesDoNotCarrySize(t *C) {
+	journal := suite.useJournal(t)
+
+	nd, _ := suite.ng.NewNode("file", graph.RootNodeId, os.FileMode(0644))
+	t.Check(nd.WriteData([]byte("data"), 0), IsNil)
+
+	changes, _ := journal.Since(1, "", 0)
+	t.Assert(len(changes) > 0, IsTrue)
+	written := changes[len(changes)-1]
+	t.Check(written.Kind, Equals, graph.ContentChanged)
+	t.Check(written.Info.Name, Equals, "file")
+	t.Check(written.Info.ParentId, Equals, graph.RootNodeId)
+	t.Check(written.Info.Size, Equals, int64(0))
+}
+
+func (suite *GraphTestSuite) TestJournal_notifiesSubscribers(t *C) {
+	journal := suite.useJournal(t)
+	notifications, unsubscribe := journal.Subscribe()
+
+	suite.ng.NewNode("first", graph.RootNodeId, os.FileMode(0644))
+	suite.ng.NewNode("second", graph.RootNodeId, os.FileMode(0644))
+
+	// Both changes coalesce into a single pending notification
+	select {
+	case <-notifications:
+	default:
+		t.Fatal("Expected a notification")
+	}
+	select {
+	case <-notifications:
+		t.Fatal("Expected notifications to be coalesced")
+	default:
+	}
+
+	unsubscribe()
+	suite.ng.NewNode("third", graph.RootNodeId, os.FileMode(0644))
+	select {
+	case <-notifications:
+		t.Fatal("Expected no notification after unsubscribing")
+	default:
+	}
+}
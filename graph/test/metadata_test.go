@@ -0,0 +1,77 @@
+package graph
+
+import (
+	"os"
+	"time"
+
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/media"
+	. "gopkg.in/check.v1"
+)
+
+// A minimal ID3v2.4 tag with UTF-8 title and artist frames
+func id3Data(title, artist string) []byte {
+	frame := func(id, text string) []byte {
+		body := append([]byte{3}, text...)
+		return append(append([]byte(id), 0, 0, 0, byte(len(body)), 0, 0), body...)
+	}
+
+	frames := append(frame("TIT2", title), frame("TPE1", artist)...)
+	return append([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, byte(len(frames))}, frames...)
+}
+
+func (suite *GraphTestSuite) TestMetadata_isExtractedFromFirstBlock(t *C) {
+	nd, err := suite.ng.NewNode("song.mp3", graph.RootNodeId, os.FileMode(0755))
+	t.Assert(err, IsNil)
+	t.Check(nd.Metadata(), HasLen, 0)
+
+	t.Assert(nd.WriteData(id3Data("Song", "Band"), 0), IsNil)
+	t.Check(nd.Metadata(), DeepEquals, media.Metadata{media.Title: "Song", media.Artist: "Band"})
+
+	t.Assert(nd.WriteData(id3Data("Other Song", "Band"), 0), IsNil)
+	info := suite.ng.NodeWithId(nd.Id).ExtendedNodeInfo()
+	t.Check(info.Name, Equals, "song.mp3")
+	t.Check(info.Metadata, DeepEquals, media.Metadata{media.Title: "Other Song", media.Artist: "Band"})
+}
+
+func (suite *GraphTestSuite) TestMetadataFilter_matchesFieldsAndCaptureTime(t *C) {
+	md := media.Metadata{media.CameraModel: "EOS 5D", media.CapturedAt: "2016-03-14T15:09:26Z"}
+	march := time.Date(2016, time.March, 1, 0, 0, 0, 0, time.UTC)
+	april := time.Date(2016, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Check(graph.MetadataFilter{}.Matches(md), Equals, true)
+	t.Check(graph.MetadataFilter{Fields: map[string]string{media.CameraModel: "eos 5d"}}.Matches(md), Equals, true)
+	t.Check(graph.MetadataFilter{Fields: map[string]string{media.CameraModel: "EOS 6D"}}.Matches(md), Equals, false)
+	t.Check(graph.MetadataFilter{CapturedAfter: march, CapturedBefore: april}.Matches(md), Equals, true)
+	t.Check(graph.MetadataFilter{CapturedAfter: april}.Matches(md), Equals, false)
+	t.Check(graph.MetadataFilter{CapturedBefore: march}.Matches(md), Equals, false)
+	t.Check(graph.MetadataFilter{CapturedAfter: march}.Matches(media.Metadata{}), Equals, false)
+}
+
+func (suite *GraphTestSuite) TestSearch_findsMatchingFilesInSubtree(t *C) {
+	dir, err := suite.ng.NewNode("music", graph.RootNodeId, os.ModeDir|os.FileMode(0755))
+	t.Assert(err, IsNil)
+
+	for i, artist := range []string{"Band", "Other Band", "Band"} {
+		nd, err := suite.ng.NewNode(string('a'+rune(i))+".mp3", dir.Id, os.FileMode(0755))
+		t.Assert(err, IsNil)
+		t.Assert(nd.WriteData(id3Data("Song", artist), 0), IsNil)
+	}
+
+	filter := graph.MetadataFilter{Fields: map[string]string{media.Artist: "band"}}
+	results := suite.ng.Search(suite.ng.RootNode, filter, 0)
+	t.Assert(results, HasLen, 2)
+	t.Check(results[0].Name(), Equals, "a.mp3")
+	t.Check(results[1].Name(), Equals, "c.mp3")
+
+	t.Check(suite.ng.Search(suite.ng.RootNode, filter, 1), HasLen, 1)
+}
+
+func (suite *GraphTestSuite) TestRemoveNode_removesMetadata(t *C) {
+	nd, err := suite.ng.NewNode("song.mp3", graph.RootNodeId, os.FileMode(0755))
+	t.Assert(err, IsNil)
+	t.Assert(nd.WriteData(id3Data("Song", "Band"), 0), IsNil)
+
+	t.Assert(suite.ng.RemoveNode(nd), IsNil)
+	t.Check(suite.ng.NodeWithId(nd.Id).Metadata(), HasLen, 0)
+}
@@ -0,0 +1,116 @@
+package graph
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/graph/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *GraphTestSuite) useMirrors(t *C, n, copies int) []string {
+	dirs := make([]string, n)
+	for i := range dirs {
+		dirs[i] = filepath.Join(suite.testDir, "disk"+string('a'+rune(i)))
+	}
+	t.Assert(graph.UseDataDirs(dirs, copies), IsNil)
+	return dirs
+}
+
+func copiesOf(dirs []string, hash string) (n int) {
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, hash)); err == nil {
+			n++
+		}
+	}
+	return
+}
+
+func (suite *GraphTestSuite) TestUseDataDirs_throwsForBadCopies(t *C) {
+	t.Check(graph.UseDataDirs([]string{suite.testDir}, 2), ErrorMatches, "Number of copies must be .*")
+	t.Check(graph.UseDataDirs([]string{}, 1), ErrorMatches, "At least one data directory is required")
+}
+
+func (suite *GraphTestSuite) TestCheckDataDir_failsForMissingDir(t *C) {
+	t.Check(graph.CheckDataDir(suite.testDir), IsNil)
+	t.Check(graph.CheckDataDir(filepath.Join(suite.testDir, "missing")), ErrorMatches, "Error writing to .*")
+}
+
+func (suite *GraphTestSuite) TestWrite_writesConfiguredNumberOfCopies(t *C) {
+	defer graph.UseDefaultDataDir()
+	dirs := suite.useMirrors(t, 3, 2)
+
+	dat := testutils.RandDat(1024)
+	hash := graph.Hash(dat)
+	_, err := graph.Write(hash, dat)
+	t.Check(err, IsNil)
+
+	t.Check(copiesOf(dirs, hash), Equals, 2)
+}
+
+func (suite *GraphTestSuite) TestRawData_rereplicatesMissingCopy(t *C) {
+	defer graph.UseDefaultDataDir()
+	dirs := suite.useMirrors(t, 2, 2)
+
+	dat := testutils.RandDat(1024)
+	hash := graph.Hash(dat)
+	_, err := graph.Write(hash, dat)
+	t.Check(err, IsNil)
+
+	t.Check(os.Remove(filepath.Join(dirs[0], hash)), IsNil)
+
+	readDat, err := graph.RawData(hash)
+	t.Check(err, IsNil)
+	t.Check(readDat, DeepEquals, dat)
+	graph.WaitForRepairs()
+	t.Check(copiesOf(dirs, hash), Equals, 2)
+}
+
+func (suite *GraphTestSuite) TestRawData_skipsAndRepairsCorruptCopy(t *C) {
+	defer graph.UseDefaultDataDir()
+	dirs := suite.useMirrors(t, 2, 2)
+
+	dat := testutils.RandDat(1024)
+	hash := graph.Hash(dat)
+	_, err := graph.Write(hash, dat)
+	t.Check(err, IsNil)
+
+	t.Check(ioutil.WriteFile(filepath.Join(dirs[0], hash), testutils.RandDat(1024), 0644), IsNil)
+
+	readDat, err := graph.RawData(hash)
+	t.Check(err, IsNil)
+	t.Check(readDat, DeepEquals, dat)
+
+	graph.WaitForRepairs()
+	for _, dir := range dirs {
+		onDisk, err := ioutil.ReadFile(filepath.Join(dir, hash))
+		t.Check(err, IsNil)
+		t.Check(onDisk, DeepEquals, dat)
+	}
+}
+
+func (suite *GraphTestSuite) TestCheckReplication_reportsAndRepairsUnderReplicatedBlocks(t *C) {
+	defer graph.UseDefaultDataDir()
+	dirs := suite.useMirrors(t, 2, 2)
+
+	dat := testutils.RandDat(1024)
+	hash := graph.Hash(dat)
+	_, err := graph.Write(hash, dat)
+	t.Check(err, IsNil)
+	t.Check(os.Remove(filepath.Join(dirs[1], hash)), IsNil)
+
+	report := graph.CheckReplication(true, false)
+	t.Check(report.Blocks, Equals, 1)
+	t.Check(report.Healthy, Equals, 0)
+	t.Check(report.UnderReplicated, DeepEquals, []string{hash})
+	t.Check(report.Dirs, HasLen, 2)
+
+	report = graph.CheckReplication(true, true)
+	t.Check(report.Repaired, Equals, 1)
+
+	report = graph.CheckReplication(true, false)
+	t.Check(report.Healthy, Equals, 1)
+	t.Check(report.UnderReplicated, HasLen, 0)
+}
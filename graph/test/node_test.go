@@ -147,6 +147,137 @@ func (suite *GraphTestSuite) TestChildrenSorted_returnsSortedMTime(t *C) {
 	t.Check(children[1].Name(), Equals, "b")
 }
 
+func (suite *GraphTestSuite) TestChildrenSorted_returnsSortedSize(t *C) {
+	small, err := suite.ng.NewNode("small", graph.RootNodeId, os.FileMode(0755))
+	t.Check(err, IsNil)
+	t.Check(small.WriteData(testutils.RandDat(10), 0), IsNil)
+
+	large, err := suite.ng.NewNode("large", graph.RootNodeId, os.FileMode(0755))
+	t.Check(err, IsNil)
+	t.Check(large.WriteData(testutils.RandDat(100), 0), IsNil)
+
+	children := suite.ng.RootNode.ChildrenSorted(graph.FileSize)
+	t.Check(children[0].Name(), Equals, "small")
+	t.Check(children[1].Name(), Equals, "large")
+
+	children = suite.ng.RootNode.ChildrenSorted(graph.Reversed(graph.FileSize))
+	t.Check(children[0].Name(), Equals, "large")
+	t.Check(children[1].Name(), Equals, "small")
+}
+
+func (suite *GraphTestSuite) TestChildrenSorted_returnsSortedNatural(t *C) {
+	for _, name := range []string{"file10", "file2", "file1"} {
+		_, err := suite.ng.NewNode(name, graph.RootNodeId, os.FileMode(0755))
+		t.Check(err, IsNil)
+	}
+
+	children := suite.ng.RootNode.ChildrenSorted(graph.Natural)
+	t.Check(children[0].Name(), Equals, "file1")
+	t.Check(children[1].Name(), Equals, "file2")
+	t.Check(children[2].Name(), Equals, "file10")
+}
+
+func (suite *GraphTestSuite) TestChildrenSorted_returnsSortedCaseInsensitive(t *C) {
+	for _, name := range []string{"b", "C", "a"} {
+		_, err := suite.ng.NewNode(name, graph.RootNodeId, os.FileMode(0755))
+		t.Check(err, IsNil)
+	}
+
+	children := suite.ng.RootNode.ChildrenSorted(graph.CaseInsensitive)
+	t.Check(children[0].Name(), Equals, "a")
+	t.Check(children[1].Name(), Equals, "b")
+	t.Check(children[2].Name(), Equals, "C")
+}
+
+func (suite *GraphTestSuite) TestChildrenSorted_listsDirectoriesFirst(t *C) {
+	_, err := suite.ng.NewNode("a", graph.RootNodeId, os.FileMode(0755))
+	t.Check(err, IsNil)
+	_, err = suite.ng.NewNode("b", graph.RootNodeId, os.ModeDir|os.FileMode(0755))
+	t.Check(err, IsNil)
+	_, err = suite.ng.NewNode("c", graph.RootNodeId, os.FileMode(0755))
+	t.Check(err, IsNil)
+
+	children := suite.ng.RootNode.ChildrenSorted(graph.DirectoriesFirst(graph.Alphabetical))
+	t.Check(children[0].Name(), Equals, "b")
+	t.Check(children[1].Name(), Equals, "a")
+	t.Check(children[2].Name(), Equals, "c")
+
+	children = suite.ng.RootNode.ChildrenSorted(graph.DirectoriesFirst(graph.Reversed(graph.Alphabetical)))
+	t.Check(children[0].Name(), Equals, "b")
+	t.Check(children[1].Name(), Equals, "c")
+	t.Check(children[2].Name(), Equals, "a")
+}
+
+func (suite *GraphTestSuite) TestChildrenSorted_breaksTiesByName(t *C) {
+	mTime := time.Now().Add(-time.Minute)
+	for _, name := range []string{"c", "a", "b"} {
+		nd, err := suite.ng.NewNode(name, graph.RootNodeId, os.FileMode(0755))
+		t.Check(err, IsNil)
+		t.Check(nd.Touch(mTime), IsNil)
+	}
+
+	for _, sorter := range []graph.Sorter{graph.DateModified, graph.Reversed(graph.DateModified)} {
+		children := suite.ng.RootNode.ChildrenSorted(sorter)
+		t.Check(children[0].Name(), Equals, "a")
+		t.Check(children[1].Name(), Equals, "b")
+		t.Check(children[2].Name(), Equals, "c")
+	}
+}
+
+func (suite *GraphTestSuite) TestParseSorter(t *C) {
+	sorter, err := graph.ParseSorter("", "", false)
+	t.Check(err, IsNil)
+	t.Check(sorter, Equals, graph.Alphabetical)
+
+	sorter, err = graph.ParseSorter("size", "desc", true)
+	t.Check(err, IsNil)
+	t.Check(sorter, Equals, graph.DirectoriesFirst(graph.Reversed(graph.FileSize)))
+
+	name, order, dirsFirst := sorter.Params()
+	t.Check(name, Equals, "size")
+	t.Check(order, Equals, "desc")
+	t.Check(dirsFirst, Equals, true)
+
+	_, err = graph.ParseSorter("color", "", false)
+	t.Check(err, ErrorMatches, "Unknown sort order: color")
+
+	_, err = graph.ParseSorter("name", "sideways", false)
+	t.Check(err, ErrorMatches, "Order must be asc or desc, not sideways")
+}
+
+func (suite *GraphTestSuite) TestType_isDetectedFromFirstBlock(t *C) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), testutils.RandDat(100)...)
+
+	nd, err := suite.ng.NewNode("photo", graph.RootNodeId, os.FileMode(0755))
+	t.Check(err, IsNil)
+	t.Check(nd.Type(), Equals, "")
+
+	t.Check(nd.WriteData(png, 0), IsNil)
+	t.Check(nd.Type(), Equals, "image/png")
+	t.Check(suite.ng.NodeWithId(nd.Id).Type(), Equals, "image/png")
+
+	mislabeled, err := suite.ng.NewNode("photo.txt", graph.RootNodeId, os.FileMode(0755))
+	t.Check(err, IsNil)
+	t.Check(mislabeled.WriteData(png, 0), IsNil)
+	t.Check(mislabeled.Type(), Equals, "image/png")
+}
+
+func (suite *GraphTestSuite) TestType_usesExtensionWhenContentIsGeneric(t *C) {
+	nd, err := suite.ng.NewNode("data.json", graph.RootNodeId, os.FileMode(0755))
+	t.Check(err, IsNil)
+
+	t.Check(nd.WriteData([]byte(`{"key": "value"}`), 0), IsNil)
+	t.Check(nd.Type(), Equals, "application/json")
+}
+
+func (suite *GraphTestSuite) TestSetName_throwsForNameWithSlash(t *C) {
+	nd, err := suite.ng.NewNode("file", graph.RootNodeId, os.FileMode(0644))
+	t.Assert(err, IsNil)
+
+	t.Check(nd.SetName("a/b"), ErrorMatches, "Error updating name: name cannot contain /")
+	t.Check(nd.Name(), Equals, "file")
+}
+
 func (suite *GraphTestSuite) TestParent(t *C) {
 	rootNode := suite.ng.RootNode
 	t.Check(rootNode.Parent(), IsNil)
@@ -222,6 +353,31 @@ func (suite *GraphTestSuite) TestWriteData_SizeChanges(t *C) {
 	t.Check(child.Size(), Equals, int64(graph.MEGABYTE*2))
 }
 
+func (suite *GraphTestSuite) TestLinkBlock_usesStoredBlock(t *C) {
+	original, err := suite.ng.NewNode("original", graph.RootNodeId, os.FileMode(0755))
+	t.Assert(err, IsNil)
+	dat := append([]byte("\x89PNG\r\n\x1a\n"), testutils.RandDat(100)...)
+	t.Assert(original.WriteData(dat, 0), IsNil)
+
+	copied, err := suite.ng.NewNode("copy", graph.RootNodeId, os.FileMode(0755))
+	t.Assert(err, IsNil)
+	t.Check(copied.LinkBlock(graph.Hash(dat), 0), IsNil)
+	t.Check(copied.BlockWithOffset(0), Equals, graph.Hash(dat))
+	t.Check(copied.Size(), Equals, int64(len(dat)))
+	t.Check(copied.Type(), Equals, "image/png")
+}
+
+func (suite *GraphTestSuite) TestLinkBlock_throwsForMissingBlock(t *C) {
+	child, err := suite.ng.NewNode("child", graph.RootNodeId, os.FileMode(0755))
+	t.Assert(err, IsNil)
+
+	dat := testutils.RandDat(1024)
+	t.Check(os.IsNotExist(child.LinkBlock(graph.Hash(dat), 0)), IsTrue)
+	t.Check(os.IsNotExist(child.LinkBlock("not-a-hash", 0)), IsTrue)
+	t.Check(child.LinkBlock(graph.Hash(dat), 10), ErrorMatches, "10 is not a valid offset .*")
+	t.Check(child.BlockWithOffset(0), Equals, "")
+}
+
 func (suite *GraphTestSuite) TestBlockWithOffset_findsCorrectBlock(t *C) {
 	child, err := suite.ng.NewNode("child", graph.RootNodeId, os.FileMode(0755))
 	t.Check(err, IsNil)
@@ -2,11 +2,13 @@ package graph
 
 import (
 	"os"
+	"sync"
 	"time"
 
 	"github.com/cayleygraph/cayley"
 	. "github.com/sdcoffey/olympus/checkers"
 	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/graph/testutils"
 	. "gopkg.in/check.v1"
 )
 
@@ -50,6 +52,48 @@ func (suite *GraphTestSuite) TestGraph_NodeWithName_FindsNodeWithNameAndParent(t
 	t.Check(fetchedChild.MTime().Sub(time.Now()) < time.Second, Equals, true)
 }
 
+func (suite *GraphTestSuite) TestGraph_NodeCount_countsNodesAndObservesQueries(t *C) {
+	queries := make(map[string]int)
+	suite.ng.ObserveQueries(func(query string, duration time.Duration) {
+		queries[query]++
+	})
+	defer suite.ng.ObserveQueries(nil)
+
+	t.Check(suite.ng.NodeCount(), Equals, 1)
+	dir, err := suite.ng.NewNode("dir", graph.RootNodeId, os.ModeDir)
+	t.Assert(err, IsNil)
+	_, err = suite.ng.NewNode("file", dir.Id, 0644)
+	t.Assert(err, IsNil)
+	t.Check(suite.ng.NodeCount(), Equals, 3)
+
+	t.Check(suite.ng.RootNode.Children(), HasLen, 1)
+	t.Check(queries["count"], Equals, 2)
+	t.Check(queries["children"], Equals, 1)
+}
+
+func (suite *GraphTestSuite) TestGraph_CheckWritable_leavesNoNodesBehind(t *C) {
+	t.Check(suite.ng.CheckWritable(), IsNil)
+	t.Check(suite.ng.NodeCount(), Equals, 1)
+	t.Check(suite.ng.RootNode.Children(), HasLen, 0)
+}
+
+func (suite *GraphTestSuite) TestNewNode_invalidNodeLeavesNothingBehind(t *C) {
+	file, err := suite.ng.NewNode("file", graph.RootNodeId, 0644)
+	t.Assert(err, IsNil)
+
+	_, err = suite.ng.NewNode("file", graph.RootNodeId, 0644)
+	t.Check(err, ErrorMatches, "Error creating new node: Node with name file already exists in root")
+	_, err = suite.ng.NewNode("a/b", graph.RootNodeId, 0644)
+	t.Check(err, ErrorMatches, "Error creating new node: name cannot contain /")
+	_, err = suite.ng.NewNode("child", file.Id, 0644)
+	t.Check(err, ErrorMatches, "Error creating new node: Cannot add node to a non-directory")
+	_, err = suite.ng.NewNode("child", "not-a-node", 0644)
+	t.Check(err, ErrorMatches, "Error creating new node: Parent does not exist")
+
+	t.Check(suite.ng.NodeCount(), Equals, 2)
+	t.Check(suite.ng.RootNode.Children(), HasLen, 1)
+}
+
 func (suite *GraphTestSuite) TestRemoveNode_throwsWhenDeletingRootNode(t *C) {
 	err := suite.ng.RemoveNode(suite.ng.RootNode)
 	t.Check(err, ErrorMatches, "Cannot delete root node")
@@ -67,3 +111,107 @@ func (suite *GraphTestSuite) TestRemoveNode_deletesAllChildNodes(t *C) {
 	t.Check(suite.ng.RemoveNode(child), IsNil)
 	t.Check(suite.ng.RootNode.Children(), HasLen, 0)
 }
+
+func (suite *GraphTestSuite) TestNodeWithPath_resolvesNestedNodes(t *C) {
+	dir, err := suite.ng.NewNode("photos", graph.RootNodeId, os.ModeDir|os.FileMode(0755))
+	t.Assert(err, IsNil)
+	file, err := suite.ng.NewNode("cat.png", dir.Id, os.FileMode(0644))
+	t.Assert(err, IsNil)
+
+	t.Check(suite.ng.NodeWithPath("/").Id, Equals, graph.RootNodeId)
+	t.Check(suite.ng.NodeWithPath("/photos").Id, Equals, dir.Id)
+	t.Check(suite.ng.NodeWithPath("photos/cat.png").Id, Equals, file.Id)
+	t.Check(suite.ng.NodeWithPath("/photos/../photos/./cat.png").Id, Equals, file.Id)
+	t.Check(suite.ng.NodeWithPath("/photos/dog.png"), IsNil)
+	t.Check(suite.ng.NodeWithPath("/photos/cat.png/whiskers"), IsNil)
+
+	t.Check(file.Path(), Equals, "/photos/cat.png")
+	t.Check(file.NodeInfo().Path, Equals, "")
+	t.Check(suite.ng.RootNode.Path(), Equals, "/")
+}
+
+func (suite *GraphTestSuite) TestAvailableName_numbersTakenNames(t *C) {
+	t.Check(suite.ng.AvailableName(graph.RootNodeId, "cat.png"), Equals, "cat.png")
+
+	suite.ng.NewNode("cat.png", graph.RootNodeId, os.FileMode(0644))
+	t.Check(suite.ng.AvailableName(graph.RootNodeId, "cat.png"), Equals, "cat (1).png")
+
+	suite.ng.NewNode("cat (1).png", graph.RootNodeId, os.FileMode(0644))
+	t.Check(suite.ng.AvailableName(graph.RootNodeId, "cat.png"), Equals, "cat (2).png")
+
+	suite.ng.NewNode("README", graph.RootNodeId, os.FileMode(0644))
+	t.Check(suite.ng.AvailableName(graph.RootNodeId, "README"), Equals, "README (1)")
+}
+
+func (suite *GraphTestSuite) TestNewAvailableNode_neverGivesTwoNodesOneName(t *C) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := suite.ng.NewAvailableNode("cat.png", graph.RootNodeId, os.FileMode(0644), "")
+			t.Check(err, IsNil)
+		}()
+	}
+	wg.Wait()
+
+	names := make(map[string]bool)
+	for _, child := range suite.ng.RootNode.Children() {
+		t.Check(names[child.Name()], Equals, false)
+		names[child.Name()] = true
+	}
+	t.Check(names, HasLen, 10)
+}
+
+func (suite *GraphTestSuite) TestNewFile_addsNodeWithItsContent(t *C) {
+	dat := append([]byte("\x89PNG\r\n\x1a\n"), testutils.RandDat(graph.BLOCK_SIZE)...)
+	hashes := []string{graph.Hash(dat[:graph.BLOCK_SIZE]), graph.Hash(dat[graph.BLOCK_SIZE:])}
+	for i, hash := range hashes {
+		_, err := graph.Write(hash, dat[i*graph.BLOCK_SIZE:])
+		t.Assert(err, IsNil)
+	}
+	mTime := time.Now().Add(-time.Hour)
+
+	file, err := suite.ng.NewFile("cat.png", graph.RootNodeId, 0644, "alice", hashes, mTime)
+	t.Assert(err, IsNil)
+	file = suite.ng.NodeWithId(file.Id)
+	t.Check(file.Name(), Equals, "cat.png")
+	t.Check(file.Owner(), Equals, "alice")
+	t.Check(file.MTime().Unix(), Equals, mTime.Unix())
+	t.Check(file.Size(), Equals, int64(len(dat)))
+	t.Check(file.Type(), Equals, "image/png")
+	t.Check(file.BlockWithOffset(graph.BLOCK_SIZE), Equals, hashes[1])
+}
+
+func (suite *GraphTestSuite) TestNewFile_missingBlockLeavesNothingBehind(t *C) {
+	dat := testutils.RandDat(100)
+	_, err := graph.Write(graph.Hash(dat), dat)
+	t.Assert(err, IsNil)
+
+	_, err = suite.ng.NewFile("file", graph.RootNodeId, 0644, "", []string{graph.Hash(dat), graph.Hash(testutils.RandDat(100))}, time.Time{})
+	t.Check(os.IsNotExist(err), IsTrue)
+	_, err = suite.ng.NewFile("dir", graph.RootNodeId, os.ModeDir|0755, "", []string{graph.Hash(dat)}, time.Time{})
+	t.Check(err, NotNil)
+
+	t.Check(suite.ng.NodeCount(), Equals, 1)
+}
+
+func (suite *GraphTestSuite) TestRemoveUnusedBlocks_keepsBlocksFilesAndVersionsUse(t *C) {
+	blocks := make([][]byte, 3)
+	hashes := make([]string, 3)
+	for i := range blocks {
+		blocks[i] = testutils.RandDat(100)
+		hashes[i] = graph.Hash(blocks[i])
+		_, err := graph.Write(hashes[i], blocks[i])
+		t.Assert(err, IsNil)
+	}
+	file, err := suite.ng.NewFile("file", graph.RootNodeId, 0644, "", hashes[:1], time.Time{})
+	t.Assert(err, IsNil)
+	_, err = file.ReplaceContent(hashes[1:2], time.Time{})
+	t.Assert(err, IsNil)
+
+	t.Check(suite.ng.RemoveUnusedBlocks(append(hashes, hashes[2])), Equals, 1)
+	t.Check(graph.HasBlock(hashes[0]), IsTrue)
+	t.Check(graph.HasBlock(hashes[1]), IsTrue)
+	t.Check(graph.HasBlock(hashes[2]), Equals, false)
+}
@@ -0,0 +1,108 @@
+package graph
+
+import (
+	"os"
+
+	"github.com/sdcoffey/olympus/graph"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *GraphTestSuite) TestOwnership_setsOwnerAndGroup(t *C) {
+	nd, err := suite.ng.NewOwnedNode("file", graph.RootNodeId, os.FileMode(0640), "alice")
+	t.Assert(err, IsNil)
+	t.Check(nd.Owner(), Equals, "alice")
+	t.Check(nd.Group(), Equals, "")
+
+	t.Check(nd.SetGroup("family"), IsNil)
+	t.Check(nd.SetOwner("bob"), IsNil)
+	t.Check(nd.SetOwner(""), NotNil)
+
+	fetched := suite.ng.NodeWithId(nd.Id)
+	t.Check(fetched.Owner(), Equals, "bob")
+	t.Check(fetched.Group(), Equals, "family")
+	t.Check(fetched.NodeInfo().Owner, Equals, "bob")
+	t.Check(fetched.NodeInfo().Group, Equals, "family")
+}
+
+func (suite *GraphTestSuite) TestOwnership_newNodesInheritFromParent(t *C) {
+	dir, err := suite.ng.NewOwnedNode("dir", graph.RootNodeId, os.ModeDir|0750, "alice")
+	t.Assert(err, IsNil)
+	t.Assert(dir.SetGroup("family"), IsNil)
+
+	file, err := suite.ng.NewNode("file", dir.Id, 0)
+	t.Assert(err, IsNil)
+	t.Check(file.Owner(), Equals, "alice")
+	t.Check(file.Group(), Equals, "family")
+	t.Check(file.Mode(), Equals, os.FileMode(0640))
+
+	subdir, err := suite.ng.NewOwnedNode("subdir", dir.Id, os.ModeDir, "bob")
+	t.Assert(err, IsNil)
+	t.Check(subdir.Owner(), Equals, "bob")
+	t.Check(subdir.Group(), Equals, "family")
+	t.Check(subdir.Mode(), Equals, os.ModeDir|0750)
+
+	explicit, err := suite.ng.NewNode("explicit", dir.Id, os.FileMode(0600))
+	t.Assert(err, IsNil)
+	t.Check(explicit.Mode(), Equals, os.FileMode(0600))
+}
+
+func (suite *GraphTestSuite) TestOwnership_unownedNodesStayUnowned(t *C) {
+	nd, err := suite.ng.NewNode("file", graph.RootNodeId, 0)
+	t.Assert(err, IsNil)
+	t.Check(nd.Owner(), Equals, "")
+	t.Check(nd.Mode(), Equals, os.FileMode(0))
+	t.Check(nd.Permits("anyone", nil, graph.WritePermission), Equals, true)
+}
+
+func (suite *GraphTestSuite) TestPermits_usesBitsForOwnerGroupAndOthers(t *C) {
+	nd, err := suite.ng.NewOwnedNode("file", graph.RootNodeId, os.FileMode(0640), "alice")
+	t.Assert(err, IsNil)
+	t.Assert(nd.SetGroup("family"), IsNil)
+
+	t.Check(nd.Permits("alice", nil, graph.ReadPermission), Equals, true)
+	t.Check(nd.Permits("alice", nil, graph.WritePermission), Equals, true)
+	t.Check(nd.Permits("alice", nil, graph.ExecutePermission), Equals, false)
+
+	t.Check(nd.Permits("bob", []string{"family"}, graph.ReadPermission), Equals, true)
+	t.Check(nd.Permits("bob", []string{"family"}, graph.WritePermission), Equals, false)
+
+	t.Check(nd.Permits("carol", []string{"friends"}, graph.ReadPermission), Equals, false)
+
+	t.Assert(nd.SetMode(os.FileMode(0604)), IsNil)
+	t.Check(nd.Permits("bob", []string{"family"}, graph.ReadPermission), Equals, false)
+	t.Check(nd.Permits("carol", []string{"friends"}, graph.ReadPermission), Equals, true)
+}
+
+func (suite *GraphTestSuite) TestUpdate_setsOwnerAndGroup(t *C) {
+	nd, err := suite.ng.NewOwnedNode("file", graph.RootNodeId, os.FileMode(0640), "alice")
+	t.Assert(err, IsNil)
+
+	t.Check(nd.Update(graph.NodeInfo{Owner: "bob", Group: "family"}), IsNil)
+	t.Check(nd.Owner(), Equals, "bob")
+	t.Check(nd.Group(), Equals, "family")
+}
+
+func (suite *GraphTestSuite) TestJournal_recordsOwnerChanges(t *C) {
+	journal := suite.useJournal(t)
+
+	nd, err := suite.ng.NewOwnedNode("file", graph.RootNodeId, os.FileMode(0640), "alice")
+	t.Assert(err, IsNil)
+	t.Check(nd.SetOwner("bob"), IsNil)
+	t.Check(nd.SetGroup("family"), IsNil)
+
+	changes, _ := journal.Since(0, "", 0)
+	t.Check(kinds(changes), DeepEquals, []graph.ChangeKind{graph.Created, graph.OwnerChanged, graph.OwnerChanged})
+	t.Check(changes[2].Info.Owner, Equals, "bob")
+	t.Check(changes[2].Info.Group, Equals, "family")
+}
+
+func (suite *GraphTestSuite) TestRemoveNode_removesOwnership(t *C) {
+	nd, err := suite.ng.NewOwnedNode("file", graph.RootNodeId, os.FileMode(0640), "alice")
+	t.Assert(err, IsNil)
+	t.Assert(nd.SetGroup("family"), IsNil)
+
+	t.Assert(suite.ng.RemoveNode(nd), IsNil)
+	fetched := suite.ng.NodeWithId(nd.Id)
+	t.Check(fetched.Owner(), Equals, "")
+	t.Check(fetched.Group(), Equals, "")
+}
@@ -0,0 +1,114 @@
+package graph
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+
+	"github.com/sdcoffey/olympus/graph"
+	. "gopkg.in/check.v1"
+)
+
+func pngData(width, height int, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func thumbnailBounds(t *C, hash string) image.Rectangle {
+	dat, err := graph.RawData(hash)
+	t.Assert(err, IsNil)
+
+	img, format, err := image.Decode(bytes.NewReader(dat))
+	t.Assert(err, IsNil)
+	t.Check(format, Equals, "jpeg")
+
+	return img.Bounds()
+}
+
+func (suite *GraphTestSuite) TestThumbnail_scalesToEachSize(t *C) {
+	nd, err := suite.ng.NewNode("photo.png", graph.RootNodeId, os.FileMode(0755))
+	t.Assert(err, IsNil)
+	t.Assert(nd.WriteData(pngData(800, 400, color.White), 0), IsNil)
+
+	hash, err := nd.Thumbnail(256)
+	t.Assert(err, IsNil)
+	bounds := thumbnailBounds(t, hash)
+	t.Check(bounds.Dx(), Equals, 256)
+	t.Check(bounds.Dy(), Equals, 128)
+
+	hash, err = nd.Thumbnail(64)
+	t.Assert(err, IsNil)
+	bounds = thumbnailBounds(t, hash)
+	t.Check(bounds.Dx(), Equals, 64)
+	t.Check(bounds.Dy(), Equals, 32)
+}
+
+func (suite *GraphTestSuite) TestThumbnail_doesNotScaleUpSmallImages(t *C) {
+	nd, err := suite.ng.NewNode("icon.png", graph.RootNodeId, os.FileMode(0755))
+	t.Assert(err, IsNil)
+	t.Assert(nd.WriteData(pngData(20, 40, color.White), 0), IsNil)
+
+	hash, err := nd.Thumbnail(512)
+	t.Assert(err, IsNil)
+	bounds := thumbnailBounds(t, hash)
+	t.Check(bounds.Dx(), Equals, 20)
+	t.Check(bounds.Dy(), Equals, 40)
+}
+
+func (suite *GraphTestSuite) TestThumbnail_regeneratesWhenContentChanges(t *C) {
+	nd, err := suite.ng.NewNode("photo.png", graph.RootNodeId, os.FileMode(0755))
+	t.Assert(err, IsNil)
+	t.Assert(nd.WriteData(pngData(100, 100, color.White), 0), IsNil)
+
+	first, err := nd.Thumbnail(64)
+	t.Assert(err, IsNil)
+
+	again, err := nd.Thumbnail(64)
+	t.Assert(err, IsNil)
+	t.Check(again, Equals, first)
+
+	t.Assert(nd.WriteData(pngData(100, 100, color.Black), 0), IsNil)
+	second, err := nd.Thumbnail(64)
+	t.Assert(err, IsNil)
+	t.Check(second, Not(Equals), first)
+}
+
+func (suite *GraphTestSuite) TestThumbnail_throwsForNonImages(t *C) {
+	nd, err := suite.ng.NewNode("notes.txt", graph.RootNodeId, os.FileMode(0755))
+	t.Assert(err, IsNil)
+	t.Assert(nd.WriteData([]byte("not a picture"), 0), IsNil)
+
+	_, err = nd.Thumbnail(64)
+	t.Check(err, Equals, graph.ErrNotAnImage)
+
+	_, err = nd.Thumbnail(65)
+	t.Check(err, ErrorMatches, "Thumbnail size must be one of .*")
+}
+
+func (suite *GraphTestSuite) TestThumbnail_refusesImagesWithTooManyPixels(t *C) {
+	// Claim enormous dimensions in the header of a tiny image
+	dat := pngData(2, 2, color.White)
+	ihdr := dat[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:4], 100000)
+	binary.BigEndian.PutUint32(ihdr[4:8], 100000)
+	binary.BigEndian.PutUint32(dat[8+8+13:], crc32.ChecksumIEEE(dat[8+4:8+8+13]))
+
+	nd, err := suite.ng.NewNode("bomb.png", graph.RootNodeId, os.FileMode(0644))
+	t.Assert(err, IsNil)
+	t.Assert(nd.WriteData(dat, 0), IsNil)
+
+	_, err = nd.Thumbnail(64)
+	t.Check(err, ErrorMatches, ".*image is too large \\(100000x100000\\)")
+}
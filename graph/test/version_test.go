@@ -0,0 +1,99 @@
+package graph
+
+import (
+	"os"
+	"time"
+
+	. "github.com/sdcoffey/olympus/checkers"
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/graph/testutils"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *GraphTestSuite) TestReplaceContent_swapsBlocksAndKeepsVersion(t *C) {
+	file, err := suite.ng.NewNode("file", graph.RootNodeId, os.FileMode(0644))
+	t.Assert(err, IsNil)
+	old := testutils.RandDat(graph.BLOCK_SIZE + 10)
+	t.Assert(file.WriteData(old[:graph.BLOCK_SIZE], 0), IsNil)
+	t.Assert(file.WriteData(old[graph.BLOCK_SIZE:], graph.BLOCK_SIZE), IsNil)
+	oldTime := time.Now().Add(-time.Hour)
+	t.Assert(file.Touch(oldTime), IsNil)
+
+	replacement := append([]byte("\x89PNG\r\n\x1a\n"), testutils.RandDat(100)...)
+	_, err = graph.Write(graph.Hash(replacement), replacement)
+	t.Assert(err, IsNil)
+
+	version, err := file.ReplaceContent([]string{graph.Hash(replacement)}, time.Time{})
+	t.Assert(err, IsNil)
+	t.Check(version.Size, Equals, int64(len(old)))
+	t.Check(version.Blocks, HasLen, 2)
+
+	file = suite.ng.NodeWithId(file.Id)
+	t.Check(file.Blocks(), DeepEquals, []graph.BlockInfo{{Hash: graph.Hash(replacement), Offset: 0}})
+	t.Check(file.Size(), Equals, int64(len(replacement)))
+	t.Check(file.Type(), Equals, "image/png")
+	t.Check(file.MTime(), WithinNow, time.Second)
+
+	versions := file.Versions()
+	t.Assert(versions, HasLen, 1)
+	t.Check(versions[0].Id, Equals, version.Id)
+	t.Check(versions[0].MTime.Unix(), Equals, oldTime.Unix())
+	t.Check(versions[0].Blocks[1], Equals, graph.BlockInfo{Hash: graph.Hash(old[graph.BLOCK_SIZE:]), Offset: graph.BLOCK_SIZE})
+
+	report, err := suite.ng.Fsck(false)
+	t.Check(err, IsNil)
+	t.Check(report.Issues, HasLen, 0)
+}
+
+func (suite *GraphTestSuite) TestReplaceContent_dropsVersionsBeyondThoseKept(t *C) {
+	suite.ng.KeepVersions(2)
+	file, err := suite.ng.NewNode("file", graph.RootNodeId, os.FileMode(0644))
+	t.Assert(err, IsNil)
+	first := testutils.RandDat(100)
+	t.Assert(file.WriteData(first, 0), IsNil)
+
+	start := time.Now().Add(-time.Hour)
+	t.Assert(file.Touch(start), IsNil)
+	for i := 1; i <= 3; i++ {
+		dat := testutils.RandDat(100)
+		_, err = graph.Write(graph.Hash(dat), dat)
+		t.Assert(err, IsNil)
+		_, err = file.ReplaceContent([]string{graph.Hash(dat)}, start.Add(time.Duration(i)*time.Minute))
+		t.Assert(err, IsNil)
+	}
+
+	versions := suite.ng.NodeWithId(file.Id).Versions()
+	t.Assert(versions, HasLen, 2)
+	t.Check(versions[0].MTime.Unix(), Equals, start.Add(2*time.Minute).Unix())
+	t.Check(versions[1].MTime.Unix(), Equals, start.Add(time.Minute).Unix())
+	t.Check(graph.HasBlock(graph.Hash(first)), Equals, false)
+
+	report, err := suite.ng.Fsck(false)
+	t.Check(err, IsNil)
+	t.Check(report.Issues, HasLen, 0)
+}
+
+func (suite *GraphTestSuite) TestReplaceContent_throwsForMissingBlock(t *C) {
+	file, err := suite.ng.NewNode("file", graph.RootNodeId, os.FileMode(0644))
+	t.Assert(err, IsNil)
+	dat := testutils.RandDat(1024)
+	t.Assert(file.WriteData(dat, 0), IsNil)
+
+	_, err = file.ReplaceContent([]string{graph.Hash(testutils.RandDat(1024))}, time.Time{})
+	t.Check(os.IsNotExist(err), IsTrue)
+	t.Check(file.BlockWithOffset(0), Equals, graph.Hash(dat))
+	t.Check(file.Versions(), HasLen, 0)
+}
+
+func (suite *GraphTestSuite) TestRemoveNode_removesVersions(t *C) {
+	file, err := suite.ng.NewNode("file", graph.RootNodeId, os.FileMode(0644))
+	t.Assert(err, IsNil)
+	dat := testutils.RandDat(1024)
+	t.Assert(file.WriteData(dat, 0), IsNil)
+	_, err = file.ReplaceContent([]string{}, time.Time{})
+	t.Assert(err, IsNil)
+	t.Check(file.Size(), Equals, int64(0))
+
+	t.Assert(suite.ng.RemoveNode(file), IsNil)
+	t.Check(suite.ng.NodeWithId(file.Id).Versions(), HasLen, 0)
+}
@@ -0,0 +1,229 @@
+package graph
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cayleygraph/cayley"
+	"github.com/cayleygraph/cayley/graph"
+)
+
+const (
+	thumbnailPrefix      = "thumb-"
+	thumbnailSourceLink  = "hasThumbnailsOf"
+	maxThumbnailedSize   = 64 * MEGABYTE
+	maxThumbnailedPixels = 40 * 1000 * 1000
+	thumbnailJpegQuality = 85
+)
+
+// The longest edge, in pixels, of each thumbnail generated for an image. Images smaller than a size are
+// stored at their original dimensions rather than scaled up.
+var ThumbnailSizes = []int{64, 256, 512}
+
+var ErrNotAnImage = errors.New("Node is not a supported image")
+
+// Generation reads whole images into memory, so only one runs at a time
+var thumbnailLock sync.Mutex
+
+func IsThumbnailable(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	default:
+		return false
+	}
+}
+
+// Hash of a thumbnail of the given size. If the node's content has changed since thumbnails were last
+// generated, or they never were, they're generated first.
+func (nd *Node) Thumbnail(size int) (string, error) {
+	if !IsThumbnailSize(size) {
+		return "", fmt.Errorf("Thumbnail size must be one of %v", ThumbnailSizes)
+	} else if hash := nd.thumbnailHash(size); hash != "" && nd.thumbnailSource() == nd.contentFingerprint() {
+		return hash, nil
+	} else if err := nd.GenerateThumbnails(); err != nil {
+		return "", err
+	}
+
+	return nd.thumbnailHash(size), nil
+}
+
+// Decode this node's image content and store a thumbnail of it for each of ThumbnailSizes, replacing any
+// generated from earlier content. Thumbnails are stored as ordinary blocks, linked to the node by size.
+func (nd *Node) GenerateThumbnails() error {
+	thumbnailLock.Lock()
+	defer thumbnailLock.Unlock()
+
+	errorFmt := func(err error) error {
+		return fmt.Errorf("Error generating thumbnails: %s", err.Error())
+	}
+
+	fingerprint := nd.contentFingerprint()
+	if !IsThumbnailable(nd.Type()) {
+		return ErrNotAnImage
+	} else if nd.Size() > maxThumbnailedSize {
+		return errorFmt(errors.New("image is too large"))
+	} else if fingerprint == nd.thumbnailSource() {
+		return nil
+	}
+
+	dat := make([]byte, nd.Size())
+	if _, err := io.ReadFull(nd.ReadSeeker(), dat); err != nil {
+		return errorFmt(err)
+	}
+
+	// A small file can claim enormous dimensions, so they're checked before anything is decoded
+	if config, _, err := image.DecodeConfig(bytes.NewReader(dat)); err != nil {
+		return errorFmt(err)
+	} else if int64(config.Width)*int64(config.Height) > maxThumbnailedPixels {
+		return errorFmt(fmt.Errorf("image is too large (%dx%d)", config.Width, config.Height))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(dat))
+	if err != nil {
+		return errorFmt(err)
+	}
+
+	// Each size is scaled from the next largest, which is much cheaper than going back to the original
+	sizes := make([]int, len(ThumbnailSizes))
+	copy(sizes, ThumbnailSizes)
+	sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+
+	// Unused blocks aren't removed while the thumbnails are written and linked
+	nd.graph.blocks.RLock()
+	defer nd.graph.blocks.RUnlock()
+	transaction := graph.NewTransaction()
+	src := flatten(img)
+	for _, size := range sizes {
+		src = scaleToFit(src, size)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, src, &jpeg.Options{Quality: thumbnailJpegQuality}); err != nil {
+			return errorFmt(err)
+		}
+
+		hash := Hash(buf.Bytes())
+		if _, err := Write(hash, buf.Bytes()); err != nil {
+			return errorFmt(err)
+		}
+
+		linkName := fmt.Sprint(thumbnailPrefix, size)
+		if existing := nd.thumbnailHash(size); existing != "" {
+			transaction.RemoveQuad(cayley.Triple(nd.Id, linkName, existing))
+		}
+		transaction.AddQuad(cayley.Triple(nd.Id, linkName, hash))
+	}
+
+	if existing := nd.thumbnailSource(); existing != "" {
+		transaction.RemoveQuad(cayley.Triple(nd.Id, thumbnailSourceLink, existing))
+	}
+	transaction.AddQuad(cayley.Triple(nd.Id, thumbnailSourceLink, fingerprint))
+
+	if err := nd.graph.ApplyTransaction(transaction); err != nil {
+		return errorFmt(err)
+	}
+
+	return nil
+}
+
+func (nd *Node) thumbnailHash(size int) string {
+	if val := nd.graphValue(fmt.Sprint(thumbnailPrefix, size)); val != nil {
+		return val.(string)
+	}
+	return ""
+}
+
+func (nd *Node) thumbnailSource() string {
+	if val := nd.graphValue(thumbnailSourceLink); val != nil {
+		return val.(string)
+	}
+	return ""
+}
+
+// Identifies the node's current content, so thumbnails can tell when they're stale without rereading it
+func (nd *Node) contentFingerprint() string {
+	blocks := nd.Blocks()
+	hashes := make([]string, len(blocks))
+	for i, block := range blocks {
+		hashes[i] = fmt.Sprint(block.Offset, ":", block.Hash)
+	}
+
+	return Hash([]byte(strings.Join(hashes, ",")))
+}
+
+func IsThumbnailSize(size int) bool {
+	for _, s := range ThumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// Draw img over white, since thumbnails are stored as JPEGs and have no alpha channel
+func flatten(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.White, image.ZP, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, bounds.Min, draw.Over)
+	return flat
+}
+
+// Scale src so its longest edge is at most size, averaging the source pixels under each destination pixel
+func scaleToFit(src *image.RGBA, size int) *image.RGBA {
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+
+	if srcW <= size && srcH <= size {
+		return src
+	}
+
+	dstW, dstH := size, srcH*size/srcW
+	if srcH > srcW {
+		dstW, dstH = srcW*size/srcH, size
+	}
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, (y+1)*srcH/dstH
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, (x+1)*srcW/dstW
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, b, n int
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					i := src.PixOffset(sx, sy)
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), 0xff})
+		}
+	}
+
+	return dst
+}
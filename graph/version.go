@@ -0,0 +1,152 @@
+package graph
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cayleygraph/cayley"
+	"github.com/cayleygraph/cayley/graph"
+	"github.com/cayleygraph/cayley/graph/path"
+	"github.com/cayleygraph/cayley/quad"
+	"github.com/pborman/uuid"
+)
+
+const versionLink = "isVersionOf"
+
+// Content a file had before it was replaced. Each version is a node outside the tree, linked to its file,
+// holding the blocks and modified time the file had.
+type Version struct {
+	Id     string      `json:"id"`
+	MTime  time.Time   `json:"m_time"`
+	Size   int64       `json:"size"`
+	Blocks []BlockInfo `json:"blocks"`
+}
+
+// Earlier contents of this file, newest first
+func (nd *Node) Versions() []Version {
+	defer nd.graph.timeQuery("versions", time.Now())
+
+	it := path.StartPath(nd.graph, quad.String(nd.Id)).In(versionLink).BuildIterator()
+	versions := make([]Version, 0)
+	for it.Next() {
+		version := nd.graph.NodeWithId(quad.NativeOf(nd.graph.NameOf(it.Result())).(string))
+		versions = append(versions, Version{
+			Id:     version.Id,
+			MTime:  version.MTime(),
+			Size:   version.Size(),
+			Blocks: version.Blocks(),
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		if !versions[i].MTime.Equal(versions[j].MTime) {
+			return versions[i].MTime.After(versions[j].MTime)
+		}
+		return versions[i].Id < versions[j].Id
+	})
+	return versions
+}
+
+// Replace this file's content with the stored blocks hashes, in order, and set its modified time to mTime.
+// The blocks, modified time, and the type and metadata read from the first block are swapped in a single
+// transaction, so readers see either the old content or the new and never a mix; the old content is kept as
+// a version of the file, and the oldest versions beyond those the graph keeps are dropped, along with blocks
+// only they used. Returns os.ErrNotExist if any of the blocks isn't stored.
+func (nd *Node) ReplaceContent(hashes []string, mTime time.Time) (Version, error) {
+	if nd.IsDir() {
+		return Version{}, errors.New("Cannot write data to directory")
+	} else if mTime = mTime.UTC(); mTime.After(time.Now()) {
+		return Version{}, errors.New("Cannot set modified time in the future")
+	} else if mTime.IsZero() {
+		mTime = time.Now().UTC()
+	}
+
+	nd.graph.blocks.RLock()
+	firstBlock, err := statBlocks(hashes)
+	if err != nil {
+		nd.graph.blocks.RUnlock()
+		return Version{}, err
+	}
+
+	version := Version{Id: uuid.New(), MTime: nd.MTime(), Size: nd.Size(), Blocks: nd.Blocks()}
+	transaction := graph.NewTransaction()
+	transaction.AddQuad(cayley.Triple(version.Id, versionLink, nd.Id))
+	if !version.MTime.IsZero() {
+		transaction.AddQuad(cayley.Triple(version.Id, mTimeLink, version.MTime.Unix()))
+		if version.MTime.Unix() != mTime.Unix() {
+			transaction.RemoveQuad(cayley.Triple(nd.Id, mTimeLink, version.MTime.Unix()))
+			transaction.AddQuad(cayley.Triple(nd.Id, mTimeLink, mTime.Unix()))
+		}
+	} else {
+		transaction.AddQuad(cayley.Triple(nd.Id, mTimeLink, mTime.Unix()))
+	}
+
+	// Offsets whose block doesn't change keep their quad
+	existing := make(map[int64]string)
+	for _, block := range version.Blocks {
+		linkName := fmt.Sprint("offset-", block.Offset)
+		transaction.AddQuad(cayley.Triple(version.Id, linkName, block.Hash))
+		if i := int(block.Offset / BLOCK_SIZE); i >= len(hashes) || hashes[i] != block.Hash {
+			transaction.RemoveQuad(cayley.Triple(nd.Id, linkName, block.Hash))
+		}
+		existing[block.Offset] = block.Hash
+	}
+	for i, hash := range hashes {
+		if offset := int64(i) * BLOCK_SIZE; existing[offset] != hash {
+			transaction.AddQuad(cayley.Triple(nd.Id, fmt.Sprint("offset-", offset), hash))
+		}
+	}
+
+	// The new version counts towards those kept, so the oldest beyond it are dropped
+	var dropped []string
+	if keep := nd.graph.keepVersions; keep > 0 {
+		if versions := nd.Versions(); len(versions) >= keep {
+			for _, old := range versions[keep-1:] {
+				nd.removeVersion(transaction, old)
+				for _, block := range old.Blocks {
+					dropped = append(dropped, block.Hash)
+				}
+			}
+		}
+	}
+
+	var mimeType string
+	if firstBlock != nil {
+		mimeType = nd.inspect(transaction, firstBlock)
+	}
+
+	err = nd.graph.ApplyTransaction(transaction)
+	nd.graph.blocks.RUnlock()
+	if err != nil {
+		return Version{}, fmt.Errorf("Error replacing content: %s", err.Error())
+	}
+	nd.propCache[mTimeLink] = time.Unix(mTime.Unix(), 0)
+	if firstBlock != nil {
+		nd.propCache[typeLink] = mimeType
+	}
+	nd.record(ContentChanged)
+
+	if len(dropped) > 0 {
+		nd.graph.RemoveUnusedBlocks(dropped)
+	}
+	return version, nil
+}
+
+// Drop the quads of this file's versions, for when the file is removed
+func (nd *Node) removeVersions(transaction *graph.Transaction) {
+	for _, version := range nd.Versions() {
+		nd.removeVersion(transaction, version)
+	}
+}
+
+func (nd *Node) removeVersion(transaction *graph.Transaction, version Version) {
+	transaction.RemoveQuad(cayley.Triple(version.Id, versionLink, nd.Id))
+	if !version.MTime.IsZero() {
+		transaction.RemoveQuad(cayley.Triple(version.Id, mTimeLink, version.MTime.Unix()))
+	}
+	for _, block := range version.Blocks {
+		transaction.RemoveQuad(cayley.Triple(version.Id, fmt.Sprint("offset-", block.Offset), block.Hash))
+	}
+}
@@ -0,0 +1,120 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Writes entries to out as JSON, one per line
+type Logger struct {
+	sync.Mutex
+	out io.Writer
+}
+
+func NewLogger(out io.Writer) *Logger {
+	return &Logger{out: out}
+}
+
+func (logger *Logger) Log(entry interface{}) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	logger.Lock()
+	defer logger.Unlock()
+	_, err = logger.out.Write(append(line, '\n'))
+	return err
+}
+
+// A file that's rotated once it grows past maxBytes: it's renamed to path.1, path.1 to path.2 and so on,
+// keeping up to keep old files. Writes are never split across files.
+type RotatingFile struct {
+	sync.Mutex
+	path     string
+	maxBytes int64
+	keep     int
+	file     *os.File
+	size     int64
+}
+
+func OpenRotating(path string, maxBytes int64, keep int) (*RotatingFile, error) {
+	rotating := &RotatingFile{path: path, maxBytes: maxBytes, keep: keep}
+	if err := os.MkdirAll(filepath.Dir(path), 0744); err != nil {
+		return nil, fmt.Errorf("Error opening %s: %s", path, err.Error())
+	} else if err := rotating.open(); err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+func (rotating *RotatingFile) open() error {
+	if file, err := os.OpenFile(rotating.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return fmt.Errorf("Error opening %s: %s", rotating.path, err.Error())
+	} else if stat, err := file.Stat(); err != nil {
+		file.Close()
+		return fmt.Errorf("Error opening %s: %s", rotating.path, err.Error())
+	} else {
+		rotating.file = file
+		rotating.size = stat.Size()
+		return nil
+	}
+}
+
+func (rotating *RotatingFile) Write(p []byte) (int, error) {
+	rotating.Lock()
+	defer rotating.Unlock()
+
+	if rotating.file == nil {
+		return 0, os.ErrClosed
+	} else if rotating.maxBytes > 0 && rotating.size > 0 && rotating.size+int64(len(p)) > rotating.maxBytes {
+		if err := rotating.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rotating.file.Write(p)
+	rotating.size += int64(n)
+	return n, err
+}
+
+func (rotating *RotatingFile) rotate() error {
+	if err := rotating.file.Close(); err != nil {
+		return err
+	}
+	rotating.file = nil
+
+	if rotating.keep < 1 {
+		os.Remove(rotating.path)
+	} else {
+		os.Remove(rotating.backup(rotating.keep))
+		for i := rotating.keep - 1; i > 0; i-- {
+			os.Rename(rotating.backup(i), rotating.backup(i+1))
+		}
+		if err := os.Rename(rotating.path, rotating.backup(1)); err != nil {
+			return err
+		}
+	}
+
+	return rotating.open()
+}
+
+func (rotating *RotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", rotating.path, i)
+}
+
+func (rotating *RotatingFile) Close() error {
+	rotating.Lock()
+	defer rotating.Unlock()
+
+	if rotating.file == nil {
+		return nil
+	}
+	err := rotating.file.Close()
+	rotating.file = nil
+	return err
+}
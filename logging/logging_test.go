@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger_writesJsonLines(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := NewLogger(buf)
+
+	assert.NoError(t, logger.Log(map[string]interface{}{"status": 200}))
+	assert.NoError(t, logger.Log(struct {
+		Method string `json:"method"`
+	}{"GET"}))
+
+	assert.Equal(t, "{\"status\":200}\n{\"method\":\"GET\"}\n", buf.String())
+}
+
+func TestRotatingFile_rotatesAndKeepsBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "olympus-logging")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "logs", "access.log")
+	rotating, err := OpenRotating(path, 10, 2)
+	assert.NoError(t, err)
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccc\n", "dddd\n", "eeeeeeeeeeeeeeee\n"} {
+		n, err := rotating.Write([]byte(line))
+		assert.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+	assert.NoError(t, rotating.Close())
+
+	read := func(path string) string {
+		data, _ := ioutil.ReadFile(path)
+		return string(data)
+	}
+	assert.Equal(t, "eeeeeeeeeeeeeeee\n", read(path))
+	assert.Equal(t, "cccc\ndddd\n", read(path+".1"))
+	assert.Equal(t, "bbbbbbbb\n", read(path+".2"))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = rotating.Write([]byte("closed"))
+	assert.Error(t, err)
+}
+
+func TestRotatingFile_appendsToExistingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "olympus-logging")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "error.log")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("old\n"), 0644))
+
+	rotating, err := OpenRotating(path, 8, 1)
+	assert.NoError(t, err)
+	rotating.Write([]byte("new\n"))
+	rotating.Write([]byte("newer\n"))
+	rotating.Close()
+
+	data, _ := ioutil.ReadFile(path + ".1")
+	assert.Equal(t, "old\nnew\n", string(data))
+	data, _ = ioutil.ReadFile(path)
+	assert.True(t, strings.HasPrefix(string(data), "newer"))
+}
@@ -0,0 +1,189 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIfd          = 0x8769
+	tagGpsIfd           = 0x8825
+	tagDateTimeOriginal = 0x9003
+
+	tagGpsLatitudeRef  = 1
+	tagGpsLatitude     = 2
+	tagGpsLongitudeRef = 3
+	tagGpsLongitude    = 4
+
+	exifTimeLayout = "2006:01:02 15:04:05"
+)
+
+// Bytes per component of each TIFF field type
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+// Find the APP1 segment holding EXIF data among a JPEG's leading segments
+func parseJpeg(data []byte, md Metadata) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return
+	}
+
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xda || length < 2 { // Start of scan, image data follows
+			return
+		}
+
+		segment := data[i+4 : minInt(i+2+length, len(data))]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			parseTiff(segment[6:], md)
+			return
+		}
+		i += 2 + length
+	}
+}
+
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func parseTiff(data []byte, md Metadata) {
+	if len(data) < 8 {
+		return
+	}
+
+	t := tiff{data: data}
+	switch string(data[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	default:
+		return
+	}
+
+	ifd0 := t.readIfd(t.order.Uint32(data[4:]))
+	md.set(CameraMake, ifd0.ascii(tagMake))
+	md.set(CameraModel, ifd0.ascii(tagModel))
+	if orientation, ok := ifd0.uint(t, tagOrientation); ok {
+		md.set(Orientation, strconv.Itoa(int(orientation)))
+	}
+
+	captured := ifd0.ascii(tagDateTime)
+	if offset, ok := ifd0.uint(t, tagExifIfd); ok {
+		if original := t.readIfd(offset).ascii(tagDateTimeOriginal); original != "" {
+			captured = original
+		}
+	}
+	if when, err := time.Parse(exifTimeLayout, captured); err == nil {
+		md.setTime(when)
+	}
+
+	if offset, ok := ifd0.uint(t, tagGpsIfd); ok {
+		gps := t.readIfd(offset)
+		if lat, ok := gps.degrees(t, tagGpsLatitude, gps.ascii(tagGpsLatitudeRef) == "S"); ok {
+			md.set(Latitude, lat)
+		}
+		if lon, ok := gps.degrees(t, tagGpsLongitude, gps.ascii(tagGpsLongitudeRef) == "W"); ok {
+			md.set(Longitude, lon)
+		}
+	}
+}
+
+type ifd map[uint16]ifdEntry
+
+func (t tiff) readIfd(offset uint32) ifd {
+	entries := make(ifd)
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return entries
+	}
+
+	count := int(t.order.Uint16(t.data[offset:]))
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(t.data) {
+			break
+		}
+
+		raw := t.data[start : start+12]
+		entry := ifdEntry{typ: t.order.Uint16(raw[2:]), count: t.order.Uint32(raw[4:])}
+		size := uint64(tiffTypeSizes[entry.typ]) * uint64(entry.count)
+		if size <= 4 {
+			entry.value = raw[8 : 8+size]
+		} else if valueOffset := uint64(t.order.Uint32(raw[8:])); valueOffset+size <= uint64(len(t.data)) {
+			entry.value = t.data[valueOffset : valueOffset+size]
+		} else {
+			continue
+		}
+
+		entries[t.order.Uint16(raw)] = entry
+	}
+
+	return entries
+}
+
+func (entries ifd) ascii(tag uint16) string {
+	if entry, ok := entries[tag]; ok && entry.typ == 2 {
+		if i := bytes.IndexByte(entry.value, 0); i >= 0 {
+			return string(entry.value[:i])
+		}
+		return string(entry.value)
+	}
+	return ""
+}
+
+func (entries ifd) uint(t tiff, tag uint16) (uint32, bool) {
+	if entry, ok := entries[tag]; !ok || entry.count < 1 {
+		return 0, false
+	} else if entry.typ == 3 {
+		return uint32(t.order.Uint16(entry.value)), true
+	} else if entry.typ == 4 {
+		return t.order.Uint32(entry.value), true
+	}
+	return 0, false
+}
+
+// GPS coordinates are stored as three rationals: degrees, minutes and seconds
+func (entries ifd) degrees(t tiff, tag uint16, negative bool) (string, bool) {
+	entry, ok := entries[tag]
+	if !ok || entry.typ != 5 || entry.count < 3 {
+		return "", false
+	}
+
+	var parts [3]float64
+	for i := range parts {
+		num, denom := t.order.Uint32(entry.value[i*8:]), t.order.Uint32(entry.value[i*8+4:])
+		if denom == 0 {
+			return "", false
+		}
+		parts[i] = float64(num) / float64(denom)
+	}
+
+	degrees := parts[0] + parts[1]/60 + parts[2]/3600
+	if negative {
+		degrees = -degrees
+	}
+
+	return fmt.Sprintf("%.6f", degrees), true
+}
+
+func minInt(lhs, rhs int) int {
+	if lhs < rhs {
+		return lhs
+	}
+	return rhs
+}
@@ -0,0 +1,113 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unicode/utf16"
+)
+
+// ID3v2.2 uses three character frame ids, later versions four
+var id3Frames = map[string]string{
+	"TT2": Title, "TIT2": Title,
+	"TP1": Artist, "TPE1": Artist,
+	"TAL": Album, "TALB": Album,
+	"TYE": Year, "TYER": Year, "TDRC": Year,
+	"TRK": Track, "TRCK": Track,
+	"TCO": Genre, "TCON": Genre,
+}
+
+func parseId3(data []byte, md Metadata) {
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		return
+	}
+
+	version, flags := data[3], data[5]
+	end := minInt(10+int(syncsafe(data[6:10])), len(data))
+	pos := 10
+
+	if flags&0x40 > 0 && version > 2 { // Extended header
+		if pos+4 > end {
+			return
+		} else if version == 3 {
+			pos += 4 + int(binary.BigEndian.Uint32(data[pos:]))
+		} else {
+			pos += int(syncsafe(data[pos : pos+4]))
+		}
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+
+	for pos+headerLen <= end && data[pos] != 0 {
+		id := string(data[pos : pos+idLen])
+
+		var size int
+		switch version {
+		case 2:
+			size = int(data[pos+3])<<16 | int(data[pos+4])<<8 | int(data[pos+5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(data[pos+4:]))
+		default:
+			size = int(syncsafe(data[pos+4 : pos+8]))
+		}
+
+		start := pos + headerLen
+		if size < 0 || start+size > end {
+			return
+		}
+
+		if key, ok := id3Frames[id]; ok && size > 1 {
+			value := decodeId3Text(data[start], data[start+1:start+size])
+			if key == Year && len(value) > 4 {
+				value = value[:4]
+			}
+			md.set(key, value)
+		}
+		pos = start + size
+	}
+}
+
+// Sizes in ID3 headers use seven bits per byte, so they never contain a sync pattern
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+// Text frames start with an encoding byte: 0 is Latin-1, 1 is UTF-16 with a BOM, 2 is UTF-16BE, 3 is UTF-8.
+// Frames may hold several null separated values, of which only the first is kept.
+func decodeId3Text(encoding byte, text []byte) string {
+	switch encoding {
+	case 0:
+		if i := bytes.IndexByte(text, 0); i >= 0 {
+			text = text[:i]
+		}
+		runes := make([]rune, len(text))
+		for i, b := range text {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	case 1, 2:
+		var order binary.ByteOrder = binary.BigEndian
+		if len(text) >= 2 && text[0] == 0xff && text[1] == 0xfe {
+			order, text = binary.LittleEndian, text[2:]
+		} else if len(text) >= 2 && text[0] == 0xfe && text[1] == 0xff {
+			text = text[2:]
+		}
+
+		units := make([]uint16, 0, len(text)/2)
+		for i := 0; i+1 < len(text); i += 2 {
+			unit := order.Uint16(text[i:])
+			if unit == 0 {
+				break
+			}
+			units = append(units, unit)
+		}
+		return string(utf16.Decode(units))
+	default:
+		if i := bytes.IndexByte(text, 0); i >= 0 {
+			text = text[:i]
+		}
+		return string(text)
+	}
+}
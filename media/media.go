@@ -0,0 +1,121 @@
+package media
+
+import (
+	"encoding/xml"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metadata fields are stored as strings under these keys. Capture times are formatted with time.RFC3339;
+// EXIF doesn't record a time zone, so photo capture times are the camera's local time, marked as UTC.
+const (
+	CapturedAt  = "captured_at"
+	CameraMake  = "camera_make"
+	CameraModel = "camera_model"
+	Orientation = "orientation"
+	Latitude    = "latitude"
+	Longitude   = "longitude"
+	Title       = "title"
+	Artist      = "artist"
+	Album       = "album"
+	Year        = "year"
+	Track       = "track"
+	Genre       = "genre"
+)
+
+var Keys = []string{CapturedAt, CameraMake, CameraModel, Orientation, Latitude, Longitude, Title, Artist, Album, Year, Track, Genre}
+
+func IsKey(key string) bool {
+	for _, k := range Keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+type Metadata map[string]string
+
+// Parse whatever metadata can be found in the start of a file. Parsing is best effort: data is often only
+// the file's first block, so anything truncated or malformed is skipped rather than reported.
+func Extract(mimeType string, data []byte) Metadata {
+	md := make(Metadata)
+	switch mimeType {
+	case "image/jpeg":
+		parseJpeg(data, md)
+	case "image/tiff":
+		parseTiff(data, md)
+	case "audio/mpeg":
+		parseId3(data, md)
+	case "audio/flac":
+		parseFlac(data, md)
+	case "audio/ogg":
+		parseOgg(data, md)
+	case "audio/mp4", "video/mp4", "video/quicktime":
+		parseMp4(data, md, strings.HasPrefix(mimeType, "video/"))
+	}
+
+	return md
+}
+
+func (md Metadata) set(key, value string) {
+	if value = strings.TrimSpace(strings.Trim(value, "\x00")); value != "" {
+		md[key] = value
+	}
+}
+
+func (md Metadata) setTime(t time.Time) {
+	if !t.IsZero() {
+		md[CapturedAt] = t.UTC().Format(time.RFC3339)
+	}
+}
+
+func (md Metadata) CapturedAt() (time.Time, bool) {
+	if val, ok := md[CapturedAt]; !ok {
+		return time.Time{}, false
+	} else if t, err := time.Parse(time.RFC3339, val); err != nil {
+		return time.Time{}, false
+	} else {
+		return t, true
+	}
+}
+
+type xmlField struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// encoding/xml can't encode maps, so fields are written as <field key="...">value</field>
+func (md Metadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	keys := make([]string, 0, len(md))
+	for key := range md {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([]xmlField, len(keys))
+	for i, key := range keys {
+		fields[i] = xmlField{key, md[key]}
+	}
+
+	return e.EncodeElement(struct {
+		Fields []xmlField `xml:"field"`
+	}{fields}, start)
+}
+
+func (md *Metadata) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var fields struct {
+		Fields []xmlField `xml:"field"`
+	}
+	if err := d.DecodeElement(&fields, &start); err != nil {
+		return err
+	}
+
+	*md = make(Metadata)
+	for _, field := range fields.Fields {
+		(*md)[field.Key] = field.Value
+	}
+
+	return nil
+}
@@ -0,0 +1,265 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type tiffField struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// Little endian TIFF with IFD0 holding the given fields, and an EXIF and GPS IFD if given. Values longer
+// than four bytes are placed after all three IFDs.
+func buildTiff(ifd0, exif, gps []tiffField) []byte {
+	ifdSize := func(fields []tiffField) int { return 2 + 12*len(fields) + 4 }
+
+	exifOffset := 8 + ifdSize(ifd0) + 24 // room for the two pointer fields
+	gpsOffset := exifOffset + ifdSize(exif)
+	dataOffset := gpsOffset + ifdSize(gps)
+
+	if len(exif) > 0 {
+		ifd0 = append(ifd0, tiffField{tagExifIfd, 4, 1, le32(uint32(exifOffset))})
+	}
+	if len(gps) > 0 {
+		ifd0 = append(ifd0, tiffField{tagGpsIfd, 4, 1, le32(uint32(gpsOffset))})
+	}
+
+	var head, tail bytes.Buffer
+	head.WriteString("II*\x00")
+	head.Write(le32(8))
+
+	writeIfd := func(fields []tiffField, at int) {
+		for head.Len() < at {
+			head.WriteByte(0)
+		}
+		binary.Write(&head, binary.LittleEndian, uint16(len(fields)))
+		for _, f := range fields {
+			binary.Write(&head, binary.LittleEndian, f.tag)
+			binary.Write(&head, binary.LittleEndian, f.typ)
+			binary.Write(&head, binary.LittleEndian, f.count)
+			if len(f.value) <= 4 {
+				head.Write(append(f.value, make([]byte, 4-len(f.value))...))
+			} else {
+				head.Write(le32(uint32(dataOffset + tail.Len())))
+				tail.Write(f.value)
+			}
+		}
+		head.Write(le32(0))
+	}
+
+	writeIfd(ifd0, 8)
+	writeIfd(exif, exifOffset)
+	writeIfd(gps, gpsOffset)
+	for head.Len() < dataOffset {
+		head.WriteByte(0)
+	}
+
+	return append(head.Bytes(), tail.Bytes()...)
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func le16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func rationals(values ...uint32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = append(b, le32(v)...)
+		b = append(b, le32(1)...)
+	}
+	return b
+}
+
+func ascii(s string) tiffField {
+	return tiffField{value: append([]byte(s), 0), typ: 2, count: uint32(len(s) + 1)}
+}
+
+func withTag(tag uint16, f tiffField) tiffField {
+	f.tag = tag
+	return f
+}
+
+func TestExtract_readsExifFromJpeg(t *testing.T) {
+	exif := buildTiff(
+		[]tiffField{
+			withTag(tagMake, ascii("Canon")),
+			withTag(tagModel, ascii("EOS 5D")),
+			{tagOrientation, 3, 1, le16(6)},
+		},
+		[]tiffField{withTag(tagDateTimeOriginal, ascii("2016:03:14 15:09:26"))},
+		[]tiffField{
+			withTag(tagGpsLatitudeRef, ascii("N")),
+			{tagGpsLatitude, 5, 3, rationals(37, 30, 0)},
+			withTag(tagGpsLongitudeRef, ascii("W")),
+			{tagGpsLongitude, 5, 3, rationals(122, 15, 0)},
+		},
+	)
+
+	segment := append([]byte("Exif\x00\x00"), exif...)
+	jpeg := []byte{0xff, 0xd8, 0xff, 0xe1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}
+	jpeg = append(jpeg, segment...)
+	jpeg = append(jpeg, 0xff, 0xda, 0x00, 0x02)
+
+	md := Extract("image/jpeg", jpeg)
+	assert.Equal(t, "Canon", md[CameraMake])
+	assert.Equal(t, "EOS 5D", md[CameraModel])
+	assert.Equal(t, "6", md[Orientation])
+	assert.Equal(t, "2016-03-14T15:09:26Z", md[CapturedAt])
+	assert.Equal(t, "37.500000", md[Latitude])
+	assert.Equal(t, "-122.250000", md[Longitude])
+}
+
+func TestExtract_toleratesTruncatedExif(t *testing.T) {
+	exif := buildTiff([]tiffField{withTag(tagMake, ascii("A camera with a long name"))}, nil, nil)
+	md := Extract("image/tiff", exif[:len(exif)-10])
+	assert.Equal(t, 0, len(md))
+}
+
+func TestExtract_readsId3v24(t *testing.T) {
+	frame := func(id, text string) []byte {
+		body := append([]byte{3}, text...)
+		header := append([]byte(id), 0, 0, 0, byte(len(body)), 0, 0)
+		return append(header, body...)
+	}
+
+	var frames []byte
+	frames = append(frames, frame("TIT2", "Song")...)
+	frames = append(frames, frame("TPE1", "Band")...)
+	frames = append(frames, frame("TDRC", "1999-05-01")...)
+	frames = append(frames, frame("TRCK", "7/12")...)
+
+	id3 := append([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, byte(len(frames))}, frames...)
+	md := Extract("audio/mpeg", id3)
+	assert.Equal(t, "Song", md[Title])
+	assert.Equal(t, "Band", md[Artist])
+	assert.Equal(t, "1999", md[Year])
+	assert.Equal(t, "7/12", md[Track])
+}
+
+func TestDecodeId3Text_decodesUtf16(t *testing.T) {
+	assert.Equal(t, "Hé", decodeId3Text(1, []byte{0xff, 0xfe, 'H', 0, 0xe9, 0, 0, 0}))
+	assert.Equal(t, "Hé", decodeId3Text(0, []byte{'H', 0xe9}))
+}
+
+func vorbisComment(comments ...string) []byte {
+	b := append(le32(6), "vendor"...)
+	b = append(b, le32(uint32(len(comments)))...)
+	for _, c := range comments {
+		b = append(b, le32(uint32(len(c)))...)
+		b = append(b, c...)
+	}
+	return b
+}
+
+func TestExtract_readsFlacVorbisComment(t *testing.T) {
+	comment := vorbisComment("TITLE=Tune", "artist=Someone", "DATE=2001-02-03")
+	flac := append([]byte("fLaC"), 0x00, 0, 0, 34)
+	flac = append(flac, make([]byte, 34)...)
+	flac = append(flac, 0x84, byte(len(comment)>>16), byte(len(comment)>>8), byte(len(comment)))
+	flac = append(flac, comment...)
+
+	md := Extract("audio/flac", flac)
+	assert.Equal(t, "Tune", md[Title])
+	assert.Equal(t, "Someone", md[Artist])
+	assert.Equal(t, "2001", md[Year])
+}
+
+func TestExtract_readsOggVorbisComment(t *testing.T) {
+	ogg := append([]byte("OggS\x00\x02"), make([]byte, 30)...)
+	ogg = append(ogg, "\x03vorbis"...)
+	ogg = append(ogg, vorbisComment("ALBUM=Record", "GENRE=Jazz")...)
+
+	md := Extract("audio/ogg", ogg)
+	assert.Equal(t, "Record", md[Album])
+	assert.Equal(t, "Jazz", md[Genre])
+}
+
+func mp4Atom(kind string, body ...[]byte) []byte {
+	joined := bytes.Join(body, nil)
+	b := make([]byte, 8, 8+len(joined))
+	binary.BigEndian.PutUint32(b, uint32(8+len(joined)))
+	copy(b[4:], kind)
+	return append(b, joined...)
+}
+
+func TestExtract_readsMp4Tags(t *testing.T) {
+	data := func(value []byte) []byte {
+		return mp4Atom("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, value)
+	}
+
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[4:], 3541104000) // 2016-03-18 in seconds since 1904
+
+	mp4 := append(mp4Atom("ftyp", []byte("isom")),
+		mp4Atom("moov",
+			mp4Atom("mvhd", mvhd),
+			mp4Atom("udta",
+				mp4Atom("meta", []byte{0, 0, 0, 0},
+					mp4Atom("ilst",
+						mp4Atom("\xa9nam", data([]byte("Clip"))),
+						mp4Atom("trkn", data([]byte{0, 0, 0, 3, 0, 10, 0, 0})),
+					),
+				),
+			),
+		)...)
+
+	md := Extract("video/mp4", mp4)
+	assert.Equal(t, "Clip", md[Title])
+	assert.Equal(t, "3", md[Track])
+	assert.Equal(t, "2016-03-18T00:00:00Z", md[CapturedAt])
+
+	md = Extract("audio/mp4", mp4)
+	assert.Equal(t, "", md[CapturedAt])
+}
+
+func TestExtract_toleratesMp4AtomSizesPastTheEnd(t *testing.T) {
+	// An extended size big enough to wrap around when added to the atom's offset
+	huge := make([]byte, 16)
+	binary.BigEndian.PutUint32(huge, 1)
+	copy(huge[4:], "free")
+	binary.BigEndian.PutUint64(huge[8:], 1<<64-8)
+
+	mp4 := append(mp4Atom("ftyp", []byte("isom")), mp4Atom("moov", mp4Atom("mvhd", make([]byte, 100)), huge)...)
+	assert.Equal(t, 0, len(Extract("video/mp4", mp4)))
+
+	// An atom that runs past the end is read as far as the data goes
+	truncated := mp4Atom("moov", mp4Atom("udta", mp4Atom("meta", []byte{0, 0, 0, 0},
+		mp4Atom("ilst", mp4Atom("\xa9nam", mp4Atom("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte("Clip")))))))
+	binary.BigEndian.PutUint32(truncated, uint32(len(truncated)+1000))
+	md := Extract("audio/mp4", append(mp4Atom("ftyp", []byte("isom")), truncated...))
+	assert.Equal(t, "Clip", md[Title])
+}
+
+func TestExtract_returnsEmptyForUnknownTypes(t *testing.T) {
+	assert.Equal(t, 0, len(Extract("text/plain", []byte("ID3 but not really"))))
+}
+
+type tagged struct {
+	Metadata Metadata `xml:"metadata"`
+}
+
+func TestMetadata_roundTripsThroughXml(t *testing.T) {
+	md := Metadata{Title: "Song", Artist: "Band"}
+	dat, err := xml.Marshal(tagged{md})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `<tagged><metadata><field key="artist">Band</field><field key="title">Song</field></metadata></tagged>`, string(dat))
+
+	var decoded tagged
+	assert.Equal(t, nil, xml.Unmarshal(dat, &decoded))
+	assert.Equal(t, md, decoded.Metadata)
+}
@@ -0,0 +1,119 @@
+package media
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+)
+
+// iTunes style tags, found at moov/udta/meta/ilst
+var mp4Tags = map[string]string{
+	"\xa9nam": Title,
+	"\xa9ART": Artist,
+	"\xa9alb": Album,
+	"\xa9day": Year,
+	"\xa9gen": Genre,
+	"trkn":    Track,
+}
+
+// MP4 timestamps count seconds from 1904
+var mp4Epoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type atom struct {
+	kind string
+	body []byte
+}
+
+// Split data into the atoms it contains. An atom running past the end of data is cut short, since only the
+// start of a file may be available.
+func atoms(data []byte) []atom {
+	var result []atom
+	for pos := 0; pos+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[pos:]))
+		kind := string(data[pos+4 : pos+8])
+		header := uint64(8)
+
+		if size == 1 && pos+16 <= len(data) {
+			size, header = binary.BigEndian.Uint64(data[pos+8:]), 16
+		} else if size == 0 {
+			size = uint64(len(data) - pos)
+		}
+		if size < header {
+			break
+		}
+
+		// Compared with what's left rather than added to pos, since a 64-bit size can overflow the sum
+		end := len(data)
+		if size < uint64(len(data)-pos) {
+			end = pos + int(size)
+		}
+		result = append(result, atom{kind, data[pos+int(header) : end]})
+		pos = end
+	}
+
+	return result
+}
+
+func child(data []byte, kind string) []byte {
+	for _, a := range atoms(data) {
+		if a.kind == kind {
+			return a.body
+		}
+	}
+	return nil
+}
+
+// Metadata lives in the moov atom, which encoders usually write at the end of a file unless it's been
+// optimized for streaming; files laid out that way yield nothing from their first block.
+func parseMp4(data []byte, md Metadata, video bool) {
+	if len(data) < 8 || string(data[4:8]) != "ftyp" {
+		return
+	}
+
+	moov := child(data, "moov")
+	if moov == nil {
+		return
+	}
+
+	if mvhd := child(moov, "mvhd"); video && len(mvhd) >= 12 {
+		var created uint64
+		if mvhd[0] == 1 {
+			created = binary.BigEndian.Uint64(mvhd[4:])
+		} else {
+			created = uint64(binary.BigEndian.Uint32(mvhd[4:]))
+		}
+		if created > 0 && created < 1<<33 {
+			md.setTime(mp4Epoch.Add(time.Duration(created) * time.Second))
+		}
+	}
+
+	// meta is a full box, with four bytes of version and flags before its children
+	meta := child(child(moov, "udta"), "meta")
+	if len(meta) < 4 {
+		return
+	}
+
+	for _, item := range atoms(child(meta[4:], "ilst")) {
+		key, ok := mp4Tags[item.kind]
+		if !ok {
+			continue
+		}
+
+		// Values are in a data atom: four bytes of type, four of locale, then the value
+		value := child(item.body, "data")
+		if len(value) < 8 {
+			continue
+		}
+		value = value[8:]
+
+		if key == Track {
+			if len(value) >= 4 && binary.BigEndian.Uint16(value[2:]) > 0 {
+				md.set(key, strconv.Itoa(int(binary.BigEndian.Uint16(value[2:]))))
+			}
+		} else if key == Year && len(value) > 4 {
+			md.set(key, string(value[:4]))
+		} else {
+			md.set(key, string(value))
+		}
+	}
+}
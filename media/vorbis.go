@@ -0,0 +1,94 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+var vorbisFields = map[string]string{
+	"TITLE":       Title,
+	"ARTIST":      Artist,
+	"ALBUM":       Album,
+	"DATE":        Year,
+	"TRACKNUMBER": Track,
+	"GENRE":       Genre,
+}
+
+const flacVorbisComment = 4
+
+// FLAC metadata blocks follow the stream marker, each with a one byte type and a three byte length
+func parseFlac(data []byte, md Metadata) {
+	if !bytes.HasPrefix(data, []byte("fLaC")) {
+		return
+	}
+
+	for pos := 4; pos+4 <= len(data); {
+		last, blockType := data[pos]&0x80 > 0, data[pos]&0x7f
+		length := int(data[pos+1])<<16 | int(data[pos+2])<<8 | int(data[pos+3])
+		start := pos + 4
+
+		if blockType == flacVorbisComment {
+			parseVorbisComment(data[start:minInt(start+length, len(data))], md)
+			return
+		} else if last {
+			return
+		}
+		pos = start + length
+	}
+}
+
+// The comment header of an Ogg Vorbis or Opus stream is normally the first packet of the second page, so
+// rather than reassembling pages it's found by its signature.
+func parseOgg(data []byte, md Metadata) {
+	if !bytes.HasPrefix(data, []byte("OggS")) {
+		return
+	}
+
+	for _, signature := range []string{"\x03vorbis", "OpusTags"} {
+		if i := bytes.Index(data, []byte(signature)); i >= 0 {
+			parseVorbisComment(data[i+len(signature):], md)
+			return
+		}
+	}
+}
+
+// A vendor string, then a count of KEY=value comments, each prefixed with its little endian length
+func parseVorbisComment(data []byte, md Metadata) {
+	readString := func(pos int) (string, int, bool) {
+		if pos+4 > len(data) {
+			return "", pos, false
+		}
+		length := int(binary.LittleEndian.Uint32(data[pos:]))
+		if length < 0 || pos+4+length > len(data) {
+			return "", pos, false
+		}
+		return string(data[pos+4 : pos+4+length]), pos + 4 + length, true
+	}
+
+	_, pos, ok := readString(0)
+	if !ok || pos+4 > len(data) {
+		return
+	}
+
+	count := int(binary.LittleEndian.Uint32(data[pos:]))
+	pos += 4
+	for i := 0; i < count; i++ {
+		var comment string
+		if comment, pos, ok = readString(pos); !ok {
+			return
+		}
+
+		if eq := strings.IndexByte(comment, '='); eq > 0 {
+			if key, ok := vorbisFields[strings.ToUpper(comment[:eq])]; ok {
+				value := comment[eq+1:]
+				if key == Year && len(value) > 4 {
+					value = value[:4]
+				}
+				if _, exists := md[key]; !exists {
+					md.set(key, value)
+				}
+			}
+		}
+	}
+}
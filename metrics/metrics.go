@@ -0,0 +1,233 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Content type of the text exposition format Prometheus scrapes
+const ContentType = "text/plain; version=0.0.4"
+
+// Buckets for latencies in seconds, from 1ms to 10s
+var LatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	counterKind   = "counter"
+	gaugeKind     = "gauge"
+	histogramKind = "histogram"
+)
+
+// A set of metrics, written together in the Prometheus text format
+type Registry struct {
+	sync.Mutex
+	families []*family
+}
+
+// A value of a metric read when the registry is written, for the label values given
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type family struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+	series           map[string]*series
+	collect          func() []Sample
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+func (registry *Registry) add(f *family) *family {
+	registry.Lock()
+	defer registry.Unlock()
+
+	for _, existing := range registry.families {
+		if existing.name == f.name {
+			panic(fmt.Sprintf("Metric %s registered twice", f.name))
+		}
+	}
+	f.series = make(map[string]*series)
+	registry.families = append(registry.families, f)
+	return f
+}
+
+// A count that only goes up, broken down by labels
+type Counter struct {
+	registry *Registry
+	family   *family
+}
+
+func (registry *Registry) Counter(name, help string, labels ...string) Counter {
+	return Counter{registry, registry.add(&family{name: name, help: help, kind: counterKind, labels: labels})}
+}
+
+func (counter Counter) Add(value float64, labelValues ...string) {
+	counter.registry.Lock()
+	defer counter.registry.Unlock()
+	counter.family.get(labelValues).value += value
+}
+
+func (counter Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Observations counted into buckets, broken down by labels
+type Histogram struct {
+	registry *Registry
+	family   *family
+}
+
+func (registry *Registry) Histogram(name, help string, buckets []float64, labels ...string) Histogram {
+	return Histogram{registry, registry.add(&family{name: name, help: help, kind: histogramKind, labels: labels, buckets: buckets})}
+}
+
+func (histogram Histogram) Observe(value float64, labelValues ...string) {
+	histogram.registry.Lock()
+	defer histogram.registry.Unlock()
+
+	s := histogram.family.get(labelValues)
+	for i, bound := range histogram.family.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// A gauge whose samples are read from collect each time the registry is written
+func (registry *Registry) GaugeFunc(name, help string, labels []string, collect func() []Sample) {
+	registry.add(&family{name: name, help: help, kind: gaugeKind, labels: labels, collect: collect})
+}
+
+// A counter whose samples are read from collect each time the registry is written
+func (registry *Registry) CounterFunc(name, help string, labels []string, collect func() []Sample) {
+	registry.add(&family{name: name, help: help, kind: counterKind, labels: labels, collect: collect})
+}
+
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("Metric %s has labels %v, got values %v", f.name, f.labels, labelValues))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...), counts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Write every metric in the text format, series sorted by label values
+func (registry *Registry) WriteTo(w io.Writer) (int64, error) {
+	registry.Lock()
+	families := make([]*family, len(registry.families))
+	copy(families, registry.families)
+	registry.Unlock()
+
+	counter := &countingWriter{w: w}
+	buf := bufio.NewWriter(counter)
+	for _, f := range families {
+		fmt.Fprintf(buf, "# HELP %s %s\n", f.name, strings.Replace(f.help, "\n", " ", -1))
+		fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.kind)
+
+		if f.collect != nil {
+			for _, sample := range f.collect() {
+				fmt.Fprintf(buf, "%s%s %s\n", f.name, labelString(f.labels, sample.LabelValues), formatValue(sample.Value))
+			}
+			continue
+		}
+
+		registry.Lock()
+		for _, s := range f.sorted() {
+			if f.kind != histogramKind {
+				fmt.Fprintf(buf, "%s%s %s\n", f.name, labelString(f.labels, s.labelValues), formatValue(s.value))
+				continue
+			}
+
+			labels := append(append([]string{}, f.labels...), "le")
+			for i, bound := range f.buckets {
+				values := append(append([]string{}, s.labelValues...), formatValue(bound))
+				fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, labelString(labels, values), s.counts[i])
+			}
+			values := append(append([]string{}, s.labelValues...), "+Inf")
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, labelString(labels, values), s.count)
+			fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, labelString(f.labels, s.labelValues), formatValue(s.value))
+			fmt.Fprintf(buf, "%s_count%s %d\n", f.name, labelString(f.labels, s.labelValues), s.count)
+		}
+		registry.Unlock()
+	}
+
+	err := buf.Flush()
+	return counter.n, err
+}
+
+func (f *family) sorted() []*series {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sorted := make([]*series, len(keys))
+	for i, key := range keys {
+		sorted[i] = f.series[key]
+	}
+	return sorted
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelString(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		var value string
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf(`%s="%s"`, label, labelEscaper.Replace(value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	} else if math.IsInf(value, -1) {
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (counter *countingWriter) Write(p []byte) (int, error) {
+	n, err := counter.w.Write(p)
+	counter.n += int64(n)
+	return n, err
+}
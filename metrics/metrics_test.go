@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_writesTextFormat(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.Counter("requests_total", "Requests served", "route", "code")
+	latency := registry.Histogram("latency_seconds", "Request latency", []float64{0.1, 1}, "route")
+	registry.GaugeFunc("nodes", "Nodes in the graph", nil, func() []Sample {
+		return []Sample{{Value: 42}}
+	})
+
+	requests.Inc("/b", "200")
+	requests.Inc("/a", "404")
+	requests.Add(2, "/b", "200")
+	latency.Observe(0.05, `/a"quoted"`)
+	latency.Observe(0.5, `/a"quoted"`)
+	latency.Observe(5, `/a"quoted"`)
+
+	buf := new(bytes.Buffer)
+	n, err := registry.WriteTo(buf)
+	assert.NoError(t, err)
+	assert.EqualValues(t, buf.Len(), n)
+
+	assert.Equal(t, `# HELP requests_total Requests served
+# TYPE requests_total counter
+requests_total{route="/a",code="404"} 1
+requests_total{route="/b",code="200"} 3
+# HELP latency_seconds Request latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a\"quoted\"",le="0.1"} 1
+latency_seconds_bucket{route="/a\"quoted\"",le="1"} 2
+latency_seconds_bucket{route="/a\"quoted\"",le="+Inf"} 3
+latency_seconds_sum{route="/a\"quoted\""} 5.55
+latency_seconds_count{route="/a\"quoted\""} 3
+# HELP nodes Nodes in the graph
+# TYPE nodes gauge
+nodes 42
+`, buf.String())
+}
+
+func TestRegistry_rejectsDuplicatesAndWrongLabels(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.Counter("requests_total", "Requests served", "route")
+
+	assert.Panics(t, func() { registry.Counter("requests_total", "Again") })
+	assert.Panics(t, func() { counter.Inc() })
+	assert.Panics(t, func() { counter.Inc("/a", "extra") })
+}
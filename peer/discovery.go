@@ -1,7 +1,9 @@
 package peer
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"net"
 	"time"
 
@@ -13,11 +15,30 @@ const (
 	maxSize = graph.KILOBYTE
 )
 
-func FindServer(timeout time.Duration) (net.IP, error) {
+// What a server broadcasts about itself. Fingerprint is the SHA-256 fingerprint of its certificate when
+// Scheme is https, so clients can pin it.
+type Announcement struct {
+	Scheme      string `json:"scheme"`
+	Port        int    `json:"port"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// A server found on the local network
+type Server struct {
+	IP net.IP
+	Announcement
+}
+
+// Base url of the server's api
+func (server Server) Address() string {
+	return fmt.Sprintf("%s://%s", server.Scheme, net.JoinHostPort(server.IP.String(), fmt.Sprint(server.Port)))
+}
+
+func FindServer(timeout time.Duration) (Server, error) {
 	if addr, err := net.ResolveUDPAddr("udp4", address); err != nil {
-		return net.IPv4zero, err
+		return Server{}, err
 	} else if socket, err := net.ListenMulticastUDP("udp4", nil, addr); err != nil {
-		return net.IPv4zero, err
+		return Server{}, err
 	} else {
 		defer socket.Close()
 		socket.SetReadDeadline(time.Now().Add(timeout))
@@ -25,26 +46,47 @@ func FindServer(timeout time.Duration) (net.IP, error) {
 		for {
 			socket.SetReadBuffer(maxSize)
 			b := make([]byte, maxSize)
-			if _, src, err := socket.ReadFromUDP(b); err != nil {
-				return net.IPv4zero, err
+			if n, src, err := socket.ReadFromUDP(b); err != nil {
+				return Server{}, err
 			} else {
-				return src.IP, nil
+				return Server{IP: src.IP, Announcement: parseAnnouncement(b[:n])}, nil
 			}
 		}
 	}
 }
 
-func ClientHeartbeat() {
+// Servers from before announcements were added just send "!", and only serve plain http on 3000
+func parseAnnouncement(b []byte) Announcement {
+	announcement := Announcement{Scheme: "http", Port: 3000}
+	json.Unmarshal(b, &announcement)
+	return announcement
+}
+
+// Announce the server on the local network every interval, until the returned func is called
+func StartHeartbeat(announcement Announcement, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go heartbeat(announcement, interval, done)
+	return func() { close(done) }
+}
+
+func heartbeat(announcement Announcement, interval time.Duration, done chan struct{}) {
+	message, _ := json.Marshal(announcement)
 	if addr, err := net.ResolveUDPAddr("udp4", address); err != nil {
-		fmt.Println(err.Error())
+		log.Println(err.Error())
 	} else if connection, err := net.DialUDP("udp4", nil, addr); err != nil {
-		fmt.Println(err.Error())
+		log.Println(err.Error())
 	} else {
-		ticker := time.Tick(time.Second) // todo config
+		defer connection.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 		for {
-			<-ticker
-			if _, err := connection.Write([]byte("!")); err != nil {
-				fmt.Println(err.Error())
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := connection.Write(message); err != nil {
+					log.Println(err.Error())
+				}
 			}
 		}
 	}
@@ -1,18 +1,31 @@
 package api
 
 import (
+	"bytes"
 	"encoding/gob"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/sdcoffey/olympus/env"
+	"github.com/sdcoffey/olympus/auth"
 	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/logging"
+	"github.com/sdcoffey/olympus/media"
+	"github.com/sdcoffey/olympus/share"
+	"github.com/sdcoffey/olympus/upload"
+	"github.com/sdcoffey/olympus/webhook"
 )
 
 type Encoder interface {
@@ -25,26 +38,113 @@ type Decoder interface {
 
 type OlympusApi struct {
 	http.Handler
-	graph *graph.NodeGraph
+	graph     *graph.NodeGraph
+	webhooks  *webhook.Dispatcher
+	users     *auth.Store
+	shares    *share.Store
+	uploads   *upload.Store
+	accessLog *logging.Logger
+	errorLog  *logging.Logger
+	metrics   *apiMetrics
+	readiness *readiness
+	// Work started by requests that outlives them
+	background *background
+
+	minFreeBytes   int64
+	ingestRoot     string
+	trustedProxies []*net.IPNet
 }
 
-func NewApi(ng *graph.NodeGraph) OlympusApi {
+// Configures optional parts of the api
+type Option func(*OlympusApi)
+
+// Serve webhook management endpoints backed by dispatcher; without this they respond 503
+func WithWebhooks(dispatcher *webhook.Dispatcher) Option {
+	return func(restApi *OlympusApi) {
+		restApi.webhooks = dispatcher
+	}
+}
+
+func NewApi(ng *graph.NodeGraph, options ...Option) OlympusApi {
 	r := mux.NewRouter()
 	v1Router := r.PathPrefix("/v1").Subrouter()
 
-	restApi := OlympusApi{r, ng}
-
-	v1Router.HandleFunc(ListNodes.Template(), restApi.ListNodes).Methods(ListNodes.Verb)
-	v1Router.HandleFunc(ListBlocks.Template(), restApi.Blocks).Methods(ListBlocks.Verb)
-	v1Router.HandleFunc(WriteBlock.Template(), restApi.WriteBlock).Methods(WriteBlock.Verb)
-	v1Router.HandleFunc(RemoveNode.Template(), restApi.RemoveNode).Methods(RemoveNode.Verb)
-	v1Router.HandleFunc(CreateNode.Template(), restApi.CreateNode).Methods(CreateNode.Verb)
-	v1Router.HandleFunc(UpdateNode.Template(), restApi.UpdateNode).Methods(UpdateNode.Verb)
-	v1Router.HandleFunc(ReadBlock.Template(), restApi.ReadBlock).Methods(ReadBlock.Verb)
-	v1Router.HandleFunc(DownloadNode.Template(), restApi.DownloadFile).Methods(ReadBlock.Verb)
+	restApi := OlympusApi{Handler: r, graph: ng, readiness: new(readiness), background: newBackground()}
+	for _, option := range options {
+		option(&restApi)
+	}
+	route := func(endpoint Endpoint, handler http.HandlerFunc) {
+		v1Router.HandleFunc(endpoint.Template(), routed(endpoint, handler)).Methods(endpoint.Verb)
+	}
 
-	blockServer := http.FileServer(http.Dir(env.EnvPath(env.DataPath)))
-	r.Handle("/block/{blockId}", http.StripPrefix("/block/", blockServer))
+	route(ListNodes, restApi.ListNodes)
+	route(ListBlocks, restApi.Blocks)
+	route(WriteBlock, restApi.WriteBlock)
+	route(RemoveNode, restApi.RemoveNode)
+	route(CreateNode, restApi.CreateNode)
+	route(UpdateNode, restApi.UpdateNode)
+	route(ReadBlock, restApi.ReadBlock)
+	route(LinkBlock, restApi.LinkBlock)
+	route(MissingBlocks, restApi.MissingBlocks)
+	route(DownloadNode, restApi.DownloadFile)
+	route(Replication, restApi.Replication)
+	route(Repair, restApi.Repair)
+	route(ExportNode, restApi.ExportNode)
+	route(ImportNode, restApi.ImportNode)
+	route(IngestPath, restApi.IngestPath)
+	route(Thumbnail, restApi.Thumbnail)
+	route(ExtendedInfo, restApi.ExtendedInfo)
+	route(Search, restApi.Search)
+	route(PathInfo, restApi.PathInfo)
+	route(CreatePath, restApi.CreatePath)
+	route(RemovePath, restApi.RemovePath)
+	route(Changes, restApi.Changes)
+	route(Events, restApi.Events)
+	route(ServerInfo, restApi.ServerInfo)
+	route(ListUploads, restApi.ListUploads)
+	route(OpenUpload, restApi.OpenUpload)
+	route(UploadStatus, restApi.UploadStatus)
+	route(UploadBlock, restApi.UploadBlock)
+	route(CommitUpload, restApi.CommitUpload)
+	route(AbortUpload, restApi.AbortUpload)
+	route(Versions, restApi.Versions)
+	route(ListWebhooks, restApi.ListWebhooks)
+	route(CreateWebhook, restApi.CreateWebhook)
+	route(RemoveWebhook, restApi.RemoveWebhook)
+	route(WebhookDeliveries, restApi.WebhookDeliveries)
+	route(TestWebhook, restApi.TestWebhook)
+
+	route(Login, restApi.Login)
+	route(CurrentUser, restApi.CurrentUser)
+	route(ListTokens, restApi.ListTokens)
+	route(CreateToken, restApi.CreateToken)
+	route(RevokeToken, restApi.RevokeToken)
+	route(ListUsers, restApi.ListUsers)
+	route(CreateUser, restApi.CreateUser)
+	route(UpdateUser, restApi.UpdateUser)
+	route(RemoveUser, restApi.RemoveUser)
+
+	route(CreateShare, restApi.CreateShare)
+	route(ListShares, restApi.ListShares)
+	route(RevokeShare, restApi.RevokeShare)
+	route(SharedNode, restApi.SharedNode)
+	route(ListShared, restApi.ListShared)
+	route(DownloadShared, restApi.DownloadShared)
+	route(CreateDropBox, restApi.CreateDropBox)
+	route(DropBoxInfo, restApi.DropBoxInfo)
+	route(DropFile, restApi.DropFile)
+	route(DropBlock, restApi.DropBlock)
+
+	r.HandleFunc("/block/{blockId}", named("/block/{blockId}", restApi.ServeBlock)).Methods("GET")
+	r.HandleFunc("/block/{blockId}", named("/block/{blockId}", restApi.HasBlock)).Methods("HEAD")
+	r.HandleFunc("/metrics", named("/metrics", restApi.Metrics)).Methods("GET")
+	r.HandleFunc("/healthz", named("/healthz", restApi.Healthz)).Methods("GET")
+	r.HandleFunc("/readyz", named("/readyz", restApi.Readyz)).Methods("GET")
+
+	if restApi.users != nil {
+		restApi.Handler = restApi.authenticate(r)
+	}
+	restApi.Handler = restApi.instrument(restApi.Handler)
 
 	return restApi
 }
@@ -77,13 +177,40 @@ func (restApi OlympusApi) DownloadFile(writer http.ResponseWriter, req *http.Req
 	if !node.Exists() {
 		writeNodeNotFoundError(node.Id, req, writer)
 		return
+	} else if !restApi.requirePermission(node, graph.ReadPermission, writer, req) {
+		return
 	}
 
-	writer.Header().Add("Content-Type", node.Type())
+	serveNode(node, writer, req)
+}
+
+// Serve a node's content as its stored type. Browsers are told not to sniff another type, and types they'd
+// run scripts in are sent as attachments, so uploaded content can't run as a page on the server's origin.
+func serveNode(node *graph.Node, writer http.ResponseWriter, req *http.Request) {
+	contentType := node.Type()
+	writer.Header().Add("Content-Type", contentType)
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	if activeContent(contentType) {
+		writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", node.Name()))
+	}
 	http.ServeContent(writer, req, node.Name(), node.MTime(), node.ReadSeeker())
 }
 
-func (restApi OlympusApi) listNodes(parentNode *graph.Node, watermark, limit int) []graph.NodeInfo {
+// Whether a browser would render content of a type as a document able to run scripts: html, svg or other xml
+func activeContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+
+	switch mediaType {
+	case "text/html", "text/xml", "application/xml":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+xml")
+}
+
+func (restApi OlympusApi) listNodes(parentNode *graph.Node, watermark, limit int, sorter graph.Sorter, filter graph.MetadataFilter) []graph.NodeInfo {
 	minI := func(lhs, rhs int) int {
 		if lhs > rhs {
 			return lhs
@@ -92,7 +219,17 @@ func (restApi OlympusApi) listNodes(parentNode *graph.Node, watermark, limit int
 		}
 	}
 
-	children := parentNode.Children()
+	children := parentNode.ChildrenSorted(sorter)
+	if !filter.Empty() {
+		matching := make([]*graph.Node, 0, len(children))
+		for _, child := range children {
+			if filter.Matches(child.Metadata()) {
+				matching = append(matching, child)
+			}
+		}
+		children = matching
+	}
+
 	var start, end int
 
 	if watermark > 0 && watermark < len(children) {
@@ -117,14 +254,30 @@ func (restApi OlympusApi) listNodes(parentNode *graph.Node, watermark, limit int
 	return response
 }
 
-// GET v1/node/{parentId}?watermark=<int>&limit=<int>
+// GET v1/node/{parentId}?watermark=<int>&limit=<int>&sort=<name|mtime|size|type|natural|iname>&order=<asc|desc>&dirs_first=<bool>
+// Children can also be filtered by metadata, see metadataFilter
 func (restApi OlympusApi) ListNodes(writer http.ResponseWriter, req *http.Request) {
 	parentNode := restApi.graph.NodeWithId(paramFromRequest("parentId", req))
 	if !parentNode.Exists() {
 		writeNodeNotFoundError(parentNode.Id, req, writer)
 		return
+	} else if !restApi.requirePermission(parentNode, graph.ReadPermission, writer, req) {
+		return
+	}
+
+	restApi.writeChildren(parentNode, writer, req)
+}
+
+func (restApi OlympusApi) writeChildren(parentNode *graph.Node, writer http.ResponseWriter, req *http.Request) {
+	if children, err := restApi.childrenFromQuery(parentNode, req); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else {
+		dataResponse(children, http.StatusOK, req, writer)
 	}
+}
 
+// Children of parentNode, paged, sorted and filtered by the query params of ListNodes
+func (restApi OlympusApi) childrenFromQuery(parentNode *graph.Node, req *http.Request) ([]graph.NodeInfo, error) {
 	watermark, limit := -1, -1
 
 	watermarkVals := req.URL.Query()["watermark"]
@@ -139,7 +292,136 @@ func (restApi OlympusApi) ListNodes(writer http.ResponseWriter, req *http.Reques
 		limit = int(l)
 	}
 
-	dataResponse(restApi.listNodes(parentNode, watermark, limit), http.StatusOK, req, writer)
+	query := req.URL.Query()
+	dirsFirst, _ := strconv.ParseBool(query.Get("dirs_first"))
+	sorter, err := graph.ParseSorter(query.Get("sort"), query.Get("order"), dirsFirst)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := metadataFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return restApi.listNodes(parentNode, watermark, limit, sorter, filter), nil
+}
+
+// GET v1/node/{nodeId}/info
+// returns -> node info including metadata extracted from its content
+func (restApi OlympusApi) ExtendedInfo(writer http.ResponseWriter, req *http.Request) {
+	node := restApi.graph.NodeWithId(paramFromRequest("nodeId", req))
+	if !node.Exists() {
+		writeNodeNotFoundError(node.Id, req, writer)
+		return
+	} else if !restApi.requirePermission(node, graph.ReadPermission, writer, req) {
+		return
+	}
+
+	dataResponse(node.ExtendedNodeInfo(), http.StatusOK, req, writer)
+}
+
+// GET v1/node/{nodeId}/search?limit=<int>, filtered as in metadataFilter
+// returns -> extended info for every file under nodeId matching the filter
+func (restApi OlympusApi) Search(writer http.ResponseWriter, req *http.Request) {
+	node := restApi.graph.NodeWithId(paramFromRequest("nodeId", req))
+	if !node.Exists() {
+		writeNodeNotFoundError(node.Id, req, writer)
+		return
+	} else if !node.IsDir() {
+		errorResponse(ApiError{INVALID_PARAM, "Can only search directories"}, http.StatusBadRequest, req, writer)
+		return
+	} else if !restApi.requirePermission(node, graph.ReadPermission, writer, req) {
+		return
+	}
+
+	filter, err := metadataFilter(req.URL.Query())
+	if err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+		return
+	}
+
+	limit, _ := strconv.Atoi(req.URL.Query().Get("limit"))
+	results := restApi.graph.Search(node, filter, limit)
+
+	infos := make([]graph.ExtendedNodeInfo, 0, len(results))
+	for _, result := range results {
+		if restApi.permitted(result, graph.ReadPermission, req) {
+			infos = append(infos, result.ExtendedNodeInfo())
+		}
+	}
+
+	dataResponse(infos, http.StatusOK, req, writer)
+}
+
+// GET v1/changes?cursor=<int>&subtree=<nodeId>&limit=<int>
+// returns -> changes recorded after cursor to subtree or anything under it, oldest first, and the cursor to
+// pass next time. With no cursor, returns no changes and the current cursor, so clients can start syncing.
+// A cursor older than the journal keeps is 410 Gone, and its client has to start over. Changes to nodes the
+// user can't read, or under directories they can't read, are left out.
+func (restApi OlympusApi) Changes(writer http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	journal := restApi.graph.Journal()
+	if journal == nil {
+		dataResponse(ChangesResponse{Changes: make([]graph.Change, 0)}, http.StatusOK, req, writer)
+		return
+	}
+
+	subtree := query.Get("subtree")
+	if subtree != "" && !restApi.graph.NodeWithId(subtree).Exists() {
+		writeNodeNotFoundError(subtree, req, writer)
+		return
+	}
+
+	if query.Get("cursor") == "" {
+		dataResponse(ChangesResponse{Changes: make([]graph.Change, 0), Cursor: journal.Seq()}, http.StatusOK, req, writer)
+		return
+	}
+
+	cursor, err := strconv.ParseUint(query.Get("cursor"), 10, 64)
+	if err != nil {
+		errorResponse(ApiError{INVALID_PARAM, fmt.Sprintf("Cursor parameter: %s", query.Get("cursor"))}, http.StatusBadRequest, req, writer)
+		return
+	} else if min := journal.MinCursor(); cursor < min {
+		errorResponse(ApiError{CURSOR_EXPIRED, fmt.Sprintf("Changes before %d are no longer kept", min)}, http.StatusGone, req, writer)
+		return
+	}
+
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	changes, next := journal.Since(cursor, subtree, limit)
+	dataResponse(ChangesResponse{Changes: restApi.readableChanges(changes, req), Cursor: next}, http.StatusOK, req, writer)
+}
+
+// Metadata filters come from query params named for metadata keys, e.g. camera_model=<string>&year=<string>,
+// plus captured_after=<time>&captured_before=<time>, where times are RFC 3339 or dates like 2016-03-01
+func metadataFilter(query url.Values) (graph.MetadataFilter, error) {
+	filter := graph.MetadataFilter{Fields: make(map[string]string)}
+	for _, key := range media.Keys {
+		if value := query.Get(key); value != "" {
+			filter.Fields[key] = value
+		}
+	}
+
+	parseTime := func(param string) (time.Time, error) {
+		value := query.Get(param)
+		if value == "" {
+			return time.Time{}, nil
+		} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, nil
+		} else if t, err := time.Parse("2006-01-02", value); err == nil {
+			return t, nil
+		}
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time or a date, not %s", param, value)
+	}
+
+	var err error
+	if filter.CapturedAfter, err = parseTime("captured_after"); err != nil {
+		return filter, err
+	} else if filter.CapturedBefore, err = parseTime("captured_before"); err != nil {
+		return filter, err
+	}
+
+	return filter, nil
 }
 
 // DELETE /v1/node/{nodeId}
@@ -150,6 +432,17 @@ func (restApi OlympusApi) RemoveNode(writer http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	restApi.removeNode(node, writer, req)
+}
+
+func (restApi OlympusApi) removeNode(node *graph.Node, writer http.ResponseWriter, req *http.Request) {
+	if node.Id == graph.RootNodeId {
+		errorResponse(ApiError{INVALID_PARAM, "Cannot delete root node"}, http.StatusBadRequest, req, writer)
+		return
+	} else if !restApi.requireParentPermission(node, writer, req) || !restApi.requireSubtreeRemovable(node, writer, req) {
+		return
+	}
+
 	err := restApi.graph.RemoveNode(node)
 	if err != nil {
 		errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
@@ -176,19 +469,31 @@ func (restApi OlympusApi) CreateNode(writer http.ResponseWriter, req *http.Reque
 		writer.WriteHeader(http.StatusBadRequest)
 		writer.Write([]byte(err.Error()))
 		return
+	}
+
+	restApi.createNode(parent, nodeInfo, "", writer, req)
+}
+
+// Create a node under parent, returning its info with nodePath as its path when the caller addressed it by one
+func (restApi OlympusApi) createNode(parent *graph.Node, nodeInfo graph.NodeInfo, nodePath string, writer http.ResponseWriter, req *http.Request) {
+	if !restApi.requirePermission(parent, graph.WritePermission, writer, req) {
+		return
 	} else if node := restApi.graph.NodeWithName(parent.Id, nodeInfo.Name); node != nil && node.Exists() {
 		errorResponse(ApiError{NODE_EXISTS, node.Id}, http.StatusBadRequest, req, writer)
 	} else {
-		if newNode, err := restApi.graph.NewNode(nodeInfo.Name, parent.Id, nodeInfo.Mode); err != nil {
+		if newNode, err := restApi.graph.NewOwnedNode(nodeInfo.Name, parent.Id, nodeInfo.Mode, ownerFromRequest(req)); err != nil {
 			errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
 		} else {
-			dataResponse(newNode.NodeInfo(), http.StatusCreated, req, writer)
+			info := newNode.NodeInfo()
+			info.Path = nodePath
+			dataResponse(info, http.StatusCreated, req, writer)
 		}
 	}
 }
 
 // PATCH v1/node/{nodeId}
-// body -> {nodeInfo}
+// body -> {nodeInfo}, where only the fields to change are set. Setting mode is chmod, and setting owner or
+// group is chown; see requireUpdatePermission for who may do what.
 func (restApi OlympusApi) UpdateNode(writer http.ResponseWriter, req *http.Request) {
 	node := restApi.graph.NodeWithId(paramFromRequest("nodeId", req))
 	if !node.Exists() {
@@ -204,6 +509,11 @@ func (restApi OlympusApi) UpdateNode(writer http.ResponseWriter, req *http.Reque
 	if err != nil {
 		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
 		return
+	} else if !restApi.requireUpdatePermission(node, nodeInfo, writer, req) {
+		return
+	} else if _, ok := restApi.user(nodeInfo.Owner); !ok {
+		errorResponse(ApiError{NO_SUCH_USER, nodeInfo.Owner}, http.StatusBadRequest, req, writer)
+		return
 	}
 
 	if err = node.Update(nodeInfo); err != nil {
@@ -223,6 +533,8 @@ func (restApi OlympusApi) Blocks(writer http.ResponseWriter, req *http.Request)
 	} else if node.IsDir() {
 		errorResponse(ApiError{IS_DIRECTORY, node.Id}, http.StatusBadRequest, req, writer)
 		return
+	} else if !restApi.requirePermission(node, graph.ReadPermission, writer, req) {
+		return
 	}
 
 	blocks := node.Blocks()
@@ -236,8 +548,14 @@ func (restApi OlympusApi) WriteBlock(writer http.ResponseWriter, req *http.Reque
 	if !node.Exists() {
 		writeNodeNotFoundError(node.Id, req, writer)
 		return
+	} else if restApi.requirePermission(node, graph.WritePermission, writer, req) {
+		restApi.writeBlock(node, -1, writer, req)
 	}
+}
 
+// Write the block in req's body to node, at the offset in its path. With a limit of 0 or more, the block must
+// end by limit bytes into the file.
+func (restApi OlympusApi) writeBlock(node *graph.Node, limit int64, writer http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
 	var data []byte
 	var err error
@@ -257,13 +575,78 @@ func (restApi OlympusApi) WriteBlock(writer http.ResponseWriter, req *http.Reque
 	offsetString := paramFromRequest("offset", req)
 	if offset, err := strconv.ParseInt(offsetString, 10, 64); err != nil {
 		errorResponse(ApiError{INVALID_PARAM, fmt.Sprintf("Offset parameter: %s", offsetString)}, http.StatusBadRequest, req, writer)
+	} else if limit >= 0 && offset+int64(len(data)) > limit {
+		errorResponse(ApiError{INVALID_PARAM, fmt.Sprintf("Block ends past the file's size of %d bytes", limit)}, http.StatusBadRequest, req, writer)
 	} else if err := node.WriteData(data, offset); err != nil {
 		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
 	} else {
+		restApi.blockWritten(node, int64(len(data)))
+		writer.WriteHeader(http.StatusCreated)
+	}
+}
+
+// A short block is the last in its file, so this is the earliest an image is likely to be complete.
+// Thumbnails that go stale or are never generated here are generated on request instead.
+func (restApi OlympusApi) blockWritten(node *graph.Node, size int64) {
+	if size < graph.BLOCK_SIZE && graph.IsThumbnailable(node.Type()) {
+		restApi.inBackground(func() { restApi.graph.NodeWithId(node.Id).GenerateThumbnails() })
+	}
+}
+
+// PUT v1/node/{nodeId}/block/{offset}/{hash}
+// Use a block the server already has at offset in the node, without sending it
+func (restApi OlympusApi) LinkBlock(writer http.ResponseWriter, req *http.Request) {
+	node := restApi.graph.NodeWithId(paramFromRequest("nodeId", req))
+	if !node.Exists() {
+		writeNodeNotFoundError(node.Id, req, writer)
+		return
+	} else if !restApi.requirePermission(node, graph.WritePermission, writer, req) {
+		return
+	}
+
+	hash := paramFromRequest("hash", req)
+	offsetString := paramFromRequest("offset", req)
+	if offset, err := strconv.ParseInt(offsetString, 10, 64); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, fmt.Sprintf("Offset parameter: %s", offsetString)}, http.StatusBadRequest, req, writer)
+	} else if err := node.LinkBlock(hash, offset); os.IsNotExist(err) {
+		errorResponse(ApiError{NO_SUCH_BLOCK, hash}, http.StatusNotFound, req, writer)
+	} else if err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else {
+		size, _ := graph.SizeOnDisk(hash)
+		restApi.blockWritten(node, size)
 		writer.WriteHeader(http.StatusCreated)
 	}
 }
 
+// Most hashes that can be asked about in one request to MissingBlocks
+const MaxMissingBlocks = 1000
+
+// POST v1/blocks/missing
+// body -> {BlockHashes}
+// returns -> {BlockHashes} (those of the given blocks the server doesn't have). Blocks are looked for, not
+// read, so this is cheap; linking one reads and checks it.
+func (restApi OlympusApi) MissingBlocks(writer http.ResponseWriter, req *http.Request) {
+	var hashes BlockHashes
+	defer req.Body.Close()
+	if err := decoderFromHeader(req.Body, req.Header).Decode(&hashes); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+		return
+	} else if len(hashes.Hashes) > MaxMissingBlocks {
+		errorResponse(ApiError{INVALID_PARAM, fmt.Sprintf("At most %d hashes may be checked at once", MaxMissingBlocks)}, http.StatusBadRequest, req, writer)
+		return
+	}
+
+	missing := BlockHashes{Hashes: []string{}}
+	for _, hash := range hashes.Hashes {
+		if !graph.Stored(hash) {
+			missing.Hashes = append(missing.Hashes, hash)
+		}
+	}
+
+	dataResponse(missing, http.StatusOK, req, writer)
+}
+
 // GET v1/node/{nodeId}/{offset}
 func (restApi OlympusApi) ReadBlock(writer http.ResponseWriter, req *http.Request) {
 	node := restApi.graph.NodeWithId(paramFromRequest("nodeId", req))
@@ -273,6 +656,8 @@ func (restApi OlympusApi) ReadBlock(writer http.ResponseWriter, req *http.Reques
 	} else if node.IsDir() {
 		errorResponse(ApiError{IS_DIRECTORY, node.Id}, http.StatusBadRequest, req, writer)
 		return
+	} else if !restApi.requirePermission(node, graph.ReadPermission, writer, req) {
+		return
 	}
 
 	offsetString := paramFromRequest("offset", req)
@@ -289,10 +674,192 @@ func (restApi OlympusApi) ReadBlock(writer http.ResponseWriter, req *http.Reques
 	}
 }
 
+// GET v1/node/{nodeId}/thumbnail/{size}
+// returns -> JPEG whose longest edge is at most size pixels
+func (restApi OlympusApi) Thumbnail(writer http.ResponseWriter, req *http.Request) {
+	node := restApi.graph.NodeWithId(paramFromRequest("nodeId", req))
+	if !node.Exists() {
+		writeNodeNotFoundError(node.Id, req, writer)
+		return
+	} else if !restApi.requirePermission(node, graph.ReadPermission, writer, req) {
+		return
+	}
+
+	sizeString := paramFromRequest("size", req)
+	if size, err := strconv.Atoi(sizeString); err != nil || !graph.IsThumbnailSize(size) {
+		errorResponse(ApiError{INVALID_PARAM, fmt.Sprintf("Size must be one of %v", graph.ThumbnailSizes)}, http.StatusBadRequest, req, writer)
+	} else if hash, err := node.Thumbnail(size); err == graph.ErrNotAnImage {
+		errorResponse(ApiError{NOT_AN_IMAGE, node.Id}, http.StatusBadRequest, req, writer)
+	} else if err != nil {
+		errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
+	} else if dat, err := graph.RawData(hash); err != nil {
+		errorResponse(ApiError{NO_SUCH_BLOCK, hash}, http.StatusNotFound, req, writer)
+	} else {
+		// The URL outlives any one thumbnail, so clients revalidate every time and get a 304 if it's unchanged
+		writer.Header().Set("Content-Type", "image/jpeg")
+		writer.Header().Set("ETag", fmt.Sprintf(`"%s"`, hash))
+		writer.Header().Set("Cache-Control", "private, no-cache")
+		http.ServeContent(writer, req, "", time.Time{}, bytes.NewReader(dat))
+	}
+}
+
+// GET v1/node/{nodeId}/export
+// returns -> tar archive of the subtree rooted at nodeId
+func (restApi OlympusApi) ExportNode(writer http.ResponseWriter, req *http.Request) {
+	node := restApi.graph.NodeWithId(paramFromRequest("nodeId", req))
+	if !node.Exists() {
+		writeNodeNotFoundError(node.Id, req, writer)
+		return
+	} else if !restApi.requirePermission(node, graph.ReadPermission, writer, req) {
+		return
+	}
+
+	writer.Header().Set("Content-Type", string(TarEncoding))
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", node.Name()+".tar"))
+	writer.WriteHeader(http.StatusOK)
+
+	// Every ancestor of a descendant that's reached is readable, so only its own mode needs checking.
+	// Headers are already sent, so the best we can do on failure is cut the archive short.
+	restApi.graph.Export(node, writer, func(descendant *graph.Node) bool {
+		return restApi.grants(descendant, graph.ReadPermission, req)
+	})
+}
+
+// POST v1/node/{parentId}/import
+// body -> tar archive produced by ExportNode
+// returns -> {ImportReport}
+func (restApi OlympusApi) ImportNode(writer http.ResponseWriter, req *http.Request) {
+	parent := restApi.graph.NodeWithId(paramFromRequest("parentId", req))
+	if !parent.Exists() {
+		writeNodeNotFoundError(parent.Id, req, writer)
+		return
+	} else if !parent.IsDir() {
+		errorResponse(ApiError{INVALID_PARAM, "Cannot import into a non-directory"}, http.StatusBadRequest, req, writer)
+		return
+	} else if !restApi.requirePermission(parent, graph.WritePermission, writer, req) {
+		return
+	}
+
+	defer req.Body.Close()
+	if report, err := restApi.graph.Import(req.Body, parent.Id, ownerFromRequest(req)); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else {
+		dataResponse(report, http.StatusCreated, req, writer)
+	}
+}
+
+// Let admins ingest server-side paths under root; without this the ingest endpoint responds 503
+func WithIngestRoot(root string) Option {
+	return func(restApi *OlympusApi) {
+		restApi.ingestRoot = root
+	}
+}
+
+// The local path an ingest request names, with symlinks resolved, as long as it's under the ingest root.
+// Relative paths are taken to be relative to the root.
+func (restApi OlympusApi) ingestSource(requested string) (string, error) {
+	root, err := filepath.EvalSymlinks(filepath.Clean(restApi.ingestRoot))
+	if err != nil {
+		return "", fmt.Errorf("Error resolving ingest root: %s", err.Error())
+	}
+	if !filepath.IsAbs(requested) {
+		requested = filepath.Join(root, requested)
+	}
+
+	source, err := filepath.EvalSymlinks(filepath.Clean(requested))
+	if err != nil {
+		return "", err
+	} else if rel, err := filepath.Rel(root, source); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not under the ingest root", requested)
+	}
+	return source, nil
+}
+
+// POST v1/node/{parentId}/ingest
+// body -> {IngestRequest} (path is local to the server, and must be under its ingest root)
+// returns -> {IngestProgress}
+func (restApi OlympusApi) IngestPath(writer http.ResponseWriter, req *http.Request) {
+	if restApi.ingestRoot == "" {
+		errorResponse(ApiError{INTERNAL, "Ingest is not enabled"}, http.StatusServiceUnavailable, req, writer)
+		return
+	} else if !restApi.requireAdmin(writer, req) {
+		return
+	}
+
+	parent := restApi.graph.NodeWithId(paramFromRequest("parentId", req))
+	if !parent.Exists() {
+		writeNodeNotFoundError(parent.Id, req, writer)
+		return
+	}
+
+	var ingestRequest IngestRequest
+	defer req.Body.Close()
+	if err := decoderFromHeader(req.Body, req.Header).Decode(&ingestRequest); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else if ingestRequest.Path == "" {
+		errorResponse(ApiError{INVALID_PARAM, "path"}, http.StatusBadRequest, req, writer)
+	} else if source, err := restApi.ingestSource(ingestRequest.Path); err != nil {
+		errorResponse(ApiError{FORBIDDEN, err.Error()}, http.StatusForbidden, req, writer)
+	} else if progress, err := restApi.graph.Ingest(source, parent.Id, nil); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else {
+		dataResponse(progress, http.StatusOK, req, writer)
+	}
+}
+
+// GET /block/{blockId}
+func (restApi OlympusApi) ServeBlock(writer http.ResponseWriter, req *http.Request) {
+	hash := paramFromRequest("blockId", req)
+	if dat, err := graph.RawData(hash); err != nil {
+		errorResponse(ApiError{NO_SUCH_BLOCK, hash}, http.StatusNotFound, req, writer)
+	} else {
+		http.ServeContent(writer, req, hash, time.Time{}, bytes.NewReader(dat))
+	}
+}
+
+// HEAD /block/{blockId}
+// returns -> 200 if the block is stored, 404 if not
+func (restApi OlympusApi) HasBlock(writer http.ResponseWriter, req *http.Request) {
+	hash := paramFromRequest("blockId", req)
+	if !graph.Stored(hash) {
+		errorResponse(ApiError{NO_SUCH_BLOCK, hash}, http.StatusNotFound, req, writer)
+	} else {
+		if size, err := graph.SizeOnDisk(hash); err == nil {
+			writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		writer.WriteHeader(http.StatusOK)
+	}
+}
+
+// GET v1/replication?verify=<bool>
+// returns -> {ReplicationReport}
+func (restApi OlympusApi) Replication(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.requireAdmin(writer, req) {
+		return
+	}
+
+	verify, _ := strconv.ParseBool(req.URL.Query().Get("verify"))
+	dataResponse(graph.CheckReplication(verify, false), http.StatusOK, req, writer)
+}
+
+// POST v1/replication/repair?verify=<bool>
+// returns -> {ReplicationReport}, after re-replicating every block with too few good copies
+func (restApi OlympusApi) Repair(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.requireAdmin(writer, req) {
+		return
+	}
+
+	verify, _ := strconv.ParseBool(req.URL.Query().Get("verify"))
+	dataResponse(graph.CheckReplication(verify, true), http.StatusOK, req, writer)
+}
+
 func dataResponse(data interface{}, statusCode int, req *http.Request, writer http.ResponseWriter) {
 	encoder := encoderFromHeader(writer, req.Header)
 	writer.WriteHeader(statusCode)
 	resp := NewDataResponse(data)
+	if id := requestId(req); id != "" {
+		resp.Meta.RequestId = id
+	}
 	encoder.Encode(resp)
 }
 
@@ -300,6 +867,10 @@ func errorResponse(err ApiError, statusCode int, req *http.Request, writer http.
 	encoder := encoderFromHeader(writer, req.Header)
 	writer.WriteHeader(statusCode)
 	resp := NewErrorResponse(&err)
+	if info := requestInfoFrom(req); info != nil {
+		resp.Meta.RequestId = info.id
+		info.err = &err
+	}
 	encoder.Encode(resp)
 }
 
@@ -1,12 +1,15 @@
 package api
 
 import (
+	"bytes"
 	"encoding/gob"
 	"encoding/json"
 	"encoding/xml"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/sdcoffey/olympus/logging"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -71,4 +74,45 @@ func TestEndpoint_Query(t *testing.T) {
 	path = ListNodes.Build("abcd").Query("watermark", "1").Query("limit", "2").String()
 	assert.Contains(t, path, "limit=2")
 	assert.Contains(t, path, "/node/abcd?")
+
+	assert.Equal(t, "/node/abcd?watermark=1&limit=2", path)
+}
+
+// Logging tests
+func TestInstrument_logsPanicsAsServerErrors(t *testing.T) {
+	access, errors := new(bytes.Buffer), new(bytes.Buffer)
+	restApi := OlympusApi{accessLog: logging.NewLogger(access), errorLog: logging.NewLogger(errors)}
+	handler := restApi.instrument(routed(ListNodes, func(writer http.ResponseWriter, req *http.Request) {
+		panic("something broke")
+	}))
+
+	req := httptest.NewRequest("GET", "/v1/node/abcd", nil)
+	req.Header.Set(RequestIdHeader, "panicking")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, "panicking", recorder.Header().Get(RequestIdHeader))
+
+	var errorEntry ErrorEntry
+	assert.NoError(t, json.Unmarshal(errors.Bytes(), &errorEntry))
+	assert.Equal(t, "panicking", errorEntry.RequestId)
+	assert.Equal(t, "/v1"+ListNodes.Template(), errorEntry.Route)
+	assert.Equal(t, "something broke", errorEntry.Message)
+	assert.Contains(t, errorEntry.Stack, "api.TestInstrument_logsPanicsAsServerErrors")
+
+	var accessEntry AccessEntry
+	assert.NoError(t, json.Unmarshal(access.Bytes(), &accessEntry))
+	assert.Equal(t, http.StatusInternalServerError, accessEntry.Status)
+}
+
+func TestInstrument_keepsResponsesFlushable(t *testing.T) {
+	restApi := OlympusApi{}
+	var flushable bool
+	handler := restApi.instrument(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		_, flushable = writer.(http.Flusher)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/events", nil))
+	assert.True(t, flushable)
 }
@@ -0,0 +1,295 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sdcoffey/olympus/auth"
+)
+
+type contextKey string
+
+const userKey contextKey = "user"
+
+// Lifetime of tokens issued by Login when the request doesn't give one
+const DefaultTokenTTL = 30 * 24 * time.Hour
+
+// Require every request to authenticate as a user in store, except logging in and using share links
+// and drop boxes
+func WithAuth(store *auth.Store) Option {
+	return func(restApi *OlympusApi) {
+		restApi.users = store
+	}
+}
+
+func (tokenRequest TokenRequest) ttl() time.Duration {
+	if tokenRequest.ExpiresIn == 0 {
+		return DefaultTokenTTL
+	} else if tokenRequest.ExpiresIn < 0 {
+		return 0
+	}
+	return time.Duration(tokenRequest.ExpiresIn) * time.Second
+}
+
+// Authenticate requests with a token, given as a Bearer Authorization header or an access_token query param
+// for clients that can't set headers, or with HTTP Basic username and password
+func (restApi OlympusApi) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v1"+Login.Template() || req.URL.Path == "/v1"+ServerInfo.Template() ||
+			req.URL.Path == "/healthz" || req.URL.Path == "/readyz" ||
+			strings.HasPrefix(req.URL.Path, "/v1/shared/") || strings.HasPrefix(req.URL.Path, "/v1/dropbox/") {
+			next.ServeHTTP(writer, req)
+			return
+		}
+
+		user, given, err := restApi.credentials(req)
+		if !given {
+			writeUnauthorizedError("Authentication required", req, writer)
+			return
+		} else if err == auth.ErrTooManyAttempts {
+			errorResponse(ApiError{UNAUTHORIZED, err.Error()}, http.StatusTooManyRequests, req, writer)
+			return
+		} else if err != nil {
+			writeUnauthorizedError(err.Error(), req, writer)
+			return
+		}
+
+		if info := requestInfoFrom(req); info != nil {
+			info.user = user.Username
+		}
+		next.ServeHTTP(writer, req.WithContext(context.WithValue(req.Context(), userKey, user)))
+	})
+}
+
+// The user a request's credentials belong to. given is false if the request has none.
+func (restApi OlympusApi) credentials(req *http.Request) (user auth.User, given bool, err error) {
+	header := req.Header.Get("Authorization")
+	if username, password, ok := req.BasicAuth(); ok {
+		user, err = restApi.users.Authenticate(username, password, restApi.remoteAddress(req))
+	} else if strings.HasPrefix(header, "Bearer ") {
+		user, err = restApi.users.ValidateToken(strings.TrimPrefix(header, "Bearer "))
+	} else if token := req.URL.Query().Get("access_token"); token != "" {
+		user, err = restApi.users.ValidateToken(token)
+	} else {
+		return user, false, nil
+	}
+	return user, true, err
+}
+
+// The user a request authenticated as, if the api requires authentication
+func userFromRequest(req *http.Request) (auth.User, bool) {
+	user, ok := req.Context().Value(userKey).(auth.User)
+	return user, ok
+}
+
+// Whether the request may use admin endpoints, writing a 403 if not. Without authentication, everyone may.
+func (restApi OlympusApi) requireAdmin(writer http.ResponseWriter, req *http.Request) bool {
+	if restApi.users == nil {
+		return true
+	} else if user, ok := userFromRequest(req); !ok || !user.Admin {
+		errorResponse(ApiError{FORBIDDEN, "Requires an admin user"}, http.StatusForbidden, req, writer)
+		return false
+	}
+	return true
+}
+
+// The user named username, if authentication is enabled. Any name is accepted when it isn't.
+func (restApi OlympusApi) user(username string) (auth.User, bool) {
+	if restApi.users == nil || username == "" {
+		return auth.User{Username: username}, true
+	}
+	return restApi.users.User(username)
+}
+
+func (restApi OlympusApi) authEnabled(writer http.ResponseWriter, req *http.Request) bool {
+	if restApi.users == nil {
+		errorResponse(ApiError{INTERNAL, "Authentication is not enabled"}, http.StatusServiceUnavailable, req, writer)
+		return false
+	}
+	return true
+}
+
+func writeUnauthorizedError(details string, req *http.Request, writer http.ResponseWriter) {
+	writer.Header().Set("WWW-Authenticate", `Bearer realm="olympus"`)
+	errorResponse(ApiError{UNAUTHORIZED, details}, http.StatusUnauthorized, req, writer)
+}
+
+// POST v1/login
+// body -> {username, password, name, expires_in}, where name and expires_in are optional
+// returns -> {token, info}
+func (restApi OlympusApi) Login(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.authEnabled(writer, req) {
+		return
+	}
+
+	var login LoginRequest
+	defer req.Body.Close()
+	if err := decoderFromHeader(req.Body, req.Header).Decode(&login); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else if user, err := restApi.users.Authenticate(login.Username, login.Password, restApi.remoteAddress(req)); err == auth.ErrTooManyAttempts {
+		errorResponse(ApiError{UNAUTHORIZED, err.Error()}, http.StatusTooManyRequests, req, writer)
+	} else if err != nil {
+		writeUnauthorizedError(err.Error(), req, writer)
+	} else {
+		restApi.issueToken(user, login.TokenRequest, writer, req)
+	}
+}
+
+// GET v1/user
+// returns -> {user} the request authenticated as
+func (restApi OlympusApi) CurrentUser(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.authEnabled(writer, req) {
+		return
+	}
+
+	user, _ := userFromRequest(req)
+	dataResponse(user, http.StatusOK, req, writer)
+}
+
+// GET v1/tokens
+// returns -> [token] belonging to the current user
+func (restApi OlympusApi) ListTokens(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.authEnabled(writer, req) {
+		return
+	}
+
+	user, _ := userFromRequest(req)
+	dataResponse(restApi.users.Tokens(user.Username), http.StatusOK, req, writer)
+}
+
+// POST v1/tokens
+// body -> {name, expires_in}
+// returns -> {token, info} for the current user
+func (restApi OlympusApi) CreateToken(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.authEnabled(writer, req) {
+		return
+	}
+
+	var tokenRequest TokenRequest
+	defer req.Body.Close()
+	if err := decoderFromHeader(req.Body, req.Header).Decode(&tokenRequest); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else {
+		user, _ := userFromRequest(req)
+		restApi.issueToken(user, tokenRequest, writer, req)
+	}
+}
+
+func (restApi OlympusApi) issueToken(user auth.User, tokenRequest TokenRequest, writer http.ResponseWriter, req *http.Request) {
+	if info, token, err := restApi.users.IssueToken(user.Username, tokenRequest.Name, tokenRequest.ttl()); err != nil {
+		errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
+	} else {
+		dataResponse(TokenResponse{token, info}, http.StatusCreated, req, writer)
+	}
+}
+
+// DELETE v1/tokens/{tokenId}
+func (restApi OlympusApi) RevokeToken(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.authEnabled(writer, req) {
+		return
+	}
+
+	user, _ := userFromRequest(req)
+	tokenId := paramFromRequest("tokenId", req)
+	if err := restApi.users.RevokeToken(user.Username, tokenId); err != nil {
+		errorResponse(ApiError{NO_SUCH_TOKEN, tokenId}, http.StatusNotFound, req, writer)
+	} else {
+		writer.WriteHeader(http.StatusOK)
+	}
+}
+
+// GET v1/users, admins only
+// returns -> [user]
+func (restApi OlympusApi) ListUsers(writer http.ResponseWriter, req *http.Request) {
+	if restApi.authEnabled(writer, req) && restApi.requireAdmin(writer, req) {
+		dataResponse(restApi.users.Users(), http.StatusOK, req, writer)
+	}
+}
+
+// POST v1/users, admins only
+// body -> {username, password, admin, groups}, where groups is optional
+// returns -> {user}
+func (restApi OlympusApi) CreateUser(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.authEnabled(writer, req) || !restApi.requireAdmin(writer, req) {
+		return
+	}
+
+	var userRequest UserRequest
+	defer req.Body.Close()
+	if err := decoderFromHeader(req.Body, req.Header).Decode(&userRequest); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else if user, err := restApi.users.AddUser(userRequest.Username, userRequest.Password, userRequest.Admin); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else if len(userRequest.Groups) == 0 {
+		dataResponse(user, http.StatusCreated, req, writer)
+	} else if err = restApi.users.SetGroups(user.Username, userRequest.Groups); err != nil {
+		restApi.users.RemoveUser(user.Username)
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else {
+		user, _ = restApi.users.User(user.Username)
+		dataResponse(user, http.StatusCreated, req, writer)
+	}
+}
+
+// PATCH v1/users/{username}, by that user or an admin
+// body -> {password, groups}, where either may be left out. Only admins may change groups.
+func (restApi OlympusApi) UpdateUser(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.authEnabled(writer, req) {
+		return
+	}
+
+	username := paramFromRequest("username", req)
+	if user, _ := userFromRequest(req); user.Username != username && !restApi.requireAdmin(writer, req) {
+		return
+	}
+
+	var userRequest UserRequest
+	defer req.Body.Close()
+	if _, ok := restApi.users.User(username); !ok {
+		errorResponse(ApiError{NO_SUCH_USER, username}, http.StatusNotFound, req, writer)
+	} else if err := decoderFromHeader(req.Body, req.Header).Decode(&userRequest); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else if userRequest.Password == "" && userRequest.Groups == nil {
+		errorResponse(ApiError{INVALID_PARAM, "Nothing to update"}, http.StatusBadRequest, req, writer)
+	} else if userRequest.Groups != nil && !restApi.requireAdmin(writer, req) {
+		return
+	} else if err := restApi.setPassword(username, userRequest.Password); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else if err := restApi.setGroups(username, userRequest.Groups); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else {
+		writer.WriteHeader(http.StatusOK)
+	}
+}
+
+func (restApi OlympusApi) setPassword(username, password string) error {
+	if password == "" {
+		return nil
+	}
+	return restApi.users.SetPassword(username, password)
+}
+
+func (restApi OlympusApi) setGroups(username string, groups []string) error {
+	if groups == nil {
+		return nil
+	}
+	return restApi.users.SetGroups(username, groups)
+}
+
+// DELETE v1/users/{username}, admins only
+func (restApi OlympusApi) RemoveUser(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.authEnabled(writer, req) || !restApi.requireAdmin(writer, req) {
+		return
+	}
+
+	username := paramFromRequest("username", req)
+	if _, ok := restApi.users.User(username); !ok {
+		errorResponse(ApiError{NO_SUCH_USER, username}, http.StatusNotFound, req, writer)
+	} else if err := restApi.users.RemoveUser(username); err != nil {
+		errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
+	} else {
+		writer.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,34 @@
+package api
+
+import "sync"
+
+// What the api has going on outside of answering requests, so the server can stop it before closing the graph
+type background struct {
+	work     sync.WaitGroup
+	stopping chan struct{}
+	stop     sync.Once
+}
+
+func newBackground() *background {
+	return &background{stopping: make(chan struct{})}
+}
+
+// Run f outside the request that asked for it, so Wait can wait for it
+func (restApi OlympusApi) inBackground(f func()) {
+	restApi.background.work.Add(1)
+	go func() {
+		defer restApi.background.work.Done()
+		f()
+	}()
+}
+
+// End event streams, and refuse new ones. A server shutting down otherwise waits on them until its
+// timeout runs out, since they never finish by themselves.
+func (restApi OlympusApi) StopStreams() {
+	restApi.background.stop.Do(func() { close(restApi.background.stopping) })
+}
+
+// Wait for work requests started in the background, like generating thumbnails, to finish
+func (restApi OlympusApi) Wait() {
+	restApi.background.work.Wait()
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/share"
+)
+
+// POST v1/node/{nodeId}/dropbox
+// body -> {password, expires_in, max_files, max_bytes}
+// returns -> {token, url, info}; anyone with the url can upload files into the directory, without an
+// account and without seeing what's already there
+func (restApi OlympusApi) CreateDropBox(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.sharesEnabled(writer, req) {
+		return
+	}
+
+	dir := restApi.graph.NodeWithId(paramFromRequest("nodeId", req))
+	if !dir.Exists() {
+		writeNodeNotFoundError(dir.Id, req, writer)
+		return
+	} else if !dir.IsDir() {
+		errorResponse(ApiError{INVALID_PARAM, "Can only upload into directories"}, http.StatusBadRequest, req, writer)
+		return
+	} else if !restApi.requirePermission(dir, graph.WritePermission, writer, req) {
+		return
+	}
+
+	var dropBoxRequest DropBoxRequest
+	defer req.Body.Close()
+	if err := decoderFromHeader(req.Body, req.Header).Decode(&dropBoxRequest); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else if dropBoxRequest.ExpiresIn < 0 {
+		errorResponse(ApiError{INVALID_PARAM, "expires_in cannot be negative"}, http.StatusBadRequest, req, writer)
+	} else if s, _, err := restApi.shares.CreateDropBox(dir.Id, ownerFromRequest(req), dropBoxRequest.Password,
+		time.Duration(dropBoxRequest.ExpiresIn)*time.Second, dropBoxRequest.Limits); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else {
+		dataResponse(restApi.shareResponse(s, req), http.StatusCreated, req, writer)
+	}
+}
+
+// GET v1/dropbox/{token}, without an account
+// returns -> {name, expires, max_files, max_bytes, files, bytes}
+func (restApi OlympusApi) DropBoxInfo(writer http.ResponseWriter, req *http.Request) {
+	if s, dir, ok := restApi.openShare(share.DropBox, writer, req); ok {
+		dataResponse(DropBoxResponse{
+			Name:     dir.Name(),
+			Expires:  s.Expires,
+			MaxFiles: s.MaxFiles,
+			MaxBytes: s.MaxBytes,
+			Files:    len(s.Uploads),
+			Bytes:    s.UploadedBytes(),
+		}, http.StatusOK, req, writer)
+	}
+}
+
+// POST v1/dropbox/{token}, without an account
+// body -> {name, size, uploader}
+// returns -> {nodeInfo} of the new file, renamed if its name was taken, whose blocks are then written with
+// DropBlock. Its size counts against the drop box's limits whether or not it's all written.
+func (restApi OlympusApi) DropFile(writer http.ResponseWriter, req *http.Request) {
+	s, dir, ok := restApi.openShare(share.DropBox, writer, req)
+	if !ok {
+		return
+	}
+
+	var dropRequest DropRequest
+	defer req.Body.Close()
+	if err := decoderFromHeader(req.Body, req.Header).Decode(&dropRequest); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+		return
+	} else if dropRequest.Name == "" || dropRequest.Size < 0 {
+		errorResponse(ApiError{INVALID_PARAM, "Uploads need a name and a size"}, http.StatusBadRequest, req, writer)
+		return
+	} else if !s.Fits(dropRequest.Size) {
+		errorResponse(ApiError{DROP_BOX_FULL, share.ErrLimitReached.Error()}, http.StatusRequestEntityTooLarge, req, writer)
+		return
+	}
+
+	// Uploads are the drop box creator's, and take the directory's permissions once it has an owner
+	mode := os.FileMode(0)
+	if dir.Owner() == "" {
+		mode = 0644
+	}
+
+	node, err := restApi.graph.NewAvailableNode(dropRequest.Name, dir.Id, mode, s.Creator)
+	if err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+		return
+	}
+
+	upload := share.Upload{
+		NodeId:   node.Id,
+		Name:     node.Name(),
+		Size:     dropRequest.Size,
+		Uploader: dropRequest.Uploader,
+		Address:  restApi.remoteAddress(req),
+	}
+	if _, err = restApi.shares.RecordUpload(s.Id, upload); err != nil {
+		restApi.graph.RemoveNode(node)
+	}
+
+	if err == share.ErrLimitReached {
+		errorResponse(ApiError{DROP_BOX_FULL, err.Error()}, http.StatusRequestEntityTooLarge, req, writer)
+	} else if err != nil {
+		errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
+	} else {
+		dataResponse(graph.NodeInfo{
+			Id:    node.Id,
+			Name:  node.Name(),
+			MTime: node.MTime(),
+			Mode:  node.Mode(),
+		}, http.StatusCreated, req, writer)
+	}
+}
+
+// PUT v1/dropbox/{token}/node/{nodeId}/block/{offset}, without an account
+// Only files uploaded to the drop box can be written, and no further than the size they were uploaded with
+func (restApi OlympusApi) DropBlock(writer http.ResponseWriter, req *http.Request) {
+	s, _, ok := restApi.openShare(share.DropBox, writer, req)
+	if !ok {
+		return
+	}
+
+	nodeId := paramFromRequest("nodeId", req)
+	node := restApi.graph.NodeWithId(nodeId)
+	if upload, ok := s.Upload(nodeId); !ok || !node.Exists() {
+		writeNodeNotFoundError(nodeId, req, writer)
+	} else {
+		restApi.writeBlock(node, upload.Size, writer, req)
+	}
+}
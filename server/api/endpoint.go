@@ -2,6 +2,7 @@ package api
 
 import (
 	"fmt"
+	"net/url"
 	"regexp"
 )
 
@@ -32,16 +33,19 @@ func (e Endpoint) Build(args ...interface{}) Endpoint {
 }
 
 func (e Endpoint) Query(key, val string) Endpoint {
-	e.query += fmt.Sprint(key, "=", val)
+	if e.query != "" {
+		e.query += "&"
+	}
+	e.query += fmt.Sprint(key, "=", url.QueryEscape(val))
 	return e
 }
 
 func (e Endpoint) String() string {
-	url := e.template
+	path := e.template
 	if e.query != "" {
-		url += "?" + e.query
+		path += "?" + e.query
 	}
-	return url
+	return path
 }
 
 func (e Endpoint) Template() string {
@@ -56,7 +60,59 @@ var (
 	UpdateNode   = newEndpoint("/node/{nodeId}", "PATCH")
 	WriteBlock   = newEndpoint("/node/{nodeId}/block/{offset}", "PUT")
 	ReadBlock    = newEndpoint("/node/{nodeId}/block/{offset}", "GET")
+	LinkBlock    = newEndpoint("/node/{nodeId}/block/{offset}/{hash}", "PUT")
 	DownloadNode = newEndpoint("/node/{nodeId}/stream", "GET")
+	Replication  = newEndpoint("/replication", "GET")
+	Repair       = newEndpoint("/replication/repair", "POST")
+	ExportNode   = newEndpoint("/node/{nodeId}/export", "GET")
+	ImportNode   = newEndpoint("/node/{parentId}/import", "POST")
+	IngestPath   = newEndpoint("/node/{parentId}/ingest", "POST")
+	Thumbnail    = newEndpoint("/node/{nodeId}/thumbnail/{size}", "GET")
+	ExtendedInfo = newEndpoint("/node/{nodeId}/info", "GET")
+	Search       = newEndpoint("/node/{nodeId}/search", "GET")
+	PathInfo     = newEndpoint("/path/{path:.*}", "GET")
+	CreatePath   = newEndpoint("/path/{path:.*}", "POST")
+	RemovePath   = newEndpoint("/path/{path:.*}", "DELETE")
+	Changes      = newEndpoint("/changes", "GET")
+	Events       = newEndpoint("/events", "GET")
+	ServerInfo   = newEndpoint("/info", "GET")
+
+	MissingBlocks = newEndpoint("/blocks/missing", "POST")
+
+	ListUploads  = newEndpoint("/uploads", "GET")
+	OpenUpload   = newEndpoint("/node/{parentId}/uploads", "POST")
+	UploadStatus = newEndpoint("/uploads/{uploadId}", "GET")
+	UploadBlock  = newEndpoint("/uploads/{uploadId}/block/{index}", "PUT")
+	CommitUpload = newEndpoint("/uploads/{uploadId}/commit", "POST")
+	AbortUpload  = newEndpoint("/uploads/{uploadId}", "DELETE")
+	Versions     = newEndpoint("/node/{nodeId}/versions", "GET")
+
+	ListWebhooks      = newEndpoint("/webhooks", "GET")
+	CreateWebhook     = newEndpoint("/webhooks", "POST")
+	RemoveWebhook     = newEndpoint("/webhooks/{hookId}", "DELETE")
+	WebhookDeliveries = newEndpoint("/webhooks/{hookId}/deliveries", "GET")
+	TestWebhook       = newEndpoint("/webhooks/{hookId}/test", "POST")
+
+	Login       = newEndpoint("/login", "POST")
+	CurrentUser = newEndpoint("/user", "GET")
+	ListTokens  = newEndpoint("/tokens", "GET")
+	CreateToken = newEndpoint("/tokens", "POST")
+	RevokeToken = newEndpoint("/tokens/{tokenId}", "DELETE")
+	ListUsers   = newEndpoint("/users", "GET")
+	CreateUser  = newEndpoint("/users", "POST")
+	UpdateUser  = newEndpoint("/users/{username}", "PATCH")
+	RemoveUser  = newEndpoint("/users/{username}", "DELETE")
+
+	CreateShare    = newEndpoint("/node/{nodeId}/shares", "POST")
+	ListShares     = newEndpoint("/node/{nodeId}/shares", "GET")
+	RevokeShare    = newEndpoint("/shares/{shareId}", "DELETE")
+	SharedNode     = newEndpoint("/shared/{token}", "GET")
+	ListShared     = newEndpoint("/shared/{token}/node/{nodeId}", "GET")
+	DownloadShared = newEndpoint("/shared/{token}/node/{nodeId}/stream", "GET")
+	CreateDropBox  = newEndpoint("/node/{nodeId}/dropbox", "POST")
+	DropBoxInfo    = newEndpoint("/dropbox/{token}", "GET")
+	DropFile       = newEndpoint("/dropbox/{token}", "POST")
+	DropBlock      = newEndpoint("/dropbox/{token}/node/{nodeId}/block/{offset}", "PUT")
 
 	templateRegex = regexp.MustCompile("{(.*?)}")
 )
@@ -67,4 +123,5 @@ const (
 	JsonEncoding Encoding = "application/json"
 	XmlEncoding  Encoding = "application/xml"
 	GobEncoding  Encoding = "application/gob"
+	TarEncoding  Encoding = "application/x-tar"
 )
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sdcoffey/olympus/graph"
+)
+
+// How often an idle event stream gets a comment line, so proxies don't time it out
+var EventKeepAlive = 15 * time.Second
+
+// GET v1/events?subtree=<nodeId>&cursor=<int>
+// returns -> a text/event-stream of changes to subtree or anything under it, each with the change's sequence
+// number as its id, its kind as its event name, and the change as JSON data. Streams from the Last-Event-ID
+// header if present, else cursor, else from now on. A cursor older than the journal keeps is 410 Gone.
+// Changes the user can't read about are left out, as in Changes.
+func (restApi OlympusApi) Events(writer http.ResponseWriter, req *http.Request) {
+	journal := restApi.graph.Journal()
+	flusher, ok := writer.(http.Flusher)
+	if journal == nil || !ok {
+		errorResponse(ApiError{INTERNAL, "Event streaming is unavailable"}, http.StatusServiceUnavailable, req, writer)
+		return
+	}
+
+	subtree := req.URL.Query().Get("subtree")
+	if subtree != "" && !restApi.graph.NodeWithId(subtree).Exists() {
+		writeNodeNotFoundError(subtree, req, writer)
+		return
+	}
+
+	cursor := journal.Seq()
+	if lastId := req.Header.Get("Last-Event-ID"); lastId != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(lastId, 10, 64); err != nil {
+			errorResponse(ApiError{INVALID_PARAM, fmt.Sprintf("Last-Event-ID: %s", lastId)}, http.StatusBadRequest, req, writer)
+			return
+		}
+	} else if param := req.URL.Query().Get("cursor"); param != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(param, 10, 64); err != nil {
+			errorResponse(ApiError{INVALID_PARAM, fmt.Sprintf("Cursor parameter: %s", param)}, http.StatusBadRequest, req, writer)
+			return
+		}
+	}
+
+	if min := journal.MinCursor(); cursor < min {
+		errorResponse(ApiError{CURSOR_EXPIRED, fmt.Sprintf("Changes before %d are no longer kept", min)}, http.StatusGone, req, writer)
+		return
+	}
+
+	// Subscribe before catching up, so nothing recorded in between is missed
+	notifications, unsubscribe := journal.Subscribe()
+	defer unsubscribe()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+	// Start with the cursor, so a client reconnecting before any changes resumes from here rather than now
+	fmt.Fprintf(writer, "retry: 3000\nid: %d\n\n", cursor)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(EventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var changes []graph.Change
+		changes, cursor = journal.Since(cursor, subtree, 0)
+		changes = restApi.readableChanges(changes, req)
+		for _, change := range changes {
+			if err := writeEvent(writer, change); err != nil {
+				return
+			}
+		}
+		if len(changes) > 0 {
+			flusher.Flush()
+		}
+
+		select {
+		case <-notifications:
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		case <-restApi.background.stopping:
+			return
+		}
+	}
+}
+
+func writeEvent(writer http.ResponseWriter, change graph.Change) error {
+	dat, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(writer, "id: %d\nevent: %s\ndata: %s\n\n", change.Seq, change.Kind, dat)
+	return err
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sdcoffey/olympus/graph"
+)
+
+// Version of the server, reported by /v1/info. Release builds set it with
+// -ldflags "-X github.com/sdcoffey/olympus/server/api.Version=<version>".
+var Version = "dev"
+
+// Version of the /v1 api, raised when it changes in ways existing clients can't handle
+const ApiVersion = 1
+
+// Optional parts of the api a server may have turned on, listed in InfoResponse.Features
+const (
+	AuthFeature     = "auth"
+	SharesFeature   = "shares"
+	WebhooksFeature = "webhooks"
+	MetricsFeature  = "metrics"
+	UploadsFeature  = "uploads"
+)
+
+// The server isn't ready while any data directory has less than minFreeBytes free. Zero turns the check off.
+func WithMinFreeBytes(minFreeBytes int64) Option {
+	return func(restApi *OlympusApi) {
+		restApi.minFreeBytes = minFreeBytes
+	}
+}
+
+// What clients need to know to talk to the server
+type InfoResponse struct {
+	Version       string     `json:"version"`
+	ApiVersion    int        `json:"api_version"`
+	Encodings     []Encoding `json:"encodings"`
+	HashAlgorithm string     `json:"hash_algorithm"`
+	BlockSize     int64      `json:"block_size"`
+	Features      []string   `json:"features"`
+}
+
+// Whether the server has the optional feature turned on
+func (info InfoResponse) Has(feature string) bool {
+	for _, f := range info.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// GET /healthz
+// returns -> 200 while the process is up
+func (restApi OlympusApi) Healthz(writer http.ResponseWriter, req *http.Request) {
+	dataResponse(HealthResponse{Status: "ok"}, http.StatusOK, req, writer)
+}
+
+// GET /readyz
+// returns -> 200 if the graph can be written, and every data directory can be written and has enough free space;
+// 503 otherwise. Checks are run at most once every ReadinessTTL. Only admins, or anyone when authentication is
+// off, are told which checks failed and why.
+func (restApi OlympusApi) Readyz(writer http.ResponseWriter, req *http.Request) {
+	response := restApi.readiness.check(restApi)
+	if restApi.users != nil {
+		if user, _, err := restApi.credentials(req); err != nil || !user.Admin {
+			response.Checks = nil
+		}
+	}
+
+	if response.Status == "ok" {
+		dataResponse(response, http.StatusOK, req, writer)
+	} else {
+		dataResponse(response, http.StatusServiceUnavailable, req, writer)
+	}
+}
+
+// How long a readiness check is reused for. It writes to the graph, so probes can't be allowed to run it on
+// every request.
+var ReadinessTTL = 5 * time.Second
+
+type readiness struct {
+	sync.Mutex
+	checked  time.Time
+	response HealthResponse
+}
+
+func (readiness *readiness) check(restApi OlympusApi) HealthResponse {
+	readiness.Lock()
+	defer readiness.Unlock()
+
+	if time.Since(readiness.checked) < ReadinessTTL {
+		return readiness.response
+	}
+
+	response := HealthResponse{Status: "ok"}
+	check := func(name string, err error) {
+		result := HealthCheck{Name: name, Ok: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+			response.Status = "unavailable"
+		}
+		response.Checks = append(response.Checks, result)
+	}
+
+	check("graph", restApi.graph.CheckWritable())
+	for _, dir := range graph.DataDirs() {
+		check("data_dir:"+dir, restApi.checkDataDir(dir))
+	}
+
+	readiness.checked, readiness.response = time.Now(), response
+	return response
+}
+
+func (restApi OlympusApi) checkDataDir(dir string) error {
+	if err := graph.CheckDataDir(dir); err != nil {
+		return err
+	} else if free, ok := graph.FreeBytes(dir); ok && free < restApi.minFreeBytes {
+		return fmt.Errorf("%d bytes free, less than the %d required", free, restApi.minFreeBytes)
+	}
+	return nil
+}
+
+// GET v1/info
+// returns -> the server's version and capabilities
+func (restApi OlympusApi) ServerInfo(writer http.ResponseWriter, req *http.Request) {
+	info := InfoResponse{
+		Version:       Version,
+		ApiVersion:    ApiVersion,
+		Encodings:     []Encoding{JsonEncoding, XmlEncoding, GobEncoding},
+		HashAlgorithm: graph.HashAlgorithm,
+		BlockSize:     graph.BLOCK_SIZE,
+		Features:      []string{},
+	}
+	if restApi.users != nil {
+		info.Features = append(info.Features, AuthFeature)
+	}
+	if restApi.shares != nil {
+		info.Features = append(info.Features, SharesFeature)
+	}
+	if restApi.webhooks != nil {
+		info.Features = append(info.Features, WebhooksFeature)
+	}
+	if restApi.metrics != nil {
+		info.Features = append(info.Features, MetricsFeature)
+	}
+	if restApi.uploads != nil {
+		info.Features = append(info.Features, UploadsFeature)
+	}
+
+	dataResponse(info, http.StatusOK, req, writer)
+}
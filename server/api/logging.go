@@ -0,0 +1,229 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/sdcoffey/olympus/logging"
+)
+
+// Every response carries the id of its request in this header. Clients may set it on requests to use their
+// own id, so they can find their requests in the server's logs.
+const RequestIdHeader = "X-Request-Id"
+
+const requestKey contextKey = "request"
+
+var (
+	requestIdRegex = regexp.MustCompile(`^[\w.:-]{1,128}$`)
+	// A share or drop box token is all it takes to use one, so it's kept out of the logs, even when the
+	// rest of the path doesn't match a route
+	tokenPathRegex = regexp.MustCompile(`^/v1/(shared|dropbox)/[^/]+`)
+)
+
+// Log every request to access, and every request that fails with a 5xx or panics to errors, as JSON.
+// Either may be nil.
+func WithLogs(access, errors *logging.Logger) Option {
+	return func(restApi *OlympusApi) {
+		restApi.accessLog = access
+		restApi.errorLog = errors
+	}
+}
+
+type AccessEntry struct {
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route,omitempty"`
+	Path      string    `json:"path"`
+	NodeId    string    `json:"node_id,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Remote    string    `json:"remote"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMs float64   `json:"latency_ms"`
+}
+
+type ErrorEntry struct {
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"request_id"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route,omitempty"`
+	Path      string    `json:"path"`
+	NodeId    string    `json:"node_id,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Status    int       `json:"status"`
+	Code      ErrorCode `json:"code,omitempty"`
+	Message   string    `json:"message"`
+	Stack     string    `json:"stack,omitempty"`
+}
+
+// What's learned about a request while it's handled, for logging
+type requestInfo struct {
+	id     string
+	route  string
+	nodeId string
+	user   string
+	err    *ApiError
+}
+
+func requestInfoFrom(req *http.Request) *requestInfo {
+	info, _ := req.Context().Value(requestKey).(*requestInfo)
+	return info
+}
+
+// Id of the request, or "" if it didn't come through the api's handler
+func requestId(req *http.Request) string {
+	if info := requestInfoFrom(req); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// Handle endpoint with handler, noting the endpoint's route and node for the logs
+func routed(endpoint Endpoint, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if info := requestInfoFrom(req); info != nil {
+			info.route = "/v1" + endpoint.Template()
+			if info.nodeId = paramFromRequest("nodeId", req); info.nodeId == "" {
+				info.nodeId = paramFromRequest("parentId", req)
+			}
+		}
+		handler(writer, req)
+	}
+}
+
+// Handle a route outside the versioned api with handler, noting the route for the logs
+func named(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if info := requestInfoFrom(req); info != nil {
+			info.route = route
+		}
+		handler(writer, req)
+	}
+}
+
+// Give each request an id, and log it once it's been handled
+func (restApi OlympusApi) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: req.Header.Get(RequestIdHeader)}
+		if !requestIdRegex.MatchString(info.id) {
+			info.id = uuid.New()
+		}
+		writer.Header().Set(RequestIdHeader, info.id)
+		recorder := &responseRecorder{ResponseWriter: writer}
+		body := &countingBody{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = body
+		}
+		req = req.WithContext(context.WithValue(req.Context(), requestKey, info))
+
+		defer func() {
+			if r := recover(); r != nil {
+				restApi.logError(info, req, http.StatusInternalServerError, fmt.Sprint(r), string(debug.Stack()))
+				if recorder.status == 0 {
+					errorResponse(ApiError{INTERNAL, "Internal error"}, http.StatusInternalServerError, req, recorder)
+				}
+			} else if info.err != nil && recorder.status >= http.StatusInternalServerError {
+				restApi.logError(info, req, recorder.status, info.err.Details, "")
+			}
+			restApi.logAccess(info, req, recorder, time.Since(start))
+			if restApi.metrics != nil {
+				restApi.metrics.observe(req, info.route, recorder, body.n, time.Since(start))
+			}
+		}()
+
+		next.ServeHTTP(recorder, req)
+	})
+}
+
+func (restApi OlympusApi) logAccess(info *requestInfo, req *http.Request, recorder *responseRecorder, latency time.Duration) {
+	if restApi.accessLog == nil {
+		return
+	}
+
+	restApi.accessLog.Log(AccessEntry{
+		Time:      time.Now().UTC(),
+		RequestId: info.id,
+		Method:    req.Method,
+		Route:     info.route,
+		Path:      loggedPath(req),
+		NodeId:    info.nodeId,
+		User:      info.user,
+		Remote:    restApi.remoteAddress(req),
+		Status:    recorder.Status(),
+		Bytes:     recorder.bytes,
+		LatencyMs: float64(latency) / float64(time.Millisecond),
+	})
+}
+
+func (restApi OlympusApi) logError(info *requestInfo, req *http.Request, status int, message, stack string) {
+	if restApi.errorLog == nil {
+		return
+	}
+
+	entry := ErrorEntry{
+		Time:      time.Now().UTC(),
+		RequestId: info.id,
+		Method:    req.Method,
+		Route:     info.route,
+		Path:      loggedPath(req),
+		NodeId:    info.nodeId,
+		User:      info.user,
+		Status:    status,
+		Message:   message,
+		Stack:     stack,
+	}
+	if info.err != nil {
+		entry.Code = info.err.Code
+	}
+	restApi.errorLog.Log(entry)
+}
+
+// Path of the request, with any share or drop box token replaced by "{token}"
+func loggedPath(req *http.Request) string {
+	return tokenPathRegex.ReplaceAllString(req.URL.Path, "/v1/$1/{token}")
+}
+
+// Records the status and size of a response as it's written
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(p []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(p)
+	recorder.bytes += int64(n)
+	return n, err
+}
+
+// Event streams need to flush
+func (recorder *responseRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Nothing written means an empty 200
+func (recorder *responseRecorder) Status() int {
+	if recorder.status == 0 {
+		return http.StatusOK
+	}
+	return recorder.status
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/metrics"
+)
+
+// Record requests and the graph's work in registry, and serve it at /metrics for Prometheus to scrape;
+// without this /metrics responds 503. When authentication is on, only admins may read it.
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(restApi *OlympusApi) {
+		restApi.metrics = newApiMetrics(registry, restApi.graph)
+	}
+}
+
+type apiMetrics struct {
+	registry   *metrics.Registry
+	requests   metrics.Counter
+	latency    metrics.Histogram
+	uploaded   metrics.Counter
+	downloaded metrics.Counter
+}
+
+func newApiMetrics(registry *metrics.Registry, ng *graph.NodeGraph) *apiMetrics {
+	apiMetrics := &apiMetrics{
+		registry: registry,
+		requests: registry.Counter("olympus_http_requests_total",
+			"Requests handled, by endpoint and status code", "method", "route", "code"),
+		latency: registry.Histogram("olympus_http_request_duration_seconds",
+			"Time taken to handle requests, by endpoint", metrics.LatencyBuckets, "method", "route"),
+		uploaded: registry.Counter("olympus_http_uploaded_bytes_total",
+			"Bytes read from request bodies, by endpoint", "method", "route"),
+		downloaded: registry.Counter("olympus_http_downloaded_bytes_total",
+			"Bytes written in responses, by endpoint", "method", "route"),
+	}
+
+	queries := registry.Histogram("olympus_graph_query_duration_seconds",
+		"Time taken by queries of the node graph, by kind", metrics.LatencyBuckets, "query")
+	ng.ObserveQueries(func(query string, duration time.Duration) {
+		queries.Observe(duration.Seconds(), query)
+	})
+
+	registry.CounterFunc("olympus_blocks_written_total", "Blocks written, including those already stored",
+		nil, func() []metrics.Sample {
+			written, _ := graph.BlockWrites()
+			return []metrics.Sample{{Value: float64(written)}}
+		})
+	registry.CounterFunc("olympus_blocks_deduplicated_total", "Blocks written that were already stored",
+		nil, func() []metrics.Sample {
+			_, deduplicated := graph.BlockWrites()
+			return []metrics.Sample{{Value: float64(deduplicated)}}
+		})
+	gauges := &graphGauges{ng: ng}
+	registry.GaugeFunc("olympus_nodes", "Nodes in the graph", nil, func() []metrics.Sample {
+		nodes, _ := gauges.read()
+		return []metrics.Sample{{Value: float64(nodes)}}
+	})
+	registry.GaugeFunc("olympus_data_dir_bytes", "Bytes of blocks in each data directory",
+		[]string{"dir"}, func() []metrics.Sample {
+			return gauges.dataDirSamples(func(dir graph.DataDirHealth) float64 { return float64(dir.Bytes) })
+		})
+	registry.GaugeFunc("olympus_data_dir_blocks", "Blocks in each data directory",
+		[]string{"dir"}, func() []metrics.Sample {
+			return gauges.dataDirSamples(func(dir graph.DataDirHealth) float64 { return float64(dir.Blocks) })
+		})
+
+	return apiMetrics
+}
+
+// How long counts of nodes and blocks are reused for. Counting walks every node and every block, so it's done
+// once per scrape rather than once for each gauge that reports it.
+const gaugeTTL = 5 * time.Second
+
+type graphGauges struct {
+	sync.Mutex
+	ng      *graph.NodeGraph
+	counted time.Time
+	nodes   int
+	dirs    []graph.DataDirHealth
+}
+
+func (gauges *graphGauges) read() (int, []graph.DataDirHealth) {
+	gauges.Lock()
+	defer gauges.Unlock()
+
+	if time.Since(gauges.counted) > gaugeTTL {
+		gauges.nodes = gauges.ng.NodeCount()
+		gauges.dirs = graph.CheckReplication(false, false).Dirs
+		gauges.counted = time.Now()
+	}
+	return gauges.nodes, gauges.dirs
+}
+
+func (gauges *graphGauges) dataDirSamples(value func(graph.DataDirHealth) float64) []metrics.Sample {
+	_, dirs := gauges.read()
+	var samples []metrics.Sample
+	for _, dir := range dirs {
+		samples = append(samples, metrics.Sample{LabelValues: []string{dir.Path}, Value: value(dir)})
+	}
+	return samples
+}
+
+func (apiMetrics *apiMetrics) observe(req *http.Request, route string, recorder *responseRecorder, uploaded int64, latency time.Duration) {
+	if route == "" {
+		// Not found, or turned away before routing
+		route = "unknown"
+	}
+
+	apiMetrics.requests.Inc(req.Method, route, strconv.Itoa(recorder.Status()))
+	apiMetrics.latency.Observe(latency.Seconds(), req.Method, route)
+	apiMetrics.uploaded.Add(float64(uploaded), req.Method, route)
+	apiMetrics.downloaded.Add(float64(recorder.bytes), req.Method, route)
+}
+
+// GET /metrics
+// returns -> metrics in the Prometheus text format
+func (restApi OlympusApi) Metrics(writer http.ResponseWriter, req *http.Request) {
+	if restApi.metrics == nil {
+		errorResponse(ApiError{INTERNAL, "Metrics are not enabled"}, http.StatusServiceUnavailable, req, writer)
+		return
+	} else if !restApi.requireAdmin(writer, req) {
+		return
+	}
+
+	writer.Header().Set("Content-Type", metrics.ContentType)
+	restApi.metrics.registry.WriteTo(writer)
+}
+
+// Counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (body *countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/sdcoffey/olympus/graph"
+)
+
+// Path endpoints mirror the node endpoints, addressing nodes by absolute path rather than id
+
+func pathFromRequest(req *http.Request) string {
+	return path.Clean("/" + paramFromRequest("path", req))
+}
+
+// GET v1/path/{path}
+// returns -> {nodeInfo}
+// GET v1/path/{path}?list=true, with the query params of ListNodes
+// returns -> [nodeInfo]
+// GET v1/path/{path}?download=true
+// returns -> file content
+func (restApi OlympusApi) PathInfo(writer http.ResponseWriter, req *http.Request) {
+	nodePath := pathFromRequest(req)
+	node := restApi.graph.NodeWithPath(nodePath)
+	if node == nil || !node.Exists() {
+		errorResponse(ApiError{NO_SUCH_NODE, nodePath}, http.StatusNotFound, req, writer)
+		return
+	} else if !restApi.requirePermission(node, graph.ReadPermission, writer, req) {
+		return
+	}
+
+	list, _ := strconv.ParseBool(req.URL.Query().Get("list"))
+	download, _ := strconv.ParseBool(req.URL.Query().Get("download"))
+
+	if list && node.IsDir() {
+		if children, err := restApi.childrenFromQuery(node, req); err != nil {
+			errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+		} else {
+			for i := range children {
+				children[i].Path = path.Join(nodePath, children[i].Name)
+			}
+			dataResponse(children, http.StatusOK, req, writer)
+		}
+	} else if list {
+		errorResponse(ApiError{INVALID_PARAM, "Can only list directories"}, http.StatusBadRequest, req, writer)
+	} else if download && node.IsDir() {
+		errorResponse(ApiError{IS_DIRECTORY, nodePath}, http.StatusBadRequest, req, writer)
+	} else if download {
+		serveNode(node, writer, req)
+	} else {
+		info := node.NodeInfo()
+		info.Path = nodePath
+		dataResponse(info, http.StatusOK, req, writer)
+	}
+}
+
+// POST v1/path/{path}?parents=<bool>
+// body -> {nodeInfo}, optional; the name comes from the path. With parents, missing directories are created.
+// returns -> {nodeInfo}
+func (restApi OlympusApi) CreatePath(writer http.ResponseWriter, req *http.Request) {
+	nodePath := pathFromRequest(req)
+	if nodePath == "/" {
+		errorResponse(ApiError{NODE_EXISTS, graph.RootNodeId}, http.StatusBadRequest, req, writer)
+		return
+	}
+
+	nodeInfo := graph.NodeInfo{Mode: 0644}
+	defer req.Body.Close()
+	if err := decoderFromHeader(req.Body, req.Header).Decode(&nodeInfo); err != nil && err != io.EOF {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+		return
+	}
+	nodeInfo.Name = path.Base(nodePath)
+
+	parents, _ := strconv.ParseBool(req.URL.Query().Get("parents"))
+	parent, err := restApi.directoryAtPath(path.Dir(nodePath), parents, req)
+	if err == errForbidden {
+		errorResponse(ApiError{FORBIDDEN, err.Error()}, http.StatusForbidden, req, writer)
+	} else if err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else if parent == nil {
+		errorResponse(ApiError{NO_SUCH_NODE, path.Dir(nodePath)}, http.StatusNotFound, req, writer)
+	} else {
+		restApi.createNode(parent, nodeInfo, nodePath, writer, req)
+	}
+}
+
+// DELETE v1/path/{path}
+func (restApi OlympusApi) RemovePath(writer http.ResponseWriter, req *http.Request) {
+	nodePath := pathFromRequest(req)
+	node := restApi.graph.NodeWithPath(nodePath)
+	if node == nil || !node.Exists() {
+		errorResponse(ApiError{NO_SUCH_NODE, nodePath}, http.StatusNotFound, req, writer)
+		return
+	}
+
+	restApi.removeNode(node, writer, req)
+}
+
+// The directory at dirPath, creating it and any missing ancestors if create is true, as the request's user.
+// Returns nil if it doesn't exist and create is false.
+func (restApi OlympusApi) directoryAtPath(dirPath string, create bool, req *http.Request) (*graph.Node, error) {
+	if node := restApi.graph.NodeWithPath(dirPath); node != nil && node.IsDir() {
+		return node, nil
+	} else if node != nil {
+		return nil, fmt.Errorf("%s is not a directory", dirPath)
+	} else if !create {
+		return nil, nil
+	}
+
+	parent, err := restApi.directoryAtPath(path.Dir(dirPath), true, req)
+	if err != nil {
+		return nil, err
+	} else if !restApi.permitted(parent, graph.WritePermission, req) {
+		return nil, errForbidden
+	}
+
+	return restApi.graph.NewOwnedNode(path.Base(dirPath), parent.Id, os.ModeDir|0755, ownerFromRequest(req))
+}
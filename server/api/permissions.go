@@ -0,0 +1,173 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/sdcoffey/olympus/graph"
+)
+
+var errForbidden = errors.New("Permission denied")
+
+// Whether the request's user is granted perm on node by its mode, writing a 403 if not. Without
+// authentication everything is permitted, and admins are permitted everything.
+func (restApi OlympusApi) requirePermission(node *graph.Node, perm graph.Permission, writer http.ResponseWriter, req *http.Request) bool {
+	if !restApi.permitted(node, perm, req) {
+		errorResponse(ApiError{FORBIDDEN, fmt.Sprintf("No %s permission on %s", perm, node.Id)}, http.StatusForbidden, req, writer)
+		return false
+	}
+	return true
+}
+
+// Adding to, removing from or renaming within a directory needs write permission on it
+func (restApi OlympusApi) requireParentPermission(node *graph.Node, writer http.ResponseWriter, req *http.Request) bool {
+	if parent := node.Parent(); parent != nil {
+		return restApi.requirePermission(parent, graph.WritePermission, writer, req)
+	}
+	return true
+}
+
+// Removing a directory removes everything in it, so every directory in the subtree that isn't empty needs
+// write permission too
+func (restApi OlympusApi) requireSubtreeRemovable(node *graph.Node, writer http.ResponseWriter, req *http.Request) bool {
+	children := node.Children()
+	if len(children) == 0 {
+		return true
+	} else if !restApi.requirePermission(node, graph.WritePermission, writer, req) {
+		return false
+	}
+
+	for _, child := range children {
+		if !restApi.requireSubtreeRemovable(child, writer, req) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the request's user is granted perm on node. Reading a node also needs read permission on every
+// ancestor, so nothing under a directory the user can't read is readable, however it's asked for.
+func (restApi OlympusApi) permitted(node *graph.Node, perm graph.Permission, req *http.Request) bool {
+	if !restApi.grants(node, perm, req) {
+		return false
+	} else if perm == graph.ReadPermission {
+		for ancestor := node.Parent(); ancestor != nil; ancestor = ancestor.Parent() {
+			if !restApi.grants(ancestor, graph.ReadPermission, req) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Whether node's own mode grants perm to the request's user
+func (restApi OlympusApi) grants(node *graph.Node, perm graph.Permission, req *http.Request) bool {
+	if restApi.users == nil {
+		return true
+	}
+
+	user, ok := userFromRequest(req)
+	return ok && (user.Admin || node.Permits(user.Username, user.Groups, perm))
+}
+
+// The changes the request's user may read about: those whose node, if it still exists, and every ancestor
+// that still exists grant read permission, as permitted requires of nodes that exist
+func (restApi OlympusApi) readableChanges(changes []graph.Change, req *http.Request) []graph.Change {
+	if restApi.users == nil {
+		return changes
+	}
+
+	// Changes in a batch mostly share ancestors, so each is only checked once
+	readable := make(map[string]bool)
+	permitted := func(nodeId string) bool {
+		if ok, checked := readable[nodeId]; checked {
+			return ok
+		}
+		node := restApi.graph.NodeWithId(nodeId)
+		ok := !node.Exists() || restApi.grants(node, graph.ReadPermission, req)
+		readable[nodeId] = ok
+		return ok
+	}
+
+	filtered := make([]graph.Change, 0, len(changes))
+	for _, change := range changes {
+		ok := permitted(change.NodeId)
+		for _, ancestor := range change.Ancestors {
+			ok = ok && permitted(ancestor)
+		}
+		if ok {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered
+}
+
+// Whether the request's user may change node's permissions, i.e. owns it, or the node has no owner
+func (restApi OlympusApi) owns(node *graph.Node, req *http.Request) bool {
+	if restApi.users == nil {
+		return true
+	}
+
+	user, ok := userFromRequest(req)
+	return ok && (user.Admin || node.Owner() == "" || node.Owner() == user.Username)
+}
+
+// Whether the request's user may put a node in group: admins may use any group, others only their own
+func (restApi OlympusApi) inGroup(group string, req *http.Request) bool {
+	if restApi.users == nil {
+		return true
+	}
+
+	user, ok := userFromRequest(req)
+	if !ok {
+		return false
+	} else if user.Admin {
+		return true
+	}
+
+	for _, userGroup := range user.Groups {
+		if userGroup == group {
+			return true
+		}
+	}
+	return false
+}
+
+// The owner of nodes a request creates: the user it authenticated as, if any
+func ownerFromRequest(req *http.Request) string {
+	user, _ := userFromRequest(req)
+	return user.Username
+}
+
+// Check each change an update would make to node: renaming or moving needs write permission on each
+// directory involved, touching needs write permission on node itself, chmod needs ownership, chgrp needs
+// ownership and membership of the new group, and only admins may give a node to another user.
+func (restApi OlympusApi) requireUpdatePermission(node *graph.Node, info graph.NodeInfo, writer http.ResponseWriter, req *http.Request) bool {
+	forbidden := func(details string) bool {
+		errorResponse(ApiError{FORBIDDEN, details}, http.StatusForbidden, req, writer)
+		return false
+	}
+
+	renaming := info.Name != "" && info.Name != node.Name()
+	moving := info.ParentId != "" && (node.Parent() == nil || info.ParentId != node.Parent().Id)
+
+	if (renaming || moving) && !restApi.requireParentPermission(node, writer, req) {
+		return false
+	} else if newParent := restApi.graph.NodeWithId(info.ParentId); moving && newParent.Exists() &&
+		!restApi.requirePermission(newParent, graph.WritePermission, writer, req) {
+		return false
+	} else if !info.MTime.IsZero() && !restApi.requirePermission(node, graph.WritePermission, writer, req) {
+		return false
+	} else if int(info.Mode) > 0 && info.Mode != node.Mode() && !restApi.owns(node, req) {
+		return forbidden("Only the owner of a node may change its mode")
+	} else if info.Owner != "" && info.Owner != node.Owner() && !restApi.requireAdmin(writer, req) {
+		return false
+	} else if info.Group != "" && info.Group != node.Group() && !restApi.owns(node, req) {
+		return forbidden("Only the owner of a node may change its group")
+	} else if info.Group != "" && info.Group != node.Group() && !restApi.inGroup(info.Group, req) {
+		return forbidden(fmt.Sprintf("Not a member of group %s", info.Group))
+	}
+
+	return true
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Believe the X-Forwarded-For and X-Forwarded-Proto headers of requests from these proxies, given as IP
+// addresses or CIDR ranges. Without any, or from anywhere else, they're ignored, since any client can set
+// them.
+func WithTrustedProxies(proxies []string) Option {
+	return func(restApi *OlympusApi) {
+		for _, proxy := range proxies {
+			if network, err := parseProxy(proxy); err == nil {
+				restApi.trustedProxies = append(restApi.trustedProxies, network)
+			}
+		}
+	}
+}
+
+// A trusted proxy, as an IP address or a CIDR range
+func parseProxy(proxy string) (*net.IPNet, error) {
+	if ip := net.ParseIP(proxy); ip == nil {
+		_, network, err := net.ParseCIDR(proxy)
+		return network, err
+	} else if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	} else {
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+}
+
+// Whether address is one of the trusted proxies
+func (restApi OlympusApi) trusted(address string) bool {
+	ip := net.ParseIP(address)
+	for _, network := range restApi.trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The address of the other end of req's connection
+func peerAddress(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// Whether req came straight from a trusted proxy, so its forwarding headers can be believed
+func (restApi OlympusApi) fromTrustedProxy(req *http.Request) bool {
+	return restApi.trusted(peerAddress(req))
+}
+
+// The address a request came from. Behind trusted proxies, that's the nearest address in X-Forwarded-For that
+// isn't one of them, since each proxy appends the address it heard from; otherwise it's the connection's.
+func (restApi OlympusApi) remoteAddress(req *http.Request) string {
+	address := peerAddress(req)
+	if !restApi.trusted(address) {
+		return address
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		address = hop
+		if !restApi.trusted(hop) {
+			break
+		}
+	}
+	return address
+}
@@ -0,0 +1,333 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/share"
+)
+
+// Serve share links from store; without this the share endpoints respond 503
+func WithShares(store *share.Store) Option {
+	return func(restApi *OlympusApi) {
+		restApi.shares = store
+	}
+}
+
+func (restApi OlympusApi) sharesEnabled(writer http.ResponseWriter, req *http.Request) bool {
+	if restApi.shares == nil {
+		errorResponse(ApiError{INTERNAL, "Sharing is not enabled"}, http.StatusServiceUnavailable, req, writer)
+		return false
+	}
+	return true
+}
+
+func (restApi OlympusApi) shareResponse(s share.Share, req *http.Request) ShareResponse {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	} else if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" && restApi.fromTrustedProxy(req) {
+		scheme = proto
+	}
+
+	token := restApi.shares.Token(s)
+	endpoint := SharedNode.Build(token)
+	if s.IsDropBox() {
+		endpoint = DropBoxInfo.Build(token)
+	}
+
+	return ShareResponse{
+		Token: token,
+		Url:   scheme + "://" + req.Host + "/v1" + endpoint.String(),
+		Info:  s,
+	}
+}
+
+// POST v1/node/{nodeId}/shares
+// body -> {password, expires_in, max_downloads}
+// returns -> {token, url, info}; anyone with the url can browse and download the node without an account
+func (restApi OlympusApi) CreateShare(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.sharesEnabled(writer, req) {
+		return
+	}
+
+	node := restApi.graph.NodeWithId(paramFromRequest("nodeId", req))
+	if !node.Exists() {
+		writeNodeNotFoundError(node.Id, req, writer)
+		return
+	} else if !restApi.requirePermission(node, graph.ReadPermission, writer, req) {
+		return
+	}
+
+	var shareRequest ShareRequest
+	defer req.Body.Close()
+	if err := decoderFromHeader(req.Body, req.Header).Decode(&shareRequest); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else if shareRequest.ExpiresIn < 0 {
+		errorResponse(ApiError{INVALID_PARAM, "expires_in cannot be negative"}, http.StatusBadRequest, req, writer)
+	} else if s, _, err := restApi.shares.Create(node.Id, ownerFromRequest(req), shareRequest.Password,
+		time.Duration(shareRequest.ExpiresIn)*time.Second, shareRequest.MaxDownloads); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else {
+		dataResponse(restApi.shareResponse(s, req), http.StatusCreated, req, writer)
+	}
+}
+
+// GET v1/node/{nodeId}/shares
+// returns -> [{token, url, info}] for the node's shares and drop boxes that haven't expired, including what
+// was uploaded to each drop box and by whom
+func (restApi OlympusApi) ListShares(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.sharesEnabled(writer, req) {
+		return
+	}
+
+	node := restApi.graph.NodeWithId(paramFromRequest("nodeId", req))
+	if !node.Exists() {
+		writeNodeNotFoundError(node.Id, req, writer)
+		return
+	} else if !restApi.requirePermission(node, graph.ReadPermission, writer, req) {
+		return
+	}
+
+	shares := restApi.shares.ForNode(node.Id)
+	responses := make([]ShareResponse, len(shares))
+	for i, s := range shares {
+		responses[i] = restApi.shareResponse(s, req)
+	}
+
+	dataResponse(responses, http.StatusOK, req, writer)
+}
+
+// DELETE v1/shares/{shareId}, by its creator or the node's owner
+func (restApi OlympusApi) RevokeShare(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.sharesEnabled(writer, req) {
+		return
+	}
+
+	shareId := paramFromRequest("shareId", req)
+	s, ok := restApi.shares.Share(shareId)
+	if !ok {
+		errorResponse(ApiError{NO_SUCH_SHARE, shareId}, http.StatusNotFound, req, writer)
+	} else if s.Creator != ownerFromRequest(req) && !restApi.owns(restApi.graph.NodeWithId(s.NodeId), req) {
+		errorResponse(ApiError{FORBIDDEN, "Only the creator of a share or the owner of its node may revoke it"}, http.StatusForbidden, req, writer)
+	} else if err := restApi.shares.Revoke(shareId); err != nil {
+		errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
+	} else {
+		writer.WriteHeader(http.StatusOK)
+	}
+}
+
+// The share of kind a request's token opens and the node it's for, writing an error if there isn't one.
+// Passwords are given as the password of HTTP Basic auth, with any username, so browsers prompt for them.
+func (restApi OlympusApi) openShare(kind share.Kind, writer http.ResponseWriter, req *http.Request) (share.Share, *graph.Node, bool) {
+	if !restApi.sharesEnabled(writer, req) {
+		return share.Share{}, nil, false
+	}
+
+	_, password, _ := req.BasicAuth()
+	s, err := restApi.shares.Open(paramFromRequest("token", req), password)
+	if err == nil && s.IsDropBox() != (kind == share.DropBox) {
+		err = share.ErrNoSuchShare
+	}
+
+	if err == share.ErrPasswordRequired {
+		writer.Header().Set("WWW-Authenticate", `Basic realm="olympus share"`)
+		errorResponse(ApiError{UNAUTHORIZED, err.Error()}, http.StatusUnauthorized, req, writer)
+		return s, nil, false
+	} else if err == share.ErrExpired {
+		errorResponse(ApiError{SHARE_EXPIRED, err.Error()}, http.StatusGone, req, writer)
+		return s, nil, false
+	} else if err != nil {
+		errorResponse(ApiError{NO_SUCH_SHARE, err.Error()}, http.StatusNotFound, req, writer)
+		return s, nil, false
+	}
+
+	node := restApi.graph.NodeWithId(s.NodeId)
+	if !node.Exists() {
+		errorResponse(ApiError{NO_SUCH_SHARE, "Shared node no longer exists"}, http.StatusNotFound, req, writer)
+		return s, nil, false
+	}
+
+	return s, node, true
+}
+
+// The download share a request's token opens and the node it asks for, which is the shared node or anything
+// under it that the share's creator may still read, writing an error if there isn't one
+func (restApi OlympusApi) sharedNode(writer http.ResponseWriter, req *http.Request) (share.Share, *graph.Node, bool) {
+	s, root, ok := restApi.openShare(share.Download, writer, req)
+	if !ok {
+		return s, nil, false
+	}
+
+	readable := restApi.sharerReads(s)
+	if !readable(root) {
+		errorResponse(ApiError{NO_SUCH_SHARE, "Shared node is no longer readable by its creator"}, http.StatusNotFound, req, writer)
+		return s, nil, false
+	}
+
+	nodeId := paramFromRequest("nodeId", req)
+	if nodeId == "" || nodeId == root.Id {
+		return s, root, true
+	}
+
+	node := restApi.graph.NodeWithId(nodeId)
+	if node.Exists() && readable(node) {
+		for parent := node.Parent(); parent != nil && readable(parent); parent = parent.Parent() {
+			if parent.Id == root.Id {
+				return s, node, true
+			}
+		}
+	}
+
+	writeNodeNotFoundError(nodeId, req, writer)
+	return s, nil, false
+}
+
+// Whether the creator of s may read a node, which bounds what the share reaches, so sharing never gives
+// anyone more than its creator has. Without authentication, everything is readable.
+func (restApi OlympusApi) sharerReads(s share.Share) func(*graph.Node) bool {
+	if restApi.users == nil {
+		return func(*graph.Node) bool { return true }
+	}
+
+	user, ok := restApi.users.User(s.Creator)
+	return func(node *graph.Node) bool {
+		return ok && (user.Admin || node.Permits(user.Username, user.Groups, graph.ReadPermission))
+	}
+}
+
+// Info about a node at nodePath within a share, which doesn't reveal who owns it or where it is outside the share
+func sharedInfo(node *graph.Node, nodePath string, rootId string) graph.NodeInfo {
+	info := node.NodeInfo()
+	info.Owner, info.Group = "", ""
+	info.Path = nodePath
+	if node.Id == rootId {
+		info.ParentId = ""
+	}
+	return info
+}
+
+// Path of node within the share rooted at rootId, which must be the node or one of its ancestors
+func sharedPath(node *graph.Node, rootId string) string {
+	var names []string
+	for ; node != nil && node.Id != rootId; node = node.Parent() {
+		names = append([]string{node.Name()}, names...)
+	}
+	return "/" + strings.Join(names, "/")
+}
+
+// GET v1/shared/{token}, without an account
+// returns -> {nodeInfo} of the shared node
+func (restApi OlympusApi) SharedNode(writer http.ResponseWriter, req *http.Request) {
+	if _, node, ok := restApi.sharedNode(writer, req); ok {
+		dataResponse(sharedInfo(node, "/", node.Id), http.StatusOK, req, writer)
+	}
+}
+
+// GET v1/shared/{token}/node/{nodeId}, without an account, with the query params of ListNodes
+// returns -> [nodeInfo] of a directory's children
+func (restApi OlympusApi) ListShared(writer http.ResponseWriter, req *http.Request) {
+	s, node, ok := restApi.sharedNode(writer, req)
+	if !ok {
+		return
+	} else if !node.IsDir() {
+		errorResponse(ApiError{INVALID_PARAM, "Can only list directories"}, http.StatusBadRequest, req, writer)
+		return
+	}
+
+	children, err := restApi.childrenFromQuery(node, req)
+	if err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+		return
+	}
+
+	dirPath := sharedPath(node, s.NodeId)
+	readable := restApi.sharerReads(s)
+	infos := make([]graph.NodeInfo, 0, len(children))
+	for _, child := range children {
+		if childNode := restApi.graph.NodeWithId(child.Id); readable(childNode) {
+			infos = append(infos, sharedInfo(childNode, path.Join(dirPath, child.Name), s.NodeId))
+		}
+	}
+	dataResponse(infos, http.StatusOK, req, writer)
+}
+
+// GET v1/shared/{token}/node/{nodeId}/stream, without an account
+// returns -> file content. Each download counts against the share's limit, except range requests that
+// resume one part way through.
+func (restApi OlympusApi) DownloadShared(writer http.ResponseWriter, req *http.Request) {
+	s, node, ok := restApi.sharedNode(writer, req)
+	if !ok {
+		return
+	} else if node.IsDir() {
+		errorResponse(ApiError{IS_DIRECTORY, node.Id}, http.StatusBadRequest, req, writer)
+		return
+	}
+
+	if !resumesDownload(node, req) {
+		if _, err := restApi.shares.CountDownload(s.Id); err == share.ErrExpired {
+			errorResponse(ApiError{SHARE_EXPIRED, err.Error()}, http.StatusGone, req, writer)
+			return
+		} else if err == share.ErrNoSuchShare {
+			errorResponse(ApiError{NO_SUCH_SHARE, err.Error()}, http.StatusNotFound, req, writer)
+			return
+		} else if err != nil {
+			errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
+			return
+		}
+	}
+
+	serveNode(node, writer, req)
+}
+
+// Whether req only asks for node's content from part way through, as when resuming a download: a single byte
+// range that starts after the beginning, which http.ServeContent will honour. Anything else, including
+// several ranges or an If-Range that doesn't match, gets content from the start.
+func resumesDownload(node *graph.Node, req *http.Request) bool {
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" {
+		if t, err := http.ParseTime(ifRange); err != nil || t.Unix() != node.MTime().Unix() {
+			return false
+		}
+	}
+
+	header := req.Header.Get("Range")
+	if !strings.HasPrefix(header, "bytes=") {
+		return false
+	}
+
+	var start int64 = -1
+	for _, spec := range strings.Split(strings.TrimPrefix(header, "bytes="), ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		} else if start >= 0 {
+			return false
+		}
+
+		dash := strings.Index(spec, "-")
+		if dash < 0 {
+			return false
+		}
+		first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+		var err error
+		if first != "" {
+			start, err = strconv.ParseInt(first, 10, 64)
+		} else if suffix, suffixErr := strconv.ParseInt(last, 10, 64); suffixErr != nil {
+			err = suffixErr
+		} else {
+			// The last suffix bytes, which is all of them if there are no more than that
+			if start = node.Size() - suffix; start < 0 {
+				start = 0
+			}
+		}
+		if err != nil || start < 0 {
+			return false
+		}
+	}
+
+	return start > 0
+}
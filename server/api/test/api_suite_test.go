@@ -26,14 +26,23 @@ type ApiTestSuite struct {
 
 func (suite *ApiTestSuite) SetUpTest(t *C) {
 	suite.ng, suite.testDir = testutils.TestInit()
-	suite.server = httptest.NewServer(api.NewApi(suite.ng))
+	suite.serve()
 	suite.client = http.DefaultClient
 }
 
 func (suite *ApiTestSuite) TearDownTest(t *C) {
+	suite.server.Close()
 	os.Remove(suite.testDir)
 }
 
+// Serve the api with the given options, in place of the server the test started with
+func (suite *ApiTestSuite) serve(options ...api.Option) {
+	if suite.server != nil {
+		suite.server.Close()
+	}
+	suite.server = httptest.NewServer(api.NewApi(suite.ng, options...))
+}
+
 func TestNodeSuite(t *testing.T) {
 	TestingT(t)
 }
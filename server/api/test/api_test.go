@@ -1,21 +1,34 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"io/ioutil"
 
+	"github.com/sdcoffey/olympus/auth"
 	. "github.com/sdcoffey/olympus/checkers"
 	"github.com/sdcoffey/olympus/graph"
 	"github.com/sdcoffey/olympus/graph/testutils"
+	"github.com/sdcoffey/olympus/logging"
+	"github.com/sdcoffey/olympus/media"
+	"github.com/sdcoffey/olympus/metrics"
 	"github.com/sdcoffey/olympus/server/api"
+	"github.com/sdcoffey/olympus/share"
+	"github.com/sdcoffey/olympus/upload"
+	"github.com/sdcoffey/olympus/webhook"
 	. "gopkg.in/check.v1"
 )
 
@@ -66,6 +79,35 @@ func (suite *ApiTestSuite) TestListNodes_returnsNFilesWhenLimitProvided(t *C) {
 	t.Check(file.Name, Equals, "child1")
 }
 
+func (suite *ApiTestSuite) TestListNodes_sortsBySortAndOrderParams(t *C) {
+	endpoint := api.ListNodes.Build(graph.RootNodeId).Query("sort", "natural").Query("order", "desc")
+	req := suite.request(endpoint, nil)
+	suite.ng.NewNode("file2", graph.RootNodeId, os.ModeDir)
+	suite.ng.NewNode("file10", graph.RootNodeId, os.ModeDir)
+
+	resp, err := suite.client.Do(req)
+	t.Check(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	var files []graph.NodeInfo
+	decode(resp, &files)
+
+	t.Check(files, HasLen, 2)
+	t.Check(files[0].Name, Equals, "file10")
+	t.Check(files[1].Name, Equals, "file2")
+}
+
+func (suite *ApiTestSuite) TestListNodes_returns400ForUnknownSort(t *C) {
+	req := suite.request(api.ListNodes.Build(graph.RootNodeId).Query("sort", "color"), nil)
+
+	resp, err := suite.client.Do(req)
+	t.Check(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	apiResponse := decode(resp, nil)
+	t.Check(apiResponse.Error.Code, Equals, api.INVALID_PARAM)
+}
+
 func (suite *ApiTestSuite) TestListNodes_startsWithNFileWhenWatermarkProvided(t *C) {
 	endpoint := api.ListNodes.Build(graph.RootNodeId).Query("watermark", "1")
 	req := suite.request(endpoint, nil)
@@ -260,6 +302,47 @@ func (suite *ApiTestSuite) TestCreateNode_createsNodeSuccessfully(t *C) {
 	t.Check(node.MTime().Sub(time.Now()) < time.Second, IsTrue)
 }
 
+func (suite *ApiTestSuite) TestDownloadNode_usesDetectedContentType(t *C) {
+	id, err := suite.createNode(graph.RootNodeId, graph.NodeInfo{Name: "photo", Mode: 0755})
+	t.Assert(err, IsNil)
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), testutils.RandDat(100)...)
+	req := suite.request(api.WriteBlock.Build(id, 0), bytes.NewReader(png))
+	req.Header.Add("Content-Hash", graph.Hash(png))
+	resp, err := suite.client.Do(req)
+	t.Check(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusCreated)
+
+	resp, err = suite.client.Do(suite.request(api.DownloadNode.Build(id), nil))
+	t.Check(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(resp.Header.Get("Content-Type"), Equals, "image/png")
+}
+
+func (suite *ApiTestSuite) TestDownloadNode_sendsScriptableContentAsAttachment(t *C) {
+	suite.serve(api.WithShares(suite.newShares(t)))
+	page := suite.writeFile(t, graph.RootNodeId, "notes.txt", []byte("<html><script>alert(1)</script></html>"))
+	t.Assert(page.Type(), Equals, "text/html")
+	created := suite.createShare(t, page.Id, api.ShareRequest{})
+
+	for _, req := range []*http.Request{
+		suite.request(api.DownloadNode.Build(page.Id), nil),
+		suite.request(api.DownloadShared.Build(created.Token, page.Id), nil),
+	} {
+		resp, err := suite.client.Do(req)
+		t.Assert(err, IsNil)
+		t.Check(resp.StatusCode, Equals, http.StatusOK)
+		t.Check(resp.Header.Get("X-Content-Type-Options"), Equals, "nosniff")
+		t.Check(resp.Header.Get("Content-Disposition"), Equals, `attachment; filename="notes.txt"`)
+	}
+
+	text := suite.writeFile(t, graph.RootNodeId, "plain.txt", []byte("just text"))
+	resp, err := suite.client.Do(suite.request(api.DownloadNode.Build(text.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.Header.Get("X-Content-Type-Options"), Equals, "nosniff")
+	t.Check(resp.Header.Get("Content-Disposition"), Equals, "")
+}
+
 func (suite *ApiTestSuite) TestUpdateNode_updatesNode(t *C) {
 	ni := graph.NodeInfo{
 		Name: "thing.txt",
@@ -624,6 +707,1893 @@ func (suite *ApiTestSuite) TestReadBlock_redirectsWhenBlockFound(t *C) {
 	t.Check(resp.ContentLength, Equals, int64(graph.MEGABYTE))
 }
 
+func (suite *ApiTestSuite) TestThumbnail_servesJpegWithEtag(t *C) {
+	id, err := suite.createNode(graph.RootNodeId, graph.NodeInfo{Name: "photo.png", Mode: 0755})
+	t.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	t.Assert(png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 200))), IsNil)
+	req := suite.request(api.WriteBlock.Build(id, 0), bytes.NewReader(buf.Bytes()))
+	req.Header.Add("Content-Hash", graph.Hash(buf.Bytes()))
+	resp, err := suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusCreated)
+
+	resp, err = suite.client.Do(suite.request(api.Thumbnail.Build(id, 64), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(resp.Header.Get("Content-Type"), Equals, "image/jpeg")
+	t.Check(resp.Header.Get("Cache-Control"), Equals, "private, no-cache")
+
+	etag := resp.Header.Get("ETag")
+	t.Check(etag, Not(Equals), "")
+
+	req = suite.request(api.Thumbnail.Build(id, 64), nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotModified)
+}
+
+func (suite *ApiTestSuite) TestThumbnail_returns400ForNonImage(t *C) {
+	id, err := suite.createNodeWithSize(graph.RootNodeId, graph.NodeInfo{Name: "notes.txt", Mode: 0755}, 1024)
+	t.Assert(err, IsNil)
+
+	resp, err := suite.client.Do(suite.request(api.Thumbnail.Build(id, 64), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+	t.Check(msg(resp), Contains, string(api.NOT_AN_IMAGE))
+
+	resp, err = suite.client.Do(suite.request(api.Thumbnail.Build(id, 65), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (suite *ApiTestSuite) uploadId3(name, artist string) string {
+	id, err := suite.createNode(graph.RootNodeId, graph.NodeInfo{Name: name, Mode: 0755})
+	if err != nil {
+		panic(err)
+	}
+
+	body := append([]byte{3}, artist...)
+	frame := append([]byte{'T', 'P', 'E', '1', 0, 0, 0, byte(len(body)), 0, 0}, body...)
+	data := append([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0, byte(len(frame))}, frame...)
+
+	req := suite.request(api.WriteBlock.Build(id, 0), bytes.NewReader(data))
+	req.Header.Add("Content-Hash", graph.Hash(data))
+	if resp, err := suite.client.Do(req); err != nil {
+		panic(err)
+	} else if resp.StatusCode != http.StatusCreated {
+		panic(msg(resp))
+	}
+
+	return id
+}
+
+func (suite *ApiTestSuite) TestExtendedInfo_includesMetadata(t *C) {
+	id := suite.uploadId3("song.mp3", "Band")
+
+	resp, err := suite.client.Do(suite.request(api.ExtendedInfo.Build(id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	var info graph.ExtendedNodeInfo
+	decode(resp, &info)
+	t.Check(info.Id, Equals, id)
+	t.Check(info.Name, Equals, "song.mp3")
+	t.Check(info.Metadata[media.Artist], Equals, "Band")
+}
+
+func (suite *ApiTestSuite) TestListNodes_filtersByMetadata(t *C) {
+	suite.uploadId3("a.mp3", "Band")
+	suite.uploadId3("b.mp3", "Other Band")
+
+	resp, err := suite.client.Do(suite.request(api.ListNodes.Build(graph.RootNodeId).Query(media.Artist, "other band"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	var files []graph.NodeInfo
+	decode(resp, &files)
+	t.Assert(files, HasLen, 1)
+	t.Check(files[0].Name, Equals, "b.mp3")
+}
+
+func (suite *ApiTestSuite) TestSearch_returnsMatchingExtendedInfos(t *C) {
+	suite.uploadId3("a.mp3", "Band")
+	suite.uploadId3("b.mp3", "Other Band")
+
+	resp, err := suite.client.Do(suite.request(api.Search.Build(graph.RootNodeId).Query(media.Artist, "Band"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	var infos []graph.ExtendedNodeInfo
+	decode(resp, &infos)
+	t.Assert(infos, HasLen, 1)
+	t.Check(infos[0].Name, Equals, "a.mp3")
+	t.Check(infos[0].Metadata[media.Artist], Equals, "Band")
+}
+
+func (suite *ApiTestSuite) TestSearch_returns400ForBadCaptureTime(t *C) {
+	resp, err := suite.client.Do(suite.request(api.Search.Build(graph.RootNodeId).Query("captured_after", "March"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+	t.Check(msg(resp), Contains, string(api.INVALID_PARAM))
+}
+
+func (suite *ApiTestSuite) TestPathInfo_returnsInfoWithPath(t *C) {
+	dir, _ := suite.ng.NewNode("docs", graph.RootNodeId, os.ModeDir|0755)
+	file, _ := suite.ng.NewNode("notes.txt", dir.Id, 0644)
+
+	resp, err := suite.client.Do(suite.request(api.PathInfo.Build("docs/notes.txt"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	var info graph.NodeInfo
+	decode(resp, &info)
+	t.Check(info.Id, Equals, file.Id)
+	t.Check(info.Path, Equals, "/docs/notes.txt")
+
+	resp, err = suite.client.Do(suite.request(api.PathInfo.Build("docs/missing.txt"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+	t.Check(decode(resp, nil).Error.Details, Equals, "/docs/missing.txt")
+}
+
+func (suite *ApiTestSuite) TestPathInfo_listsAndDownloads(t *C) {
+	dir, _ := suite.ng.NewNode("docs", graph.RootNodeId, os.ModeDir|0755)
+	file, _ := suite.ng.NewNode("notes.txt", dir.Id, 0644)
+	t.Assert(file.WriteData([]byte("hello"), 0), IsNil)
+
+	resp, err := suite.client.Do(suite.request(api.PathInfo.Build("docs").Query("list", "true"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	var files []graph.NodeInfo
+	decode(resp, &files)
+	t.Assert(files, HasLen, 1)
+	t.Check(files[0].Path, Equals, "/docs/notes.txt")
+
+	resp, err = suite.client.Do(suite.request(api.PathInfo.Build("docs/notes.txt").Query("download", "true"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	body, _ := ioutil.ReadAll(resp.Body)
+	t.Check(string(body), Equals, "hello")
+}
+
+func (suite *ApiTestSuite) TestCreatePath_createsMissingParents(t *C) {
+	req := suite.request(api.CreatePath.Build("a/b/c.txt"), nil)
+	resp, err := suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+
+	req = suite.request(api.CreatePath.Build("a/b/c.txt").Query("parents", "true"), nil)
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusCreated)
+
+	var info graph.NodeInfo
+	decode(resp, &info)
+	t.Check(info.Path, Equals, "/a/b/c.txt")
+	t.Check(info.Mode, Equals, os.FileMode(0644))
+	t.Check(suite.ng.NodeWithPath("/a/b").IsDir(), IsTrue)
+}
+
+func (suite *ApiTestSuite) TestRemovePath_removesNode(t *C) {
+	dir, _ := suite.ng.NewNode("docs", graph.RootNodeId, os.ModeDir|0755)
+	suite.ng.NewNode("notes.txt", dir.Id, 0644)
+
+	resp, err := suite.client.Do(suite.request(api.RemovePath.Build("docs/notes.txt"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(suite.ng.NodeWithPath("/docs/notes.txt"), IsNil)
+}
+
+func (suite *ApiTestSuite) TestRemovePath_returns400ForRoot(t *C) {
+	resp, err := suite.client.Do(suite.request(api.RemovePath.Build(""), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+	t.Check(decode(resp, nil).Error.Code, Equals, api.INVALID_PARAM)
+	t.Check(suite.ng.RootNode.Exists(), IsTrue)
+}
+
+func (suite *ApiTestSuite) TestExportNode_returns404ForMissingNode(t *C) {
+	req := suite.request(api.ExportNode.Build("not-a-node"), nil)
+	resp, err := suite.client.Do(req)
+	t.Check(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (suite *ApiTestSuite) TestExportImport_roundTripsSubtree(t *C) {
+	folder, err := suite.ng.NewNode("folder", graph.RootNodeId, os.ModeDir)
+	t.Check(err, IsNil)
+	_, err = suite.createNodeWithSize(folder.Id, graph.NodeInfo{Name: "file.txt", Mode: 0644}, 1024)
+	t.Check(err, IsNil)
+	destination, err := suite.ng.NewNode("destination", graph.RootNodeId, os.ModeDir)
+	t.Check(err, IsNil)
+
+	resp, err := suite.client.Do(suite.request(api.ExportNode.Build(folder.Id), nil))
+	t.Check(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(resp.Header.Get("Content-Type"), Equals, string(api.TarEncoding))
+
+	req := suite.request(api.ImportNode.Build(destination.Id), resp.Body)
+	req.Header.Set("Content-Type", string(api.TarEncoding))
+	resp, err = suite.client.Do(req)
+	t.Check(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusCreated)
+
+	var report graph.ImportReport
+	decode(resp, &report)
+	t.Check(report.Nodes, Equals, 2)
+	t.Check(report.SkippedBlocks, Equals, 1)
+
+	imported := suite.ng.NodeWithName(destination.Id, "folder")
+	t.Assert(imported, NotNil)
+	t.Check(imported.Children(), HasLen, 1)
+	t.Check(imported.Children()[0].Size(), Equals, int64(1024))
+}
+
+func (suite *ApiTestSuite) TestChanges_returnsChangesSinceCursorForSubtree(t *C) {
+	journal, _ := graph.OpenJournal("")
+	suite.ng.UseJournal(journal)
+
+	dir, _ := suite.ng.NewNode("dir", graph.RootNodeId, os.ModeDir)
+	resp, err := suite.client.Do(suite.request(api.Changes.Build(), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	var changes api.ChangesResponse
+	decode(resp, &changes)
+	t.Check(changes.Changes, HasLen, 0)
+	t.Check(changes.Cursor, Equals, uint64(1))
+
+	file, _ := suite.ng.NewNode("file", dir.Id, 0644)
+	suite.ng.NewNode("elsewhere", graph.RootNodeId, 0644)
+	file.SetName("renamed")
+
+	endpoint := api.Changes.Build().Query("cursor", fmt.Sprint(changes.Cursor)).Query("subtree", dir.Id)
+	resp, err = suite.client.Do(suite.request(endpoint, nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	decode(resp, &changes)
+	t.Assert(changes.Changes, HasLen, 2)
+	t.Check(changes.Changes[0].Kind, Equals, graph.Created)
+	t.Check(changes.Changes[1].Kind, Equals, graph.Renamed)
+	t.Check(changes.Changes[1].Info.Name, Equals, "renamed")
+	t.Check(changes.Cursor, Equals, uint64(4))
+}
+
+func (suite *ApiTestSuite) TestChanges_returns400ForBadCursor(t *C) {
+	journal, _ := graph.OpenJournal("")
+	suite.ng.UseJournal(journal)
+
+	resp, err := suite.client.Do(suite.request(api.Changes.Build().Query("cursor", "latest"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+	t.Check(msg(resp), Contains, string(api.INVALID_PARAM))
+}
+
+func (suite *ApiTestSuite) TestChanges_returns410ForCursorNoLongerKept(t *C) {
+	journal, _ := graph.OpenJournal("")
+	suite.ng.UseJournal(journal)
+	for i := 0; i < 3; i++ {
+		suite.ng.NewNode(fmt.Sprint("file", i), graph.RootNodeId, 0644)
+	}
+	t.Assert(journal.Retain(1), IsNil)
+
+	resp, err := suite.client.Do(suite.request(api.Changes.Build().Query("cursor", "1"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusGone)
+	t.Check(msg(resp), Contains, string(api.CURSOR_EXPIRED))
+
+	resp, err = suite.client.Do(suite.request(api.Changes.Build().Query("cursor", "2"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+// Read server-sent events from rd until count of them have carried data
+func readEvents(rd *bufio.Reader, count int) (ids, kinds []string) {
+	for len(kinds) < count {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			panic(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		} else if strings.HasPrefix(line, "event: ") {
+			kinds = append(kinds, strings.TrimPrefix(line, "event: "))
+		}
+	}
+	return ids, kinds
+}
+
+func (suite *ApiTestSuite) TestEvents_streamsChangesToSubtree(t *C) {
+	journal, _ := graph.OpenJournal("")
+	suite.ng.UseJournal(journal)
+	dir, _ := suite.ng.NewNode("dir", graph.RootNodeId, os.ModeDir)
+
+	resp, err := suite.client.Do(suite.request(api.Events.Build().Query("subtree", dir.Id), nil))
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(resp.Header.Get("Content-Type"), Equals, "text/event-stream")
+
+	suite.ng.NewNode("elsewhere", graph.RootNodeId, 0644)
+	file, _ := suite.ng.NewNode("file", dir.Id, 0644)
+	file.SetName("renamed")
+
+	ids, kinds := readEvents(bufio.NewReader(resp.Body), 2)
+	t.Check(ids, DeepEquals, []string{"1", "3", "4"})
+	t.Check(kinds, DeepEquals, []string{string(graph.Created), string(graph.Renamed)})
+}
+
+func (suite *ApiTestSuite) TestEvents_resumesFromLastEventId(t *C) {
+	journal, _ := graph.OpenJournal("")
+	suite.ng.UseJournal(journal)
+	file, _ := suite.ng.NewNode("file", graph.RootNodeId, 0644)
+	file.SetName("renamed")
+	file.SetMode(0600)
+
+	req := suite.request(api.Events.Build(), nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := suite.client.Do(req)
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+
+	ids, kinds := readEvents(bufio.NewReader(resp.Body), 2)
+	t.Check(ids, DeepEquals, []string{"1", "2", "3"})
+	t.Check(kinds, DeepEquals, []string{string(graph.Renamed), string(graph.ModeChanged)})
+}
+
+func (suite *ApiTestSuite) TestEvents_endWhenStreamsAreStopped(t *C) {
+	journal, _ := graph.OpenJournal("")
+	suite.ng.UseJournal(journal)
+	restApi := api.NewApi(suite.ng)
+	suite.server.Close()
+	suite.server = httptest.NewServer(restApi)
+
+	resp, err := suite.client.Do(suite.request(api.Events.Build(), nil))
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	ended := make(chan error, 1)
+	go func() {
+		_, err := ioutil.ReadAll(resp.Body)
+		ended <- err
+	}()
+	restApi.StopStreams()
+
+	select {
+	case err := <-ended:
+		t.Check(err, IsNil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event stream still open after StopStreams")
+	}
+}
+
+func (suite *ApiTestSuite) TestEvents_returns503WithoutJournal(t *C) {
+	resp, err := suite.client.Do(suite.request(api.Events.Build(), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+}
+
+// A webhook dispatcher for the graph's changes, to serve the api with
+func (suite *ApiTestSuite) newWebhooks(t *C) *webhook.Dispatcher {
+	journal, _ := graph.OpenJournal("")
+	suite.ng.UseJournal(journal)
+	dispatcher, err := webhook.NewDispatcher("", journal)
+	t.Assert(err, IsNil)
+	dispatcher.AllowLocal = true
+	return dispatcher
+}
+
+func (suite *ApiTestSuite) TestWebhooks_createListTestAndRemove(t *C) {
+	suite.serve(api.WithWebhooks(suite.newWebhooks(t)))
+	dir, _ := suite.ng.NewNode("inbox", graph.RootNodeId, os.ModeDir)
+
+	received := make(chan *http.Request, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req
+	}))
+	defer receiver.Close()
+
+	body := encode(webhook.Hook{Url: receiver.URL, Subtree: dir.Id, Events: []graph.ChangeKind{graph.Created}})
+	resp, err := suite.client.Do(suite.request(api.CreateWebhook, body))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusCreated)
+	var hook webhook.Hook
+	decode(resp, &hook)
+	t.Check(hook.Url, Equals, receiver.URL)
+	t.Check(hook.Secret, Not(Equals), "")
+
+	resp, err = suite.client.Do(suite.request(api.ListWebhooks, nil))
+	t.Assert(err, IsNil)
+	var hooks []webhook.Hook
+	decode(resp, &hooks)
+	t.Assert(hooks, HasLen, 1)
+	t.Check(hooks[0].Id, Equals, hook.Id)
+
+	resp, err = suite.client.Do(suite.request(api.TestWebhook.Build(hook.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	var delivery webhook.Delivery
+	decode(resp, &delivery)
+	t.Check(delivery.Delivered, IsTrue)
+	t.Check((<-received).Header.Get(webhook.EventHeader), Equals, string(webhook.Ping))
+
+	resp, err = suite.client.Do(suite.request(api.WebhookDeliveries.Build(hook.Id), nil))
+	t.Assert(err, IsNil)
+	var deliveries []webhook.Delivery
+	decode(resp, &deliveries)
+	t.Assert(deliveries, HasLen, 1)
+	t.Check(deliveries[0].Id, Equals, delivery.Id)
+
+	resp, err = suite.client.Do(suite.request(api.RemoveWebhook.Build(hook.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	resp, err = suite.client.Do(suite.request(api.WebhookDeliveries.Build(hook.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+	t.Check(msg(resp), Contains, string(api.NO_SUCH_WEBHOOK))
+}
+
+func (suite *ApiTestSuite) TestCreateWebhook_returns400ForBadUrl(t *C) {
+	suite.serve(api.WithWebhooks(suite.newWebhooks(t)))
+
+	resp, err := suite.client.Do(suite.request(api.CreateWebhook, encode(webhook.Hook{Url: "not a url"})))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+	t.Check(msg(resp), Contains, string(api.INVALID_PARAM))
+}
+
+func (suite *ApiTestSuite) TestWebhooks_deliversUploadsUnderSubtree(t *C) {
+	dispatcher := suite.newWebhooks(t)
+	suite.serve(api.WithWebhooks(dispatcher))
+	dispatcher.Start()
+	defer dispatcher.Stop()
+	dir, _ := suite.ng.NewNode("inbox", graph.RootNodeId, os.ModeDir)
+
+	payloads := make(chan webhook.Payload, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var payload webhook.Payload
+		json.NewDecoder(req.Body).Decode(&payload)
+		payloads <- payload
+	}))
+	defer receiver.Close()
+
+	dispatcher.Add(webhook.Hook{Url: receiver.URL, Subtree: dir.Id, Events: []graph.ChangeKind{graph.Created}})
+
+	suite.ng.NewNode("elsewhere.txt", graph.RootNodeId, 0644)
+	_, err := suite.createNode(dir.Id, graph.NodeInfo{Name: "upload.txt", Mode: 0644})
+	t.Assert(err, IsNil)
+
+	select {
+	case payload := <-payloads:
+		t.Check(payload.Event, Equals, string(graph.Created))
+		t.Check(payload.Change.Info.Name, Equals, "upload.txt")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for webhook")
+	}
+}
+
+// A user store with an admin and a regular user, to serve the api with
+func (suite *ApiTestSuite) newUsers(t *C) *auth.Store {
+	auth.Iterations = 10
+	store, _ := auth.NewStore("")
+	_, err := store.AddUser("admin", "admin password", true)
+	t.Assert(err, IsNil)
+	_, err = store.AddUser("user", "user password", false)
+	t.Assert(err, IsNil)
+	return store
+}
+
+func (suite *ApiTestSuite) login(t *C, username, password string) string {
+	resp, err := suite.client.Do(suite.request(api.Login, encode(api.LoginRequest{Username: username, Password: password})))
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+
+	var token api.TokenResponse
+	decode(resp, &token)
+	return token.Token
+}
+
+func (suite *ApiTestSuite) TestAuth_rejectsUnauthenticatedRequests(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+
+	resp, err := suite.client.Do(suite.request(api.ListNodes.Build(graph.RootNodeId), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+	t.Check(resp.Header.Get("WWW-Authenticate"), Equals, `Bearer realm="olympus"`)
+	t.Check(msg(resp), Contains, string(api.UNAUTHORIZED))
+
+	req := suite.request(api.ListNodes.Build(graph.RootNodeId), nil)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	req = suite.request(api.ListNodes.Build(graph.RootNodeId), nil)
+	req.SetBasicAuth("user", "wrong password")
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	resp, err = suite.client.Do(suite.request(api.Login, encode(api.LoginRequest{Username: "user", Password: "wrong password"})))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+}
+
+func (suite *ApiTestSuite) TestAuth_returns429AfterRepeatedFailures(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+
+	for i := 0; i < auth.FreeLoginAttempts; i++ {
+		resp, err := suite.client.Do(suite.request(api.Login, encode(api.LoginRequest{Username: "user", Password: "wrong password"})))
+		t.Assert(err, IsNil)
+		t.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+	}
+	resp, err := suite.client.Do(suite.request(api.Login, encode(api.LoginRequest{Username: "user", Password: "wrong password"})))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	req := suite.request(api.ListNodes.Build(graph.RootNodeId), nil)
+	req.SetBasicAuth("user", "user password")
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusTooManyRequests)
+}
+
+func (suite *ApiTestSuite) TestAuth_acceptsTokensAndBasicAuth(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+	token := suite.login(t, "user", "user password")
+
+	req := suite.request(api.CurrentUser, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	var user auth.User
+	decode(resp, &user)
+	t.Check(user.Username, Equals, "user")
+
+	resp, err = suite.client.Do(suite.request(api.ListNodes.Build(graph.RootNodeId).Query("access_token", token), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	req = suite.request(api.ListNodes.Build(graph.RootNodeId), nil)
+	req.SetBasicAuth("user", "user password")
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (suite *ApiTestSuite) TestAuth_restrictsAdminEndpoints(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+
+	req := suite.request(api.ListUsers, nil)
+	req.SetBasicAuth("user", "user password")
+	resp, err := suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+	t.Check(msg(resp), Contains, string(api.FORBIDDEN))
+
+	req = suite.request(api.CreateUser, encode(api.UserRequest{Username: "new", Password: "new password"}))
+	req.SetBasicAuth("admin", "admin password")
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusCreated)
+
+	req = suite.request(api.ListUsers, nil)
+	req.SetBasicAuth("admin", "admin password")
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	var users []auth.User
+	decode(resp, &users)
+	t.Check(users, HasLen, 3)
+}
+
+func (suite *ApiTestSuite) TestAuth_usersCanChangeOnlyTheirOwnPassword(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+
+	req := suite.request(api.UpdateUser.Build("admin"), encode(api.UserRequest{Password: "taken over"}))
+	req.SetBasicAuth("user", "user password")
+	resp, err := suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+
+	req = suite.request(api.UpdateUser.Build("user"), encode(api.UserRequest{Password: "new password"}))
+	req.SetBasicAuth("user", "user password")
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	suite.login(t, "user", "new password")
+}
+
+func (suite *ApiTestSuite) TestTokens_createListAndRevoke(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+	token := suite.login(t, "user", "user password")
+
+	req := suite.request(api.CreateToken, encode(api.TokenRequest{Name: "script", ExpiresIn: 60}))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusCreated)
+	var created api.TokenResponse
+	decode(resp, &created)
+	t.Check(created.Info.Name, Equals, "script")
+	t.Check(created.Info.Expires.Sub(created.Info.Created), Equals, time.Minute)
+
+	req = suite.request(api.ListTokens, nil)
+	req.Header.Set("Authorization", "Bearer "+created.Token)
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	var tokens []auth.Token
+	decode(resp, &tokens)
+	t.Check(tokens, HasLen, 2)
+
+	req = suite.request(api.RevokeToken.Build(created.Info.Id), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	req = suite.request(api.ListTokens, nil)
+	req.Header.Set("Authorization", "Bearer "+created.Token)
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+}
+
+// Send req with basic auth as username, whose password is "<username> password" as in newUsers
+func (suite *ApiTestSuite) doAs(t *C, username string, req *http.Request) *http.Response {
+	req.SetBasicAuth(username, username+" password")
+	resp, err := suite.client.Do(req)
+	t.Assert(err, IsNil)
+	return resp
+}
+
+func (suite *ApiTestSuite) createNodeAs(t *C, username, parentId string, nodeInfo graph.NodeInfo) graph.NodeInfo {
+	resp := suite.doAs(t, username, suite.request(api.CreateNode.Build(parentId), encode(nodeInfo)))
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+
+	var created graph.NodeInfo
+	decode(resp, &created)
+	return created
+}
+
+func (suite *ApiTestSuite) TestPermissions_createdNodesAreOwnedByTheirCreator(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+
+	dir := suite.createNodeAs(t, "user", graph.RootNodeId, graph.NodeInfo{Name: "dir", Mode: os.ModeDir | 0750})
+	t.Check(dir.Owner, Equals, "user")
+
+	file := suite.createNodeAs(t, "admin", dir.Id, graph.NodeInfo{Name: "file"})
+	t.Check(file.Owner, Equals, "admin")
+	t.Check(file.Mode, Equals, os.FileMode(0640))
+
+	resp := suite.doAs(t, "user", suite.request(api.CreatePath.Build("dir/nested/file").Query("parents", "true"), nil))
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	t.Check(suite.ng.NodeWithPath("/dir/nested").Owner(), Equals, "user")
+}
+
+func (suite *ApiTestSuite) TestPermissions_enforcesModeOnNodes(t *C) {
+	store := suite.newUsers(t)
+	suite.serve(api.WithAuth(store))
+	store.AddUser("other", "other password", false)
+
+	dir := suite.createNodeAs(t, "user", graph.RootNodeId, graph.NodeInfo{Name: "dir", Mode: os.ModeDir | 0700})
+	file := suite.createNodeAs(t, "user", dir.Id, graph.NodeInfo{Name: "file", Mode: 0600})
+	dat := testutils.RandDat(1024)
+	req := suite.request(api.WriteBlock.Build(file.Id, 0), bytes.NewBuffer(dat))
+	req.Header.Set("Content-Hash", graph.Hash(dat))
+	t.Assert(suite.doAs(t, "user", req).StatusCode, Equals, http.StatusCreated)
+
+	forbidden := func(req *http.Request) {
+		resp := suite.doAs(t, "other", req)
+		t.Check(resp.StatusCode, Equals, http.StatusForbidden, Commentf("%s %s", req.Method, req.URL))
+		t.Check(msg(resp), Contains, string(api.FORBIDDEN))
+	}
+	forbidden(suite.request(api.ListNodes.Build(dir.Id), nil))
+	forbidden(suite.request(api.DownloadNode.Build(file.Id), nil))
+	forbidden(suite.request(api.ListBlocks.Build(file.Id), nil))
+	forbidden(suite.request(api.CreateNode.Build(dir.Id), encode(graph.NodeInfo{Name: "intruder"})))
+	forbidden(suite.request(api.RemoveNode.Build(file.Id), nil))
+	forbidden(suite.request(api.PathInfo.Build("dir").Query("list", "true"), nil))
+
+	resp := suite.doAs(t, "admin", suite.request(api.ListNodes.Build(dir.Id), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	t.Assert(suite.doAs(t, "user", suite.request(api.UpdateNode.Build(dir.Id), encode(graph.NodeInfo{Mode: os.ModeDir | 0755}))).StatusCode, Equals, http.StatusOK)
+	t.Assert(suite.doAs(t, "user", suite.request(api.UpdateNode.Build(file.Id), encode(graph.NodeInfo{Mode: 0644}))).StatusCode, Equals, http.StatusOK)
+
+	t.Check(suite.doAs(t, "other", suite.request(api.ListNodes.Build(dir.Id), nil)).StatusCode, Equals, http.StatusOK)
+	resp = suite.doAs(t, "other", suite.request(api.DownloadNode.Build(file.Id), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	body, _ := ioutil.ReadAll(resp.Body)
+	t.Check(body, DeepEquals, dat)
+
+	req = suite.request(api.WriteBlock.Build(file.Id, 0), bytes.NewBuffer(dat))
+	req.Header.Set("Content-Hash", graph.Hash(dat))
+	forbidden(req)
+	forbidden(suite.request(api.RemoveNode.Build(file.Id), nil))
+	forbidden(suite.request(api.UpdateNode.Build(file.Id), encode(graph.NodeInfo{Name: "renamed"})))
+}
+
+func (suite *ApiTestSuite) TestPermissions_moveNeedsWriteOnBothParents(t *C) {
+	store := suite.newUsers(t)
+	suite.serve(api.WithAuth(store))
+	store.AddUser("other", "other password", false)
+
+	mine := suite.createNodeAs(t, "other", graph.RootNodeId, graph.NodeInfo{Name: "mine", Mode: os.ModeDir | 0755})
+	theirs := suite.createNodeAs(t, "user", graph.RootNodeId, graph.NodeInfo{Name: "theirs", Mode: os.ModeDir | 0755})
+	file := suite.createNodeAs(t, "other", mine.Id, graph.NodeInfo{Name: "file", Mode: 0644})
+
+	resp := suite.doAs(t, "other", suite.request(api.UpdateNode.Build(file.Id), encode(graph.NodeInfo{ParentId: theirs.Id})))
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+	t.Check(suite.ng.NodeWithId(file.Id).Parent().Id, Equals, mine.Id)
+
+	resp = suite.doAs(t, "user", suite.request(api.UpdateNode.Build(file.Id), encode(graph.NodeInfo{ParentId: theirs.Id})))
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+
+	resp = suite.doAs(t, "admin", suite.request(api.UpdateNode.Build(file.Id), encode(graph.NodeInfo{ParentId: theirs.Id})))
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(suite.ng.NodeWithId(file.Id).Parent().Id, Equals, theirs.Id)
+}
+
+func (suite *ApiTestSuite) TestPermissions_chmodAndChown(t *C) {
+	store := suite.newUsers(t)
+	suite.serve(api.WithAuth(store))
+	store.AddUser("other", "other password", false)
+	store.SetGroups("user", []string{"family"})
+	store.SetGroups("other", []string{"family"})
+
+	file := suite.createNodeAs(t, "user", graph.RootNodeId, graph.NodeInfo{Name: "file", Mode: 0600})
+	update := func(username string, info graph.NodeInfo) int {
+		return suite.doAs(t, username, suite.request(api.UpdateNode.Build(file.Id), encode(info))).StatusCode
+	}
+
+	t.Check(update("other", graph.NodeInfo{Mode: 0666}), Equals, http.StatusForbidden)
+	t.Check(update("user", graph.NodeInfo{Group: "strangers"}), Equals, http.StatusForbidden)
+	t.Check(update("user", graph.NodeInfo{Owner: "other"}), Equals, http.StatusForbidden)
+
+	t.Check(update("user", graph.NodeInfo{Mode: 0640, Group: "family"}), Equals, http.StatusOK)
+	resp := suite.doAs(t, "other", suite.request(api.DownloadNode.Build(file.Id), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	t.Check(update("admin", graph.NodeInfo{Owner: "nobody"}), Equals, http.StatusBadRequest)
+	t.Check(update("admin", graph.NodeInfo{Owner: "other"}), Equals, http.StatusOK)
+	t.Check(suite.ng.NodeWithId(file.Id).Owner(), Equals, "other")
+	t.Check(update("user", graph.NodeInfo{Mode: 0666}), Equals, http.StatusForbidden)
+}
+
+func (suite *ApiTestSuite) TestUpdateUser_onlyAdminsSetGroups(t *C) {
+	store := suite.newUsers(t)
+	suite.serve(api.WithAuth(store))
+
+	resp := suite.doAs(t, "user", suite.request(api.UpdateUser.Build("user"), encode(api.UserRequest{Groups: []string{"admins"}})))
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+
+	resp = suite.doAs(t, "admin", suite.request(api.UpdateUser.Build("user"), encode(api.UserRequest{Groups: []string{"family"}})))
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	user, _ := store.User("user")
+	t.Check(user.Groups, DeepEquals, []string{"family"})
+}
+
+func (suite *ApiTestSuite) newShares(t *C) *share.Store {
+	store, err := share.NewStore("")
+	t.Assert(err, IsNil)
+	return store
+}
+
+func (suite *ApiTestSuite) createShare(t *C, nodeId string, shareRequest api.ShareRequest) api.ShareResponse {
+	resp, err := suite.client.Do(suite.request(api.CreateShare.Build(nodeId), encode(shareRequest)))
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+
+	var created api.ShareResponse
+	decode(resp, &created)
+	return created
+}
+
+func (suite *ApiTestSuite) writeFile(t *C, parentId, name string, dat []byte) *graph.Node {
+	nd, err := suite.ng.NewNode(name, parentId, os.FileMode(0644))
+	t.Assert(err, IsNil)
+	t.Assert(nd.WriteData(dat, 0), IsNil)
+	return nd
+}
+
+func (suite *ApiTestSuite) TestShares_downloadFileWithoutAccount(t *C) {
+	suite.serve(api.WithShares(suite.newShares(t)))
+	dat := testutils.RandDat(1024)
+	file := suite.writeFile(t, graph.RootNodeId, "file.dat", dat)
+
+	created := suite.createShare(t, file.Id, api.ShareRequest{MaxDownloads: 2})
+	t.Check(created.Info.NodeId, Equals, file.Id)
+	t.Check(created.Url, Equals, suite.server.URL+"/v1/shared/"+created.Token)
+
+	resp, err := http.Get(created.Url)
+	t.Assert(err, IsNil)
+	var info graph.NodeInfo
+	decode(resp, &info)
+	t.Check(info.Name, Equals, "file.dat")
+	t.Check(info.Path, Equals, "/")
+	t.Check(info.ParentId, Equals, "")
+
+	download := suite.request(api.DownloadShared.Build(created.Token, file.Id), nil)
+	for i := 0; i < 2; i++ {
+		resp, err = suite.client.Do(download)
+		t.Assert(err, IsNil)
+		t.Check(resp.StatusCode, Equals, http.StatusOK)
+		body, _ := ioutil.ReadAll(resp.Body)
+		t.Check(body, DeepEquals, dat)
+	}
+
+	resp, err = suite.client.Do(download)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusGone)
+	t.Check(msg(resp), Contains, string(api.SHARE_EXPIRED))
+}
+
+func (suite *ApiTestSuite) TestShares_countsEveryRangeFromTheStart(t *C) {
+	suite.serve(api.WithShares(suite.newShares(t)))
+	file := suite.writeFile(t, graph.RootNodeId, "file.dat", testutils.RandDat(1024))
+	created := suite.createShare(t, file.Id, api.ShareRequest{MaxDownloads: 3})
+
+	download := func(rangeHeader string) *http.Response {
+		req := suite.request(api.DownloadShared.Build(created.Token, file.Id), nil)
+		req.Header.Set("Range", rangeHeader)
+		resp, err := suite.client.Do(req)
+		t.Assert(err, IsNil)
+		return resp
+	}
+
+	// Resuming part way through doesn't count, however often it's done
+	for i := 0; i < 4; i++ {
+		t.Check(download("bytes=512-").StatusCode, Equals, http.StatusPartialContent)
+	}
+
+	for _, rangeHeader := range []string{"bytes=00-", "bytes= 0-99", "bytes=512-,0-"} {
+		t.Check(download(rangeHeader).StatusCode, Equals, http.StatusPartialContent, Commentf(rangeHeader))
+	}
+	t.Check(download("bytes=-2048").StatusCode, Equals, http.StatusGone)
+}
+
+func (suite *ApiTestSuite) TestShares_browseDirectory(t *C) {
+	suite.serve(api.WithShares(suite.newShares(t)))
+	dir, _ := suite.ng.NewNode("dir", graph.RootNodeId, os.ModeDir|0755)
+	nested, _ := suite.ng.NewNode("nested", dir.Id, os.ModeDir|0755)
+	dat := testutils.RandDat(512)
+	file := suite.writeFile(t, nested.Id, "file.dat", dat)
+	outside := suite.writeFile(t, graph.RootNodeId, "outside.dat", dat)
+
+	created := suite.createShare(t, dir.Id, api.ShareRequest{})
+
+	resp, err := suite.client.Do(suite.request(api.ListShared.Build(created.Token, nested.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	var children []graph.NodeInfo
+	decode(resp, &children)
+	t.Assert(children, HasLen, 1)
+	t.Check(children[0].Id, Equals, file.Id)
+	t.Check(children[0].Path, Equals, "/nested/file.dat")
+
+	resp, err = suite.client.Do(suite.request(api.DownloadShared.Build(created.Token, file.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	resp, err = suite.client.Do(suite.request(api.DownloadShared.Build(created.Token, outside.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+
+	resp, err = suite.client.Do(suite.request(api.ListShared.Build(created.Token+"x", nested.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+	t.Check(msg(resp), Contains, string(api.NO_SUCH_SHARE))
+}
+
+func (suite *ApiTestSuite) TestShares_requirePassword(t *C) {
+	auth.Iterations = 10
+	suite.serve(api.WithShares(suite.newShares(t)))
+	file := suite.writeFile(t, graph.RootNodeId, "file.dat", testutils.RandDat(64))
+
+	created := suite.createShare(t, file.Id, api.ShareRequest{Password: "open sesame"})
+	t.Check(created.Info.Protected, Equals, true)
+
+	resp, err := suite.client.Do(suite.request(api.SharedNode.Build(created.Token), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+	t.Check(resp.Header.Get("WWW-Authenticate"), Equals, `Basic realm="olympus share"`)
+
+	req := suite.request(api.SharedNode.Build(created.Token), nil)
+	req.SetBasicAuth("", "open sesame")
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (suite *ApiTestSuite) TestShares_listAndRevoke(t *C) {
+	suite.serve(api.WithShares(suite.newShares(t)))
+	file := suite.writeFile(t, graph.RootNodeId, "file.dat", testutils.RandDat(64))
+
+	first := suite.createShare(t, file.Id, api.ShareRequest{ExpiresIn: 3600})
+	second := suite.createShare(t, file.Id, api.ShareRequest{})
+	t.Check(first.Info.Expires.Sub(first.Info.Created), Equals, time.Hour)
+
+	resp, err := suite.client.Do(suite.request(api.ListShares.Build(file.Id), nil))
+	t.Assert(err, IsNil)
+	var shares []api.ShareResponse
+	decode(resp, &shares)
+	t.Assert(shares, HasLen, 2)
+	t.Check(shares[0].Token, Equals, first.Token)
+
+	resp, err = suite.client.Do(suite.request(api.RevokeShare.Build(second.Info.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	resp, err = suite.client.Do(suite.request(api.SharedNode.Build(second.Token), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+
+	resp, err = suite.client.Do(suite.request(api.RevokeShare.Build(second.Info.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (suite *ApiTestSuite) TestShares_workWithoutCredentialsWhenAuthIsRequired(t *C) {
+	auth.Iterations = 10
+	users, _ := auth.NewStore("")
+	users.AddUser("user", "user password", false)
+	users.AddUser("other", "other password", false)
+	suite.serve(api.WithAuth(users), api.WithShares(suite.newShares(t)))
+
+	file, err := suite.ng.NewOwnedNode("file.dat", graph.RootNodeId, os.FileMode(0600), "user")
+	t.Assert(err, IsNil)
+	t.Assert(file.WriteData(testutils.RandDat(64), 0), IsNil)
+
+	resp := suite.doAs(t, "other", suite.request(api.CreateShare.Build(file.Id), encode(api.ShareRequest{})))
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+
+	resp = suite.doAs(t, "user", suite.request(api.CreateShare.Build(file.Id), encode(api.ShareRequest{})))
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	var created api.ShareResponse
+	decode(resp, &created)
+	t.Check(created.Info.Creator, Equals, "user")
+
+	resp, err = suite.client.Do(suite.request(api.DownloadShared.Build(created.Token, file.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	resp = suite.doAs(t, "other", suite.request(api.RevokeShare.Build(created.Info.Id), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (suite *ApiTestSuite) TestShares_onlyReachWhatTheirCreatorCanRead(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)), api.WithShares(suite.newShares(t)))
+
+	dir, err := suite.ng.NewOwnedNode("dir", graph.RootNodeId, os.ModeDir|0755, "user")
+	t.Assert(err, IsNil)
+	public, err := suite.ng.NewOwnedNode("public.dat", dir.Id, os.FileMode(0644), "user")
+	t.Assert(err, IsNil)
+	private, err := suite.ng.NewOwnedNode("private.dat", dir.Id, os.FileMode(0600), "admin")
+	t.Assert(err, IsNil)
+
+	resp := suite.doAs(t, "user", suite.request(api.CreateShare.Build(dir.Id), encode(api.ShareRequest{})))
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	var created api.ShareResponse
+	decode(resp, &created)
+
+	resp, err = suite.client.Do(suite.request(api.ListShared.Build(created.Token, dir.Id), nil))
+	t.Assert(err, IsNil)
+	var children []graph.NodeInfo
+	decode(resp, &children)
+	t.Assert(children, HasLen, 1)
+	t.Check(children[0].Id, Equals, public.Id)
+
+	resp, err = suite.client.Do(suite.request(api.DownloadShared.Build(created.Token, private.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+
+	// Once the creator can't read the shared directory, neither can anyone with the link
+	t.Assert(dir.SetOwner("admin"), IsNil)
+	t.Assert(dir.SetMode(os.ModeDir|0700), IsNil)
+	resp, err = suite.client.Do(suite.request(api.DownloadShared.Build(created.Token, public.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (suite *ApiTestSuite) createDropBox(t *C, dirId string, dropBoxRequest api.DropBoxRequest) api.ShareResponse {
+	resp, err := suite.client.Do(suite.request(api.CreateDropBox.Build(dirId), encode(dropBoxRequest)))
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+
+	var created api.ShareResponse
+	decode(resp, &created)
+	return created
+}
+
+func (suite *ApiTestSuite) dropFile(t *C, token string, dropRequest api.DropRequest) *http.Response {
+	resp, err := suite.client.Do(suite.request(api.DropFile.Build(token), encode(dropRequest)))
+	t.Assert(err, IsNil)
+	return resp
+}
+
+func (suite *ApiTestSuite) dropBlock(t *C, token, nodeId string, offset int64, dat []byte) *http.Response {
+	req := suite.request(api.DropBlock.Build(token, nodeId, offset), bytes.NewBuffer(dat))
+	req.Header.Set("Content-Hash", graph.Hash(dat))
+	resp, err := suite.client.Do(req)
+	t.Assert(err, IsNil)
+	return resp
+}
+
+func (suite *ApiTestSuite) TestDropBox_uploadsWithoutSeeingContents(t *C) {
+	suite.serve(api.WithShares(suite.newShares(t)))
+	dir, _ := suite.ng.NewNode("inbox", graph.RootNodeId, os.ModeDir|0755)
+	suite.writeFile(t, dir.Id, "report.txt", testutils.RandDat(64))
+
+	created := suite.createDropBox(t, dir.Id, api.DropBoxRequest{})
+	t.Check(created.Info.Kind, Equals, share.DropBox)
+	t.Check(created.Url, Equals, suite.server.URL+"/v1/dropbox/"+created.Token)
+
+	resp := suite.dropFile(t, created.Token, api.DropRequest{Name: "report.txt", Size: 100, Uploader: "bob@example.com"})
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	var info graph.NodeInfo
+	decode(resp, &info)
+	t.Check(info.Name, Equals, "report (1).txt")
+
+	dat := testutils.RandDat(100)
+	t.Check(suite.dropBlock(t, created.Token, info.Id, 0, dat).StatusCode, Equals, http.StatusCreated)
+	uploaded := suite.ng.NodeWithId(info.Id)
+	t.Check(uploaded.Parent().Id, Equals, dir.Id)
+	t.Check(uploaded.Size(), Equals, int64(100))
+
+	resp, err := suite.client.Do(suite.request(api.ListShared.Build(created.Token, dir.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+
+	resp, err = suite.client.Do(suite.request(api.ListShares.Build(dir.Id), nil))
+	t.Assert(err, IsNil)
+	var shares []api.ShareResponse
+	decode(resp, &shares)
+	t.Assert(shares, HasLen, 1)
+	t.Assert(shares[0].Info.Uploads, HasLen, 1)
+	t.Check(shares[0].Info.Uploads[0].NodeId, Equals, info.Id)
+	t.Check(shares[0].Info.Uploads[0].Uploader, Equals, "bob@example.com")
+	t.Check(shares[0].Info.Uploads[0].Address, Equals, "127.0.0.1")
+}
+
+func (suite *ApiTestSuite) TestDropBox_believesForwardedForOnlyFromTrustedProxies(t *C) {
+	dropFrom := func(forwardedFor string) string {
+		dir, _ := suite.ng.NewNode("inbox", graph.RootNodeId, os.ModeDir|0755)
+		created := suite.createDropBox(t, dir.Id, api.DropBoxRequest{})
+		req := suite.request(api.DropFile.Build(created.Token), encode(api.DropRequest{Name: "report.txt", Size: 10}))
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		resp, err := suite.client.Do(req)
+		t.Assert(err, IsNil)
+		t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+
+		resp, err = suite.client.Do(suite.request(api.ListShares.Build(dir.Id), nil))
+		t.Assert(err, IsNil)
+		var shares []api.ShareResponse
+		decode(resp, &shares)
+		t.Assert(shares, HasLen, 1)
+		t.Assert(shares[0].Info.Uploads, HasLen, 1)
+		t.Assert(suite.ng.RemoveNode(dir), IsNil)
+		return shares[0].Info.Uploads[0].Address
+	}
+
+	suite.serve(api.WithShares(suite.newShares(t)))
+	t.Check(dropFrom("203.0.113.7"), Equals, "127.0.0.1")
+
+	suite.serve(api.WithShares(suite.newShares(t)), api.WithTrustedProxies([]string{"127.0.0.0/8", "10.0.0.1"}))
+	t.Check(dropFrom("198.51.100.1, 203.0.113.7, 10.0.0.1"), Equals, "203.0.113.7")
+}
+
+func (suite *ApiTestSuite) TestDropBox_onlyWritesItsOwnUploads(t *C) {
+	suite.serve(api.WithShares(suite.newShares(t)))
+	dir, _ := suite.ng.NewNode("inbox", graph.RootNodeId, os.ModeDir|0755)
+	existing := suite.writeFile(t, dir.Id, "existing.txt", testutils.RandDat(64))
+	created := suite.createDropBox(t, dir.Id, api.DropBoxRequest{})
+
+	dat := testutils.RandDat(64)
+	t.Check(suite.dropBlock(t, created.Token, existing.Id, 0, dat).StatusCode, Equals, http.StatusNotFound)
+
+	resp := suite.dropFile(t, created.Token, api.DropRequest{Name: "small.txt", Size: 10})
+	var info graph.NodeInfo
+	decode(resp, &info)
+	resp = suite.dropBlock(t, created.Token, info.Id, 0, dat)
+	t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+	t.Check(suite.ng.NodeWithId(info.Id).Size(), Equals, int64(0))
+}
+
+func (suite *ApiTestSuite) TestDropBox_enforcesLimits(t *C) {
+	suite.serve(api.WithShares(suite.newShares(t)))
+	dir, _ := suite.ng.NewNode("inbox", graph.RootNodeId, os.ModeDir|0755)
+	created := suite.createDropBox(t, dir.Id, api.DropBoxRequest{Limits: share.Limits{MaxFiles: 2, MaxBytes: 1000}})
+
+	t.Check(suite.dropFile(t, created.Token, api.DropRequest{Name: "big", Size: 1001}).StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	t.Check(suite.dropFile(t, created.Token, api.DropRequest{Name: "a", Size: 600}).StatusCode, Equals, http.StatusCreated)
+	resp := suite.dropFile(t, created.Token, api.DropRequest{Name: "b", Size: 500})
+	t.Check(resp.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	t.Check(msg(resp), Contains, string(api.DROP_BOX_FULL))
+	t.Check(suite.dropFile(t, created.Token, api.DropRequest{Name: "b", Size: 400}).StatusCode, Equals, http.StatusCreated)
+	t.Check(suite.dropFile(t, created.Token, api.DropRequest{Name: "c", Size: 0}).StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	t.Check(dir.Children(), HasLen, 2)
+
+	resp, err := suite.client.Do(suite.request(api.DropBoxInfo.Build(created.Token), nil))
+	t.Assert(err, IsNil)
+	var info api.DropBoxResponse
+	decode(resp, &info)
+	t.Check(info.Name, Equals, "inbox")
+	t.Check(info.Files, Equals, 2)
+	t.Check(info.Bytes, Equals, int64(1000))
+	t.Check(info.MaxFiles, Equals, 2)
+}
+
+func (suite *ApiTestSuite) TestDropBox_uploadsBelongToItsCreator(t *C) {
+	auth.Iterations = 10
+	users, _ := auth.NewStore("")
+	users.AddUser("user", "user password", false)
+	users.AddUser("other", "other password", false)
+	suite.serve(api.WithAuth(users), api.WithShares(suite.newShares(t)))
+
+	dir, err := suite.ng.NewOwnedNode("inbox", graph.RootNodeId, os.ModeDir|0750, "user")
+	t.Assert(err, IsNil)
+
+	resp := suite.doAs(t, "other", suite.request(api.CreateDropBox.Build(dir.Id), encode(api.DropBoxRequest{})))
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+
+	resp = suite.doAs(t, "user", suite.request(api.CreateDropBox.Build(dir.Id), encode(api.DropBoxRequest{})))
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	var created api.ShareResponse
+	decode(resp, &created)
+
+	resp = suite.dropFile(t, created.Token, api.DropRequest{Name: "upload.txt", Size: 10})
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	var info graph.NodeInfo
+	decode(resp, &info)
+	t.Check(info.Owner, Equals, "")
+
+	uploaded := suite.ng.NodeWithId(info.Id)
+	t.Check(uploaded.Owner(), Equals, "user")
+	t.Check(uploaded.Mode(), Equals, os.FileMode(0640))
+}
+
+func accessEntries(t *C, access *bytes.Buffer) []api.AccessEntry {
+	var entries []api.AccessEntry
+	decoder := json.NewDecoder(bytes.NewReader(access.Bytes()))
+	for decoder.More() {
+		var entry api.AccessEntry
+		t.Assert(decoder.Decode(&entry), IsNil)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (suite *ApiTestSuite) TestRequestId_isReturnedInHeaderAndResponse(t *C) {
+	req := suite.request(api.ListNodes.Build(graph.RootNodeId), nil)
+	req.Header.Set(api.RequestIdHeader, "client-request.1")
+	resp, err := suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.Header.Get(api.RequestIdHeader), Equals, "client-request.1")
+	t.Check(decode(resp, nil).Meta.RequestId, Equals, "client-request.1")
+
+	req = suite.request(api.ListNodes.Build("not-a-node"), nil)
+	req.Header.Set(api.RequestIdHeader, "not a valid id")
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	id := resp.Header.Get(api.RequestIdHeader)
+	t.Check(id, Not(Equals), "")
+	t.Check(id, Not(Equals), "not a valid id")
+	t.Check(decode(resp, nil).Meta.RequestId, Equals, id)
+}
+
+func (suite *ApiTestSuite) TestLogs_recordEachRequest(t *C) {
+	access, errors := new(bytes.Buffer), new(bytes.Buffer)
+	suite.serve(api.WithAuth(suite.newUsers(t)), api.WithLogs(logging.NewLogger(access), logging.NewLogger(errors)))
+
+	req := suite.request(api.ListNodes.Build(graph.RootNodeId), nil)
+	req.Header.Set(api.RequestIdHeader, "listing")
+	resp := suite.doAs(t, "user", req)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	resp, err := suite.client.Do(suite.request(api.ExtendedInfo.Build("not-a-node"), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusUnauthorized)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	entries := accessEntries(t, access)
+	t.Assert(entries, HasLen, 2)
+
+	t.Check(entries[0].RequestId, Equals, "listing")
+	t.Check(entries[0].Method, Equals, "GET")
+	t.Check(entries[0].Route, Equals, "/v1"+api.ListNodes.Template())
+	t.Check(entries[0].NodeId, Equals, graph.RootNodeId)
+	t.Check(entries[0].User, Equals, "user")
+	t.Check(entries[0].Status, Equals, http.StatusOK)
+	t.Check(entries[0].Bytes > 0, IsTrue)
+
+	t.Check(entries[1].RequestId, Equals, resp.Header.Get(api.RequestIdHeader))
+	t.Check(entries[1].Path, Equals, "/v1/node/not-a-node/info")
+	t.Check(entries[1].User, Equals, "")
+	t.Check(entries[1].Status, Equals, http.StatusUnauthorized)
+
+	// Only server errors go in the error log
+	t.Check(errors.Len(), Equals, 0)
+}
+
+func (suite *ApiTestSuite) TestLogs_leaveOutShareTokens(t *C) {
+	access := new(bytes.Buffer)
+	suite.serve(api.WithShares(suite.newShares(t)), api.WithLogs(logging.NewLogger(access), nil))
+	file := suite.writeFile(t, graph.RootNodeId, "file.dat", testutils.RandDat(512))
+	created := suite.createShare(t, file.Id, api.ShareRequest{})
+	access.Reset()
+
+	resp, err := suite.client.Do(suite.request(api.SharedNode.Build(created.Token), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	resp.Body.Close()
+
+	resp, err = suite.client.Get(suite.server.URL + "/v1/shared/" + created.Token + "/not/a/route")
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+	resp.Body.Close()
+
+	t.Check(strings.Contains(access.String(), created.Token), Equals, false)
+	entries := accessEntries(t, access)
+	t.Assert(entries, HasLen, 2)
+	t.Check(entries[0].Path, Equals, "/v1/shared/{token}")
+	t.Check(entries[1].Path, Equals, "/v1/shared/{token}/not/a/route")
+}
+
+func (suite *ApiTestSuite) metricsRequest() *http.Request {
+	req, _ := http.NewRequest("GET", suite.server.URL+"/metrics", nil)
+	return req
+}
+
+func (suite *ApiTestSuite) TestMetrics_returns503WhenNotEnabled(t *C) {
+	resp, err := suite.client.Do(suite.metricsRequest())
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+}
+
+func (suite *ApiTestSuite) TestMetrics_requiresAdmin(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)), api.WithMetrics(metrics.NewRegistry()))
+
+	resp := suite.doAs(t, "user", suite.metricsRequest())
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (suite *ApiTestSuite) TestMetrics_countsRequestsBytesAndBlocks(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)), api.WithMetrics(metrics.NewRegistry()))
+
+	file := suite.createNodeAs(t, "admin", graph.RootNodeId, graph.NodeInfo{Name: "file", Mode: 0755})
+	dat := testutils.RandDat(1024)
+	for i := 0; i < 2; i++ {
+		req := suite.request(api.WriteBlock.Build(file.Id, 0), bytes.NewReader(dat))
+		req.Header.Add("Content-Hash", graph.Hash(dat))
+		resp := suite.doAs(t, "admin", req)
+		t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+		resp.Body.Close()
+	}
+
+	resp := suite.doAs(t, "admin", suite.request(api.ListNodes.Build(graph.RootNodeId), nil))
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	resp = suite.doAs(t, "admin", suite.metricsRequest())
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(resp.Header.Get("Content-Type"), Equals, metrics.ContentType)
+	body, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	exposition := string(body)
+
+	listRoute := "/v1" + api.ListNodes.Template()
+	writeRoute := "/v1" + api.WriteBlock.Template()
+	for _, line := range []string{
+		`olympus_http_requests_total{method="GET",route="` + listRoute + `",code="200"} 1`,
+		`olympus_http_requests_total{method="PUT",route="` + writeRoute + `",code="201"} 2`,
+		`olympus_http_request_duration_seconds_count{method="GET",route="` + listRoute + `"} 1`,
+		`olympus_http_uploaded_bytes_total{method="PUT",route="` + writeRoute + `"} 2048`,
+		`olympus_nodes 2`,
+	} {
+		t.Check(strings.Contains(exposition, line+"\n"), IsTrue, Commentf("missing %s", line))
+	}
+	t.Check(strings.Contains(exposition, `olympus_http_downloaded_bytes_total{method="GET",route="`+listRoute+`"}`), IsTrue)
+	t.Check(strings.Contains(exposition, "olympus_blocks_deduplicated_total "), IsTrue)
+	t.Check(strings.Contains(exposition, `olympus_graph_query_duration_seconds_count{query="children"}`), IsTrue)
+}
+
+func (suite *ApiTestSuite) TestMetrics_nameRoutesOutsideTheApi(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)), api.WithMetrics(metrics.NewRegistry()))
+
+	req, _ := http.NewRequest("GET", suite.server.URL+"/block/"+graph.Hash(testutils.RandDat(10)), nil)
+	resp := suite.doAs(t, "admin", req)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+	resp.Body.Close()
+
+	resp = suite.doAs(t, "admin", suite.metricsRequest())
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(resp.Body)
+	t.Assert(err, IsNil)
+	t.Check(strings.Contains(string(body), `olympus_http_requests_total{method="GET",route="/block/{blockId}",code="404"} 1`), IsTrue)
+	t.Check(strings.Contains(string(body), `route="unknown"`), Equals, false)
+}
+
+func (suite *ApiTestSuite) rootRequest(path string) *http.Request {
+	req, _ := http.NewRequest("GET", suite.server.URL+path, nil)
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+func (suite *ApiTestSuite) TestHealthz_respondsWithoutAuthentication(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+
+	resp, err := suite.client.Do(suite.rootRequest("/healthz"))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	var health api.HealthResponse
+	decode(resp, &health)
+	t.Check(health.Status, Equals, "ok")
+}
+
+func (suite *ApiTestSuite) TestReadyz_checksGraphAndDataDirs(t *C) {
+	resp, err := suite.client.Do(suite.rootRequest("/readyz"))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	var health api.HealthResponse
+	decode(resp, &health)
+	t.Check(health.Status, Equals, "ok")
+	t.Assert(health.Checks, HasLen, 1+len(graph.DataDirs()))
+	t.Check(health.Checks[0], Equals, api.HealthCheck{Name: "graph", Ok: true})
+	t.Check(health.Checks[1].Name, Equals, "data_dir:"+graph.DataDirs()[0])
+	t.Check(health.Checks[1].Ok, IsTrue)
+}
+
+func (suite *ApiTestSuite) TestReadyz_returns503WhenDataDirIsLowOnSpace(t *C) {
+	suite.serve(api.WithMinFreeBytes(1 << 62))
+
+	resp, err := suite.client.Do(suite.rootRequest("/readyz"))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	var health api.HealthResponse
+	decode(resp, &health)
+	t.Check(health.Status, Equals, "unavailable")
+	t.Assert(health.Checks, HasLen, 1+len(graph.DataDirs()))
+	t.Check(health.Checks[0].Ok, IsTrue)
+	t.Check(health.Checks[1].Ok, Equals, false)
+	t.Check(health.Checks[1].Error, Matches, ".* bytes free, less than the 4611686018427387904 required")
+}
+
+func (suite *ApiTestSuite) TestReadyz_onlyTellsAdminsWhichChecksFailed(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)), api.WithMinFreeBytes(1<<62))
+
+	resp, err := suite.client.Do(suite.rootRequest("/readyz"))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	var health api.HealthResponse
+	decode(resp, &health)
+	t.Check(health.Status, Equals, "unavailable")
+	t.Check(health.Checks, HasLen, 0)
+
+	resp = suite.doAs(t, "user", suite.rootRequest("/readyz"))
+	t.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	health = api.HealthResponse{}
+	decode(resp, &health)
+	t.Check(health.Checks, HasLen, 0)
+
+	resp = suite.doAs(t, "admin", suite.rootRequest("/readyz"))
+	t.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	health = api.HealthResponse{}
+	decode(resp, &health)
+	t.Check(health.Checks, HasLen, 1+len(graph.DataDirs()))
+}
+
+func (suite *ApiTestSuite) TestServerInfo_describesServerWithoutAuthentication(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+
+	resp, err := suite.client.Do(suite.request(api.ServerInfo, nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	var info api.InfoResponse
+	decode(resp, &info)
+	t.Check(info.Version, Equals, api.Version)
+	t.Check(info.ApiVersion, Equals, api.ApiVersion)
+	t.Check(info.Encodings, DeepEquals, []api.Encoding{api.JsonEncoding, api.XmlEncoding, api.GobEncoding})
+	t.Check(info.HashAlgorithm, Equals, graph.HashAlgorithm)
+	t.Check(info.BlockSize, Equals, int64(graph.BLOCK_SIZE))
+	t.Check(info.Features, DeepEquals, []string{api.AuthFeature})
+}
+
+func (suite *ApiTestSuite) TestHasBlock_reportsStoredBlocks(t *C) {
+	id, err := suite.createNode(graph.RootNodeId, graph.NodeInfo{Name: "file", Mode: 0755})
+	t.Assert(err, IsNil)
+	hash, err := suite.writeBlock(1024, 0, id)
+	t.Assert(err, IsNil)
+
+	req, _ := http.NewRequest("HEAD", suite.server.URL+"/block/"+hash, nil)
+	resp, err := suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(resp.ContentLength, Equals, int64(1024))
+
+	req, _ = http.NewRequest("HEAD", suite.server.URL+"/block/"+graph.Hash(testutils.RandDat(10)), nil)
+	resp, err = suite.client.Do(req)
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (suite *ApiTestSuite) TestMissingBlocks_returnsHashesNotStored(t *C) {
+	id, err := suite.createNode(graph.RootNodeId, graph.NodeInfo{Name: "file", Mode: 0755})
+	t.Assert(err, IsNil)
+	stored, err := suite.writeBlock(1024, 0, id)
+	t.Assert(err, IsNil)
+	unstored := graph.Hash(testutils.RandDat(1024))
+
+	hashes := api.BlockHashes{Hashes: []string{stored, unstored, "not-a-hash"}}
+	resp, err := suite.client.Do(suite.request(api.MissingBlocks, encode(hashes)))
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	var missing api.BlockHashes
+	decode(resp, &missing)
+	t.Check(missing.Hashes, DeepEquals, []string{unstored, "not-a-hash"})
+}
+
+func (suite *ApiTestSuite) TestMissingBlocks_limitsHashesPerRequest(t *C) {
+	hashes := api.BlockHashes{Hashes: make([]string, api.MaxMissingBlocks+1)}
+	resp, err := suite.client.Do(suite.request(api.MissingBlocks, encode(hashes)))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (suite *ApiTestSuite) TestLinkBlock_attachesStoredBlockByHash(t *C) {
+	original, err := suite.createNode(graph.RootNodeId, graph.NodeInfo{Name: "original", Mode: 0755})
+	t.Assert(err, IsNil)
+	hash, err := suite.writeBlock(1024, 0, original)
+	t.Assert(err, IsNil)
+
+	copied, err := suite.createNode(graph.RootNodeId, graph.NodeInfo{Name: "copy", Mode: 0755})
+	t.Assert(err, IsNil)
+	resp, err := suite.client.Do(suite.request(api.LinkBlock.Build(copied, 0, hash), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusCreated)
+	t.Check(suite.ng.NodeWithId(copied).BlockWithOffset(0), Equals, hash)
+	t.Check(suite.ng.NodeWithId(copied).Size(), Equals, int64(1024))
+
+	resp, err = suite.client.Do(suite.request(api.LinkBlock.Build(copied, graph.BLOCK_SIZE, graph.Hash(testutils.RandDat(10))), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+	t.Check(suite.ng.NodeWithId(copied).BlockWithOffset(graph.BLOCK_SIZE), Equals, "")
+}
+
+func (suite *ApiTestSuite) newUploads(t *C) *upload.Store {
+	store, err := upload.NewStore("", time.Hour)
+	t.Assert(err, IsNil)
+	return store
+}
+
+// The hashes of dat's blocks, to open an upload of it with
+func uploadRequest(name string, dat []byte) api.UploadRequest {
+	uploadRequest := api.UploadRequest{Name: name, Mode: 0644, Size: int64(len(dat)), Hashes: []string{}}
+	for offset := 0; offset < len(dat); offset += graph.BLOCK_SIZE {
+		end := offset + graph.BLOCK_SIZE
+		if end > len(dat) {
+			end = len(dat)
+		}
+		uploadRequest.Hashes = append(uploadRequest.Hashes, graph.Hash(dat[offset:end]))
+	}
+	return uploadRequest
+}
+
+func (suite *ApiTestSuite) uploadBlock(uploadId string, index int, dat []byte) int {
+	end := (index + 1) * graph.BLOCK_SIZE
+	if end > len(dat) {
+		end = len(dat)
+	}
+	resp, _ := suite.client.Do(suite.request(api.UploadBlock.Build(uploadId, index), bytes.NewReader(dat[index*graph.BLOCK_SIZE:end])))
+	return resp.StatusCode
+}
+
+func (suite *ApiTestSuite) TestUploads_return503WhenNotEnabled(t *C) {
+	resp, err := suite.client.Do(suite.request(api.ListUploads, nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+}
+
+func (suite *ApiTestSuite) TestUploads_commitsBlocksSentInAnyOrder(t *C) {
+	suite.serve(api.WithUploads(suite.newUploads(t)))
+	dat := testutils.RandDat(graph.BLOCK_SIZE*2 + 100)
+
+	resp, err := suite.client.Do(suite.request(api.OpenUpload.Build(graph.RootNodeId), encode(uploadRequest("file", dat))))
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	var opened api.UploadResponse
+	decode(resp, &opened)
+	t.Check(opened.Missing, DeepEquals, []int{0, 1, 2})
+	uploadId := opened.Info.Id
+
+	t.Check(suite.uploadBlock(uploadId, 2, dat), Equals, http.StatusCreated)
+	t.Check(suite.uploadBlock(uploadId, 0, dat), Equals, http.StatusCreated)
+	t.Check(suite.uploadBlock(uploadId, 1, testutils.RandDat(graph.BLOCK_SIZE*2)), Equals, http.StatusBadRequest)
+
+	resp, err = suite.client.Do(suite.request(api.CommitUpload.Build(uploadId), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusConflict)
+	t.Check(decode(resp, nil).Error.MissingBlocks(), DeepEquals, []int{1})
+	t.Check(suite.ng.NodeWithName(graph.RootNodeId, "file"), IsNil)
+
+	resp, err = suite.client.Do(suite.request(api.UploadStatus.Build(uploadId), nil))
+	t.Assert(err, IsNil)
+	var status api.UploadResponse
+	decode(resp, &status)
+	t.Check(status.Missing, DeepEquals, []int{1})
+	t.Check(status.Info.Received, DeepEquals, []int{2, 0})
+
+	t.Check(suite.uploadBlock(uploadId, 1, dat), Equals, http.StatusCreated)
+	resp, err = suite.client.Do(suite.request(api.CommitUpload.Build(uploadId), nil))
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	var info graph.NodeInfo
+	decode(resp, &info)
+	t.Check(info.Name, Equals, "file")
+	t.Check(info.Size, Equals, int64(len(dat)))
+
+	node := suite.ng.NodeWithId(info.Id)
+	t.Check(node.Blocks(), HasLen, 3)
+	written, _ := ioutil.ReadAll(node.ReadSeeker())
+	t.Check(bytes.Equal(written, dat), IsTrue)
+
+	resp, err = suite.client.Do(suite.request(api.UploadStatus.Build(uploadId), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (suite *ApiTestSuite) TestUploads_rejectsInvalidSessions(t *C) {
+	suite.serve(api.WithUploads(suite.newUploads(t)))
+	dat := testutils.RandDat(graph.BLOCK_SIZE + 1)
+	_, err := suite.createNode(graph.RootNodeId, graph.NodeInfo{Name: "taken", Mode: 0644})
+	t.Assert(err, IsNil)
+
+	missingHash := uploadRequest("file", dat)
+	missingHash.Hashes = missingHash.Hashes[:1]
+	badHash := uploadRequest("file", dat)
+	badHash.Hashes[1] = "not-a-hash"
+
+	for _, invalid := range []api.UploadRequest{uploadRequest("taken", dat), uploadRequest("", dat), missingHash, badHash} {
+		resp, err := suite.client.Do(suite.request(api.OpenUpload.Build(graph.RootNodeId), encode(invalid)))
+		t.Assert(err, IsNil)
+		t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+	}
+}
+
+func (suite *ApiTestSuite) TestUploads_areOnlyUsableByCreator(t *C) {
+	users, _ := auth.NewStore("")
+	auth.Iterations = 10
+	for _, username := range []string{"admin", "user", "other"} {
+		_, err := users.AddUser(username, username+" password", username == "admin")
+		t.Assert(err, IsNil)
+	}
+	suite.serve(api.WithAuth(users), api.WithUploads(suite.newUploads(t)))
+	dir, err := suite.ng.NewOwnedNode("dir", graph.RootNodeId, os.ModeDir|0777, "user")
+	t.Assert(err, IsNil)
+
+	resp := suite.doAs(t, "user", suite.request(api.OpenUpload.Build(dir.Id), encode(uploadRequest("file", []byte("data")))))
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	var opened api.UploadResponse
+	decode(resp, &opened)
+	t.Check(opened.Info.Creator, Equals, "user")
+
+	resp = suite.doAs(t, "other", suite.request(api.UploadStatus.Build(opened.Info.Id), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusNotFound)
+	resp = suite.doAs(t, "admin", suite.request(api.UploadStatus.Build(opened.Info.Id), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+
+	var sessions []upload.Session
+	decode(suite.doAs(t, "other", suite.request(api.ListUploads, nil)), &sessions)
+	t.Check(sessions, HasLen, 0)
+	decode(suite.doAs(t, "user", suite.request(api.ListUploads, nil)), &sessions)
+	t.Check(sessions, HasLen, 1)
+}
+
+func (suite *ApiTestSuite) TestUploads_abortsSessions(t *C) {
+	store := suite.newUploads(t)
+	suite.serve(api.WithUploads(store))
+
+	resp, err := suite.client.Do(suite.request(api.OpenUpload.Build(graph.RootNodeId), encode(uploadRequest("file", []byte("data")))))
+	t.Assert(err, IsNil)
+	var opened api.UploadResponse
+	decode(resp, &opened)
+
+	resp, err = suite.client.Do(suite.request(api.AbortUpload.Build(opened.Info.Id), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	_, err = store.Session(opened.Info.Id)
+	t.Check(err, Equals, upload.ErrNoSuchSession)
+}
+
+func (suite *ApiTestSuite) TestUploads_removeUnusedBlocksOfExpiredSessions(t *C) {
+	store, err := upload.NewStore("", time.Nanosecond)
+	t.Assert(err, IsNil)
+	restApi := api.NewApi(suite.ng, api.WithUploads(store))
+	suite.server.Close()
+	suite.server = httptest.NewServer(restApi)
+
+	used := testutils.RandDat(graph.BLOCK_SIZE)
+	suite.writeFile(t, graph.RootNodeId, "used", used)
+	abandoned := testutils.RandDat(100)
+	dat := append(append([]byte{}, used...), abandoned...)
+	_, err = store.Open(upload.Session{ParentId: graph.RootNodeId, Name: "abandoned", Size: int64(len(dat)),
+		BlockSize: graph.BLOCK_SIZE, Hashes: uploadRequest("abandoned", dat).Hashes})
+	t.Assert(err, IsNil)
+	_, err = graph.Write(graph.Hash(abandoned), abandoned)
+	t.Assert(err, IsNil)
+	time.Sleep(time.Millisecond)
+
+	// Opening another session clears out the expired one
+	resp, err := suite.client.Do(suite.request(api.OpenUpload.Build(graph.RootNodeId), encode(uploadRequest("next", used))))
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	restApi.Wait()
+	t.Check(graph.HasBlock(graph.Hash(abandoned)), Equals, false)
+	t.Check(graph.HasBlock(graph.Hash(used)), Equals, true)
+}
+
+func (suite *ApiTestSuite) TestUploads_keepBlocksThumbnailsUseWhenSessionsExpire(t *C) {
+	store, err := upload.NewStore("", time.Nanosecond)
+	t.Assert(err, IsNil)
+	restApi := api.NewApi(suite.ng, api.WithUploads(store))
+	suite.server.Close()
+	suite.server = httptest.NewServer(restApi)
+
+	var buf bytes.Buffer
+	t.Assert(png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 200))), IsNil)
+	photo := suite.writeFile(t, graph.RootNodeId, "photo.png", buf.Bytes())
+	thumbnail, err := suite.ng.NodeWithId(photo.Id).Thumbnail(64)
+	t.Assert(err, IsNil)
+	size, err := graph.SizeOnDisk(thumbnail)
+	t.Assert(err, IsNil)
+
+	// Anyone who learns the thumbnail's hash can name it in a session and let it expire
+	_, err = store.Open(upload.Session{ParentId: graph.RootNodeId, Name: "thumbnail.jpg", Size: size,
+		BlockSize: graph.BLOCK_SIZE, Hashes: []string{thumbnail}})
+	t.Assert(err, IsNil)
+	time.Sleep(time.Millisecond)
+	resp, err := suite.client.Do(suite.request(api.OpenUpload.Build(graph.RootNodeId), encode(uploadRequest("next", []byte("data")))))
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	restApi.Wait()
+
+	t.Check(graph.HasBlock(thumbnail), Equals, true)
+	resp, err = suite.client.Do(suite.request(api.Thumbnail.Build(photo.Id, 64), nil))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (suite *ApiTestSuite) TestUploads_replaceExistingFileOnCommit(t *C) {
+	suite.serve(api.WithUploads(suite.newUploads(t)))
+	old := testutils.RandDat(graph.BLOCK_SIZE + 10)
+	file := suite.writeFile(t, graph.RootNodeId, "file", old[:graph.BLOCK_SIZE])
+	t.Assert(file.WriteData(old[graph.BLOCK_SIZE:], graph.BLOCK_SIZE), IsNil)
+	dat := testutils.RandDat(100)
+
+	resp, err := suite.client.Do(suite.request(api.OpenUpload.Build(graph.RootNodeId), encode(uploadRequest("file", dat))))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	replacing := uploadRequest("file", dat)
+	replacing.Replace = true
+	resp, err = suite.client.Do(suite.request(api.OpenUpload.Build(graph.RootNodeId), encode(replacing)))
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	var opened api.UploadResponse
+	decode(resp, &opened)
+
+	// Sent blocks stay out of sight until the commit
+	t.Check(suite.uploadBlock(opened.Info.Id, 0, dat), Equals, http.StatusCreated)
+	t.Check(suite.ng.NodeWithId(file.Id).Size(), Equals, int64(len(old)))
+
+	resp, err = suite.client.Do(suite.request(api.CommitUpload.Build(opened.Info.Id), nil))
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+	var info graph.NodeInfo
+	decode(resp, &info)
+	t.Check(info.Id, Equals, file.Id)
+	t.Check(info.Size, Equals, int64(len(dat)))
+	written, _ := ioutil.ReadAll(suite.ng.NodeWithId(file.Id).ReadSeeker())
+	t.Check(bytes.Equal(written, dat), IsTrue)
+
+	resp, err = suite.client.Do(suite.request(api.Versions.Build(file.Id), nil))
+	t.Assert(err, IsNil)
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+	var versions []graph.Version
+	decode(resp, &versions)
+	t.Assert(versions, HasLen, 1)
+	t.Check(versions[0].Size, Equals, int64(len(old)))
+	t.Check(versions[0].Blocks, HasLen, 2)
+}
+
+func (suite *ApiTestSuite) TestUploads_cannotReplaceDirectory(t *C) {
+	suite.serve(api.WithUploads(suite.newUploads(t)))
+	_, err := suite.ng.NewNode("dir", graph.RootNodeId, os.ModeDir|0755)
+	t.Assert(err, IsNil)
+
+	replacing := uploadRequest("dir", []byte("data"))
+	replacing.Replace = true
+	resp, err := suite.client.Do(suite.request(api.OpenUpload.Build(graph.RootNodeId), encode(replacing)))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (suite *ApiTestSuite) TestIngestPath_returns503WithoutIngestRoot(t *C) {
+	resp, err := suite.client.Do(suite.request(api.IngestPath.Build(graph.RootNodeId), encode(api.IngestRequest{Path: suite.testDir})))
+	t.Assert(err, IsNil)
+	t.Check(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+}
+
+func (suite *ApiTestSuite) TestIngestPath_onlyIngestsUnderRootForAdmins(t *C) {
+	root := filepath.Join(suite.testDir, "ingest")
+	t.Assert(os.MkdirAll(filepath.Join(root, "photos"), 0755), IsNil)
+	t.Assert(ioutil.WriteFile(filepath.Join(root, "photos", "cat.png"), testutils.RandDat(100), 0644), IsNil)
+	t.Assert(os.Symlink(suite.testDir, filepath.Join(root, "escape")), IsNil)
+	suite.serve(api.WithAuth(suite.newUsers(t)), api.WithIngestRoot(root))
+
+	resp := suite.doAs(t, "user", suite.request(api.IngestPath.Build(graph.RootNodeId), encode(api.IngestRequest{Path: "photos"})))
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+
+	for _, outside := range []string{suite.testDir, filepath.Join(root, ".."), "escape", "/etc"} {
+		resp = suite.doAs(t, "admin", suite.request(api.IngestPath.Build(graph.RootNodeId), encode(api.IngestRequest{Path: outside})))
+		t.Check(resp.StatusCode, Equals, http.StatusForbidden, Commentf(outside))
+	}
+	t.Check(suite.ng.RootNode.Children(), HasLen, 0)
+
+	resp = suite.doAs(t, "admin", suite.request(api.IngestPath.Build(graph.RootNodeId), encode(api.IngestRequest{Path: "photos"})))
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+	var progress graph.IngestProgress
+	decode(resp, &progress)
+	t.Check(progress.Files, Equals, 1)
+	t.Check(suite.ng.NodeWithPath("/photos/cat.png"), NotNil)
+}
+
+func (suite *ApiTestSuite) TestChanges_leavesOutChangesUserCannotRead(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+	journal, _ := graph.OpenJournal("")
+	suite.ng.UseJournal(journal)
+
+	private, err := suite.ng.NewOwnedNode("private", graph.RootNodeId, os.ModeDir|0700, "admin")
+	t.Assert(err, IsNil)
+	_, err = suite.ng.NewOwnedNode("secret.txt", private.Id, 0644, "admin")
+	t.Assert(err, IsNil)
+	public, err := suite.ng.NewOwnedNode("public.txt", graph.RootNodeId, 0644, "admin")
+	t.Assert(err, IsNil)
+
+	var changes api.ChangesResponse
+	resp := suite.doAs(t, "user", suite.request(api.Changes.Build().Query("cursor", "0"), nil))
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+	decode(resp, &changes)
+	t.Assert(changes.Changes, HasLen, 1)
+	t.Check(changes.Changes[0].NodeId, Equals, public.Id)
+	t.Check(changes.Cursor, Equals, uint64(3))
+
+	resp = suite.doAs(t, "admin", suite.request(api.Changes.Build().Query("cursor", "0"), nil))
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+	decode(resp, &changes)
+	t.Check(changes.Changes, HasLen, 3)
+}
+
+func (suite *ApiTestSuite) TestPathInfo_requiresReadPermission(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+	_, err := suite.ng.NewOwnedNode("private", graph.RootNodeId, os.ModeDir|0700, "admin")
+	t.Assert(err, IsNil)
+
+	resp := suite.doAs(t, "user", suite.request(api.PathInfo.Build("private"), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+	resp = suite.doAs(t, "admin", suite.request(api.PathInfo.Build("private"), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (suite *ApiTestSuite) TestPermissions_readableFileInUnreadableDirectoryIsHidden(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+	dir, err := suite.ng.NewOwnedNode("private", graph.RootNodeId, os.ModeDir|0700, "admin")
+	t.Assert(err, IsNil)
+	file := suite.writeFile(t, dir.Id, "file", testutils.RandDat(100))
+	t.Assert(file.SetOwner("admin"), IsNil)
+	t.Assert(file.SetMode(0644), IsNil)
+
+	for _, req := range []*http.Request{
+		suite.request(api.PathInfo.Build("private/file"), nil),
+		suite.request(api.PathInfo.Build("private/file").Query("download", "true"), nil),
+		suite.request(api.ExtendedInfo.Build(file.Id), nil),
+		suite.request(api.DownloadNode.Build(file.Id), nil),
+		suite.request(api.ListBlocks.Build(file.Id), nil),
+	} {
+		resp := suite.doAs(t, "user", req)
+		t.Check(resp.StatusCode, Equals, http.StatusForbidden, Commentf("%s %s", req.Method, req.URL))
+	}
+
+	resp := suite.doAs(t, "admin", suite.request(api.DownloadNode.Build(file.Id), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Assert(dir.SetMode(os.ModeDir|0755), IsNil)
+	resp = suite.doAs(t, "user", suite.request(api.PathInfo.Build("private/file"), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+}
+
+func (suite *ApiTestSuite) TestExportNode_leavesOutDescendantsRequesterCannotRead(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+	dir, err := suite.ng.NewOwnedNode("shared", graph.RootNodeId, os.ModeDir|0755, "user")
+	t.Assert(err, IsNil)
+	suite.writeFile(t, dir.Id, "mine", testutils.RandDat(100))
+	secret := suite.writeFile(t, dir.Id, "secret", testutils.RandDat(100))
+	t.Assert(secret.SetOwner("admin"), IsNil)
+	t.Assert(secret.SetMode(0600), IsNil)
+
+	resp := suite.doAs(t, "user", suite.request(api.ExportNode.Build(dir.Id), nil))
+	t.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	destination, err := suite.ng.NewNode("destination", graph.RootNodeId, os.ModeDir)
+	t.Assert(err, IsNil)
+	report, err := suite.ng.Import(resp.Body, destination.Id, "")
+	t.Assert(err, IsNil)
+	t.Check(report.Nodes, Equals, 2)
+
+	imported := suite.ng.NodeWithName(destination.Id, "shared")
+	t.Assert(imported, NotNil)
+	t.Check(suite.ng.NodeWithName(imported.Id, "mine"), NotNil)
+	t.Check(suite.ng.NodeWithName(imported.Id, "secret"), IsNil)
+}
+
+func (suite *ApiTestSuite) TestRemoveNode_refusesSubtreeWithDirectoriesRequesterCannotWrite(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+	dir, err := suite.ng.NewOwnedNode("shared", graph.RootNodeId, os.ModeDir|0755, "user")
+	t.Assert(err, IsNil)
+	theirs, err := suite.ng.NewOwnedNode("theirs", dir.Id, os.ModeDir|0755, "admin")
+	t.Assert(err, IsNil)
+	file := suite.writeFile(t, theirs.Id, "file", testutils.RandDat(100))
+
+	resp := suite.doAs(t, "user", suite.request(api.RemoveNode.Build(dir.Id), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusForbidden)
+	t.Check(decode(resp, nil).Error.Code, Equals, api.FORBIDDEN)
+	t.Check(dir.Exists(), IsTrue)
+	t.Check(file.Exists(), IsTrue)
+
+	t.Assert(suite.ng.RemoveNode(file), IsNil)
+	resp = suite.doAs(t, "user", suite.request(api.RemoveNode.Build(dir.Id), nil))
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(dir.Exists(), Equals, false)
+}
+
+func (suite *ApiTestSuite) TestImportNode_importedNodesAreOwnedByRequester(t *C) {
+	suite.serve(api.WithAuth(suite.newUsers(t)))
+	folder, err := suite.ng.NewOwnedNode("folder", graph.RootNodeId, os.ModeDir|0755, "admin")
+	t.Assert(err, IsNil)
+	suite.writeFile(t, folder.Id, "file", testutils.RandDat(100))
+	destination, err := suite.ng.NewOwnedNode("destination", graph.RootNodeId, os.ModeDir|0777, "admin")
+	t.Assert(err, IsNil)
+
+	var archive bytes.Buffer
+	t.Assert(suite.ng.Export(folder, &archive, nil), IsNil)
+	req := suite.request(api.ImportNode.Build(destination.Id), &archive)
+	req.Header.Set("Content-Type", string(api.TarEncoding))
+	resp := suite.doAs(t, "user", req)
+	t.Assert(resp.StatusCode, Equals, http.StatusCreated)
+
+	imported := suite.ng.NodeWithName(destination.Id, "folder")
+	t.Assert(imported, NotNil)
+	t.Check(imported.Owner(), Equals, "user")
+	t.Check(suite.ng.NodeWithName(imported.Id, "file").Owner(), Equals, "user")
+}
+
 // Helpers
 func (suite *ApiTestSuite) createNode(parentId string, nodeInfo graph.NodeInfo) (string, error) {
 	req := suite.request(api.CreateNode.Build(parentId), encode(nodeInfo))
@@ -54,3 +54,9 @@ func (suite *ApiTestSuite) TestApiResponse_newDataResponse_includesData(t *C) {
 	t.Check(unmarshaledData["one"], Equals, "foo")
 	t.Check(unmarshaledData["two"], Equals, "bar")
 }
+
+func (suite *ApiTestSuite) TestApiError_MissingBlocks_listsIndexes(t *C) {
+	t.Check(api.ApiError{api.BLOCKS_MISSING, "0,3,7"}.MissingBlocks(), DeepEquals, []int{0, 3, 7})
+	t.Check(api.ApiError{api.BLOCKS_MISSING, ""}.MissingBlocks(), HasLen, 0)
+	t.Check(api.ApiError{api.INTERNAL, "1"}.MissingBlocks(), HasLen, 0)
+}
@@ -2,8 +2,16 @@ package api
 
 import (
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pborman/uuid"
+	"github.com/sdcoffey/olympus/auth"
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/share"
+	"github.com/sdcoffey/olympus/upload"
 )
 
 type ErrorCode string
@@ -16,6 +24,19 @@ const (
 	IS_DIRECTORY     ErrorCode = "node_is_dir"
 	INCONGRUOUS_HASH ErrorCode = "incongruous_hash"
 	NO_SUCH_BLOCK    ErrorCode = "no_such_block"
+	NOT_AN_IMAGE     ErrorCode = "not_an_image"
+	NO_SUCH_WEBHOOK  ErrorCode = "no_such_webhook"
+	UNAUTHORIZED     ErrorCode = "unauthorized"
+	FORBIDDEN        ErrorCode = "forbidden"
+	NO_SUCH_USER     ErrorCode = "no_such_user"
+	NO_SUCH_TOKEN    ErrorCode = "no_such_token"
+	NO_SUCH_SHARE    ErrorCode = "no_such_share"
+	SHARE_EXPIRED    ErrorCode = "share_expired"
+	DROP_BOX_FULL    ErrorCode = "drop_box_full"
+	NO_SUCH_UPLOAD   ErrorCode = "no_such_upload"
+	UPLOAD_EXPIRED   ErrorCode = "upload_expired"
+	BLOCKS_MISSING   ErrorCode = "blocks_missing"
+	CURSOR_EXPIRED   ErrorCode = "cursor_expired"
 )
 
 type ApiResponse struct {
@@ -33,6 +54,64 @@ func (apiError ApiError) Error() string {
 	return fmt.Sprint(apiError.Code, " => ", apiError.Details)
 }
 
+// A BLOCKS_MISSING error, whose details list the indexes of the blocks a commit found missing, separated by
+// commas, so the client can send them again
+func missingBlocksError(indexes []int) ApiError {
+	details := make([]string, len(indexes))
+	for i, index := range indexes {
+		details[i] = strconv.Itoa(index)
+	}
+	return ApiError{BLOCKS_MISSING, strings.Join(details, ",")}
+}
+
+// The indexes of the blocks a BLOCKS_MISSING error lists
+func (apiError ApiError) MissingBlocks() []int {
+	indexes := make([]int, 0)
+	if apiError.Code != BLOCKS_MISSING {
+		return indexes
+	}
+	for _, field := range strings.Split(apiError.Details, ",") {
+		if index, err := strconv.Atoi(strings.TrimSpace(field)); err == nil {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+type IngestRequest struct {
+	Path string `json:"path"`
+}
+
+type ChangesResponse struct {
+	Changes []graph.Change `json:"changes"`
+	Cursor  uint64         `json:"cursor"`
+}
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	TokenRequest
+}
+
+type TokenRequest struct {
+	Name string `json:"name"`
+	// Seconds until the token expires; 0 uses DefaultTokenTTL, and a negative value issues a token that
+	// doesn't expire
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type TokenResponse struct {
+	Token string     `json:"token"`
+	Info  auth.Token `json:"info"`
+}
+
+type UserRequest struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Admin    bool     `json:"admin"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
 type ApiResponseMetadata struct {
 	RequestId string `json:"request_id"`
 }
@@ -50,3 +129,63 @@ func NewDataResponse(data interface{}) ApiResponse {
 		Data: data,
 	}
 }
+
+// Expiry is in seconds from now; it and the other fields are optional
+type ShareRequest struct {
+	Password     string `json:"password,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	MaxDownloads int    `json:"max_downloads,omitempty"`
+}
+
+type ShareResponse struct {
+	Token string      `json:"token"`
+	Url   string      `json:"url"`
+	Info  share.Share `json:"info"`
+}
+
+// Expiry is in seconds from now; it and the other fields are optional
+type DropBoxRequest struct {
+	Password  string `json:"password,omitempty"`
+	ExpiresIn int64  `json:"expires_in,omitempty"`
+	share.Limits
+}
+
+// What an uploader can see of a drop box: how much more it will take, but not what's in it
+type DropBoxResponse struct {
+	Name     string    `json:"name"`
+	Expires  time.Time `json:"expires,omitempty"`
+	MaxFiles int       `json:"max_files,omitempty"`
+	MaxBytes int64     `json:"max_bytes,omitempty"`
+	Files    int       `json:"files"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// Uploader is optional, and is whatever the uploader would like to be known as
+type DropRequest struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Uploader string `json:"uploader,omitempty"`
+}
+
+// Hashes of blocks: those a client has, when it asks which are missing, and those the server is missing
+type BlockHashes struct {
+	Hashes []string `json:"hashes"`
+}
+
+// A file to upload a block at a time: its hashes are those of each BlockSize block of its data, in order.
+// MTime is optional. With Replace, an existing file of the same name has its content replaced on commit,
+// keeping the old content as a version, rather than the upload failing with NODE_EXISTS.
+type UploadRequest struct {
+	Name    string      `json:"name"`
+	Mode    os.FileMode `json:"mode"`
+	MTime   time.Time   `json:"mtime,omitempty"`
+	Size    int64       `json:"size"`
+	Hashes  []string    `json:"hashes"`
+	Replace bool        `json:"replace,omitempty"`
+}
+
+// An upload session, and the indexes of the blocks that still need to be sent
+type UploadResponse struct {
+	Info    upload.Session `json:"info"`
+	Missing []int          `json:"missing"`
+}
@@ -0,0 +1,277 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/upload"
+)
+
+// Keep resumable upload sessions in store; without this the upload endpoints respond 503
+func WithUploads(store *upload.Store) Option {
+	return func(restApi *OlympusApi) {
+		restApi.uploads = store
+	}
+}
+
+func (restApi OlympusApi) uploadsEnabled(writer http.ResponseWriter, req *http.Request) bool {
+	if restApi.uploads == nil {
+		errorResponse(ApiError{INTERNAL, "Upload sessions are not enabled"}, http.StatusServiceUnavailable, req, writer)
+		return false
+	}
+	return true
+}
+
+// The session named in a request's path, writing an error if it doesn't exist, has expired, or isn't the
+// request user's. Admins may use anyone's sessions.
+func (restApi OlympusApi) openUpload(writer http.ResponseWriter, req *http.Request) (upload.Session, bool) {
+	if !restApi.uploadsEnabled(writer, req) {
+		return upload.Session{}, false
+	}
+
+	uploadId := paramFromRequest("uploadId", req)
+	session, err := restApi.uploads.Session(uploadId)
+	if err == nil && restApi.users != nil {
+		if user, ok := userFromRequest(req); !ok || (!user.Admin && user.Username != session.Creator) {
+			err = upload.ErrNoSuchSession
+		}
+	}
+
+	if err == upload.ErrExpired {
+		errorResponse(ApiError{UPLOAD_EXPIRED, uploadId}, http.StatusGone, req, writer)
+		return session, false
+	} else if err != nil {
+		errorResponse(ApiError{NO_SUCH_UPLOAD, uploadId}, http.StatusNotFound, req, writer)
+		return session, false
+	}
+	return session, true
+}
+
+// Indexes of the session's blocks the server doesn't have yet. Blocks are looked for, not read: those
+// received in the session were checked against their hashes as they arrived, so only need to still be
+// stored, and others need a copy of the right size.
+func missingBlocks(session upload.Session) []int {
+	missing := make([]int, 0)
+	for i, hash := range session.Hashes {
+		if session.WasReceived(i) && graph.Stored(hash) {
+			continue
+		} else if size, err := graph.SizeOnDisk(hash); err != nil || size != session.BlockLength(i) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// GET v1/uploads
+// returns -> [Session] (the requesting user's open sessions, oldest first)
+func (restApi OlympusApi) ListUploads(writer http.ResponseWriter, req *http.Request) {
+	if restApi.uploadsEnabled(writer, req) {
+		dataResponse(restApi.uploads.ForCreator(ownerFromRequest(req)), http.StatusOK, req, writer)
+	}
+}
+
+// POST v1/node/{parentId}/uploads
+// body -> {UploadRequest}
+// returns -> {UploadResponse}; the blocks it lists as missing are sent with UploadBlock, in any order, before
+// the file is committed
+func (restApi OlympusApi) OpenUpload(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.uploadsEnabled(writer, req) {
+		return
+	}
+
+	parent := restApi.graph.NodeWithId(paramFromRequest("parentId", req))
+	if !parent.Exists() {
+		writeNodeNotFoundError(parent.Id, req, writer)
+		return
+	} else if !parent.IsDir() {
+		errorResponse(ApiError{INVALID_PARAM, "Files can only be uploaded into a directory"}, http.StatusBadRequest, req, writer)
+		return
+	} else if !restApi.requirePermission(parent, graph.WritePermission, writer, req) {
+		return
+	}
+
+	var uploadRequest UploadRequest
+	defer req.Body.Close()
+	if err := decoderFromHeader(req.Body, req.Header).Decode(&uploadRequest); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+		return
+	} else if node := restApi.graph.NodeWithName(parent.Id, uploadRequest.Name); node != nil && node.Exists() &&
+		!restApi.mayReplace(node, uploadRequest.Replace, writer, req) {
+		return
+	} else if uploadRequest.MTime.After(time.Now()) {
+		errorResponse(ApiError{INVALID_PARAM, "Cannot set modified time in the future"}, http.StatusBadRequest, req, writer)
+		return
+	}
+	for _, hash := range uploadRequest.Hashes {
+		if !graph.ValidHash(hash) {
+			errorResponse(ApiError{INVALID_PARAM, fmt.Sprintf("Invalid block hash: %s", hash)}, http.StatusBadRequest, req, writer)
+			return
+		}
+	}
+
+	session, err := restApi.uploads.Open(upload.Session{
+		Creator:   ownerFromRequest(req),
+		ParentId:  parent.Id,
+		Name:      uploadRequest.Name,
+		Mode:      uploadRequest.Mode,
+		MTime:     uploadRequest.MTime,
+		Size:      uploadRequest.Size,
+		BlockSize: graph.BLOCK_SIZE,
+		Hashes:    uploadRequest.Hashes,
+		Replace:   uploadRequest.Replace,
+	})
+	if err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else {
+		dataResponse(UploadResponse{session, missingBlocks(session)}, http.StatusCreated, req, writer)
+		restApi.inBackground(restApi.expireUploads)
+	}
+}
+
+// Close expired sessions, and delete the blocks sent for them that no file ended up using. Nothing else
+// would ever remove those blocks.
+func (restApi OlympusApi) expireUploads() {
+	if hashes, err := restApi.uploads.Expire(); err == nil && len(hashes) > 0 {
+		restApi.graph.RemoveUnusedBlocks(hashes)
+	}
+}
+
+// GET v1/uploads/{uploadId}
+// returns -> {UploadResponse}
+func (restApi OlympusApi) UploadStatus(writer http.ResponseWriter, req *http.Request) {
+	if session, ok := restApi.openUpload(writer, req); ok {
+		dataResponse(UploadResponse{session, missingBlocks(session)}, http.StatusOK, req, writer)
+	}
+}
+
+// PUT v1/uploads/{uploadId}/block/{index}
+// body -> the block's data, which must have the hash given for it when the session was opened
+func (restApi OlympusApi) UploadBlock(writer http.ResponseWriter, req *http.Request) {
+	session, ok := restApi.openUpload(writer, req)
+	if !ok {
+		return
+	}
+
+	defer req.Body.Close()
+	indexString := paramFromRequest("index", req)
+	index, err := strconv.Atoi(indexString)
+	if err != nil || index < 0 || index >= len(session.Hashes) {
+		errorResponse(ApiError{INVALID_PARAM, fmt.Sprintf("Block index: %s", indexString)}, http.StatusBadRequest, req, writer)
+		return
+	}
+
+	hash := session.Hashes[index]
+	if data, err := ioutil.ReadAll(io.LimitReader(req.Body, session.BlockSize+1)); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else if int64(len(data)) != session.BlockLength(index) || graph.Hash(data) != hash {
+		errorResponse(ApiError{INCONGRUOUS_HASH, fmt.Sprintf("Block %d should have hash %s", index, hash)}, http.StatusBadRequest, req, writer)
+	} else if _, err := graph.Write(hash, data); err != nil {
+		errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
+	} else if err := restApi.uploads.Receive(session.Id, index); err != nil {
+		errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
+	} else {
+		writer.WriteHeader(http.StatusCreated)
+	}
+}
+
+// POST v1/uploads/{uploadId}/commit
+// returns -> {nodeInfo} of the new file, once every block has been uploaded, or 200 with the replaced file's
+// {nodeInfo} for a session that replaces one; 409 listing the indexes of any blocks still missing
+func (restApi OlympusApi) CommitUpload(writer http.ResponseWriter, req *http.Request) {
+	session, ok := restApi.openUpload(writer, req)
+	if !ok {
+		return
+	}
+
+	parent := restApi.graph.NodeWithId(session.ParentId)
+	existing := restApi.graph.NodeWithName(parent.Id, session.Name)
+	replacing := existing != nil && existing.Exists()
+	if !parent.Exists() {
+		writeNodeNotFoundError(parent.Id, req, writer)
+		return
+	} else if !restApi.requirePermission(parent, graph.WritePermission, writer, req) {
+		return
+	} else if replacing && !restApi.mayReplace(existing, session.Replace, writer, req) {
+		return
+	}
+	if missing := missingBlocks(session); len(missing) > 0 {
+		errorResponse(missingBlocksError(missing), http.StatusConflict, req, writer)
+		return
+	}
+
+	var node *graph.Node
+	var err error
+	status := http.StatusCreated
+	if replacing {
+		_, err = existing.ReplaceContent(session.Hashes, session.MTime)
+		node, status = existing, http.StatusOK
+	} else {
+		node, err = restApi.graph.NewFile(session.Name, parent.Id, session.Mode, session.Creator, session.Hashes, session.MTime)
+	}
+	if os.IsNotExist(err) {
+		// A block was removed since it was checked
+		errorResponse(missingBlocksError(missingBlocks(session)), http.StatusConflict, req, writer)
+		return
+	} else if err != nil && replacing {
+		errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
+		return
+	} else if err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+		return
+	}
+	if last := len(session.Hashes) - 1; last >= 0 {
+		restApi.blockWritten(node, session.BlockLength(last))
+	}
+
+	// The file has its content now, so a session that fails to close is left to expire
+	restApi.uploads.Remove(session.Id)
+	dataResponse(node.NodeInfo(), status, req, writer)
+}
+
+// Whether an upload may take the name of node, which already exists: only to replace the content of a file
+// the request may write, and only if it asked to. Writes an error if not.
+func (restApi OlympusApi) mayReplace(node *graph.Node, replace bool, writer http.ResponseWriter, req *http.Request) bool {
+	if !replace {
+		errorResponse(ApiError{NODE_EXISTS, node.Id}, http.StatusBadRequest, req, writer)
+		return false
+	} else if node.IsDir() {
+		errorResponse(ApiError{IS_DIRECTORY, node.Id}, http.StatusBadRequest, req, writer)
+		return false
+	}
+	return restApi.requirePermission(node, graph.WritePermission, writer, req)
+}
+
+// GET v1/node/{nodeId}/versions
+// returns -> [Version] (the file's earlier contents, newest first)
+func (restApi OlympusApi) Versions(writer http.ResponseWriter, req *http.Request) {
+	node := restApi.graph.NodeWithId(paramFromRequest("nodeId", req))
+	if !node.Exists() {
+		writeNodeNotFoundError(node.Id, req, writer)
+		return
+	} else if node.IsDir() {
+		errorResponse(ApiError{IS_DIRECTORY, node.Id}, http.StatusBadRequest, req, writer)
+		return
+	} else if !restApi.requirePermission(node, graph.ReadPermission, writer, req) {
+		return
+	}
+
+	dataResponse(node.Versions(), http.StatusOK, req, writer)
+}
+
+// DELETE v1/uploads/{uploadId}
+// Blocks already uploaded are kept, since other files may use them too
+func (restApi OlympusApi) AbortUpload(writer http.ResponseWriter, req *http.Request) {
+	if session, ok := restApi.openUpload(writer, req); !ok {
+		return
+	} else if err := restApi.uploads.Remove(session.Id); err != nil {
+		errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
+	} else {
+		writer.WriteHeader(http.StatusOK)
+	}
+}
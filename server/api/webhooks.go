@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/sdcoffey/olympus/webhook"
+)
+
+// Webhooks see every change on the server, so only admins may manage them
+func (restApi OlympusApi) webhooksEnabled(writer http.ResponseWriter, req *http.Request) bool {
+	if restApi.webhooks == nil {
+		errorResponse(ApiError{INTERNAL, "Webhooks are not enabled"}, http.StatusServiceUnavailable, req, writer)
+		return false
+	}
+	return restApi.requireAdmin(writer, req)
+}
+
+// GET v1/webhooks
+// returns -> [webhook]
+func (restApi OlympusApi) ListWebhooks(writer http.ResponseWriter, req *http.Request) {
+	if restApi.webhooksEnabled(writer, req) {
+		dataResponse(restApi.webhooks.Hooks(), http.StatusOK, req, writer)
+	}
+}
+
+// POST v1/webhooks
+// body -> {url, subtree, events, secret}, where subtree, events and secret are optional
+// returns -> {webhook}, including its secret
+func (restApi OlympusApi) CreateWebhook(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.webhooksEnabled(writer, req) {
+		return
+	}
+
+	var hook webhook.Hook
+	defer req.Body.Close()
+	if err := decoderFromHeader(req.Body, req.Header).Decode(&hook); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else if hook.Subtree != "" && !restApi.graph.NodeWithId(hook.Subtree).Exists() {
+		writeNodeNotFoundError(hook.Subtree, req, writer)
+	} else if hook, err = restApi.webhooks.Add(hook); err != nil {
+		errorResponse(ApiError{INVALID_PARAM, err.Error()}, http.StatusBadRequest, req, writer)
+	} else {
+		dataResponse(hook, http.StatusCreated, req, writer)
+	}
+}
+
+// DELETE v1/webhooks/{hookId}
+func (restApi OlympusApi) RemoveWebhook(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.webhooksEnabled(writer, req) {
+		return
+	}
+
+	hookId := paramFromRequest("hookId", req)
+	if _, ok := restApi.webhooks.Hook(hookId); !ok {
+		errorResponse(ApiError{NO_SUCH_WEBHOOK, hookId}, http.StatusNotFound, req, writer)
+	} else if err := restApi.webhooks.Remove(hookId); err != nil {
+		errorResponse(ApiError{INTERNAL, err.Error()}, http.StatusInternalServerError, req, writer)
+	} else {
+		writer.WriteHeader(http.StatusOK)
+	}
+}
+
+// GET v1/webhooks/{hookId}/deliveries
+// returns -> [delivery], newest first
+func (restApi OlympusApi) WebhookDeliveries(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.webhooksEnabled(writer, req) {
+		return
+	}
+
+	hookId := paramFromRequest("hookId", req)
+	if _, ok := restApi.webhooks.Hook(hookId); !ok {
+		errorResponse(ApiError{NO_SUCH_WEBHOOK, hookId}, http.StatusNotFound, req, writer)
+	} else {
+		dataResponse(restApi.webhooks.Deliveries(hookId), http.StatusOK, req, writer)
+	}
+}
+
+// POST v1/webhooks/{hookId}/test
+// returns -> {delivery} of a ping event, sent once
+func (restApi OlympusApi) TestWebhook(writer http.ResponseWriter, req *http.Request) {
+	if !restApi.webhooksEnabled(writer, req) {
+		return
+	}
+
+	hookId := paramFromRequest("hookId", req)
+	if delivery, err := restApi.webhooks.Test(hookId); err != nil {
+		errorResponse(ApiError{NO_SUCH_WEBHOOK, hookId}, http.StatusNotFound, req, writer)
+	} else {
+		dataResponse(delivery, http.StatusOK, req, writer)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sdcoffey/olympus/cert"
+	"github.com/sdcoffey/olympus/config"
+	"github.com/sdcoffey/olympus/env"
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/peer"
+	"github.com/sdcoffey/olympus/server/api"
+	"github.com/sdcoffey/olympus/webhook"
+	"github.com/wsxiaoys/terminal/color"
+)
+
+// The parts of a running server that change when its config is reloaded
+type runningServer struct {
+	sync.Mutex
+	configFile string
+	flags      config.Flags
+	webhooks   *webhook.Dispatcher
+	graph      *graph.NodeGraph
+	restApi    api.OlympusApi
+
+	config        config.Config
+	certificate   *tls.Certificate
+	logFile       *os.File
+	stopHeartbeat func()
+}
+
+// Serve the api over HTTPS, with HTTP/2, unless TLS is turned off, reloading the config on SIGHUP and
+// shutting down on SIGTERM or SIGINT
+func (running *runningServer) serve(cfg config.Config) int {
+	running.config = cfg
+	if err := running.apply(cfg); err != nil {
+		color.Println("@r", err.Error())
+		return 1
+	}
+
+	server := &http.Server{
+		Addr:           cfg.Listen,
+		Handler:        running.restApi,
+		IdleTimeout:    time.Duration(cfg.Limits.IdleTimeout),
+		MaxHeaderBytes: cfg.Limits.MaxHeaderBytes,
+	}
+	if cfg.TLS.Enabled {
+		server.TLSConfig = cert.ServerConfig(running.getCertificate)
+	}
+
+	log.Printf("Serving %s on %s", running.scheme(), cfg.Listen)
+	go running.reloadOnHangup()
+	stopped := make(chan int, 1)
+	go running.shutdownOnSignal(server, stopped)
+
+	var err error
+	if cfg.TLS.Enabled {
+		// The certificate comes from TLSConfig
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Println(err.Error())
+		return 1
+	}
+	return <-stopped
+}
+
+// Stop accepting connections and end event streams, give requests in flight the shutdown timeout to finish,
+// wait for the work they started in the background, then close the graph
+func (running *runningServer) shutdownOnSignal(server *http.Server, stopped chan<- int) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	received := <-signals
+
+	running.Lock()
+	timeout := time.Duration(running.config.Limits.ShutdownTimeout)
+	running.Unlock()
+	log.Printf("Received %s, shutting down", received)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	running.restApi.StopStreams()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Closing connections still open after", timeout)
+		server.Close()
+	}
+
+	running.Lock()
+	defer running.Unlock()
+	if running.stopHeartbeat != nil {
+		running.stopHeartbeat()
+	}
+	running.restApi.Wait()
+	running.webhooks.Stop()
+	graph.WaitForRepairs()
+
+	status := 0
+	if err := running.graph.Close(); err != nil {
+		log.Println("Error closing graph:", err.Error())
+		status = 1
+	}
+	log.Println("Shut down")
+	stopped <- status
+}
+
+func (running *runningServer) reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if next, err := config.Load(running.configFile, running.flags); err != nil {
+			log.Println("Not reloading config:", err.Error())
+		} else if err := running.apply(next); err != nil {
+			log.Println("Error reloading config:", err.Error())
+		} else {
+			log.Println("Reloaded config from", running.configFile)
+		}
+	}
+}
+
+// Apply the settings in next that can change while the server is running, warning about any others that
+// have changed
+func (running *runningServer) apply(next config.Config) error {
+	running.Lock()
+	defer running.Unlock()
+
+	for _, name := range running.config.RestartRequired(next) {
+		log.Printf("Restart the server to change %s", name)
+	}
+
+	if err := running.openLog(next.Log); err != nil {
+		return err
+	}
+	if running.config.TLS.Enabled {
+		if certificate, err := cert.Load(next.TLS.Cert, next.TLS.Key, env.EnvPath(env.ConfigPath)); err != nil {
+			return err
+		} else {
+			running.certificate = &certificate
+			log.Println("Certificate fingerprint:", cert.Fingerprint(certificate))
+		}
+		running.config.TLS = next.TLS
+	}
+
+	running.webhooks.SetRetries(next.Limits.WebhookAttempts, time.Duration(next.Limits.WebhookBackoff))
+	running.config.Limits.WebhookAttempts = next.Limits.WebhookAttempts
+	running.config.Limits.WebhookBackoff = next.Limits.WebhookBackoff
+
+	running.config.Discovery = next.Discovery
+	running.announce()
+
+	return nil
+}
+
+// Send log output to the configured file, reopening it in case it's been rotated
+func (running *runningServer) openLog(logConfig config.Log) error {
+	previous := running.logFile
+	if logConfig.File == "" {
+		log.SetOutput(os.Stderr)
+		running.logFile = nil
+	} else if file, err := os.OpenFile(logConfig.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return fmt.Errorf("Error opening log file: %s", err.Error())
+	} else {
+		log.SetOutput(file)
+		running.logFile = file
+	}
+
+	if previous != nil {
+		previous.Close()
+	}
+	running.config.Log = logConfig
+	return nil
+}
+
+// (Re)start announcing the server, if discovery is on
+func (running *runningServer) announce() {
+	if running.stopHeartbeat != nil {
+		running.stopHeartbeat()
+		running.stopHeartbeat = nil
+	}
+	if !running.config.Discovery.Enabled {
+		return
+	}
+
+	_, portString, _ := net.SplitHostPort(running.config.Listen)
+	port, _ := strconv.Atoi(portString)
+	announcement := peer.Announcement{Scheme: running.scheme(), Port: port}
+	if running.certificate != nil {
+		announcement.Fingerprint = cert.Fingerprint(*running.certificate)
+	}
+	running.stopHeartbeat = peer.StartHeartbeat(announcement, time.Duration(running.config.Discovery.Interval))
+}
+
+func (running *runningServer) scheme() string {
+	if running.config.TLS.Enabled {
+		return "https"
+	}
+	return "http"
+}
+
+func (running *runningServer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	running.Lock()
+	defer running.Unlock()
+	return running.certificate, nil
+}
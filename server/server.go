@@ -1,38 +1,198 @@
 package main
 
 import (
-	"net/http"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/cayleygraph/cayley"
 	cgraph "github.com/cayleygraph/cayley/graph"
 	_ "github.com/cayleygraph/cayley/graph/bolt"
+	"github.com/sdcoffey/olympus/auth"
+	"github.com/sdcoffey/olympus/cert"
+	"github.com/sdcoffey/olympus/config"
 	"github.com/sdcoffey/olympus/env"
 	"github.com/sdcoffey/olympus/graph"
-	"github.com/sdcoffey/olympus/peer"
+	"github.com/sdcoffey/olympus/logging"
+	"github.com/sdcoffey/olympus/metrics"
 	"github.com/sdcoffey/olympus/server/api"
+	"github.com/sdcoffey/olympus/share"
+	"github.com/sdcoffey/olympus/upload"
+	"github.com/sdcoffey/olympus/webhook"
 	"github.com/wsxiaoys/terminal/color"
 )
 
-var debug = false
-
 func main() {
+	configFile := flag.String("config", "", "Config file (defaults to $OLYMPUS_HOME/cfg/"+config.FileName+")")
+	fsck := flag.Bool("fsck", false, "Check the node graph for inconsistencies and exit")
+	repair := flag.Bool("repair", false, "With -fsck, repair any inconsistencies found")
+	ingest := flag.String("ingest", "", "Copy a local file or directory into the graph and exit")
+	into := flag.String("into", graph.RootNodeId, "With -ingest, id of the directory to copy into")
+	addUser := flag.String("adduser", "", "Add a user, reading their password from stdin, and exit")
+	admin := flag.Bool("admin", false, "With -adduser, make the user an admin")
+	fingerprint := flag.Bool("fingerprint", false, "Print the fingerprint of the TLS certificate and exit")
+	flags := config.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
 	env.InitializeEnvironment()
-	if nodeGraph, err := initDb(); err != nil {
+	if *configFile == "" {
+		*configFile = filepath.Join(env.EnvPath(env.ConfigPath), config.FileName)
+	}
+
+	cfg, err := config.Load(*configFile, flags)
+	if err != nil {
+		color.Println("@r", err)
+		os.Exit(1)
+	} else if len(cfg.DataDirs) > 0 {
+		if err := graph.UseDataDirs(cfg.DataDirs, cfg.Copies); err != nil {
+			color.Println("@r", err)
+			os.Exit(1)
+		}
+	}
+
+	if *fingerprint {
+		os.Exit(runFingerprint(cfg.TLS))
+	}
+
+	users, err := initUsers()
+	if err != nil {
+		color.Println("@r", err)
+		os.Exit(1)
+	} else if *addUser != "" {
+		os.Exit(runAddUser(users, *addUser, *admin))
+	}
+
+	if nodeGraph, err := initDb(cfg); err != nil {
+		color.Println("@r", err)
+		os.Exit(1)
+	} else if *fsck {
+		os.Exit(runFsck(nodeGraph, *repair))
+	} else if *ingest != "" {
+		os.Exit(runIngest(nodeGraph, *ingest, *into))
+	} else if webhooks, err := initWebhooks(nodeGraph, cfg); err != nil {
+		color.Println("@r", err)
+		os.Exit(1)
+	} else if shares, err := initShares(cfg); err != nil {
 		color.Println("@r", err)
 		os.Exit(1)
+	} else if uploads, err := initUploads(cfg); err != nil {
+		color.Println("@r", err)
+		os.Exit(1)
+	} else if removed, err := graph.RemoveStaleTempFiles(); err != nil {
+		color.Println("@r", err)
+		os.Exit(1)
+	} else {
+		if removed > 0 {
+			color.Printf("@yRemoved %d temp files left in the data directories by an earlier crash\n", removed)
+		}
+		webhooks.Start()
+		access, errors, err := initLogs(cfg.Log)
+		if err != nil {
+			color.Println("@r", err)
+			os.Exit(1)
+		}
+		options := []api.Option{api.WithWebhooks(webhooks), api.WithShares(shares), api.WithUploads(uploads),
+			api.WithLogs(access, errors), api.WithMetrics(metrics.NewRegistry()), api.WithMinFreeBytes(cfg.Limits.MinFreeBytes),
+			api.WithIngestRoot(cfg.IngestRoot), api.WithTrustedProxies(cfg.TrustedProxies)}
+		if cfg.Auth {
+			options = append(options, api.WithAuth(users))
+		}
+
+		running := &runningServer{configFile: *configFile, flags: flags, webhooks: webhooks, graph: nodeGraph,
+			restApi: api.NewApi(nodeGraph, options...)}
+		os.Exit(running.serve(cfg))
+	}
+}
+
+func runFingerprint(tlsConfig config.TLS) int {
+	if certificate, err := cert.Load(tlsConfig.Cert, tlsConfig.Key, env.EnvPath(env.ConfigPath)); err != nil {
+		color.Println("@r", err.Error())
+		return 1
 	} else {
-		go peer.ClientHeartbeat()
-		http.ListenAndServe(":3000", api.NewApi(nodeGraph))
+		fmt.Println(cert.Fingerprint(certificate))
+		return 0
+	}
+}
+
+// JSON access and error logs, rotated under the log directory
+func initLogs(logConfig config.Log) (access, errors *logging.Logger, err error) {
+	logDir := logConfig.Dir
+	if logDir == "" {
+		logDir = env.EnvPath(env.LogPath)
+	}
+
+	var accessFile, errorFile *logging.RotatingFile
+	if accessFile, err = logging.OpenRotating(filepath.Join(logDir, "access.log"), logConfig.RotateBytes, logConfig.Keep); err != nil {
+		return
+	} else if errorFile, err = logging.OpenRotating(filepath.Join(logDir, "error.log"), logConfig.RotateBytes, logConfig.Keep); err != nil {
+		accessFile.Close()
+		return
+	}
+	return logging.NewLogger(accessFile), logging.NewLogger(errorFile), nil
+}
+
+func initUsers() (*auth.Store, error) {
+	return auth.NewStore(filepath.Join(env.EnvPath(env.ConfigPath), "users.json"))
+}
+
+func runAddUser(users *auth.Store, username string, admin bool) int {
+	fmt.Fprintf(os.Stderr, "Password for %s: ", username)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		color.Println("@r", err.Error())
+		return 1
+	}
+
+	if _, err := users.AddUser(username, strings.TrimRight(password, "\r\n"), admin); err != nil {
+		color.Println("@r", err.Error())
+		return 1
+	}
+
+	fmt.Println("Added user", username)
+	return 0
+}
+
+func initWebhooks(nodeGraph *graph.NodeGraph, cfg config.Config) (*webhook.Dispatcher, error) {
+	hooksPath := ""
+	if cfg.Storage != config.Memory {
+		hooksPath = filepath.Join(env.EnvPath(env.ConfigPath), "webhooks.json")
 	}
+	return webhook.NewDispatcher(hooksPath, nodeGraph.Journal())
 }
 
-func initDb() (*graph.NodeGraph, error) {
+func initShares(cfg config.Config) (*share.Store, error) {
+	sharesPath := ""
+	if cfg.Storage != config.Memory {
+		sharesPath = filepath.Join(env.EnvPath(env.ConfigPath), "shares.json")
+	}
+	return share.NewStore(sharesPath)
+}
+
+func initUploads(cfg config.Config) (*upload.Store, error) {
+	uploadsPath := ""
+	if cfg.Storage != config.Memory {
+		uploadsPath = filepath.Join(env.EnvPath(env.ConfigPath), "uploads.json")
+	}
+	return upload.NewStore(uploadsPath, time.Duration(cfg.Limits.UploadTimeout))
+}
+
+func initDb(cfg config.Config) (*graph.NodeGraph, error) {
+	dbDir := cfg.DbDir
+	if dbDir == "" {
+		dbDir = env.EnvPath(env.DbPath)
+	} else if err := os.MkdirAll(dbDir, 0744); err != nil {
+		return nil, err
+	}
+
 	var handle *cayley.Handle
 	var err error
-	if !debug {
-		dbPath := filepath.Join(env.EnvPath(env.DbPath), "db.dat")
+	if cfg.Storage == config.Bolt {
+		dbPath := filepath.Join(dbDir, "db.dat")
 		if !env.Exists(dbPath) {
 			if err = cgraph.InitQuadStore("bolt", dbPath, nil); err != nil {
 				return nil, err
@@ -47,5 +207,64 @@ func initDb() (*graph.NodeGraph, error) {
 		}
 	}
 
-	return graph.NewGraph(handle)
+	nodeGraph, err := graph.NewGraph(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	journalPath := ""
+	if cfg.Storage == config.Bolt {
+		journalPath = filepath.Join(dbDir, "journal.log")
+	}
+	if journal, err := graph.OpenJournal(journalPath); err != nil {
+		return nil, err
+	} else if err = journal.Retain(cfg.Limits.JournalChanges); err != nil {
+		return nil, err
+	} else {
+		nodeGraph.UseJournal(journal)
+	}
+	nodeGraph.KeepVersions(cfg.Limits.FileVersions)
+
+	return nodeGraph, nil
+}
+
+func runFsck(nodeGraph *graph.NodeGraph, repair bool) int {
+	report, err := nodeGraph.Fsck(repair)
+	for _, issue := range report.Issues {
+		if issue.Repaired {
+			color.Println("@y", issue.String())
+		} else {
+			color.Println("@r", issue.String())
+		}
+	}
+
+	fmt.Printf("Checked %d nodes, found %d problems\n", report.NodesChecked, len(report.Issues))
+	if err != nil {
+		color.Println("@rError repairing graph: ", err.Error())
+		return 1
+	} else if !report.Clean() && !repair {
+		return 1
+	}
+
+	return 0
+}
+
+func runIngest(nodeGraph *graph.NodeGraph, localPath, parentId string) int {
+	var reported int
+	progress, err := nodeGraph.Ingest(localPath, parentId, func(progress graph.IngestProgress) {
+		for ; reported < len(progress.Errors); reported++ {
+			color.Println("@r", progress.Errors[reported])
+		}
+		fmt.Printf("\r%d files, %d dirs, %d skipped, %d bytes", progress.Files, progress.Dirs, progress.Skipped, progress.Bytes)
+	})
+	fmt.Println()
+
+	if err != nil {
+		color.Println("@r", err.Error())
+		return 1
+	} else if len(progress.Errors) > 0 {
+		return 1
+	}
+
+	return 0
 }
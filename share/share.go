@@ -0,0 +1,360 @@
+package share
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/sdcoffey/olympus/auth"
+	"github.com/sdcoffey/olympus/util"
+)
+
+var (
+	ErrNoSuchShare      = errors.New("No such share")
+	ErrExpired          = errors.New("Share has expired")
+	ErrPasswordRequired = errors.New("Share requires a password")
+	ErrLimitReached     = errors.New("Drop box is full")
+)
+
+type Kind string
+
+const (
+	Download Kind = "download"
+	DropBox  Kind = "dropbox"
+)
+
+// A link to a node for people without an account. Anyone with the token of a download share can browse and
+// download the node, and everything under it if it's a directory, until it expires or has been downloaded
+// MaxDownloads times. A drop box share instead lets them upload files into a directory without seeing
+// what's in it, up to MaxFiles files of MaxBytes in all. Zero values mean no limit.
+type Share struct {
+	Id           string    `json:"id"`
+	Kind         Kind      `json:"kind"`
+	NodeId       string    `json:"node_id"`
+	Creator      string    `json:"creator,omitempty"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires,omitempty"`
+	MaxDownloads int       `json:"max_downloads,omitempty"`
+	Downloads    int       `json:"downloads"`
+	Protected    bool      `json:"protected"`
+	MaxFiles     int       `json:"max_files,omitempty"`
+	MaxBytes     int64     `json:"max_bytes,omitempty"`
+	Uploads      []Upload  `json:"uploads,omitempty"`
+}
+
+// A file uploaded to a drop box, by whoever Uploader says they are, from Address
+type Upload struct {
+	NodeId   string    `json:"node_id"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Uploader string    `json:"uploader,omitempty"`
+	Address  string    `json:"address"`
+	Time     time.Time `json:"time"`
+}
+
+// Limits on what can be uploaded to a drop box. Zero values mean no limit.
+type Limits struct {
+	MaxFiles int   `json:"max_files,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// Shares saved before drop boxes existed have no kind, and are download shares
+func (share Share) IsDropBox() bool {
+	return share.Kind == DropBox
+}
+
+// Total size of the files uploaded to a drop box
+func (share Share) UploadedBytes() (total int64) {
+	for _, upload := range share.Uploads {
+		total += upload.Size
+	}
+	return
+}
+
+// The upload that created nodeId, if it was uploaded to this drop box
+func (share Share) Upload(nodeId string) (Upload, bool) {
+	for _, upload := range share.Uploads {
+		if upload.NodeId == nodeId {
+			return upload, true
+		}
+	}
+	return Upload{}, false
+}
+
+// Whether a drop box has room for another file of size bytes
+func (share Share) Fits(size int64) bool {
+	if share.MaxFiles > 0 && len(share.Uploads) >= share.MaxFiles {
+		return false
+	}
+	return share.MaxBytes == 0 || share.UploadedBytes()+size <= share.MaxBytes
+}
+
+func (share Share) Expired() bool {
+	if !share.Expires.IsZero() && !time.Now().Before(share.Expires) {
+		return true
+	}
+	return share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads
+}
+
+type storedShare struct {
+	Share
+	Password *auth.PasswordHash `json:"password,omitempty"`
+}
+
+type storeFile struct {
+	Secret string         `json:"secret"`
+	Shares []*storedShare `json:"shares"`
+}
+
+// Shares, saved to a JSON file on every change along with the secret their tokens are signed with
+type Store struct {
+	sync.Mutex
+	path   string
+	secret []byte
+	shares map[string]*storedShare
+}
+
+// Load the store at path, creating it when the first share is made. An empty path keeps everything in
+// memory only, so tokens don't survive a restart.
+func NewStore(path string) (*Store, error) {
+	store := &Store{path: path, shares: make(map[string]*storedShare)}
+
+	if path != "" {
+		if dat, err := ioutil.ReadFile(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Error reading shares: %s", err.Error())
+		} else if err == nil {
+			var saved storeFile
+			if err = json.Unmarshal(dat, &saved); err != nil {
+				return nil, fmt.Errorf("Error reading shares: %s", err.Error())
+			} else if store.secret, err = base64.RawURLEncoding.DecodeString(saved.Secret); err != nil {
+				return nil, fmt.Errorf("Error reading shares: %s", err.Error())
+			}
+			for _, saved := range saved.Shares {
+				store.shares[saved.Id] = saved
+			}
+		}
+	}
+
+	if len(store.secret) == 0 {
+		store.secret = make([]byte, 32)
+		if _, err := rand.Read(store.secret); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// Share a node, returning the share and the token to give out for it. With a password, the token alone
+// isn't enough to open the share.
+func (store *Store) Create(nodeId, creator, password string, ttl time.Duration, maxDownloads int) (Share, string, error) {
+	if maxDownloads < 0 {
+		return Share{}, "", fmt.Errorf("Invalid download limit: %d", maxDownloads)
+	}
+
+	return store.create(Share{
+		Kind:         Download,
+		NodeId:       nodeId,
+		Creator:      creator,
+		MaxDownloads: maxDownloads,
+	}, password, ttl)
+}
+
+// Make a drop box for uploading into a directory, returning it and the token to give out for it
+func (store *Store) CreateDropBox(dirId, creator, password string, ttl time.Duration, limits Limits) (Share, string, error) {
+	if limits.MaxFiles < 0 || limits.MaxBytes < 0 {
+		return Share{}, "", fmt.Errorf("Invalid drop box limits: %d files, %d bytes", limits.MaxFiles, limits.MaxBytes)
+	}
+
+	return store.create(Share{
+		Kind:     DropBox,
+		NodeId:   dirId,
+		Creator:  creator,
+		MaxFiles: limits.MaxFiles,
+		MaxBytes: limits.MaxBytes,
+	}, password, ttl)
+}
+
+func (store *Store) create(share Share, password string, ttl time.Duration) (Share, string, error) {
+	stored := &storedShare{Share: share}
+	stored.Id = uuid.New()
+	stored.Created = time.Now().UTC()
+	stored.Protected = password != ""
+	if ttl > 0 {
+		stored.Expires = stored.Created.Add(ttl)
+	}
+	if password != "" {
+		if hash, err := auth.HashPassword(password); err != nil {
+			return Share{}, "", err
+		} else {
+			stored.Password = &hash
+		}
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	store.shares[stored.Id] = stored
+	if err := store.save(); err != nil {
+		delete(store.shares, stored.Id)
+		return Share{}, "", err
+	}
+
+	return stored.Share, store.token(stored.Id), nil
+}
+
+// The token for a share: its id signed with the store's secret, so tokens can't be guessed from ids
+func (store *Store) Token(share Share) string {
+	return store.token(share.Id)
+}
+
+// The share a token is for, if it's still open and password matches. Fails with ErrNoSuchShare for tokens
+// that were never issued or have been revoked, ErrExpired for shares past their expiry or download limit,
+// and ErrPasswordRequired when password is wrong.
+func (store *Store) Open(token, password string) (Share, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 || !hmac.Equal([]byte(store.token(token[:i])), []byte(token)) {
+		return Share{}, ErrNoSuchShare
+	}
+
+	store.Lock()
+	stored, ok := store.shares[token[:i]]
+	store.Unlock()
+
+	if !ok {
+		return Share{}, ErrNoSuchShare
+	} else if stored.Expired() {
+		return Share{}, ErrExpired
+	} else if stored.Password != nil && !stored.Password.Matches(password) {
+		return Share{}, ErrPasswordRequired
+	}
+
+	return stored.Share, nil
+}
+
+// Count a download through a share, failing with ErrExpired if it's used up
+func (store *Store) CountDownload(id string) (Share, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	stored, ok := store.shares[id]
+	if !ok {
+		return Share{}, ErrNoSuchShare
+	} else if stored.Expired() {
+		return Share{}, ErrExpired
+	}
+
+	updated := *stored
+	updated.Downloads++
+	store.shares[id] = &updated
+	if err := store.save(); err != nil {
+		store.shares[id] = stored
+		return Share{}, err
+	}
+
+	return updated.Share, nil
+}
+
+// Record a file uploaded to a drop box, failing with ErrLimitReached if it doesn't fit
+func (store *Store) RecordUpload(id string, upload Upload) (Share, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	stored, ok := store.shares[id]
+	if !ok || !stored.IsDropBox() {
+		return Share{}, ErrNoSuchShare
+	} else if stored.Expired() {
+		return Share{}, ErrExpired
+	} else if !stored.Fits(upload.Size) {
+		return Share{}, ErrLimitReached
+	}
+
+	updated := *stored
+	upload.Time = time.Now().UTC()
+	updated.Uploads = append(append([]Upload(nil), stored.Uploads...), upload)
+	store.shares[id] = &updated
+	if err := store.save(); err != nil {
+		store.shares[id] = stored
+		return Share{}, err
+	}
+
+	return updated.Share, nil
+}
+
+func (store *Store) Share(id string) (Share, bool) {
+	store.Lock()
+	defer store.Unlock()
+	if stored, ok := store.shares[id]; ok {
+		return stored.Share, true
+	}
+	return Share{}, false
+}
+
+// A node's shares that haven't expired, oldest first
+func (store *Store) ForNode(nodeId string) []Share {
+	store.Lock()
+	defer store.Unlock()
+
+	shares := make([]Share, 0)
+	for _, stored := range store.shares {
+		if stored.NodeId == nodeId && !stored.Expired() {
+			shares = append(shares, stored.Share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if !shares[i].Created.Equal(shares[j].Created) {
+			return shares[i].Created.Before(shares[j].Created)
+		}
+		return shares[i].Id < shares[j].Id
+	})
+	return shares
+}
+
+func (store *Store) Revoke(id string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.shares[id]; !ok {
+		return ErrNoSuchShare
+	}
+
+	delete(store.shares, id)
+	return store.save()
+}
+
+func (store *Store) token(id string) string {
+	mac := hmac.New(sha256.New, store.secret)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (store *Store) save() error {
+	if store.path == "" {
+		return nil
+	}
+
+	saved := storeFile{Secret: base64.RawURLEncoding.EncodeToString(store.secret)}
+	for _, stored := range store.shares {
+		if !stored.Expired() {
+			saved.Shares = append(saved.Shares, stored)
+		}
+	}
+
+	if dat, err := json.MarshalIndent(saved, "", "  "); err != nil {
+		return err
+	} else if err = util.WriteFileAtomic(store.path, dat, 0600); err != nil {
+		return fmt.Errorf("Error saving shares: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package share
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sdcoffey/olympus/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	auth.Iterations = 10
+}
+
+func TestStore_opensSharesByToken(t *testing.T) {
+	store, _ := NewStore("")
+
+	share, token, err := store.Create("node", "alice", "", 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "node", share.NodeId)
+	assert.Equal(t, "alice", share.Creator)
+	assert.Equal(t, false, share.Protected)
+	assert.Equal(t, token, store.Token(share))
+
+	opened, err := store.Open(token, "")
+	assert.NoError(t, err)
+	assert.Equal(t, share, opened)
+
+	_, err = store.Open(share.Id, "")
+	assert.Equal(t, ErrNoSuchShare, err)
+	_, err = store.Open(share.Id+".forged", "")
+	assert.Equal(t, ErrNoSuchShare, err)
+
+	other, _ := NewStore("")
+	_, err = other.Open(token, "")
+	assert.Equal(t, ErrNoSuchShare, err)
+}
+
+func TestStore_requiresPassword(t *testing.T) {
+	store, _ := NewStore("")
+	share, token, _ := store.Create("node", "alice", "open sesame", 0, 0)
+	assert.Equal(t, true, share.Protected)
+
+	_, err := store.Open(token, "")
+	assert.Equal(t, ErrPasswordRequired, err)
+	_, err = store.Open(token, "open barley")
+	assert.Equal(t, ErrPasswordRequired, err)
+	_, err = store.Open(token, "open sesame")
+	assert.NoError(t, err)
+}
+
+func TestStore_expiresShares(t *testing.T) {
+	store, _ := NewStore("")
+	_, token, _ := store.Create("node", "alice", "", time.Nanosecond, 0)
+	time.Sleep(time.Millisecond)
+
+	_, err := store.Open(token, "")
+	assert.Equal(t, ErrExpired, err)
+	assert.Equal(t, 0, len(store.ForNode("node")))
+}
+
+func TestStore_limitsDownloads(t *testing.T) {
+	store, _ := NewStore("")
+	share, token, _ := store.Create("node", "alice", "", 0, 2)
+
+	_, err := store.CountDownload(share.Id)
+	assert.NoError(t, err)
+	counted, err := store.CountDownload(share.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counted.Downloads)
+
+	_, err = store.CountDownload(share.Id)
+	assert.Equal(t, ErrExpired, err)
+	_, err = store.Open(token, "")
+	assert.Equal(t, ErrExpired, err)
+
+	_, _, err = store.Create("node", "alice", "", 0, -1)
+	assert.Error(t, err)
+}
+
+func TestStore_revokesShares(t *testing.T) {
+	store, _ := NewStore("")
+	first, _, _ := store.Create("node", "alice", "", 0, 0)
+	second, token, _ := store.Create("node", "bob", "", 0, 0)
+	store.Create("other", "alice", "", 0, 0)
+	assert.Equal(t, []Share{first, second}, store.ForNode("node"))
+
+	assert.NoError(t, store.Revoke(second.Id))
+	assert.Equal(t, ErrNoSuchShare, store.Revoke(second.Id))
+	_, err := store.Open(token, "")
+	assert.Equal(t, ErrNoSuchShare, err)
+	assert.Equal(t, []Share{first}, store.ForNode("node"))
+}
+
+func TestStore_persistsSharesAndSecret(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "shares")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shares.json")
+
+	store, err := NewStore(path)
+	assert.NoError(t, err)
+	share, token, _ := store.Create("node", "alice", "open sesame", 0, 3)
+	store.CountDownload(share.Id)
+
+	store, err = NewStore(path)
+	assert.NoError(t, err)
+	opened, err := store.Open(token, "open sesame")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, opened.Downloads)
+
+	info, _ := os.Stat(path)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestStore_recordsUploadsWithinLimits(t *testing.T) {
+	store, _ := NewStore("")
+
+	_, _, err := store.CreateDropBox("dir", "alice", "", 0, Limits{MaxFiles: -1})
+	assert.Error(t, err)
+
+	dropBox, token, err := store.CreateDropBox("dir", "alice", "", 0, Limits{MaxFiles: 2, MaxBytes: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, DropBox, dropBox.Kind)
+	opened, _ := store.Open(token, "")
+	assert.Equal(t, true, opened.IsDropBox())
+
+	dropBox, err = store.RecordUpload(dropBox.Id, Upload{NodeId: "a", Name: "a.txt", Size: 60, Uploader: "bob"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(60), dropBox.UploadedBytes())
+	upload, ok := dropBox.Upload("a")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "bob", upload.Uploader)
+
+	_, err = store.RecordUpload(dropBox.Id, Upload{NodeId: "b", Name: "b.txt", Size: 41})
+	assert.Equal(t, ErrLimitReached, err)
+	_, err = store.RecordUpload(dropBox.Id, Upload{NodeId: "b", Name: "b.txt", Size: 40})
+	assert.NoError(t, err)
+	_, err = store.RecordUpload(dropBox.Id, Upload{NodeId: "c", Name: "c.txt", Size: 0})
+	assert.Equal(t, ErrLimitReached, err)
+
+	download, _, _ := store.Create("dir", "alice", "", 0, 0)
+	_, err = store.RecordUpload(download.Id, Upload{NodeId: "d", Name: "d.txt"})
+	assert.Equal(t, ErrNoSuchShare, err)
+
+	recorded, _ := store.Share(dropBox.Id)
+	assert.Equal(t, 2, len(recorded.Uploads))
+}
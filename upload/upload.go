@@ -0,0 +1,255 @@
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/sdcoffey/olympus/util"
+)
+
+var (
+	ErrNoSuchSession = errors.New("No such upload session")
+	ErrExpired       = errors.New("Upload session has expired")
+)
+
+// A file being uploaded a block at a time. Blocks can be sent in any order, and sent again if sending them
+// fails; they're stored as they arrive, but the file's node is only created when the session is committed,
+// so an upload that fails partway leaves nothing in the graph and can be picked up where it left off. A
+// session that replaces an existing file swaps the new content in on commit instead.
+type Session struct {
+	Id        string      `json:"id"`
+	Creator   string      `json:"creator,omitempty"`
+	ParentId  string      `json:"parent_id"`
+	Name      string      `json:"name"`
+	Mode      os.FileMode `json:"mode"`
+	MTime     time.Time   `json:"mtime,omitempty"`
+	Size      int64       `json:"size"`
+	BlockSize int64       `json:"block_size"`
+	Hashes    []string    `json:"hashes"`
+	Replace   bool        `json:"replace,omitempty"`
+	Created   time.Time   `json:"created"`
+	Expires   time.Time   `json:"expires"`
+	// Indexes of the blocks received in this session, which were checked against their hashes as they arrived
+	Received []int `json:"received,omitempty"`
+}
+
+// Offset into the file of block i
+func (session Session) Offset(i int) int64 {
+	return int64(i) * session.BlockSize
+}
+
+// Length of block i: the block size, except for the last block, which may be shorter
+func (session Session) BlockLength(i int) int64 {
+	if remaining := session.Size - session.Offset(i); remaining < session.BlockSize {
+		return remaining
+	}
+	return session.BlockSize
+}
+
+// Whether block i has been received in this session
+func (session Session) WasReceived(i int) bool {
+	for _, index := range session.Received {
+		if index == i {
+			return true
+		}
+	}
+	return false
+}
+
+func (session Session) Expired() bool {
+	return !time.Now().Before(session.Expires)
+}
+
+// Whether session is for the same file as other: the same name, place and contents, and both replacing
+// what's there or neither
+func (session Session) Matches(other Session) bool {
+	if session.ParentId != other.ParentId || session.Name != other.Name || session.Size != other.Size ||
+		session.BlockSize != other.BlockSize || session.Replace != other.Replace || len(session.Hashes) != len(other.Hashes) {
+		return false
+	}
+	for i, hash := range session.Hashes {
+		if other.Hashes[i] != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// Open upload sessions, saved to a JSON file on every change so uploads can be resumed after a restart
+type Store struct {
+	sync.Mutex
+	path     string
+	timeout  time.Duration
+	sessions map[string]*Session
+}
+
+// Load the store at path, creating it when the first session is opened. An empty path keeps sessions in
+// memory only. Sessions expire timeout after they're opened.
+func NewStore(path string, timeout time.Duration) (*Store, error) {
+	store := &Store{path: path, timeout: timeout, sessions: make(map[string]*Session)}
+
+	if path != "" {
+		if dat, err := ioutil.ReadFile(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("Error reading upload sessions: %s", err.Error())
+		} else if err == nil {
+			var saved []*Session
+			if err = json.Unmarshal(dat, &saved); err != nil {
+				return nil, fmt.Errorf("Error reading upload sessions: %s", err.Error())
+			}
+			for _, session := range saved {
+				store.sessions[session.Id] = session
+			}
+		}
+	}
+
+	return store, nil
+}
+
+// Open a session for uploading a file with the given name, place, size and block hashes
+func (store *Store) Open(session Session) (Session, error) {
+	if session.Name == "" {
+		return Session{}, errors.New("A name is required")
+	} else if session.Size < 0 || session.BlockSize <= 0 {
+		return Session{}, fmt.Errorf("Invalid size %d for block size %d", session.Size, session.BlockSize)
+	} else if blocks := (session.Size + session.BlockSize - 1) / session.BlockSize; int64(len(session.Hashes)) != blocks {
+		return Session{}, fmt.Errorf("A file of %d bytes has %d blocks, but %d hashes were given", session.Size, blocks, len(session.Hashes))
+	}
+
+	session.Id = uuid.New()
+	session.Created = time.Now().UTC()
+	session.Expires = session.Created.Add(store.timeout)
+	session.Hashes = append([]string(nil), session.Hashes...)
+
+	store.Lock()
+	defer store.Unlock()
+	store.sessions[session.Id] = &session
+	if err := store.save(); err != nil {
+		delete(store.sessions, session.Id)
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+// The session with id, failing with ErrNoSuchSession if there's none and ErrExpired if it's expired
+func (store *Store) Session(id string) (Session, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if session, ok := store.sessions[id]; !ok {
+		return Session{}, ErrNoSuchSession
+	} else if session.Expired() {
+		return Session{}, ErrExpired
+	} else {
+		return *session, nil
+	}
+}
+
+// Sessions opened by creator that haven't expired, oldest first
+func (store *Store) ForCreator(creator string) []Session {
+	store.Lock()
+	defer store.Unlock()
+
+	sessions := make([]Session, 0)
+	for _, session := range store.sessions {
+		if session.Creator == creator && !session.Expired() {
+			sessions = append(sessions, *session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].Created.Equal(sessions[j].Created) {
+			return sessions[i].Created.Before(sessions[j].Created)
+		}
+		return sessions[i].Id < sessions[j].Id
+	})
+	return sessions
+}
+
+// Record that block index of a session has been received and checked
+func (store *Store) Receive(id string, index int) error {
+	store.Lock()
+	defer store.Unlock()
+
+	session, ok := store.sessions[id]
+	if !ok {
+		return ErrNoSuchSession
+	} else if session.WasReceived(index) {
+		return nil
+	}
+
+	session.Received = append(session.Received, index)
+	if err := store.save(); err != nil {
+		session.Received = session.Received[:len(session.Received)-1]
+		return err
+	}
+	return nil
+}
+
+// Close a session once it's been committed or aborted
+func (store *Store) Remove(id string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.sessions[id]; !ok {
+		return ErrNoSuchSession
+	}
+
+	delete(store.sessions, id)
+	return store.save()
+}
+
+// Close every expired session, returning the hashes of their blocks that no open session has too, which
+// may be left over. Expired sessions are kept until then, across restarts too, so none are missed.
+func (store *Store) Expire() ([]string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	expired, open := make(map[string]bool), make(map[string]bool)
+	for id, session := range store.sessions {
+		for _, hash := range session.Hashes {
+			if session.Expired() {
+				expired[hash] = true
+			} else {
+				open[hash] = true
+			}
+		}
+		if session.Expired() {
+			delete(store.sessions, id)
+		}
+	}
+
+	hashes := make([]string, 0, len(expired))
+	for hash := range expired {
+		if !open[hash] {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	return hashes, store.save()
+}
+
+func (store *Store) save() error {
+	if store.path == "" {
+		return nil
+	}
+
+	saved := make([]*Session, 0, len(store.sessions))
+	for _, session := range store.sessions {
+		saved = append(saved, session)
+	}
+
+	if dat, err := json.MarshalIndent(saved, "", "  "); err != nil {
+		return err
+	} else if err = util.WriteFileAtomic(store.path, dat, 0600); err != nil {
+		return fmt.Errorf("Error saving upload sessions: %s", err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSession(size int64, hashes ...string) Session {
+	return Session{Creator: "alice", ParentId: "parent", Name: "file", Size: size, BlockSize: 10, Hashes: hashes}
+}
+
+func TestStore_opensSessions(t *testing.T) {
+	store, _ := NewStore("", time.Hour)
+
+	session, err := store.Open(testSession(25, "a", "b", "c"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, session.Id)
+	assert.Equal(t, session.Created.Add(time.Hour), session.Expires)
+	assert.Equal(t, int64(20), session.Offset(2))
+	assert.Equal(t, int64(10), session.BlockLength(1))
+	assert.Equal(t, int64(5), session.BlockLength(2))
+
+	opened, err := store.Session(session.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, session, opened)
+	assert.Equal(t, true, opened.Matches(testSession(25, "a", "b", "c")))
+	assert.Equal(t, false, opened.Matches(testSession(25, "a", "b", "d")))
+	replacing := testSession(25, "a", "b", "c")
+	replacing.Replace = true
+	assert.Equal(t, false, opened.Matches(replacing))
+
+	_, err = store.Session("nope")
+	assert.Equal(t, ErrNoSuchSession, err)
+}
+
+func TestStore_requiresAHashPerBlock(t *testing.T) {
+	store, _ := NewStore("", time.Hour)
+
+	_, err := store.Open(testSession(25, "a", "b"))
+	assert.Error(t, err)
+	_, err = store.Open(testSession(20, "a", "b", "c"))
+	assert.Error(t, err)
+	_, err = store.Open(testSession(0))
+	assert.NoError(t, err)
+
+	nameless := testSession(5, "a")
+	nameless.Name = ""
+	_, err = store.Open(nameless)
+	assert.Error(t, err)
+}
+
+func TestStore_expiresSessions(t *testing.T) {
+	store, _ := NewStore("", time.Nanosecond)
+	session, _ := store.Open(testSession(5, "a"))
+	time.Sleep(time.Millisecond)
+
+	_, err := store.Session(session.Id)
+	assert.Equal(t, ErrExpired, err)
+	assert.Equal(t, 0, len(store.ForCreator("alice")))
+}
+
+func TestStore_Expire_returnsBlocksNoOpenSessionHas(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upload")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "uploads.json")
+
+	store, _ := NewStore(path, time.Nanosecond)
+	expired, _ := store.Open(testSession(25, "a", "b", "c"))
+	time.Sleep(time.Millisecond)
+	store.timeout = time.Hour
+	open, _ := store.Open(testSession(5, "b"))
+
+	reloaded, err := NewStore(path, time.Hour)
+	assert.NoError(t, err)
+	hashes, err := reloaded.Expire()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, hashes)
+	_, err = reloaded.Session(expired.Id)
+	assert.Equal(t, ErrNoSuchSession, err)
+	_, err = reloaded.Session(open.Id)
+	assert.NoError(t, err)
+
+	hashes, err = reloaded.Expire()
+	assert.NoError(t, err)
+	assert.Empty(t, hashes)
+}
+
+func TestStore_removesSessions(t *testing.T) {
+	store, _ := NewStore("", time.Hour)
+	first, _ := store.Open(testSession(5, "a"))
+	second, _ := store.Open(testSession(5, "b"))
+	other := testSession(5, "c")
+	other.Creator = "bob"
+	store.Open(other)
+	assert.Equal(t, []Session{first, second}, store.ForCreator("alice"))
+
+	assert.NoError(t, store.Remove(first.Id))
+	assert.Equal(t, []Session{second}, store.ForCreator("alice"))
+	assert.Equal(t, ErrNoSuchSession, store.Remove(first.Id))
+}
+
+func TestStore_recordsReceivedBlocks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upload")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "uploads.json")
+
+	store, _ := NewStore(path, time.Hour)
+	session, _ := store.Open(testSession(25, "a", "b", "c"))
+	assert.NoError(t, store.Receive(session.Id, 2))
+	assert.NoError(t, store.Receive(session.Id, 2))
+	assert.Equal(t, ErrNoSuchSession, store.Receive("nope", 0))
+
+	reloaded, _ := NewStore(path, time.Hour)
+	session, err := reloaded.Session(session.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2}, session.Received)
+	assert.Equal(t, true, session.WasReceived(2))
+	assert.Equal(t, false, session.WasReceived(0))
+}
+
+func TestStore_persistsSessions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upload")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "uploads.json")
+
+	store, err := NewStore(path, time.Hour)
+	assert.NoError(t, err)
+	kept, _ := store.Open(testSession(15, "a", "b"))
+	removed, _ := store.Open(testSession(5, "c"))
+	store.Remove(removed.Id)
+
+	reloaded, err := NewStore(path, time.Hour)
+	assert.NoError(t, err)
+	session, err := reloaded.Session(kept.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, kept.Hashes, session.Hashes)
+	assert.Equal(t, true, kept.Created.Equal(session.Created))
+	_, err = reloaded.Session(removed.Id)
+	assert.Equal(t, ErrNoSuchSession, err)
+
+	ioutil.WriteFile(path, []byte("not json"), 0600)
+	_, err = NewStore(path, time.Hour)
+	assert.Error(t, err)
+}
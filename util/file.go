@@ -0,0 +1,37 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Replace the file at path with dat. It's written to a temp file beside path, synced, then renamed over
+// path, so a crash leaves either the old contents or the new, never a mix or an empty file.
+func WriteFileAtomic(path string, dat []byte, mode os.FileMode) error {
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(dat); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	} else if err = os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Make the rename itself durable; not every platform can sync a directory, so failing to is no error
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic_replacesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "olympus-util")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "saved.json")
+	assert.NoError(t, WriteFileAtomic(path, []byte("first"), 0600))
+	assert.NoError(t, WriteFileAtomic(path, []byte("second"), 0600))
+
+	dat, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(dat))
+
+	stat, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0600, stat.Mode().Perm())
+
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWriteFileAtomic_leavesFileAloneOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "olympus-util")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "saved.json")
+	assert.NoError(t, WriteFileAtomic(path, []byte("first"), 0600))
+	assert.Error(t, WriteFileAtomic(filepath.Join(dir, "missing", "saved.json"), []byte("second"), 0600))
+
+	dat, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(dat))
+}
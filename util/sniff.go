@@ -0,0 +1,88 @@
+package util
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+const OctetStream = "application/octet-stream"
+
+type signature struct {
+	offset   int
+	magic    []byte
+	mimeType string
+}
+
+// Formats http.DetectContentType doesn't know about, or reports only as a generic container. These are
+// checked first, in order, so more specific signatures must come before ones they share a prefix with.
+var signatures = []signature{
+	{0, []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{0, []byte("II*\x00"), "image/tiff"},
+	{0, []byte("MM\x00*"), "image/tiff"},
+	{0, []byte("8BPS"), "image/vnd.adobe.photoshop"},
+	{4, []byte("ftypheic"), "image/heic"},
+	{4, []byte("ftypheix"), "image/heic"},
+	{4, []byte("ftypmif1"), "image/heif"},
+	{4, []byte("ftypM4A "), "audio/mp4"},
+	{4, []byte("ftypqt  "), "video/quicktime"},
+	{4, []byte("ftyp"), "video/mp4"},
+	{0, []byte("\x1aE\xdf\xa3"), "video/x-matroska"},
+	{0, []byte("fLaC"), "audio/flac"},
+	{0, []byte("ID3"), "audio/mpeg"},
+	{0, []byte("\xff\xfb"), "audio/mpeg"},
+	{0, []byte("\xff\xf3"), "audio/mpeg"},
+	{0, []byte("\xff\xf2"), "audio/mpeg"},
+	{0, []byte("OggS"), "audio/ogg"},
+	{0, []byte("%PDF-"), "application/pdf"},
+	{0, []byte("7z\xbc\xaf\x27\x1c"), "application/x-7z-compressed"},
+	{0, []byte("Rar!\x1a\x07"), "application/x-rar-compressed"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte("\xfd7zXZ\x00"), "application/x-xz"},
+	{0, []byte("\x1f\x8b"), "application/gzip"},
+	{257, []byte("ustar"), "application/x-tar"},
+	{0, []byte("SQLite format 3\x00"), "application/x-sqlite3"},
+	{0, []byte("\x00asm"), "application/wasm"},
+	{0, []byte("\x7fELF"), "application/x-executable"},
+	{0, []byte("wOFF"), "font/woff"},
+	{0, []byte("wOF2"), "font/woff2"},
+}
+
+// Determine the MIME type of a file from its first bytes, returning OctetStream if nothing matches
+func DetectContentType(data []byte) string {
+	for _, sig := range signatures {
+		if len(data) >= sig.offset+len(sig.magic) && bytes.Equal(data[sig.offset:sig.offset+len(sig.magic)], sig.magic) {
+			return sig.mimeType
+		}
+	}
+
+	mimeType := http.DetectContentType(data)
+	if strings.Contains(mimeType, ";") {
+		mimeType = strings.Split(mimeType, ";")[0]
+	}
+
+	return mimeType
+}
+
+// Whether a detected type says too little to override a type derived from the file's name. Plain text
+// covers JSON, CSV, source code and the like, and zip is the container for docx, jar, epub and others.
+func IsGenericType(mimeType string) bool {
+	switch mimeType {
+	case "", OctetStream, "text/plain", "application/zip":
+		return true
+	default:
+		return false
+	}
+}
+
+// The type of a file given the type detected from its content and its name. Detected types win unless
+// they're generic, so mislabeled files are typed by what they contain.
+func ResolveType(detected, filename string) string {
+	if byName := MimeType(filename); IsGenericType(detected) && byName != "" {
+		return byName
+	} else if detected != "" {
+		return detected
+	} else {
+		return byName
+	}
+}
@@ -0,0 +1,30 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDetectContentType_usesMagicNumbers(t *testing.T) {
+	assert.Equal(t, "image/png", DetectContentType([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")))
+	assert.Equal(t, "audio/flac", DetectContentType([]byte("fLaC\x00\x00\x00\x22")))
+	assert.Equal(t, "audio/mp4", DetectContentType([]byte("\x00\x00\x00\x20ftypM4A \x00\x00\x00\x00")))
+	assert.Equal(t, "video/mp4", DetectContentType([]byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00")))
+}
+
+func TestDetectContentType_fallsBackToStandardLibrary(t *testing.T) {
+	assert.Equal(t, "text/html", DetectContentType([]byte("<!DOCTYPE html><html></html>")))
+	assert.Equal(t, "text/plain", DetectContentType([]byte("just some words")))
+	assert.Equal(t, OctetStream, DetectContentType([]byte{0x00, 0x01, 0x02, 0x03}))
+}
+
+func TestResolveType_prefersDetectedType(t *testing.T) {
+	assert.Equal(t, "image/png", ResolveType("image/png", "photo.jpg"))
+	assert.Equal(t, "image/png", ResolveType("image/png", "photo"))
+}
+
+func TestResolveType_usesNameForGenericTypes(t *testing.T) {
+	assert.Equal(t, "application/json", ResolveType("text/plain", "data.json"))
+	assert.Equal(t, "text/plain", ResolveType("text/plain", "README"))
+	assert.Equal(t, "application/json", ResolveType("", "data.json"))
+}
@@ -0,0 +1,581 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/sdcoffey/olympus/util"
+)
+
+// Sent by Test, so receivers can be checked without changing anything
+const Ping graph.ChangeKind = "ping"
+
+const (
+	SignatureHeader = "X-Olympus-Signature"
+	EventHeader     = "X-Olympus-Event"
+	DeliveryHeader  = "X-Olympus-Delivery"
+)
+
+// Number of deliveries kept for each hook
+const deliveryLogSize = 50
+
+// Most changes waiting to be sent to one hook; beyond it, the oldest are dropped
+const queueSize = 1000
+
+var changeKinds = []graph.ChangeKind{
+	graph.Created, graph.Renamed, graph.Moved, graph.ModeChanged, graph.OwnerChanged, graph.Touched, graph.ContentChanged,
+	graph.Deleted,
+}
+
+// A URL to POST changes to. Only changes under Subtree are sent, or all changes if it's empty, and only
+// those of the kinds in Events, or all kinds if it's empty. Each POST is signed with Secret.
+type Hook struct {
+	Id      string             `json:"id"`
+	Url     string             `json:"url"`
+	Subtree string             `json:"subtree,omitempty"`
+	Events  []graph.ChangeKind `json:"events,omitempty"`
+	Secret  string             `json:"secret"`
+	Created time.Time          `json:"created"`
+}
+
+func (hook Hook) Matches(change graph.Change) bool {
+	if !change.Under(hook.Subtree) {
+		return false
+	} else if len(hook.Events) == 0 {
+		return true
+	}
+
+	for _, kind := range hook.Events {
+		if kind == change.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (hook Hook) validate(allowLocal bool) error {
+	u, err := url.Parse(hook.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid webhook url: %s", hook.Url)
+	} else if host := u.Hostname(); !allowLocal && (host == "localhost" || local(net.ParseIP(host))) {
+		return fmt.Errorf("Webhooks can't be sent to %s", host)
+	}
+
+	for _, kind := range hook.Events {
+		valid := false
+		for _, known := range changeKinds {
+			valid = valid || kind == known
+		}
+		if !valid {
+			return fmt.Errorf("Invalid webhook event: %s", kind)
+		}
+	}
+
+	return nil
+}
+
+// The body of each POST
+type Payload struct {
+	DeliveryId string       `json:"delivery_id"`
+	HookId     string       `json:"hook_id"`
+	Event      string       `json:"event"`
+	Change     graph.Change `json:"change"`
+}
+
+// A record of sending one change to one hook. Delivered is false until a 2xx response; Error and StatusCode
+// describe the latest attempt.
+type Delivery struct {
+	Id         string           `json:"id"`
+	HookId     string           `json:"hook_id"`
+	Seq        uint64           `json:"seq"`
+	Event      graph.ChangeKind `json:"event"`
+	Attempts   int              `json:"attempts"`
+	Delivered  bool             `json:"delivered"`
+	StatusCode int              `json:"status_code,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Time       time.Time        `json:"time"`
+}
+
+// Whether ip is loopback, link-local or unspecified, any of which would let a hook reach the server's own
+// host or the cloud metadata service rather than somewhere on the network
+func local(ip net.IP) bool {
+	return ip != nil && (ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified())
+}
+
+// Sends journal changes to hooks. Hooks are saved to a JSON file so they survive restarts; deliveries are
+// only kept in memory. Each hook gets its changes in order, from a queue of its own.
+type Dispatcher struct {
+	sync.Mutex
+	// Failed deliveries are retried up to MaxAttempts in all, waiting Backoff before the first retry and
+	// doubling the wait each time after
+	Backoff     time.Duration
+	MaxAttempts int
+	Client      *http.Client
+	// Lets hooks be sent to loopback and link-local addresses, which are refused otherwise
+	AllowLocal bool
+
+	path       string
+	journal    *graph.Journal
+	hooks      map[string]Hook
+	deliveries map[string][]*Delivery
+	queues     map[string]*queue
+	stop       chan struct{}
+	// The goroutine sending changes to queues, and each queue's worker
+	workers sync.WaitGroup
+}
+
+// Changes waiting to be sent to one hook, oldest first. Its worker waits on ready for more, and returns
+// once stop is closed.
+type queue struct {
+	changes []graph.Change
+	ready   chan struct{}
+	stop    chan struct{}
+}
+
+// Load hooks from path, creating it when the first is added. An empty path keeps hooks in memory only.
+func NewDispatcher(path string, journal *graph.Journal) (*Dispatcher, error) {
+	dispatcher := &Dispatcher{
+		Backoff:     time.Second,
+		MaxAttempts: 6,
+		path:        path,
+		journal:     journal,
+		hooks:       make(map[string]Hook),
+		deliveries:  make(map[string][]*Delivery),
+		queues:      make(map[string]*queue),
+	}
+	dispatcher.Client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{DialContext: dispatcher.dial},
+	}
+
+	if path == "" {
+		return dispatcher, nil
+	} else if dat, err := ioutil.ReadFile(path); os.IsNotExist(err) {
+		return dispatcher, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading webhooks: %s", err.Error())
+	} else {
+		var hooks []Hook
+		if err = json.Unmarshal(dat, &hooks); err != nil {
+			return nil, fmt.Errorf("Error reading webhooks: %s", err.Error())
+		}
+		for _, hook := range hooks {
+			dispatcher.hooks[hook.Id] = hook
+		}
+	}
+
+	return dispatcher, nil
+}
+
+// Begin sending changes recorded from now on, until Stop is called
+func (dispatcher *Dispatcher) Start() {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+	if dispatcher.stop != nil {
+		return
+	}
+
+	dispatcher.stop = make(chan struct{})
+	notifications, unsubscribe := dispatcher.journal.Subscribe()
+	cursor := dispatcher.journal.Seq()
+
+	dispatcher.workers.Add(1)
+	go func(stop chan struct{}) {
+		defer dispatcher.workers.Done()
+		defer unsubscribe()
+		for {
+			select {
+			case <-notifications:
+			case <-stop:
+				return
+			}
+
+			var changes []graph.Change
+			changes, cursor = dispatcher.journal.Since(cursor, "", 0)
+			for _, change := range changes {
+				dispatcher.dispatch(change)
+			}
+		}
+	}(dispatcher.stop)
+}
+
+// Stop sending changes, dropping any still queued, and wait for deliveries in progress to be abandoned
+func (dispatcher *Dispatcher) Stop() {
+	dispatcher.Lock()
+	if dispatcher.stop != nil {
+		close(dispatcher.stop)
+		dispatcher.stop = nil
+	}
+	for id, q := range dispatcher.queues {
+		close(q.stop)
+		delete(dispatcher.queues, id)
+	}
+	dispatcher.Unlock()
+
+	dispatcher.workers.Wait()
+}
+
+// All hooks, oldest first
+func (dispatcher *Dispatcher) Hooks() []Hook {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+
+	hooks := make([]Hook, 0, len(dispatcher.hooks))
+	for _, hook := range dispatcher.hooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		if !hooks[i].Created.Equal(hooks[j].Created) {
+			return hooks[i].Created.Before(hooks[j].Created)
+		}
+		return hooks[i].Id < hooks[j].Id
+	})
+
+	return hooks
+}
+
+func (dispatcher *Dispatcher) Hook(id string) (Hook, bool) {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+	hook, ok := dispatcher.hooks[id]
+	return hook, ok
+}
+
+// Validate and save hook, filling in its id, creation time, and a secret if it has none
+func (dispatcher *Dispatcher) Add(hook Hook) (Hook, error) {
+	dispatcher.Lock()
+	allowLocal := dispatcher.AllowLocal
+	dispatcher.Unlock()
+	if err := hook.validate(allowLocal); err != nil {
+		return hook, err
+	}
+
+	hook.Id = uuid.New()
+	hook.Created = time.Now().UTC()
+	if hook.Secret == "" {
+		secret := make([]byte, 20)
+		if _, err := rand.Read(secret); err != nil {
+			return hook, err
+		}
+		hook.Secret = hex.EncodeToString(secret)
+	}
+
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+	dispatcher.hooks[hook.Id] = hook
+	if err := dispatcher.save(); err != nil {
+		delete(dispatcher.hooks, hook.Id)
+		return hook, err
+	}
+
+	return hook, nil
+}
+
+func (dispatcher *Dispatcher) Remove(id string) error {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+
+	hook, ok := dispatcher.hooks[id]
+	if !ok {
+		return fmt.Errorf("No such webhook: %s", id)
+	}
+
+	delete(dispatcher.hooks, id)
+	if err := dispatcher.save(); err != nil {
+		dispatcher.hooks[id] = hook
+		return err
+	}
+	delete(dispatcher.deliveries, id)
+	if q, ok := dispatcher.queues[id]; ok {
+		close(q.stop)
+		delete(dispatcher.queues, id)
+	}
+
+	return nil
+}
+
+// Recent deliveries to a hook, newest first
+func (dispatcher *Dispatcher) Deliveries(hookId string) []Delivery {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+
+	log := dispatcher.deliveries[hookId]
+	deliveries := make([]Delivery, len(log))
+	for i, delivery := range log {
+		deliveries[len(log)-1-i] = *delivery
+	}
+	return deliveries
+}
+
+// Send a ping to a hook once, without retrying, and return how it went
+func (dispatcher *Dispatcher) Test(hookId string) (Delivery, error) {
+	hook, ok := dispatcher.Hook(hookId)
+	if !ok {
+		return Delivery{}, fmt.Errorf("No such webhook: %s", hookId)
+	}
+
+	delivery := dispatcher.newDelivery(hook, graph.Change{Kind: Ping, Time: time.Now().UTC()})
+	dispatcher.attempt(context.Background(), hook, delivery, graph.Change{Kind: Ping, Time: delivery.Time})
+
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+	return *delivery, nil
+}
+
+func (dispatcher *Dispatcher) dispatch(change graph.Change) {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+	if dispatcher.stop == nil {
+		// Stopped while these changes were being read
+		return
+	}
+	for _, hook := range dispatcher.hooks {
+		if hook.Matches(change) {
+			dispatcher.enqueue(hook, change)
+		}
+	}
+}
+
+// Queue change for hook, starting its worker if it has none. A change of the same kind to the same node
+// that's still waiting is superseded, so a burst of writes to a file is sent once. Call with the lock held.
+func (dispatcher *Dispatcher) enqueue(hook Hook, change graph.Change) {
+	q, ok := dispatcher.queues[hook.Id]
+	if !ok {
+		q = &queue{ready: make(chan struct{}, 1), stop: make(chan struct{})}
+		dispatcher.queues[hook.Id] = q
+		dispatcher.workers.Add(1)
+		go dispatcher.work(hook, q)
+	}
+
+	for i, queued := range q.changes {
+		if queued.Kind == change.Kind && queued.NodeId == change.NodeId {
+			q.changes = append(q.changes[:i], q.changes[i+1:]...)
+			break
+		}
+	}
+	if len(q.changes) >= queueSize {
+		log.Printf("Webhook %s is too far behind; dropping change %d", hook.Id, q.changes[0].Seq)
+		q.changes = q.changes[1:]
+	}
+	q.changes = append(q.changes, change)
+
+	select {
+	case q.ready <- struct{}{}:
+	default: // Already has a notification pending
+	}
+}
+
+// Send hook the changes queued for it one at a time, in order, until its queue is stopped
+func (dispatcher *Dispatcher) work(hook Hook, q *queue) {
+	defer dispatcher.workers.Done()
+	for {
+		select {
+		case <-q.ready:
+		case <-q.stop:
+			return
+		}
+
+		for {
+			dispatcher.Lock()
+			if len(q.changes) == 0 {
+				dispatcher.Unlock()
+				break
+			}
+			change := q.changes[0]
+			q.changes = q.changes[1:]
+			dispatcher.Unlock()
+
+			if !dispatcher.deliver(hook, change, q.stop) {
+				return
+			}
+		}
+	}
+}
+
+// Change how failed deliveries are retried, including those already being retried
+func (dispatcher *Dispatcher) SetRetries(maxAttempts int, backoff time.Duration) {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+	dispatcher.MaxAttempts = maxAttempts
+	dispatcher.Backoff = backoff
+}
+
+// Send change to hook, retrying until it's accepted or out of attempts. Returns false if stop was closed,
+// which abandons the attempt in progress as well as any retries.
+func (dispatcher *Dispatcher) deliver(hook Hook, change graph.Change, stop <-chan struct{}) bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	delivery := dispatcher.newDelivery(hook, change)
+	dispatcher.Lock()
+	wait := dispatcher.Backoff
+	dispatcher.Unlock()
+	for !dispatcher.attempt(ctx, hook, delivery, change) {
+		dispatcher.Lock()
+		attempts, maxAttempts := delivery.Attempts, dispatcher.MaxAttempts
+		dispatcher.Unlock()
+
+		if attempts >= maxAttempts {
+			return true
+		}
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return false
+		}
+		wait *= 2
+	}
+	return true
+}
+
+// Connect to the first address host resolves to that hooks may be sent to, which, unless AllowLocal is
+// set, excludes local ones. Checking here rather than only in Add also catches names that resolve locally.
+func (dispatcher *Dispatcher) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	dispatcher.Lock()
+	allowLocal := dispatcher.AllowLocal
+	dispatcher.Unlock()
+
+	dialer := net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	for _, addr := range addrs {
+		if allowLocal || !local(addr.IP) {
+			return dialer.DialContext(ctx, network, net.JoinHostPort(addr.IP.String(), port))
+		}
+	}
+	return nil, fmt.Errorf("Webhooks can't be sent to %s", host)
+}
+
+func (dispatcher *Dispatcher) newDelivery(hook Hook, change graph.Change) *Delivery {
+	delivery := &Delivery{
+		Id:     uuid.New(),
+		HookId: hook.Id,
+		Seq:    change.Seq,
+		Event:  change.Kind,
+		Time:   time.Now().UTC(),
+	}
+
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+	log := append(dispatcher.deliveries[hook.Id], delivery)
+	if len(log) > deliveryLogSize {
+		log = log[len(log)-deliveryLogSize:]
+	}
+	dispatcher.deliveries[hook.Id] = log
+
+	return delivery
+}
+
+// POST change to hook once, recording the outcome on delivery. Returns whether it was accepted.
+func (dispatcher *Dispatcher) attempt(ctx context.Context, hook Hook, delivery *Delivery, change graph.Change) bool {
+	body, err := json.Marshal(Payload{delivery.Id, hook.Id, string(change.Kind), change})
+	if err != nil {
+		dispatcher.recordAttempt(delivery, 0, err)
+		return false
+	}
+
+	req, err := http.NewRequest("POST", hook.Url, bytes.NewReader(body))
+	if err != nil {
+		dispatcher.recordAttempt(delivery, 0, err)
+		return false
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(change.Kind))
+	req.Header.Set(DeliveryHeader, delivery.Id)
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, body))
+
+	resp, err := dispatcher.Client.Do(req)
+	if err != nil {
+		dispatcher.recordAttempt(delivery, 0, err)
+		return false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		dispatcher.recordAttempt(delivery, resp.StatusCode, errors.New(resp.Status))
+		return false
+	}
+
+	dispatcher.recordAttempt(delivery, resp.StatusCode, nil)
+	return true
+}
+
+func (dispatcher *Dispatcher) recordAttempt(delivery *Delivery, statusCode int, err error) {
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+
+	delivery.Attempts++
+	delivery.StatusCode = statusCode
+	delivery.Time = time.Now().UTC()
+	if err != nil {
+		delivery.Error = err.Error()
+	} else {
+		delivery.Error = ""
+		delivery.Delivered = true
+	}
+}
+
+func (dispatcher *Dispatcher) save() error {
+	if dispatcher.path == "" {
+		return nil
+	}
+
+	hooks := make([]Hook, 0, len(dispatcher.hooks))
+	for _, hook := range dispatcher.hooks {
+		hooks = append(hooks, hook)
+	}
+
+	if dat, err := json.MarshalIndent(hooks, "", "  "); err != nil {
+		return err
+	} else if err = util.WriteFileAtomic(dispatcher.path, dat, 0600); err != nil {
+		return fmt.Errorf("Error saving webhooks: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Signature of body for the X-Olympus-Signature header: sha256= followed by the hex HMAC-SHA256 of body,
+// keyed with the hook's secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Whether signature is the one Sign would give, for receivers to check a POST came from us
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
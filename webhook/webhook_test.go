@@ -0,0 +1,314 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sdcoffey/olympus/graph"
+	"github.com/stretchr/testify/assert"
+)
+
+type receiver struct {
+	sync.Mutex
+	*httptest.Server
+	failures  int
+	requests  []*http.Request
+	payloads  []Payload
+	verified  []bool
+	delivered chan struct{}
+}
+
+// A server that responds 500 to the first failures requests it gets, and 200 after that
+func newReceiver(secret string, failures int) *receiver {
+	r := &receiver{failures: failures, delivered: make(chan struct{}, 10)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		var payload Payload
+		json.Unmarshal(body, &payload)
+
+		r.Lock()
+		defer r.Unlock()
+		r.requests = append(r.requests, req)
+		r.payloads = append(r.payloads, payload)
+		r.verified = append(r.verified, Verify(secret, body, req.Header.Get(SignatureHeader)))
+		if len(r.requests) <= r.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.delivered <- struct{}{}
+	}))
+	return r
+}
+
+func (r *receiver) wait(t *testing.T) {
+	select {
+	case <-r.delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for delivery")
+	}
+}
+
+// Poll until done returns true
+func eventually(t *testing.T, done func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newDispatcher(t *testing.T) (*Dispatcher, *graph.Journal) {
+	journal, err := graph.OpenJournal("")
+	assert.NoError(t, err)
+	dispatcher, err := NewDispatcher("", journal)
+	assert.NoError(t, err)
+	dispatcher.Backoff = time.Millisecond
+	dispatcher.AllowLocal = true
+	return dispatcher, journal
+}
+
+func TestHook_Matches(t *testing.T) {
+	change := graph.Change{Kind: graph.Created, NodeId: "file", Ancestors: []string{"inbox", graph.RootNodeId}}
+
+	assert.True(t, Hook{}.Matches(change))
+	assert.True(t, Hook{Subtree: "inbox"}.Matches(change))
+	assert.False(t, Hook{Subtree: "outbox"}.Matches(change))
+	assert.True(t, Hook{Events: []graph.ChangeKind{graph.Deleted, graph.Created}}.Matches(change))
+	assert.False(t, Hook{Subtree: "inbox", Events: []graph.ChangeKind{graph.Deleted}}.Matches(change))
+}
+
+func TestSign_verifiesOnlyMatchingSecretAndBody(t *testing.T) {
+	signature := Sign("secret", []byte("body"))
+	assert.True(t, Verify("secret", []byte("body"), signature))
+	assert.False(t, Verify("other", []byte("body"), signature))
+	assert.False(t, Verify("secret", []byte("body!"), signature))
+}
+
+func TestDispatcher_Add_validatesHooks(t *testing.T) {
+	dispatcher, _ := newDispatcher(t)
+
+	_, err := dispatcher.Add(Hook{Url: "ftp://example.com"})
+	assert.Error(t, err)
+	_, err = dispatcher.Add(Hook{Url: "http://example.com", Events: []graph.ChangeKind{"exploded"}})
+	assert.Error(t, err)
+
+	hook, err := dispatcher.Add(Hook{Url: "http://example.com"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, "", hook.Id)
+	assert.Equal(t, 40, len(hook.Secret))
+	assert.Equal(t, []Hook{hook}, dispatcher.Hooks())
+}
+
+func TestDispatcher_Add_refusesLocalTargets(t *testing.T) {
+	dispatcher, _ := newDispatcher(t)
+	dispatcher.AllowLocal = false
+
+	for _, target := range []string{"http://localhost:3000", "http://127.0.0.1/hook", "http://[::1]/", "http://169.254.169.254/latest", "http://0.0.0.0/"} {
+		_, err := dispatcher.Add(Hook{Url: target})
+		assert.Error(t, err, target)
+	}
+	assert.Empty(t, dispatcher.Hooks())
+}
+
+func TestDispatcher_refusesToConnectToLocalAddresses(t *testing.T) {
+	dispatcher, _ := newDispatcher(t)
+	r := newReceiver("", 0)
+	defer r.Close()
+
+	hook, _ := dispatcher.Add(Hook{Url: r.URL})
+	dispatcher.AllowLocal = false
+	delivery, err := dispatcher.Test(hook.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, false, delivery.Delivered)
+	assert.Contains(t, delivery.Error, "can't be sent to")
+
+	r.Lock()
+	defer r.Unlock()
+	assert.Empty(t, r.requests)
+}
+
+func TestDispatcher_deliversSignedChangesUnderSubtree(t *testing.T) {
+	dispatcher, journal := newDispatcher(t)
+	r := newReceiver("secret", 0)
+	defer r.Close()
+
+	hook, err := dispatcher.Add(Hook{Url: r.URL, Subtree: "inbox", Secret: "secret"})
+	assert.NoError(t, err)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	journal.Record(graph.Change{Kind: graph.Created, NodeId: "elsewhere", Ancestors: []string{graph.RootNodeId}})
+	journal.Record(graph.Change{Kind: graph.Created, NodeId: "file", Ancestors: []string{"inbox", graph.RootNodeId}})
+	r.wait(t)
+
+	r.Lock()
+	defer r.Unlock()
+	assert.Equal(t, 1, len(r.payloads))
+	assert.Equal(t, true, r.verified[0])
+	assert.Equal(t, "file", r.payloads[0].Change.NodeId)
+	assert.Equal(t, uint64(2), r.payloads[0].Change.Seq)
+	assert.Equal(t, hook.Id, r.payloads[0].HookId)
+	assert.Equal(t, string(graph.Created), r.requests[0].Header.Get(EventHeader))
+	assert.Equal(t, r.payloads[0].DeliveryId, r.requests[0].Header.Get(DeliveryHeader))
+}
+
+func TestDispatcher_retriesFailedDeliveries(t *testing.T) {
+	dispatcher, journal := newDispatcher(t)
+	r := newReceiver("", 2)
+	defer r.Close()
+
+	hook, _ := dispatcher.Add(Hook{Url: r.URL})
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	journal.Record(graph.Change{Kind: graph.Deleted, NodeId: "file"})
+	eventually(t, func() bool {
+		deliveries := dispatcher.Deliveries(hook.Id)
+		return len(deliveries) == 1 && deliveries[0].Delivered
+	})
+
+	deliveries := dispatcher.Deliveries(hook.Id)
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, 3, deliveries[0].Attempts)
+	assert.Equal(t, true, deliveries[0].Delivered)
+	assert.Equal(t, http.StatusOK, deliveries[0].StatusCode)
+	assert.Equal(t, "", deliveries[0].Error)
+}
+
+func TestDispatcher_givesUpAfterMaxAttempts(t *testing.T) {
+	dispatcher, journal := newDispatcher(t)
+	dispatcher.MaxAttempts = 3
+	r := newReceiver("", 100)
+	defer r.Close()
+
+	hook, _ := dispatcher.Add(Hook{Url: r.URL})
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	journal.Record(graph.Change{Kind: graph.Deleted, NodeId: "file"})
+
+	eventually(t, func() bool {
+		deliveries := dispatcher.Deliveries(hook.Id)
+		return len(deliveries) == 1 && deliveries[0].Attempts == 3
+	})
+	time.Sleep(20 * time.Millisecond) // Long enough for a fourth attempt, were one coming
+
+	deliveries := dispatcher.Deliveries(hook.Id)
+	assert.Equal(t, 3, deliveries[0].Attempts)
+	assert.Equal(t, false, deliveries[0].Delivered)
+	assert.Equal(t, http.StatusInternalServerError, deliveries[0].StatusCode)
+	assert.Equal(t, "500 Internal Server Error", deliveries[0].Error)
+}
+
+func TestDispatcher_sendsEachHookItsChangesInOrder(t *testing.T) {
+	dispatcher, _ := newDispatcher(t)
+	r := newReceiver("", 0)
+	defer r.Close()
+
+	hook, _ := dispatcher.Add(Hook{Url: r.URL})
+	defer dispatcher.Stop()
+
+	// Queue everything before the worker can take any, so the repeated write supersedes the first
+	dispatcher.Lock()
+	for _, change := range []graph.Change{
+		{Seq: 1, Kind: graph.Created, NodeId: "a"},
+		{Seq: 2, Kind: graph.ContentChanged, NodeId: "a"},
+		{Seq: 3, Kind: graph.Created, NodeId: "b"},
+		{Seq: 4, Kind: graph.ContentChanged, NodeId: "a"},
+	} {
+		dispatcher.enqueue(hook, change)
+	}
+	dispatcher.Unlock()
+
+	for i := 0; i < 3; i++ {
+		r.wait(t)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	seqs := make([]uint64, len(r.payloads))
+	for i, payload := range r.payloads {
+		seqs[i] = payload.Change.Seq
+	}
+	assert.Equal(t, []uint64{1, 3, 4}, seqs)
+}
+
+func TestDispatcher_Stop_abandonsDeliveryInProgress(t *testing.T) {
+	dispatcher, journal := newDispatcher(t)
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	hook, _ := dispatcher.Add(Hook{Url: server.URL})
+	dispatcher.Start()
+	journal.Record(graph.Change{Kind: graph.Deleted, NodeId: "file"})
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for delivery")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited on a delivery in progress")
+	}
+
+	deliveries := dispatcher.Deliveries(hook.Id)
+	assert.Equal(t, 1, len(deliveries))
+	assert.Equal(t, false, deliveries[0].Delivered)
+}
+
+func TestDispatcher_Test_sendsPing(t *testing.T) {
+	dispatcher, _ := newDispatcher(t)
+	r := newReceiver("", 0)
+	defer r.Close()
+
+	hook, _ := dispatcher.Add(Hook{Url: r.URL})
+	delivery, err := dispatcher.Test(hook.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, Ping, delivery.Event)
+	assert.Equal(t, true, delivery.Delivered)
+	assert.Equal(t, 1, len(dispatcher.Deliveries(hook.Id)))
+
+	_, err = dispatcher.Test("not-a-hook")
+	assert.Error(t, err)
+}
+
+func TestDispatcher_persistsHooks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "webhooks")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "webhooks.json")
+	journal, _ := graph.OpenJournal("")
+
+	dispatcher, err := NewDispatcher(path, journal)
+	assert.NoError(t, err)
+	kept, _ := dispatcher.Add(Hook{Url: "http://example.com/kept"})
+	removed, _ := dispatcher.Add(Hook{Url: "http://example.com/removed"})
+	assert.NoError(t, dispatcher.Remove(removed.Id))
+
+	dispatcher, err = NewDispatcher(path, journal)
+	assert.NoError(t, err)
+	hooks := dispatcher.Hooks()
+	assert.Equal(t, 1, len(hooks))
+	assert.Equal(t, kept.Id, hooks[0].Id)
+	assert.Equal(t, kept.Secret, hooks[0].Secret)
+}